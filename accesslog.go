@@ -0,0 +1,81 @@
+package dispatch
+
+import (
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+// The access log has one record per command for audit and capacity
+// planning, kept apart from the server log: when it ran, who sent it, the
+// tube and job it was about, the first word of the reply, and how long it
+// took to handle.
+
+var (
+	accessLogPath   string
+	accessLogFormat = "json"
+	accessLog       *slog.Logger
+)
+
+// accessLogOpen sets up accessLog. The returned file, if any, should be
+// closed on exit.
+func accessLogOpen() (*os.File, error) {
+	var f *os.File
+	switch accessLogPath {
+	case "stdout":
+		f = os.Stdout
+	case "stderr":
+		f = os.Stderr
+	default:
+		var err error
+		f, err = os.OpenFile(accessLogPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o640)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var h slog.Handler
+	if accessLogFormat == "text" {
+		h = slog.NewTextHandler(f, nil)
+	} else {
+		h = slog.NewJSONHandler(f, nil)
+	}
+	accessLog = slog.New(h)
+
+	if f == os.Stdout || f == os.Stderr {
+		return nil, nil
+	}
+	return f, nil
+}
+
+// accessLogCmd records the command c has just handled, which it started
+// on at start.
+func accessLogCmd(c *conn, start time.Time) {
+	outcome := ""
+	if c.state != connStateClose {
+		var reply string
+		if c.replyBuf != nil {
+			reply = logReplyLine(*c.replyBuf)
+		} else {
+			reply = logReplyLine([]byte(c.reply))
+		}
+		outcome, _, _ = strings.Cut(reply, " ")
+	}
+
+	attrs := []any{
+		"conn", c.id,
+		"remote", c.conn.RemoteAddr().String(),
+		"identity", c.identity,
+		"cmd", strings.TrimSpace(opNames[whichCmd(c.cmd)]),
+		"tube", c.use.name,
+	}
+	if c.cmdJob != 0 {
+		attrs = append(attrs, "job", c.cmdJob)
+	}
+	if c.client != "" {
+		attrs = append(attrs, "client", c.client)
+	}
+	attrs = append(attrs, "outcome", outcome, "duration", time.Since(start))
+	accessLog.Info("access", attrs...)
+}
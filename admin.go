@@ -0,0 +1,83 @@
+package dispatch
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"time"
+)
+
+// The admin listener serves HTTP for operators, separately from the job
+// protocol so that it can be bound to a private address. It is off unless
+// -admin-addr is given.
+
+var (
+	adminAddr  string
+	adminPprof bool
+)
+
+// adminMux builds the admin handlers. The pprof ones are only registered
+// with -pprof, since profiles expose internals and cost CPU to take.
+func adminMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", adminHealthz)
+	mux.HandleFunc("/readyz", adminReadyz)
+	mux.HandleFunc("/metrics", adminMetrics)
+	apiRoutes(mux)
+	mux.HandleFunc("GET /{$}", adminDashboard)
+	if adminPprof {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+	return mux
+}
+
+// adminHealthz answers as long as the process can serve HTTP at all.
+func adminHealthz(w http.ResponseWriter, r *http.Request) {
+	io.WriteString(w, "ok\n")
+}
+
+// adminReadyz answers 200 only while the protocol listeners are accepting,
+// the server is not draining, and storage can take writes, so that a load
+// balancer sends clients elsewhere otherwise.
+func adminReadyz(w http.ResponseWriter, r *http.Request) {
+	if !serving.Load() {
+		http.Error(w, "not accepting connections", http.StatusServiceUnavailable)
+		return
+	}
+	if draining.Load() {
+		http.Error(w, "draining", http.StatusServiceUnavailable)
+		return
+	}
+	jobsMu.Lock()
+	err := storeCheck()
+	jobsMu.Unlock()
+	if err != nil {
+		http.Error(w, "storage: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	io.WriteString(w, "ok\n")
+}
+
+// adminListen binds the admin address, so that it is taken before -u
+// drops privileges like the protocol port.
+func adminListen() (net.Listener, error) {
+	return net.Listen("tcp", adminAddr)
+}
+
+func adminServe(l net.Listener) {
+	srv := &http.Server{
+		Handler:           adminMux(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	slog.Info("admin listening", "addr", l.Addr().String(), "pprof", adminPprof)
+	if err := srv.Serve(l); err != nil && err != http.ErrServerClosed && !errors.Is(err, net.ErrClosed) {
+		slog.Error("admin server failed", "err", err)
+	}
+}
@@ -0,0 +1,128 @@
+//go:build amqp
+
+package dispatch
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// amqpMaxBackoff caps the wait between attempts to reconnect to RabbitMQ.
+const amqpMaxBackoff = 30 * time.Second
+
+// amqpStart starts the bridge described in bridge.go. The returned
+// function stops it, letting the message being put finish.
+func amqpStart() (func(), error) {
+	uri, err := amqp.ParseURI(amqpURL)
+	if err != nil {
+		return nil, err
+	}
+	if amqpPrefetch < 1 {
+		return nil, errors.New("-amqp-prefetch must be at least 1")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		amqpRun(ctx, uri)
+	}()
+	return func() {
+		cancel()
+		<-done
+	}, nil
+}
+
+// amqpRun consumes until ctx is done, reconnecting with backoff. A
+// connection that lasted longer than the longest backoff starts it over.
+func amqpRun(ctx context.Context, uri amqp.URI) {
+	var backoff time.Duration
+	for {
+		start := time.Now()
+		err := amqpConsume(ctx, uri)
+		if ctx.Err() != nil {
+			return
+		}
+		if time.Since(start) > amqpMaxBackoff {
+			backoff = 0
+		}
+		if backoff == 0 {
+			backoff = time.Second
+		} else if backoff *= 2; backoff > amqpMaxBackoff {
+			backoff = amqpMaxBackoff
+		}
+		slog.Warn("AMQP bridge disconnected", "host", uri.Host, "err", err, "retry", backoff)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// amqpConsume puts the messages of one connection until it fails or ctx
+// is done. Messages it has not acked when it returns go back to the queue.
+func amqpConsume(ctx context.Context, uri amqp.URI) error {
+	conn, err := amqp.DialConfig(uri.String(), amqp.Config{
+		Properties: amqp.Table{"connection_name": "dispatch " + serverID},
+	})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	closed := conn.NotifyClose(make(chan *amqp.Error, 1))
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	if err := ch.Qos(amqpPrefetch, 0, false); err != nil {
+		return err
+	}
+	deliveries, err := ch.ConsumeWithContext(ctx, amqpQueue, "dispatch-"+serverID, false, false, false, false, nil)
+	if err != nil {
+		return err
+	}
+	slog.Info("AMQP bridge consuming", "host", uri.Host, "vhost", uri.Vhost, "queue", amqpQueue)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-closed:
+			if err == nil {
+				return errors.New("connection closed")
+			}
+			return err
+		case d, ok := <-deliveries:
+			if !ok {
+				return errors.New("consumer canceled")
+			}
+			amqpDeliver(ctx, &d)
+		}
+	}
+}
+
+// amqpDeliver puts d and settles it with RabbitMQ.
+func amqpDeliver(ctx context.Context, d *amqp.Delivery) {
+	id, err := bridgePut(ctx, originAMQP, d.RoutingKey, d.Headers, d.Body)
+	switch {
+	case err == nil:
+		if logDebug() {
+			slog.Debug("AMQP message put", "routing-key", d.RoutingKey, "job", id)
+		}
+		d.Ack(false)
+	case errors.Is(err, errBridgeReject):
+		slog.Warn("AMQP message rejected", "routing-key", d.RoutingKey, "err", err)
+		d.Reject(false)
+	default:
+		slog.Warn("AMQP message requeued", "routing-key", d.RoutingKey, "err", err)
+		select {
+		case <-time.After(bridgeRetryDelay):
+		case <-ctx.Done():
+		}
+		d.Nack(false, true)
+	}
+}
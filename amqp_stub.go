@@ -0,0 +1,9 @@
+//go:build !amqp
+
+package dispatch
+
+import "errors"
+
+func amqpStart() (func(), error) {
+	return nil, errors.New("the AMQP bridge is not compiled in; build with -tags amqp")
+}
@@ -0,0 +1,357 @@
+package dispatch
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// The REST API on the admin listener lets dashboards and scripts inspect
+// and manage the server without speaking the text protocol:
+//
+//	GET    /api/tubes              all tubes with their stats
+//	GET    /api/tubes/{name}       one tube
+//	POST   /api/tubes/{name}/pause pause for {"delay": seconds}
+//	GET    /api/tubes/{name}/jobs  the tube's jobs in id order, filtered by
+//	                               ?state= and capped by ?limit= (100);
+//	                               ready jobs are in delivery order
+//	GET    /api/jobs/{id}          peek at a job, body in base64
+//	DELETE /api/jobs/{id}          delete a job
+//	POST   /api/jobs/{id}/kick     move a buried or delayed job to ready
+//	GET    /api/server             server state
+//	POST   /api/drain              refuse new jobs from now on
+//	POST   /api/shutdown           stop and exit, authenticated, see shutdown.go
+//	GET    /api/schedules          schedules, see schedule.go
+//
+// Replies are JSON; errors are {"error": "..."} with a 4xx or 5xx status.
+// Nothing reserves jobs yet, so a pause is only recorded and reported.
+
+type apiTube struct {
+	Name          string `json:"name"`
+	Ready         int    `json:"ready"`
+	Delayed       int    `json:"delayed"`
+	Reserved      int    `json:"reserved"`
+	Buried        int    `json:"buried"`
+	Held          int    `json:"held"`
+	Puts          uint64 `json:"puts"`
+	Deletes       uint64 `json:"deletes"`
+	Timeouts      uint64 `json:"timeouts"`
+	Expired       uint64 `json:"expired"`
+	Bytes         uint64 `json:"bytes"`
+	MaxJobSize    uint64 `json:"max_job_size"`
+	MaxJobs       int    `json:"max_jobs"`
+	MaxBytes      uint64 `json:"max_bytes"`
+	Pause         int64  `json:"pause"`
+	PauseTimeLeft int64  `json:"pause_time_left"`
+	Delivery      string `json:"delivery"`
+	Users         int    `json:"users"`
+	// IdleFor is how many seconds the tube has been empty and unused.
+	IdleFor int64 `json:"idle_for"`
+	// Mirror is the server the tube's jobs are copied to, if any.
+	Mirror string `json:"mirror,omitempty"`
+	// NATSSubject is where the tube's jobs are published, if anywhere.
+	NATSSubject string `json:"nats_subject,omitempty"`
+}
+
+type apiServer struct {
+	ID           string `json:"id"`
+	Hostname     string `json:"hostname"`
+	Version      string `json:"version"`
+	Uptime       int64  `json:"uptime"`
+	Draining     bool   `json:"draining"`
+	ShuttingDown bool   `json:"shutting_down"`
+	Tubes        int    `json:"tubes"`
+	Jobs         int    `json:"jobs"`
+	Connections  int    `json:"connections"`
+}
+
+var errAPINotFound = errors.New("not found")
+
+func apiRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("GET /api/tubes", apiTubes)
+	mux.HandleFunc("GET /api/tubes/{name}", apiTubeGet)
+	mux.HandleFunc("POST /api/tubes/{name}/pause", apiTubePause)
+	mux.HandleFunc("GET /api/tubes/{name}/jobs", apiTubeJobs)
+	mux.HandleFunc("GET /api/jobs/{id}", apiJobGet)
+	mux.HandleFunc("DELETE /api/jobs/{id}", apiJobDelete)
+	mux.HandleFunc("POST /api/jobs/{id}/kick", apiJobKick)
+	mux.HandleFunc("GET /api/server", apiServerGet)
+	mux.HandleFunc("POST /api/drain", apiDrain)
+	mux.HandleFunc("POST /api/shutdown", apiShutdown)
+	mux.HandleFunc("GET /api/schedules", apiSchedules)
+	mux.HandleFunc("PUT /api/schedules/{name}", apiSchedulePut)
+	mux.HandleFunc("DELETE /api/schedules/{name}", apiScheduleDelete)
+}
+
+func apiReply(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func apiError(w http.ResponseWriter, status int, err error) {
+	apiReply(w, status, map[string]string{"error": err.Error()})
+}
+
+// apiTubeOf describes t. The caller must hold jobsMu.
+func apiTubeOf(t *tube, now time.Time) apiTube {
+	a := apiTube{
+		Name:       t.name,
+		Ready:      t.stat.ready,
+		Delayed:    t.stat.delayed,
+		Reserved:   t.stat.reserved,
+		Buried:     t.stat.buried,
+		Held:       t.stat.held,
+		Puts:       t.stat.puts,
+		Deletes:    t.stat.deletes,
+		Timeouts:   t.stat.timeouts,
+		Expired:    t.stat.expired,
+		Bytes:      t.stat.bytes,
+		MaxJobSize: t.maxJobSize.Load(),
+		MaxJobs:    t.maxJobs,
+		MaxBytes:   t.maxBytes,
+		Pause:      int64(t.pauseDelay / time.Second),
+	}
+	if left := t.pauseDeadline.Sub(now); left > 0 {
+		a.PauseTimeLeft = int64((left + time.Second - 1) / time.Second)
+	}
+	a.Delivery = "fifo"
+	if t.lifo {
+		a.Delivery = "lifo"
+	}
+	a.Mirror = t.mirror
+	a.NATSSubject = t.natsSubject
+	a.Users = t.users
+	if !t.idleSince.IsZero() {
+		a.IdleFor = int64(now.Sub(t.idleSince) / time.Second)
+	}
+	return a
+}
+
+func apiTubes(w http.ResponseWriter, r *http.Request) {
+	now := clock.Now()
+	jobsMu.Lock()
+	all := make([]apiTube, 0, len(tubes))
+	for _, t := range tubes {
+		all = append(all, apiTubeOf(t, now))
+	}
+	jobsMu.Unlock()
+
+	sort.Slice(all, func(i, k int) bool { return all[i].Name < all[k].Name })
+	apiReply(w, http.StatusOK, all)
+}
+
+func apiTubeGet(w http.ResponseWriter, r *http.Request) {
+	jobsMu.Lock()
+	t := tubes[r.PathValue("name")]
+	var a apiTube
+	if t != nil {
+		a = apiTubeOf(t, clock.Now())
+	}
+	jobsMu.Unlock()
+
+	if t == nil {
+		apiError(w, http.StatusNotFound, errAPINotFound)
+		return
+	}
+	apiReply(w, http.StatusOK, a)
+}
+
+func apiTubePause(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Delay *uint32 `json:"delay"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Delay == nil {
+		apiError(w, http.StatusBadRequest, errors.New(`want {"delay": seconds}`))
+		return
+	}
+
+	now := clock.Now()
+	jobsMu.Lock()
+	t := tubes[r.PathValue("name")]
+	var a apiTube
+	if t != nil {
+		t.pauseDelay = time.Duration(*req.Delay) * time.Second
+		t.pauseDeadline = now.Add(t.pauseDelay)
+		tubeWake(t)
+		a = apiTubeOf(t, now)
+	}
+	jobsMu.Unlock()
+
+	if t == nil {
+		apiError(w, http.StatusNotFound, errAPINotFound)
+		return
+	}
+	slog.Info("tube paused", "tube", a.Name, "delay", a.Pause, "remote", r.RemoteAddr)
+	audit("pause-tube", "", r.RemoteAddr, "tube", a.Name, "delay", a.Pause)
+	apiReply(w, http.StatusOK, a)
+}
+
+func apiTubeJobs(w http.ResponseWriter, r *http.Request) {
+	limit := 100
+	if s := r.FormValue("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			apiError(w, http.StatusBadRequest, errors.New("bad limit"))
+			return
+		}
+		limit = n
+	}
+	state := r.FormValue("state")
+	if state != "" {
+		known := false
+		for _, name := range jobStateNames {
+			known = known || name == state
+		}
+		if !known {
+			apiError(w, http.StatusBadRequest, errors.New("bad state"))
+			return
+		}
+	}
+
+	now := clock.Now()
+	jobsMu.Lock()
+	t := tubes[r.PathValue("name")]
+	var ids []uint64
+	for id, j := range allJobs {
+		if j.tube == t && (state == "" || jobStateNames[j.state] == state) {
+			ids = append(ids, id)
+		}
+	}
+	if state == jobStateNames[jobStateReady] {
+		sort.Slice(ids, func(i, k int) bool { return jobDeliveredBefore(allJobs[ids[i]], allJobs[ids[k]]) })
+	} else {
+		sort.Slice(ids, func(i, k int) bool { return ids[i] < ids[k] })
+	}
+	if len(ids) > limit {
+		ids = ids[:limit]
+	}
+	recs := make([]dumpRecord, len(ids))
+	for i, id := range ids {
+		recs[i] = dumpRecordOf(allJobs[id], now)
+	}
+	jobsMu.Unlock()
+
+	if t == nil {
+		apiError(w, http.StatusNotFound, errAPINotFound)
+		return
+	}
+	apiReply(w, http.StatusOK, recs)
+}
+
+// apiJob finds the job named by the request's id. The caller must hold
+// jobsMu.
+func apiJob(r *http.Request) (*job, error) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		return nil, errors.New("bad job id")
+	}
+	j := allJobs[id]
+	if j == nil {
+		return nil, errAPINotFound
+	}
+	return j, nil
+}
+
+func apiJobError(w http.ResponseWriter, err error) {
+	if err == errAPINotFound {
+		apiError(w, http.StatusNotFound, err)
+		return
+	}
+	apiError(w, http.StatusBadRequest, err)
+}
+
+func apiJobGet(w http.ResponseWriter, r *http.Request) {
+	jobsMu.Lock()
+	j, err := apiJob(r)
+	var rec dumpRecord
+	if err == nil {
+		rec = dumpRecordOf(j, clock.Now())
+		// The body goes back to its pool if the job is deleted.
+		rec.Body = bytes.Clone(rec.Body)
+	}
+	jobsMu.Unlock()
+
+	if err != nil {
+		apiJobError(w, err)
+		return
+	}
+	apiReply(w, http.StatusOK, &rec)
+}
+
+func apiJobDelete(w http.ResponseWriter, r *http.Request) {
+	jobsMu.Lock()
+	j, err := apiJob(r)
+	if err != nil {
+		jobsMu.Unlock()
+		apiJobError(w, err)
+		return
+	}
+	err = jobDelete(j)
+	jobsMu.Unlock()
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	slog.Info("job deleted", "job", j.id, "remote", r.RemoteAddr)
+	audit("delete", "", r.RemoteAddr, "job", j.id, "tube", j.tube.name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func apiJobKick(w http.ResponseWriter, r *http.Request) {
+	jobsMu.Lock()
+	j, err := apiJob(r)
+	if err != nil {
+		jobsMu.Unlock()
+		apiJobError(w, err)
+		return
+	}
+	kicked, err := jobKick(j)
+	rec := dumpRecordOf(j, clock.Now())
+	jobsMu.Unlock()
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if !kicked {
+		apiError(w, http.StatusConflict, errors.New("job is not buried or delayed"))
+		return
+	}
+
+	slog.Info("job kicked", "job", j.id, "remote", r.RemoteAddr)
+	audit("kick", "", r.RemoteAddr, "job", j.id, "tube", j.tube.name)
+	apiReply(w, http.StatusOK, &rec)
+}
+
+func apiServerGet(w http.ResponseWriter, r *http.Request) {
+	jobsMu.Lock()
+	s := apiServer{
+		ID:           serverID,
+		Hostname:     hostname,
+		Version:      version,
+		Uptime:       int64(time.Since(startTime).Seconds()),
+		Draining:     draining.Load(),
+		ShuttingDown: shuttingDown.Load(),
+		Tubes:        len(tubes),
+		Jobs:         len(allJobs),
+		Connections:  countCurConns(),
+	}
+	jobsMu.Unlock()
+	apiReply(w, http.StatusOK, &s)
+}
+
+// apiDrain puts the server in drain mode, in which puts are answered with
+// DRAINING. Like beanstalkd's, it lasts until the server exits.
+func apiDrain(w http.ResponseWriter, r *http.Request) {
+	if !draining.Swap(true) {
+		slog.Info("draining", "remote", r.RemoteAddr)
+		audit("drain", "", r.RemoteAddr)
+	}
+	apiServerGet(w, r)
+}
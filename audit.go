@@ -0,0 +1,47 @@
+package dispatch
+
+import (
+	"log/slog"
+	"os"
+)
+
+// With -audit-log the actions that change the server from outside the
+// flow of jobs are recorded, one JSON object a line, in a file of their
+// own that is only appended to: pauses, kicks, deletes, drains and
+// schedule changes through the admin API or gRPC, verify repair, snapshots
+// and config reloads, along with failed auths and commands -authz
+// refused. Each record has the time, the action, the identity and remote
+// address it came from, empty where there is none, and what it acted on.
+
+var (
+	auditLogPath string
+	auditLog     *slog.Logger
+)
+
+// auditLogOpen sets up auditLog. The returned file, if any, should be
+// closed on exit.
+func auditLogOpen() (*os.File, error) {
+	switch auditLogPath {
+	case "stdout":
+		auditLog = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+		return nil, nil
+	case "stderr":
+		auditLog = slog.New(slog.NewJSONHandler(os.Stderr, nil))
+		return nil, nil
+	}
+	f, err := os.OpenFile(auditLogPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	auditLog = slog.New(slog.NewJSONHandler(f, nil))
+	return f, nil
+}
+
+// audit records action, if there is an audit log. attrs are what it acted
+// on, as key-value pairs.
+func audit(action, identity, remote string, attrs ...any) {
+	if auditLog == nil {
+		return
+	}
+	auditLog.Info("audit", append([]any{"action", action, "identity", identity, "remote", remote}, attrs...)...)
+}
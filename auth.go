@@ -0,0 +1,105 @@
+package dispatch
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// With -auth-file a client must send
+//
+//	auth <token>\r\n
+//
+// before any other command but quit, and is answered OK or UNAUTHORIZED.
+// A token that matches gives the connection the identity it is listed
+// under, which -authz rules can then refer to. Clients that presented a
+// TLS client certificate are already authenticated.
+
+const (
+	msgAuthOK       = "OK\r\n"
+	msgUnauthorized = "UNAUTHORIZED\r\n"
+)
+
+// authFile is the -auth-file path.
+var authFile string
+
+type authToken struct {
+	identity string
+	token    []byte
+}
+
+// authTokens are the tokens clients may present, nil without -auth-file.
+var authTokens []authToken
+
+var authFailCount atomic.Uint64
+
+func authLoadFile(path string) ([]authToken, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return authParseTokens(f, path)
+}
+
+// authParseTokens reads one token per line, in the form
+//
+//	identity:token
+//
+// Blank lines and lines starting with # are ignored.
+func authParseTokens(f *os.File, name string) ([]authToken, error) {
+	tokens := []authToken{}
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		identity, token, ok := strings.Cut(line, ":")
+		if !ok || identity == "" || token == "" || strings.ContainsAny(token, " \t") {
+			return nil, fmt.Errorf("%s:%d: want identity:token", name, n)
+		}
+		tokens = append(tokens, authToken{identity: identity, token: []byte(token)})
+	}
+	return tokens, sc.Err()
+}
+
+// authCheck returns the identity token is listed under. Every token is
+// compared in constant time, so timing tells nothing about them.
+func authCheck(token []byte) (string, bool) {
+	var identity string
+	found := 0
+	for _, t := range authTokens {
+		if subtle.ConstantTimeCompare(t.token, token) == 1 {
+			identity = t.identity
+			found = 1
+		}
+	}
+	return identity, found == 1
+}
+
+// authRequired reports whether c has yet to authenticate.
+func authRequired(c *conn) bool {
+	return authTokens != nil && c.identity == ""
+}
+
+func doAuth(c *conn, token []byte) {
+	identity, ok := authCheck(token)
+	if !ok {
+		authFailCount.Add(1)
+		audit("auth-failure", c.identity, c.conn.RemoteAddr().String())
+		replyMsg(c, msgUnauthorized)
+		return
+	}
+	if c.identity == "" {
+		authConnCount.Add(1)
+	}
+	c.identity = identity
+	nsEnter(c)
+	slog.Info("client authenticated", "remote", c.conn.RemoteAddr().String(), "identity", identity)
+	replyMsg(c, msgAuthOK)
+}
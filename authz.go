@@ -0,0 +1,316 @@
+package dispatch
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Authorization is delegated to an authorizer, consulted for every command
+// with the connection's identity, the operation, and the tube it applies
+// to. Without -authz every command is allowed.
+//
+// -authz takes one of
+//
+//	file:<path>          rules in an htpasswd-style file, see authzParseRules
+//	http://... https://  an external policy service such as OPA, see httpAuthz
+
+type authzRequest struct {
+	// ctx bounds asking an external provider, as the command or call
+	// asked about is bounded.
+	ctx context.Context
+	// identity is empty for connections that have not authenticated.
+	identity string
+	remote   string
+	op       string
+	// tube is empty for commands that are not about a tube, such as stats.
+	tube string
+}
+
+type authorizer interface {
+	authorize(r *authzRequest) (bool, error)
+}
+
+var (
+	authz         authorizer
+	authzCacheTTL = 30 * time.Second
+)
+
+func authzOpen(spec string) (authorizer, error) {
+	switch {
+	case strings.HasPrefix(spec, "file:"):
+		return authzLoadFile(strings.TrimPrefix(spec, "file:"))
+	case strings.HasPrefix(spec, "http://"), strings.HasPrefix(spec, "https://"):
+		return newHTTPAuthz(spec, authzCacheTTL), nil
+	}
+	return nil, fmt.Errorf("unknown authorization provider %q", spec)
+}
+
+// authorizeCmd reports whether c may perform op on tube. Errors from the
+// provider deny the command.
+func authorizeCmd(c *conn, op opType, tube string) bool {
+	if authz == nil {
+		return true
+	}
+	return authorizeReq(&authzRequest{
+		ctx:      c.ctx,
+		identity: c.identity,
+		remote:   c.conn.RemoteAddr().String(),
+		op:       strings.TrimSpace(opNames[op]),
+		tube:     tube,
+	})
+}
+
+// authorizeReq is authorizeCmd for requests that did not come in over the
+// text protocol.
+func authorizeReq(r *authzRequest) bool {
+	if authz == nil {
+		return true
+	}
+	ok, err := authz.authorize(r)
+	if err != nil {
+		slog.Warn("authorization failed", "remote", r.remote, "op", r.op, "err", err)
+		ok = false
+	}
+	if !ok {
+		audit("forbidden", r.identity, r.remote, "op", r.op, "tube", r.tube)
+	}
+	return ok
+}
+
+// authzRule allows the identities matching identity to perform ops on the
+// tubes matching tube. "*" in any position matches any run of characters;
+// a lone "*" also matches the empty identity and the empty tube.
+type authzRule struct {
+	identity string
+	ops      []string
+	tube     string
+}
+
+// staticAuthz allows a command if any of its rules does.
+type staticAuthz struct {
+	rules []authzRule
+}
+
+func (a *staticAuthz) authorize(r *authzRequest) (bool, error) {
+	for _, rule := range a.rules {
+		if !globMatch(rule.identity, r.identity) || !globMatch(rule.tube, r.tube) {
+			continue
+		}
+		for _, op := range rule.ops {
+			if op == "*" || op == r.op {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+func authzLoadFile(path string) (*staticAuthz, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	rules, err := authzParseRules(f, path)
+	if err != nil {
+		return nil, err
+	}
+	return &staticAuthz{rules: rules}, nil
+}
+
+// authzRoles name groups of operations, so that a rule can grant a role
+// instead of listing commands. Commands the server does not have yet are
+// included so that rules need not change when they arrive.
+var authzRoles = map[string][]string{
+	"produce": {"put", "use"},
+	"consume": {"reserve", "reserve-with-timeout", "delete", "release", "bury", "touch", "watch", "ignore"},
+	"admin": {"stats", "stats-job", "stats-tube", "list-tubes", "peek", "peek-ready", "peek-delayed",
+		"peek-buried", "kick", "kick-job", "pause-tube", "verify", "snapshot", "shutdown"},
+}
+
+// authzParseRules reads one rule per line, in the form
+//
+//	identity:op[,op...]:tube-pattern
+//
+// where an op is a command, a role from authzRoles, or * for any. The
+// identity is a TLS client certificate's common name or the name an -auth-file
+// token is listed under. For example
+//
+//	# any client may put into and use the jobs.* tubes
+//	*:produce:jobs.*
+//	worker:consume:jobs.*
+//	ops:*:*
+//
+// Blank lines and lines starting with # are ignored.
+func authzParseRules(f *os.File, name string) ([]authzRule, error) {
+	var rules []authzRule
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		parts := strings.Split(line, ":")
+		if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+			return nil, fmt.Errorf("%s:%d: want identity:ops:tube", name, n)
+		}
+		var ops []string
+		for _, op := range strings.Split(parts[1], ",") {
+			if role, ok := authzRoles[op]; ok {
+				ops = append(ops, role...)
+			} else {
+				ops = append(ops, op)
+			}
+		}
+		rules = append(rules, authzRule{
+			identity: parts[0],
+			ops:      ops,
+			tube:     parts[2],
+		})
+	}
+	return rules, sc.Err()
+}
+
+// globMatch matches s against a pattern in which only '*' is special.
+func globMatch(pattern, s string) bool {
+	for {
+		i := strings.IndexByte(pattern, '*')
+		if i < 0 {
+			return pattern == s
+		}
+		if !strings.HasPrefix(s, pattern[:i]) {
+			return false
+		}
+		s = s[i:]
+		pattern = pattern[i+1:]
+		if pattern == "" {
+			return true
+		}
+		for k := 0; k <= len(s); k++ {
+			if globMatch(pattern, s[k:]) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// httpAuthz asks a policy service. It POSTs
+//
+//	{"input": {"identity": ..., "remote": ..., "op": ..., "tube": ...}}
+//
+// and expects {"result": true} to allow the command, which is the shape of
+// OPA's data API. remote is the client's host, without the port, which
+// changes with every connection. Answers are cached per identity, remote
+// host, operation and tube: everything the service was asked about, so
+// that an answer given for one client's address is not reused for
+// another's, and a client that reconnects is not asked about again.
+type httpAuthz struct {
+	url    string
+	client *http.Client
+	ttl    time.Duration
+
+	mu    sync.Mutex
+	cache map[authzKey]authzAnswer
+}
+
+type authzKey struct {
+	identity, remote, op, tube string
+}
+
+type authzAnswer struct {
+	allow   bool
+	expires time.Time
+}
+
+const authzMaxCache = 10000
+
+func newHTTPAuthz(url string, ttl time.Duration) *httpAuthz {
+	return &httpAuthz{
+		url:    url,
+		client: &http.Client{Timeout: 2 * time.Second},
+		ttl:    ttl,
+		cache:  map[authzKey]authzAnswer{},
+	}
+}
+
+func (a *httpAuthz) authorize(r *authzRequest) (bool, error) {
+	key := authzKey{r.identity, authzHost(r.remote), r.op, r.tube}
+	now := time.Now()
+
+	a.mu.Lock()
+	ans, ok := a.cache[key]
+	a.mu.Unlock()
+	if ok && now.Before(ans.expires) {
+		return ans.allow, nil
+	}
+
+	allow, err := a.ask(r)
+	if err != nil {
+		return false, err
+	}
+
+	a.mu.Lock()
+	if len(a.cache) >= authzMaxCache {
+		a.cache = map[authzKey]authzAnswer{}
+	}
+	a.cache[key] = authzAnswer{allow: allow, expires: now.Add(a.ttl)}
+	a.mu.Unlock()
+	return allow, nil
+}
+
+// authzHost returns the host of remote, a client's address, or remote
+// itself if it has no port, as a Unix socket's address has not.
+func authzHost(remote string) string {
+	if host, _, err := net.SplitHostPort(remote); err == nil {
+		return host
+	}
+	return remote
+}
+
+func (a *httpAuthz) ask(r *authzRequest) (bool, error) {
+	body, err := json.Marshal(map[string]interface{}{
+		"input": map[string]string{
+			"identity": r.identity,
+			"remote":   authzHost(r.remote),
+			"op":       r.op,
+			"tube":     r.tube,
+		},
+	})
+	if err != nil {
+		return false, err
+	}
+
+	req, err := http.NewRequestWithContext(r.ctx, http.MethodPost, a.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("policy service returned %s", resp.Status)
+	}
+
+	var out struct {
+		Result bool `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return false, err
+	}
+	return out.Result, nil
+}
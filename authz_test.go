@@ -0,0 +1,46 @@
+package dispatch
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHTTPAuthzCacheByRemote(t *testing.T) {
+	asked := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		asked++
+		var in struct {
+			Input map[string]string `json:"input"`
+		}
+		json.NewDecoder(r.Body).Decode(&in)
+		json.NewEncoder(w).Encode(map[string]bool{"result": in.Input["remote"] == "10.0.0.1"})
+	}))
+	defer srv.Close()
+
+	a := newHTTPAuthz(srv.URL, time.Minute)
+	check := func(remote string, want bool) {
+		t.Helper()
+		allow, err := a.authorize(&authzRequest{ctx: context.Background(), remote: remote, op: "put", tube: "t"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if allow != want {
+			t.Errorf("remote %s: allow = %v, want %v", remote, allow, want)
+		}
+	}
+	check("10.0.0.1:1000", true)
+	check("10.0.0.2:1000", false)
+	check("10.0.0.1:1000", true)
+	// A new connection from the same host has a new port but the same
+	// answer.
+	check("10.0.0.1:1001", true)
+	check("[::1]:1000", false)
+	check("@", false)
+	if asked != 4 {
+		t.Errorf("policy service asked %d times, want 4", asked)
+	}
+}
@@ -0,0 +1,330 @@
+package dispatch
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jkasarherou/dispatch/client"
+)
+
+// The bench harness measures the queue core: producers put jobs as fast as
+// they can, and at the end it reports the throughput of each operation, its
+// latency percentiles and a histogram of its latencies. Each connection
+// waits for every reply, so latency is a full round trip and throughput is
+// bounded by -producers. -idle holds that many more connections open and
+// silent throughout, to compare the server's connection models under many
+// idle clients, as BenchmarkConnModel does in process. With -pool the
+// producers share a client.Pool instead of holding a connection each.
+//
+// The text protocol has no watch or reserve, so -consumers defaults to 0;
+// set it only to compare against a beanstalkd, where consumers reserve and
+// delete the jobs as they come. Failed commands are counted as errors; a
+// connection that cannot be set up fails the run.
+
+type benchConfig struct {
+	addr      string
+	duration  time.Duration
+	producers int
+	consumers int
+	size      int
+	tubes     int
+	idle      int
+	pool      bool
+}
+
+// benchSamples are the latencies of one kind of operation, and its errors.
+type benchSamples struct {
+	lat    []time.Duration
+	errors int
+}
+
+type benchResults struct {
+	mu  sync.Mutex
+	ops map[string]*benchSamples
+}
+
+func (r *benchResults) add(op string, lat []time.Duration, errors int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := r.ops[op]
+	if s == nil {
+		s = &benchSamples{}
+		r.ops[op] = s
+	}
+	s.lat = append(s.lat, lat...)
+	s.errors += errors
+}
+
+func benchMain(args []string) int {
+	var cfg benchConfig
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	addr := os.Getenv("DISPATCH_ADDR")
+	if addr == "" {
+		addr = "127.0.0.1:3333"
+	}
+	fs.StringVar(&cfg.addr, "addr", addr, "server `host:port`")
+	fs.DurationVar(&cfg.duration, "duration", 10*time.Second, "how long to run")
+	fs.IntVar(&cfg.producers, "producers", 4, "connections putting jobs")
+	fs.IntVar(&cfg.consumers, "consumers", 0, "connections reserving and deleting jobs, against a beanstalkd")
+	fs.IntVar(&cfg.size, "size", 128, "job body size in `bytes`")
+	fs.IntVar(&cfg.tubes, "tubes", 1, "number of tubes to spread jobs over")
+	fs.IntVar(&cfg.idle, "idle", 0, "idle connections to hold open during the run")
+	fs.BoolVar(&cfg.pool, "pool", false, "producers share a connection pool")
+	fs.Parse(args)
+	if fs.NArg() != 0 || cfg.producers < 0 || cfg.consumers < 0 || cfg.producers+cfg.consumers == 0 ||
+		cfg.size < 0 || cfg.tubes < 1 || cfg.idle < 0 {
+		fs.Usage()
+		return 2
+	}
+
+	ctx, cancel := cliContext()
+	defer cancel()
+
+	fmt.Printf("bench: %d producers, %d consumers, %d-byte jobs over %d tubes for %v\n",
+		cfg.producers, cfg.consumers, cfg.size, cfg.tubes, cfg.duration)
+
+	idle := make([]*client.Conn, 0, cfg.idle)
+	defer func() {
+		for _, cc := range idle {
+			cc.Abort()
+		}
+	}()
+	for len(idle) < cfg.idle {
+		cc, err := cliDial(ctx, cfg.addr)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "bench: idle connection %d: %v\n", len(idle)+1, err)
+			return 1
+		}
+		idle = append(idle, cc)
+	}
+
+	res := &benchResults{ops: map[string]*benchSamples{}}
+	deadline := time.Now().Add(cfg.duration)
+	start := time.Now()
+	errc := make(chan error, cfg.producers+cfg.consumers)
+	var pool *client.Pool
+	if cfg.pool {
+		pool = client.NewPool(cfg.producers)
+		pool.Dial = cliDial
+		defer pool.Close()
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < cfg.producers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var err error
+			if pool != nil {
+				err = benchPoolProducer(ctx, &cfg, pool, i, deadline, res)
+			} else {
+				err = benchProducer(ctx, &cfg, i, deadline, res)
+			}
+			if err != nil {
+				errc <- err
+			}
+		}(i)
+	}
+	for i := 0; i < cfg.consumers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := benchConsumer(ctx, &cfg, deadline, res); err != nil {
+				errc <- err
+			}
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	close(errc)
+	failed := false
+	for err := range errc {
+		fmt.Fprintf(os.Stderr, "bench: %v\n", err)
+		failed = true
+	}
+
+	benchReport(res, elapsed)
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+func benchTube(i int) string {
+	return "bench-" + strconv.Itoa(i)
+}
+
+// benchProducer puts jobs into one tube until deadline.
+func benchProducer(ctx context.Context, cfg *benchConfig, i int, deadline time.Time, res *benchResults) error {
+	cc, err := cliDial(ctx, cfg.addr)
+	if err != nil {
+		return err
+	}
+	defer cc.Close()
+	if err := cc.Use(ctx, benchTube(i%cfg.tubes)); err != nil {
+		return err
+	}
+
+	body := benchBody(cfg.size)
+	line := cmdPut + "1024 0 60 " + strconv.Itoa(cfg.size)
+	var (
+		lat    []time.Duration
+		errors int
+	)
+	for ctx.Err() == nil && time.Now().Before(deadline) {
+		t := time.Now()
+		if _, err := cc.Expect(ctx, msgInserted, line, body); err != nil {
+			errors++
+			continue
+		}
+		lat = append(lat, time.Since(t))
+	}
+	res.add("put", lat, errors)
+	return nil
+}
+
+// benchPoolProducer puts jobs into one tube through pool until deadline.
+func benchPoolProducer(ctx context.Context, cfg *benchConfig, pool *client.Pool, i int, deadline time.Time, res *benchResults) error {
+	body := benchBody(cfg.size)
+	tube := benchTube(i % cfg.tubes)
+	var (
+		lat    []time.Duration
+		errors int
+	)
+	for ctx.Err() == nil && time.Now().Before(deadline) {
+		t := time.Now()
+		if _, err := pool.Put(ctx, cfg.addr, tube, 1024, 0, 60, body); err != nil {
+			errors++
+			continue
+		}
+		lat = append(lat, time.Since(t))
+	}
+	res.add("put", lat, errors)
+	return nil
+}
+
+func benchBody(size int) []byte {
+	body := make([]byte, size)
+	for k := range body {
+		body[k] = 'a' + byte(k%26)
+	}
+	return body
+}
+
+// benchConsumer reserves and deletes jobs from every bench tube until
+// deadline.
+func benchConsumer(ctx context.Context, cfg *benchConfig, deadline time.Time, res *benchResults) error {
+	cc, err := cliDial(ctx, cfg.addr)
+	if err != nil {
+		return err
+	}
+	defer cc.Close()
+	for i := 0; i < cfg.tubes; i++ {
+		if _, err := cc.Expect(ctx, "WATCHING ", "watch "+benchTube(i), nil); err != nil {
+			return err
+		}
+	}
+	if _, err := cc.Expect(ctx, "WATCHING ", "ignore "+defaultTubeName, nil); err != nil {
+		return err
+	}
+
+	var (
+		resLat, delLat       []time.Duration
+		resErrors, delErrors int
+	)
+	for ctx.Err() == nil && time.Now().Before(deadline) {
+		t := time.Now()
+		reply, err := cc.Cmd(ctx, "reserve-with-timeout 1", nil)
+		if err != nil {
+			return err
+		}
+		if reply == "TIMED_OUT" {
+			continue
+		}
+		var id, size string
+		if n, _ := fmt.Sscanf(reply, "RESERVED %s %s", &id, &size); n != 2 {
+			resErrors++
+			continue
+		}
+		if _, err := cc.Data(ctx, size); err != nil {
+			return err
+		}
+		resLat = append(resLat, time.Since(t))
+
+		t = time.Now()
+		if _, err := cc.Expect(ctx, "DELETED", "delete "+id, nil); err != nil {
+			delErrors++
+			continue
+		}
+		delLat = append(delLat, time.Since(t))
+	}
+	res.add("reserve", resLat, resErrors)
+	res.add("delete", delLat, delErrors)
+	return nil
+}
+
+func benchReport(res *benchResults, elapsed time.Duration) {
+	fmt.Printf("%-8s %10s %10s %10s %10s %10s %10s %8s\n",
+		"op", "count", "ops/s", "p50", "p90", "p99", "max", "errors")
+	for _, op := range []string{"put", "reserve", "delete"} {
+		s := res.ops[op]
+		if s == nil {
+			continue
+		}
+		sort.Slice(s.lat, func(i, j int) bool { return s.lat[i] < s.lat[j] })
+		pct := func(p float64) time.Duration {
+			if len(s.lat) == 0 {
+				return 0
+			}
+			return s.lat[int(p*float64(len(s.lat)-1))]
+		}
+		fmt.Printf("%-8s %10d %10.0f %10v %10v %10v %10v %8d\n",
+			op, len(s.lat), float64(len(s.lat))/elapsed.Seconds(),
+			pct(0.50), pct(0.90), pct(0.99), pct(1), s.errors)
+	}
+	for _, op := range []string{"put", "reserve", "delete"} {
+		if s := res.ops[op]; s != nil && len(s.lat) > 0 {
+			fmt.Printf("\n%s latency:\n", op)
+			benchHistogram(s.lat)
+		}
+	}
+}
+
+// benchHistogram prints the sorted latencies lat in buckets that double in
+// width, from the power of two below the fastest.
+func benchHistogram(lat []time.Duration) {
+	const width = 40
+	lo := time.Duration(1)
+	for lo*2 <= lat[0] {
+		lo *= 2
+	}
+	var bounds []time.Duration
+	var counts []int
+	for i := 0; i < len(lat); {
+		hi := lo * 2
+		n := 0
+		for i < len(lat) && lat[i] < hi {
+			n++
+			i++
+		}
+		bounds = append(bounds, hi)
+		counts = append(counts, n)
+		lo = hi
+	}
+	most := 0
+	for _, n := range counts {
+		most = max(most, n)
+	}
+	for k, n := range counts {
+		bar := make([]byte, (n*width+most-1)/most)
+		for i := range bar {
+			bar[i] = '#'
+		}
+		fmt.Printf("  < %-10v %10d %6.2f%% %s\n", bounds[k], n, 100*float64(n)/float64(len(lat)), bar)
+	}
+}
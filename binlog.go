@@ -0,0 +1,912 @@
+package dispatch
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jkasarherou/dispatch/protocol"
+)
+
+// The binlog is an append-only write-ahead log of job records kept in the
+// directory given with -b. Files are named binlog.N and start with a
+// version header. Every job mutation is appended as one length-prefixed,
+// checksummed record and written with a single write call, so a record torn
+// by a crash can be detected and discarded when the log is read back.
+//
+// A new segment is started once the current one reaches binlogMaxSize. Each
+// live job is homed in the segment holding its most recent put record, and
+// a segment is removed once it is the oldest and no job is homed there. To
+// get there, the compactor rewrites the jobs of the oldest segment into the
+// current one while the log holds more dead records than live ones.
+//
+// Record layout (little endian):
+//
+//	u32 payload length
+//	u32 crc32 of payload
+//	payload:
+//	  u8  kind
+//	  u64 job id
+//	  kind-specific fields, see walEncodePut and walEncodeState
+
+const (
+	binlogVersion = 1
+	binlogPrefix  = "binlog."
+	binlogLock    = "lock"
+
+	recHeaderSize = 8
+
+	// walRecordMax bounds the payload of a record: that of a put of the
+	// largest job there can be, with the longest tube name and the most
+	// dependencies and headers, sealed. A record claiming more is torn.
+	walRecordMax = walSealOverhead + 1 + 8 + 1 + 5*8 + 2 + protocol.TubeNameMax +
+		4 + jobSizeMax + 2 + 2 + depsMax*8 + 2 + headersMax*(1+headerMaxKey+2+headerMaxValue) + 1
+
+	// walCompactBatch bounds how many jobs are moved while holding jobsMu.
+	walCompactBatch = 64
+)
+
+// walFlagCompressed marks a put record whose body is gzipped.
+const walFlagCompressed = 1 << 0
+
+type recKind uint8
+
+const (
+	recPut recKind = iota + 1
+	recState
+	recDelete
+	recTube
+)
+
+var errBinlogCorrupt = errors.New("binlog: corrupt record")
+
+type binlog struct {
+	mu sync.Mutex
+
+	dir  string
+	lock *os.File
+
+	// segs are the segments on disk, oldest first. The last one is cur,
+	// which is open for writing as f.
+	segs []*walSegment
+	cur  *walSegment
+	f    *os.File
+
+	buf []byte
+	// aead seals the records written, nil to write them in the clear, and
+	// sealed holds a record while it is.
+	aead   cipher.AEAD
+	sealed []byte
+
+	dirty bool
+	done  chan struct{}
+	// closed is set once walClose has closed f. The background loops check
+	// it, as they may have been waiting for mu while walClose held it.
+	closed bool
+	// syncErr is the last background sync failure, cleared once a sync
+	// succeeds.
+	syncErr error
+
+	compact chan struct{}
+
+	recordsWritten  uint64
+	recordsMigrated uint64
+
+	snapshotting bool
+}
+
+type walSegment struct {
+	seq  int
+	size int64
+	// sealed is set if the segment's records are encrypted.
+	sealed bool
+
+	// jobs are the live jobs homed in this segment and live is the size of
+	// their put records.
+	jobs map[uint64]*job
+	live int64
+}
+
+// wal is nil unless the server was started with -b.
+var wal *binlog
+
+// Sync policy, set with -f and -F. With a positive rate, writes are synced
+// by a background loop at most once per period; a zero rate syncs every
+// record before it is acknowledged.
+var (
+	binlogSyncRate = 50 * time.Millisecond
+	binlogNoSync   bool
+)
+
+// binlogMaxSize is the size at which a new segment is started, set with -s.
+var binlogMaxSize int64 = 10 << 20
+
+func walInit(dir string) (*binlog, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+
+	lock, err := walLockDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := walKeyLoad(binlogKeySpec)
+	if err != nil {
+		lock.Close()
+		return nil, err
+	}
+	w := &binlog{
+		dir:     dir,
+		lock:    lock,
+		aead:    aead,
+		done:    make(chan struct{}),
+		compact: make(chan struct{}, 1),
+	}
+
+	seqs, err := walSegments(dir)
+	if err != nil {
+		lock.Close()
+		return nil, err
+	}
+	damage, err := walReplay(w, seqs)
+	if err != nil {
+		lock.Close()
+		return nil, err
+	}
+	for _, d := range damage {
+		slog.Warn("binlog: discarding damaged tail", "file", walSegmentPath(dir, d.seq), "records", d.records, "err", d.err)
+	}
+
+	next := 1
+	if len(seqs) > 0 {
+		next = seqs[len(seqs)-1] + 1
+	}
+
+	if err := walOpenSegment(w, next); err != nil {
+		lock.Close()
+		return nil, err
+	}
+
+	if !binlogNoSync && binlogSyncRate > 0 {
+		go walSyncLoop(w, binlogSyncRate)
+	}
+	go walCompactLoop(w)
+	w.compact <- struct{}{}
+	return w, nil
+}
+
+// walLockDir takes an exclusive lock on the binlog directory, so that two
+// processes never write to or repair the same log.
+func walLockDir(dir string) (*os.File, error) {
+	lock, err := os.OpenFile(filepath.Join(dir, binlogLock), os.O_WRONLY|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	if err := walFlock(lock); err != nil {
+		lock.Close()
+		return nil, fmt.Errorf("binlog: %s is locked by another process: %w", dir, err)
+	}
+	return lock, nil
+}
+
+func walSyncLoop(w *binlog, rate time.Duration) {
+	t := time.NewTicker(rate)
+	defer t.Stop()
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-t.C:
+		}
+
+		w.mu.Lock()
+		if w.dirty && !w.closed {
+			failFsyncDelay()
+			if err := w.f.Sync(); err != nil {
+				slog.Error("binlog sync failed", "err", err)
+				w.syncErr = err
+			} else {
+				w.dirty = false
+				w.syncErr = nil
+			}
+		}
+		w.mu.Unlock()
+	}
+}
+
+// walCheck reports whether the binlog can still be written: the last
+// background sync succeeded and the directory is writable.
+func walCheck(w *binlog) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.syncErr != nil {
+		return w.syncErr
+	}
+	if err := walDirWritable(w.dir); err != nil {
+		return fmt.Errorf("binlog: %s is not writable: %w", w.dir, err)
+	}
+	return nil
+}
+
+// walSyncPolicy describes the effective sync policy for stats.
+func walSyncPolicy() string {
+	switch {
+	case wal == nil:
+		return "disabled"
+	case binlogNoSync:
+		return "never"
+	case binlogSyncRate <= 0:
+		return "always"
+	}
+	return "interval"
+}
+
+// walSegments returns the sequence numbers of the binlog files in dir, in
+// ascending order.
+func walSegments(dir string) ([]int, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var seqs []int
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasPrefix(name, binlogPrefix) {
+			continue
+		}
+		n, err := strconv.Atoi(name[len(binlogPrefix):])
+		if err != nil || n <= 0 {
+			continue
+		}
+		seqs = append(seqs, n)
+	}
+	sort.Ints(seqs)
+	return seqs, nil
+}
+
+func walSegmentPath(dir string, seq int) string {
+	return filepath.Join(dir, binlogPrefix+strconv.Itoa(seq))
+}
+
+func walOpenSegment(w *binlog, seq int) error {
+	f, err := os.OpenFile(walSegmentPath(w.dir, seq), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+
+	var hdr [4]byte
+	binary.LittleEndian.PutUint32(hdr[:], walVersion(w.aead))
+	if _, err := f.Write(hdr[:]); err != nil {
+		f.Close()
+		return err
+	}
+
+	w.cur = &walSegment{seq: seq, size: int64(len(hdr)), sealed: w.aead != nil, jobs: map[uint64]*job{}}
+	w.segs = append(w.segs, w.cur)
+	w.f = f
+	return nil
+}
+
+// walRotate closes the current segment and starts the next one. The caller
+// must hold w.mu.
+func walRotate(w *binlog) error {
+	return walRotateTo(w, w.cur.seq+1)
+}
+
+func walRotateTo(w *binlog, seq int) error {
+	if !binlogNoSync {
+		if err := w.f.Sync(); err != nil {
+			return err
+		}
+	}
+	if err := w.f.Close(); err != nil {
+		return err
+	}
+	w.dirty = false
+
+	if err := walOpenSegment(w, seq); err != nil {
+		return err
+	}
+
+	select {
+	case w.compact <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func walClose(w *binlog) error {
+	if w == nil {
+		return nil
+	}
+	close(w.done)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.closed = true
+	var err error
+	if !binlogNoSync {
+		err = w.f.Sync()
+	}
+	if cerr := w.f.Close(); err == nil {
+		err = cerr
+	}
+	if lerr := w.lock.Close(); err == nil {
+		err = lerr
+	}
+	return err
+}
+
+// walWritePut records a newly created job, including its tube and body.
+func walWritePut(w *binlog, j *job) error {
+	if w == nil {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return walWritePutLocked(w, j)
+}
+
+func walWritePutLocked(w *binlog, j *job) error {
+	w.buf = walEncodePut(w.buf[:0], j)
+	if err := walAppend(w); err != nil {
+		return err
+	}
+
+	walUnhome(j)
+	j.walSeg = w.cur
+	j.walSize = int64(len(w.buf))
+	w.cur.jobs[j.id] = j
+	w.cur.live += j.walSize
+	return nil
+}
+
+// walUnhome detaches j from the segment holding its put record.
+func walUnhome(j *job) {
+	if j.walSeg == nil {
+		return
+	}
+	delete(j.walSeg.jobs, j.id)
+	j.walSeg.live -= j.walSize
+	j.walSeg = nil
+}
+
+// walWriteState records a change of state, priority, or delay of a job that
+// has already been written with walWritePut.
+func walWriteState(w *binlog, j *job) error {
+	if w == nil {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.buf = walEncodeState(w.buf[:0], j)
+	return walAppend(w)
+}
+
+// walWriteDelete records that a job no longer exists.
+func walWriteDelete(w *binlog, j *job) error {
+	if w == nil {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.buf = walEncodeRecord(w.buf[:0], recDelete, j.id)
+	if err := walAppend(w); err != nil {
+		return err
+	}
+	walUnhome(j)
+	return nil
+}
+
+// walAppend frames the payload in w.buf and writes it out, starting a new
+// segment first if the record would take the current one past
+// binlogMaxSize.
+func walAppend(w *binlog) error {
+	if w.aead != nil {
+		w.sealed = walSeal(w.aead, append(w.sealed[:0], w.buf[:recHeaderSize]...), w.buf[recHeaderSize:])
+		w.buf, w.sealed = w.sealed, w.buf
+	}
+	n := len(w.buf) - recHeaderSize
+	binary.LittleEndian.PutUint32(w.buf[0:4], uint32(n))
+	binary.LittleEndian.PutUint32(w.buf[4:8], crc32.ChecksumIEEE(w.buf[recHeaderSize:]))
+
+	if w.cur.size > 4 && w.cur.size+int64(len(w.buf)) > binlogMaxSize {
+		if err := walRotate(w); err != nil {
+			return err
+		}
+	}
+
+	if failTornWrite() {
+		w.f.Write(w.buf[:len(w.buf)/2])
+		slog.Error("failpoint binlog-torn-write: exiting")
+		os.Exit(3)
+	}
+	if failDropWrite() {
+		return nil
+	}
+	if _, err := w.f.Write(w.buf); err != nil {
+		return err
+	}
+	w.cur.size += int64(len(w.buf))
+	w.recordsWritten++
+
+	switch {
+	case binlogNoSync:
+	case binlogSyncRate <= 0:
+		failFsyncDelay()
+		return w.f.Sync()
+	default:
+		w.dirty = true
+	}
+	return nil
+}
+
+func walEncodeRecord(b []byte, kind recKind, id uint64) []byte {
+	b = append(b, make([]byte, recHeaderSize)...)
+	b = append(b, byte(kind))
+	return binary.LittleEndian.AppendUint64(b, id)
+}
+
+func walEncodePut(b []byte, j *job) []byte {
+	b = walEncodeRecord(b, recPut, j.id)
+	b = append(b, byte(j.state))
+	b = binary.LittleEndian.AppendUint64(b, j.pri)
+	b = binary.LittleEndian.AppendUint64(b, j.delay)
+	b = binary.LittleEndian.AppendUint64(b, j.ttr)
+	b = binary.LittleEndian.AppendUint64(b, walTime(j.created))
+	b = binary.LittleEndian.AppendUint64(b, walTime(j.deadline))
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(j.tube.name)))
+	b = append(b, j.tube.name...)
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(j.body)))
+	b = append(b, j.body...)
+	if len(j.deps) > 0 || len(j.headers) > 0 || j.compressed {
+		b = binary.LittleEndian.AppendUint16(b, uint16(len(j.deps)))
+		for _, id := range j.deps {
+			b = binary.LittleEndian.AppendUint64(b, id)
+		}
+	}
+	if len(j.headers) > 0 || j.compressed {
+		b = binary.LittleEndian.AppendUint16(b, uint16(len(j.headers)))
+		for _, h := range j.headers {
+			b = append(b, byte(len(h.key)))
+			b = append(b, h.key...)
+			b = binary.LittleEndian.AppendUint16(b, uint16(len(h.value)))
+			b = append(b, h.value...)
+		}
+	}
+	if j.compressed {
+		b = append(b, walFlagCompressed)
+	}
+	return b
+}
+
+func walEncodeTube(b []byte, t *tube) []byte {
+	b = walEncodeRecord(b, recTube, 0)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(t.name)))
+	return append(b, t.name...)
+}
+
+func walEncodeState(b []byte, j *job) []byte {
+	b = walEncodeRecord(b, recState, j.id)
+	b = append(b, byte(j.state))
+	b = binary.LittleEndian.AppendUint64(b, j.pri)
+	b = binary.LittleEndian.AppendUint64(b, j.delay)
+	return binary.LittleEndian.AppendUint64(b, walTime(j.deadline))
+}
+
+// walTime encodes t as nanoseconds since the epoch, with 0 for the zero time.
+func walTime(t time.Time) uint64 {
+	if t.IsZero() {
+		return 0
+	}
+	return uint64(t.UnixNano())
+}
+
+func walTimeDecode(n uint64) time.Time {
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, int64(n))
+}
+
+// walDamage describes a segment whose tail could not be decoded. The first
+// records records, ending at offset good, were applied.
+type walDamage struct {
+	seq     int
+	records int
+	good    int64
+	err     error
+}
+
+// walReplay reads the given binlog segments in order and rebuilds the job
+// and tube tables from them. A segment whose tail cannot be decoded, as
+// left by a crash in the middle of a write, is read up to the last good
+// record and reported in the returned list.
+func walReplay(w *binlog, seqs []int) ([]walDamage, error) {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+
+	var damage []walDamage
+
+	var maxID uint64
+	for _, seq := range seqs {
+		path := walSegmentPath(w.dir, seq)
+		seg := &walSegment{seq: seq, jobs: map[uint64]*job{}}
+		if fi, err := os.Stat(path); err == nil {
+			seg.size = fi.Size()
+		}
+		w.segs = append(w.segs, seg)
+
+		n, good, err := walReplaySegment(seg, path, w.aead, &maxID)
+		if err != nil {
+			if !errors.Is(err, errBinlogCorrupt) && !errors.Is(err, io.ErrUnexpectedEOF) {
+				return nil, fmt.Errorf("binlog: %s: %w", path, err)
+			}
+			damage = append(damage, walDamage{seq: seq, records: n, good: good, err: err})
+		}
+	}
+
+	if maxID >= nextJobID {
+		nextJobID = maxID + 1
+	}
+	return damage, nil
+}
+
+// walReplaySegment applies every record in one segment and returns how many
+// records were read and the offset just past the last of them.
+func walReplaySegment(seg *walSegment, path string, aead cipher.AEAD, maxID *uint64) (int, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		if err == io.EOF {
+			return 0, 0, nil
+		}
+		return 0, 0, err
+	}
+	switch v := binary.LittleEndian.Uint32(hdr[:]); v {
+	case binlogVersion:
+	case binlogVersionSealed:
+		if aead == nil {
+			return 0, 0, errBinlogNoKey
+		}
+		seg.sealed = true
+	default:
+		return 0, 0, fmt.Errorf("unsupported version %d", v)
+	}
+
+	good := int64(len(hdr))
+	var buf []byte
+	for n := 0; ; n++ {
+		var rh [recHeaderSize]byte
+		if _, err := io.ReadFull(r, rh[:]); err != nil {
+			if err == io.EOF {
+				return n, good, nil
+			}
+			return n, good, err
+		}
+
+		size := binary.LittleEndian.Uint32(rh[0:4])
+		sum := binary.LittleEndian.Uint32(rh[4:8])
+		if size > walRecordMax {
+			// A length no record can have is as good as a bad checksum,
+			// and must not be allocated.
+			return n, good, errBinlogCorrupt
+		}
+
+		if cap(buf) < int(size) {
+			buf = make([]byte, size)
+		}
+		buf = buf[:size]
+		if _, err := io.ReadFull(r, buf); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return n, good, err
+		}
+		if crc32.ChecksumIEEE(buf) != sum {
+			return n, good, errBinlogCorrupt
+		}
+		p := buf
+		if seg.sealed {
+			if p, err = walUnseal(aead, buf); err != nil {
+				return n, good, err
+			}
+		}
+
+		if err := walApply(seg, p, maxID); err != nil {
+			return n, good, err
+		}
+		good += int64(recHeaderSize) + int64(size)
+	}
+}
+
+// walApply replays a single record payload. The caller must hold jobsMu.
+func walApply(seg *walSegment, p []byte, maxID *uint64) error {
+	d := walDecoder{p: p}
+	kind := recKind(d.u8())
+	id := d.u64()
+	if d.bad {
+		return errBinlogCorrupt
+	}
+	if id > *maxID {
+		*maxID = id
+	}
+
+	switch kind {
+	case recPut:
+		j, err := walDecodeJob(&d, id)
+		if err != nil {
+			return err
+		}
+
+		if old, ok := allJobs[id]; ok {
+			walUnhome(old)
+			unstoreJob(old)
+		}
+		storeJob(j)
+
+		j.walSeg = seg
+		j.walSize = int64(recHeaderSize + len(p))
+		if seg.sealed {
+			j.walSize += walSealOverhead
+		}
+		seg.jobs[id] = j
+		seg.live += j.walSize
+	case recState:
+		state := jobState(d.u8())
+		pri := d.u64()
+		delay := d.u64()
+		deadline := walTimeDecode(d.u64())
+		if d.bad {
+			return errBinlogCorrupt
+		}
+
+		j, ok := allJobs[id]
+		if !ok {
+			// The put record was in a segment that has been removed.
+			return nil
+		}
+		unstoreJob(j)
+		j.state = state
+		j.pri = pri
+		j.delay = delay
+		j.deadline = deadline
+		storeJob(j)
+	case recTube:
+		name := d.bytes(int(d.u16()))
+		if d.bad {
+			return errBinlogCorrupt
+		}
+		tubeFindOrMakeLocked(string(name))
+	case recDelete:
+		if j, ok := allJobs[id]; ok {
+			walUnhome(j)
+			unstoreJob(j)
+		}
+	default:
+		return errBinlogCorrupt
+	}
+	return nil
+}
+
+// walDecodeJob decodes the fields of a put record that follow the job id.
+// The caller must hold jobsMu.
+func walDecodeJob(d *walDecoder, id uint64) (*job, error) {
+	j := &job{id: id}
+	j.state = jobState(d.u8())
+	j.pri = d.u64()
+	j.delay = d.u64()
+	j.ttr = d.u64()
+	j.created = walTimeDecode(d.u64())
+	j.deadline = walTimeDecode(d.u64())
+	name := d.bytes(int(d.u16()))
+	j.body = d.bytes(int(d.u32()))
+	// The dependencies of a put-after, the headers of a put-headers and
+	// the flags follow, as far as the job needs them.
+	if len(d.p) > 0 {
+		if n := d.u16(); n > 0 {
+			j.deps = make([]uint64, n)
+			for i := range j.deps {
+				j.deps[i] = d.u64()
+			}
+		}
+	}
+	if len(d.p) > 0 {
+		j.headers = make([]jobHeader, d.u16())
+		for i := range j.headers {
+			k := d.take(int(d.u8()))
+			v := d.take(int(d.u16()))
+			j.headers[i] = jobHeader{string(k), string(v)}
+		}
+		if len(j.headers) == 0 {
+			j.headers = nil
+		}
+	}
+	if len(d.p) > 0 {
+		j.compressed = d.u8()&walFlagCompressed != 0
+	}
+	if d.bad {
+		return nil, errBinlogCorrupt
+	}
+	j.bodySize = uint64(len(j.body))
+	j.tube = tubeFindOrMakeLocked(string(name))
+	return j, nil
+}
+
+// walDecoder reads fixed-size fields from a record payload. Reading past the
+// end sets bad instead of panicking, so a record only needs to be checked
+// once after all of its fields have been read.
+type walDecoder struct {
+	p   []byte
+	bad bool
+}
+
+func (d *walDecoder) take(n int) []byte {
+	if d.bad || n > len(d.p) {
+		d.bad = true
+		return nil
+	}
+	b := d.p[:n]
+	d.p = d.p[n:]
+	return b
+}
+
+func (d *walDecoder) u8() uint8 {
+	if b := d.take(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (d *walDecoder) u16() uint16 {
+	if b := d.take(2); b != nil {
+		return binary.LittleEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (d *walDecoder) u32() uint32 {
+	if b := d.take(4); b != nil {
+		return binary.LittleEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (d *walDecoder) u64() uint64 {
+	if b := d.take(8); b != nil {
+		return binary.LittleEndian.Uint64(b)
+	}
+	return 0
+}
+
+// bytes returns a copy of the next n bytes, since the payload buffer is
+// reused for the following record.
+func (d *walDecoder) bytes(n int) []byte {
+	b := d.take(n)
+	if b == nil {
+		return nil
+	}
+	return append([]byte(nil), b...)
+}
+
+func walCompactLoop(w *binlog) {
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-w.compact:
+		}
+		if err := walCompact(w); err != nil {
+			slog.Error("binlog compaction failed", "err", err)
+		}
+	}
+}
+
+// walCompact removes dead segments from the front of the log, moving jobs
+// out of the oldest segment while that is worth doing. It works in batches
+// so that puts are not held up for long.
+func walCompact(w *binlog) error {
+	for {
+		select {
+		case <-w.done:
+			return nil
+		default:
+		}
+
+		done, err := walCompactStep(w)
+		if err != nil || done {
+			return err
+		}
+	}
+}
+
+func walCompactStep(w *binlog) (bool, error) {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed || len(w.segs) < 2 {
+		return true, nil
+	}
+
+	old := w.segs[0]
+	if len(old.jobs) == 0 {
+		if err := os.Remove(walSegmentPath(w.dir, old.seq)); err != nil && !os.IsNotExist(err) {
+			return true, err
+		}
+		w.segs = w.segs[1:]
+		return false, nil
+	}
+
+	var size, live int64
+	for _, seg := range w.segs {
+		size += seg.size
+		live += seg.live
+	}
+	if size-live <= live {
+		return true, nil
+	}
+
+	n := 0
+	for _, j := range old.jobs {
+		if n == walCompactBatch {
+			break
+		}
+		if err := walWritePutLocked(w, j); err != nil {
+			return true, err
+		}
+		w.recordsMigrated++
+		n++
+	}
+	return false, nil
+}
+
+type walStat struct {
+	oldestIndex     int
+	currentIndex    int
+	maxSize         int64
+	recordsWritten  uint64
+	recordsMigrated uint64
+}
+
+func walStats(w *binlog) walStat {
+	if w == nil {
+		return walStat{}
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return walStat{
+		oldestIndex:     w.segs[0].seq,
+		currentIndex:    w.cur.seq,
+		maxSize:         binlogMaxSize,
+		recordsWritten:  w.recordsWritten,
+		recordsMigrated: w.recordsMigrated,
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !unix
+
+package dispatch
+
+import "os"
+
+// Without flock(2) and access(2) the binlog directory is not locked, so
+// running two servers on one directory is left to the operator to avoid,
+// and a directory that is no longer writable shows in the next write.
+
+func walFlock(f *os.File) error { return nil }
+
+func walDirWritable(dir string) error { return nil }
@@ -0,0 +1,153 @@
+package dispatch
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"testing"
+)
+
+// walTestRecord frames payload as a record.
+func walTestRecord(payload []byte) []byte {
+	b := binary.LittleEndian.AppendUint32(nil, uint32(len(payload)))
+	b = binary.LittleEndian.AppendUint32(b, crc32.ChecksumIEEE(payload))
+	return append(b, payload...)
+}
+
+func TestWalReplayTornTail(t *testing.T) {
+	tubeRec := walTestRecord(walEncodeTube(nil, &tube{name: "kept"})[recHeaderSize:])
+	tests := []struct {
+		name string
+		tail []byte
+	}{
+		{"bad checksum", []byte{4, 0, 0, 0, 1, 2, 3, 4, 'a', 'b', 'c', 'd'}},
+		{"oversized", binary.LittleEndian.AppendUint32([]byte{0xf0, 0xff, 0xff, 0xff}, 0)},
+		{"just over", binary.LittleEndian.AppendUint32(binary.LittleEndian.AppendUint32(nil, walRecordMax+1), 0)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serverReset()
+			t.Cleanup(serverReset)
+			dir := t.TempDir()
+			seg := binary.LittleEndian.AppendUint32(nil, binlogVersion)
+			seg = append(seg, tubeRec...)
+			good := len(seg)
+			seg = append(seg, tt.tail...)
+			if err := os.WriteFile(walSegmentPath(dir, 1), seg, 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			damage, err := walReplay(&binlog{dir: dir}, []int{1})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(damage) != 1 {
+				t.Fatalf("got %d damaged segments, want 1", len(damage))
+			}
+			d := damage[0]
+			if !errors.Is(d.err, errBinlogCorrupt) || d.records != 1 || d.good != int64(good) {
+				t.Errorf("got %d records to %d, %v; want 1 to %d, %v", d.records, d.good, d.err, good, errBinlogCorrupt)
+			}
+			if tubes["kept"] == nil {
+				t.Error("the record before the tail was not applied")
+			}
+		})
+	}
+}
+
+func TestWalRotateCompact(t *testing.T) {
+	savedMax, savedNoSync := binlogMaxSize, binlogNoSync
+	binlogMaxSize, binlogNoSync = 4096, true
+	serverReset()
+	t.Cleanup(func() {
+		binlogMaxSize, binlogNoSync = savedMax, savedNoSync
+		serverReset()
+	})
+	dir := t.TempDir()
+	open := func() *binlog {
+		t.Helper()
+		w, err := walInit(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		jobStore, wal = binlogStorage{w}, w
+		return w
+	}
+	w := open()
+
+	for i := 0; i < 200; i++ {
+		body := fmt.Sprintf("%-200d\r\n", i)
+		j := makeJob(uint64(i), 0, 60, uint64(len(body)))
+		copy(j.body, body)
+		j.tube = tubeFindOrMake("t")
+		if err := jobInsert(j, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	before, err := walSegments(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(before) < 5 {
+		t.Fatalf("200 puts of 4096-byte segments left %d segments", len(before))
+	}
+
+	// Keep every tenth job, so that most of the log is dead.
+	type kept struct {
+		pri  uint64
+		body string
+	}
+	want := map[uint64]kept{}
+	jobsMu.Lock()
+	for id, j := range allJobs {
+		if id%10 == 0 {
+			want[id] = kept{j.pri, string(j.body)}
+			continue
+		}
+		if err := jobDelete(j); err != nil {
+			jobsMu.Unlock()
+			t.Fatal(err)
+		}
+	}
+	jobsMu.Unlock()
+
+	if err := walCompact(w); err != nil {
+		t.Fatal(err)
+	}
+	st := walStats(w)
+	if st.recordsMigrated == 0 || st.oldestIndex == before[0] {
+		t.Errorf("compaction moved %d records and kept segment %d, want the oldest gone", st.recordsMigrated, st.oldestIndex)
+	}
+	after, err := walSegments(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after[0] == before[0] {
+		t.Errorf("segment %d is still on disk", before[0])
+	}
+
+	// Replay what is left into an empty server.
+	if err := walClose(w); err != nil {
+		t.Fatal(err)
+	}
+	serverReset()
+	w = open()
+	t.Cleanup(func() { walClose(w) })
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	if len(allJobs) != len(want) {
+		t.Errorf("replayed %d jobs, want %d", len(allJobs), len(want))
+	}
+	for id, k := range want {
+		j := allJobs[id]
+		if j == nil {
+			t.Errorf("job %d is missing", id)
+			continue
+		}
+		if string(j.body) != k.body || j.pri != k.pri || j.tube.name != "t" {
+			t.Errorf("job %d replayed as pri %d in %s with %q", id, j.pri, j.tube.name, j.body)
+		}
+	}
+}
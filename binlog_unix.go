@@ -0,0 +1,21 @@
+//go:build unix
+
+package dispatch
+
+import (
+	"os"
+	"syscall"
+)
+
+// unixWriteOK is W_OK for access(2), which package syscall does not name.
+const unixWriteOK = 0x2
+
+// walFlock takes an exclusive lock on f without waiting for it.
+func walFlock(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+}
+
+// walDirWritable reports whether the process may write to dir.
+func walDirWritable(dir string) error {
+	return syscall.Access(dir, unixWriteOK)
+}
@@ -0,0 +1,147 @@
+package dispatch
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/jkasarherou/dispatch/protocol"
+)
+
+// A client that sends binMagic as the first byte of a connection speaks
+// the binary framing for the rest of it, which spares producers the text
+// parsing and CRLF scanning of put. Each request is a frame,
+//
+//	u32 length of what follows
+//	u8  kind
+//	'c': a command line without its CRLF
+//	'p': u32 pri, u32 delay, u32 ttr, then the job body without its CRLF
+//
+// and each reply the text protocol's, CRLFs and all, framed as
+//
+//	u32 length of the reply
+//	reply
+//
+// with integers big-endian. A 'p' frame is a put into the tube in use.
+// The other put commands and mput send their bodies after their line, so
+// they are text protocol only, and answered BAD_FORMAT in a 'c' frame. A
+// frame of an unknown kind loses the framing and closes the connection.
+// Both framings end up in doCmd, so commands behave, and are authorized,
+// counted and logged, the same in either.
+
+const (
+	binMagic = 0xbe
+
+	binFrameCmd = 'c'
+	binFramePut = 'p'
+
+	// binHeaderSize is the length and kind of a frame, and binPutSize
+	// the fields of a put frame that follow them.
+	binHeaderSize = 5
+	binPutSize    = 12
+)
+
+var (
+	errBinFrame  = errors.New("bad binary frame")
+	errBinNoBody = errors.New("command with a body in a command frame")
+)
+
+// binPutArgs are the fields of the put frame being handled.
+type binPutArgs struct {
+	pri, delay, ttr, size uint64
+}
+
+// binDetect reads the first byte of c, and switches c to the binary
+// framing if it is binMagic.
+func binDetect(c *conn) error {
+	c.protoKnown = true
+	b, err := c.reader.Peek(1)
+	if err != nil {
+		return err
+	}
+	if b[0] == binMagic {
+		c.reader.Discard(1)
+		c.binary = true
+		binaryConnCount.Add(1)
+	}
+	return nil
+}
+
+// binBuffered reports whether a whole frame header has been read.
+func binBuffered(c *conn) bool {
+	return c.reader.Buffered() >= binHeaderSize
+}
+
+// binReadFrame reads the next frame into c.cmd, as the command line it
+// stands for, and for a put frame its fields into c.binPut; the body is
+// left to be read as in the text protocol. Like connReadLine it skips a
+// command too long and returns errLineTooLong, and it returns errBinNoBody
+// for a command that needs a body.
+func binReadFrame(c *conn) error {
+	hdr, err := c.reader.Peek(binHeaderSize)
+	if err != nil {
+		return err
+	}
+	length, kind := binary.BigEndian.Uint32(hdr), hdr[4]
+	if length == 0 {
+		return errBinFrame
+	}
+	n := uint64(length) - 1
+	c.reader.Discard(binHeaderSize)
+	c.binPut = nil
+
+	switch kind {
+	case binFrameCmd:
+		if n > uint64(lineBufSize-2) {
+			if _, err := c.reader.Discard(int(n)); err != nil {
+				return err
+			}
+			c.cmd = c.cmd[:0]
+			return errLineTooLong
+		}
+		line, err := c.reader.Peek(int(n))
+		if err != nil {
+			return err
+		}
+		c.cmd = append(append(c.cmd[:0], line...), "\r\n"...)
+		c.reader.Discard(int(n))
+		switch whichCmd(c.cmd) {
+		case opPut, opPutUnique, opPutAfter, opPutHeaders, opMput:
+			c.cmd = c.cmd[:0]
+			return errBinNoBody
+		}
+		return nil
+	case binFramePut:
+		if n < binPutSize {
+			return errBinFrame
+		}
+		f, err := c.reader.Peek(binPutSize)
+		if err != nil {
+			return err
+		}
+		c.binPutBuf = binPutArgs{
+			pri:   uint64(binary.BigEndian.Uint32(f)),
+			delay: uint64(binary.BigEndian.Uint32(f[4:])),
+			ttr:   uint64(binary.BigEndian.Uint32(f[8:])),
+			size:  n - binPutSize,
+		}
+		c.reader.Discard(binPutSize)
+		c.binPut = &c.binPutBuf
+		// The line the frame stands for, for logs and traces.
+		c.cmd = protocol.AppendPut(c.cmd[:0], c.binPut.pri, c.binPut.delay, c.binPut.ttr, c.binPut.size)
+		return nil
+	default:
+		return errBinFrame
+	}
+}
+
+// binReplySize is the length of the reply writeReply is about to send.
+func binReplySize(c *conn) uint32 {
+	n := len(c.reply)
+	if c.replyBuf != nil {
+		n = len(*c.replyBuf)
+	}
+	if c.state == connStateSendJob {
+		n += len(c.replyBody)
+	}
+	return uint32(n)
+}
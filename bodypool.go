@@ -0,0 +1,58 @@
+package dispatch
+
+import (
+	"math/bits"
+	"sync"
+	"sync/atomic"
+)
+
+// Job bodies come from pools of buffers sized in powers of two, from 64
+// bytes to 1 MiB, and go back when the job is deleted, which takes most of
+// the garbage out of put-heavy workloads. Larger bodies are allocated and
+// left to the collector as before.
+
+const (
+	bodyMinClass = 6  // 64 bytes
+	bodyMaxClass = 20 // 1 MiB
+)
+
+var bodyPools [bodyMaxClass - bodyMinClass + 1]sync.Pool
+
+// bodyHold keeps freed bodies out of the pools while it is above 0, for
+// snapshots, which write bodies after letting go of jobsMu.
+var bodyHold atomic.Int32
+
+// bodyClass is the power of two n bytes are rounded up to.
+func bodyClass(n uint64) int {
+	if n <= 1<<bodyMinClass {
+		return bodyMinClass
+	}
+	return bits.Len64(n - 1)
+}
+
+// bodyAlloc returns a buffer of n bytes. Its contents are not zeroed.
+func bodyAlloc(n uint64) []byte {
+	c := bodyClass(n)
+	if c > bodyMaxClass {
+		return make([]byte, n)
+	}
+	if p, ok := bodyPools[c-bodyMinClass].Get().(*[]byte); ok {
+		return (*p)[:n]
+	}
+	return make([]byte, n, 1<<c)
+}
+
+// bodyFree returns b to its pool. b must not be used afterwards. Buffers
+// that are not the size of a class are left to the collector.
+func bodyFree(b []byte) {
+	if bodyHold.Load() > 0 {
+		return
+	}
+	n := uint64(cap(b))
+	c := bodyClass(n)
+	if n != 1<<c || c > bodyMaxClass {
+		return
+	}
+	b = b[:0]
+	bodyPools[c-bodyMinClass].Put(&b)
+}
@@ -0,0 +1,60 @@
+package dispatch
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestBodyAlloc(t *testing.T) {
+	tests := []struct {
+		n       uint64
+		wantCap int
+	}{
+		{0, 64},
+		{1, 64},
+		{64, 64},
+		{65, 128},
+		{1000, 1024},
+		{1 << 20, 1 << 20},
+		{1<<20 + 1, 1<<20 + 1},
+	}
+	for _, tt := range tests {
+		b := bodyAlloc(tt.n)
+		if uint64(len(b)) != tt.n || cap(b) != tt.wantCap {
+			t.Errorf("bodyAlloc(%d): len %d cap %d, want len %d cap %d", tt.n, len(b), cap(b), tt.n, tt.wantCap)
+		}
+		bodyFree(b)
+	}
+}
+
+// BenchmarkPutBody compares taking a put's body from the pools, as puts do,
+// with allocating it, as they did before.
+func BenchmarkPutBody(b *testing.B) {
+	for _, size := range []int{100, 4 << 10, 64 << 10, 256 << 10} {
+		body := make([]byte, size)
+		b.Run(fmt.Sprintf("pooled/%d", size), func(b *testing.B) {
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				j := makeJob(0, 0, 60, uint64(size)+2)
+				copy(j.body, body)
+				copy(j.body[size:], "\r\n")
+				bodyFree(j.body)
+			}
+		})
+		b.Run(fmt.Sprintf("plain/%d", size), func(b *testing.B) {
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				j := &job{pri: 0, ttr: 60, bodySize: uint64(size) + 2}
+				j.body = make([]byte, j.bodySize)
+				copy(j.body, body)
+				copy(j.body[size:], "\r\n")
+				benchSink = j.body
+			}
+		})
+	}
+}
+
+// benchSink keeps the plain benchmark's bodies from being optimized away.
+var benchSink []byte
@@ -0,0 +1,119 @@
+//go:build bolt
+
+package dispatch
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// The bolt storage keeps each job as one key in a bbolt database, using the
+// binlog's put record encoding as the value. Every change is its own
+// transaction, synced before the reply is sent unless -F is given, so there
+// are no segments to rotate or compact. It suits small deployments where a
+// sync per operation is affordable.
+
+var (
+	boltJobsBucket  = []byte("jobs")
+	boltTubesBucket = []byte("tubes")
+)
+
+type boltStorage struct {
+	db  *bolt.DB
+	buf []byte
+}
+
+func boltOpen(path string) (storage, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second, NoSync: binlogNoSync})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(boltJobsBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(boltTubesBucket)
+		return err
+	})
+	if err == nil {
+		err = boltLoad(db)
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltStorage{db: db}, nil
+}
+
+func boltLoad(db *bolt.DB) error {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+
+	return db.View(func(tx *bolt.Tx) error {
+		err := tx.Bucket(boltTubesBucket).ForEach(func(k, v []byte) error {
+			tubeFindOrMakeLocked(string(k))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		return tx.Bucket(boltJobsBucket).ForEach(func(k, v []byte) error {
+			d := walDecoder{p: v}
+			if recKind(d.u8()) != recPut {
+				return errBinlogCorrupt
+			}
+			id := d.u64()
+			j, err := walDecodeJob(&d, id)
+			if err != nil {
+				return err
+			}
+			storeJob(j)
+			if id >= nextJobID {
+				nextJobID = id + 1
+			}
+			return nil
+		})
+	})
+}
+
+func boltKey(id uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, id)
+}
+
+func (s *boltStorage) putJob(j *job) error {
+	// Skip the binlog record header; the value is the payload alone.
+	s.buf = walEncodePut(s.buf[:0], j)
+	v := s.buf[recHeaderSize:]
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(boltTubesBucket).Put([]byte(j.tube.name), nil); err != nil {
+			return err
+		}
+		return tx.Bucket(boltJobsBucket).Put(boltKey(j.id), v)
+	})
+}
+
+func (s *boltStorage) updateJob(j *job) error {
+	return s.putJob(j)
+}
+
+func (s *boltStorage) deleteJob(j *job) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltJobsBucket).Delete(boltKey(j.id))
+	})
+}
+
+func (s *boltStorage) check() error {
+	if s.db.IsReadOnly() {
+		return errors.New("bolt: database is read-only")
+	}
+	return nil
+}
+
+func (s *boltStorage) close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,9 @@
+//go:build !bolt
+
+package dispatch
+
+import "errors"
+
+func boltOpen(path string) (storage, error) {
+	return nil, errors.New("bolt storage is not compiled in; build with -tags bolt")
+}
@@ -0,0 +1,232 @@
+package dispatch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/jkasarherou/dispatch/protocol"
+)
+
+// The bridges connect dispatch to message brokers, so that producers can
+// move to it one at a time while the rest still publish to the broker, and
+// event-driven systems can follow its tubes.
+//
+// The AMQP bridge, built with -tags amqp and turned on by -amqp-url,
+// consumes messages from a RabbitMQ queue. The NATS bridge, built with
+// -tags nats and turned on by -nats-url, subscribes with -nats-put-prefix
+// to <prefix>.>, in the queue group dispatch so that each message is put
+// by one server of those sharing the subjects. Either way a message
+// becomes a job as follows:
+//
+//	tube   the AMQP routing key, or the NATS subject after <prefix>.;
+//	       default if that is empty
+//	pri    its priority header, or 1024
+//	delay  its delay header, in seconds, or 0
+//	ttr    its ttr header, in seconds, or 60
+//	body   its body
+//
+// The headers are integers, or strings of digits. The put is checked as
+// one from the text protocol: against -authz under the identity amqp or
+// nats, whose namespace it goes into if it has one, and the tube's size,
+// quota and rate limits. A message that can never be put is one refused for
+// its tube name, headers, size or authorization; one that cannot be put yet
+// is refused because the server is draining, the tube is full or over its
+// put rate, or storage failed.
+//
+// An AMQP message is acked once its job is stored. One that can never be
+// put is rejected without requeueing, so that the queue's dead-letter
+// exchange gets it if it has one, and one that cannot be put yet is
+// requeued after bridgeRetryDelay. A NATS message sent as a request is
+// answered INSERTED <id>, REJECTED <reason> if it can never be put, or
+// ERROR <reason>; NATS has no redelivery, so other messages that are not
+// put are only logged and counted as nats-errors. Both bridges reconnect
+// when they lose the connection.
+//
+// The NATS bridge also works the other way: a tube given a subject in the
+// config file,
+//
+//	[tube."orders"]
+//	nats-subject = "orders.created"
+//
+// has each job put into it published there, in the background as mirrors
+// are sent, with the body as put and the job in headers: Dispatch-Job,
+// Dispatch-Tube, Dispatch-Pri, Dispatch-Delay and Dispatch-TTR, and the
+// job's own put-headers. Up to natsQueueSize jobs wait for NATS and later
+// ones are dropped; stats count them as nats-published and nats-dropped.
+// Without -nats-url the setting does nothing.
+
+var (
+	amqpURL      string
+	amqpQueue    = "dispatch"
+	amqpPrefetch = 64
+
+	natsURL       string
+	natsPutPrefix string
+)
+
+const (
+	bridgePri = 1024
+	bridgeTTR = 60
+
+	// bridgeRetryDelay is how long a message that could not be put yet
+	// is held before it is requeued, so that it does not spin.
+	bridgeRetryDelay = time.Second
+
+	// natsQueueGroup is the queue group the NATS bridge subscribes in.
+	natsQueueGroup = "dispatch"
+
+	// natsQueueSize is the number of jobs waiting to be published to NATS
+	// at most.
+	natsQueueSize = 4096
+)
+
+// errBridgeReject marks messages that can never be put.
+var errBridgeReject = errors.New("rejected")
+
+// bridgePut puts a message that came from o, with headers and body, into
+// the tube key names and returns the job's id. Errors wrap errBridgeReject
+// if retrying cannot help.
+func bridgePut(ctx context.Context, o origin, key string, headers map[string]any, body []byte) (uint64, error) {
+	if key == "" {
+		key = defaultTubeName
+	}
+	identity := originNames[o]
+	name := nsPrefix(identity) + key
+	if !protocol.ValidTubeName(name) {
+		return 0, fmt.Errorf("%w: bad tube name %q", errBridgeReject, name)
+	}
+	pri, err := bridgeHeader(headers, "priority", bridgePri)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", errBridgeReject, err)
+	}
+	delay, err := bridgeHeader(headers, "delay", 0)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", errBridgeReject, err)
+	}
+	ttr, err := bridgeHeader(headers, "ttr", bridgeTTR)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", errBridgeReject, err)
+	}
+
+	sp := spanStart("dispatch.put")
+	defer spanEnd(sp)
+	spanString(sp, "dispatch.tube", name)
+	spanInt(sp, "dispatch.body_size", int64(len(body)))
+
+	if !authorizeReq(&authzRequest{ctx: ctx, identity: identity, remote: identity, op: "put", tube: name}) {
+		return 0, fmt.Errorf("%w: forbidden", errBridgeReject)
+	}
+	if draining.Load() {
+		return 0, errors.New("draining")
+	}
+	t := tubeFindOrMake(name)
+	if uint64(len(body)) > t.maxJobSize.Load() {
+		return 0, fmt.Errorf("%w: job too big", errBridgeReject)
+	}
+	var given putFields
+	for name, f := range map[string]putFields{"priority": putPri, "delay": putDelay, "ttr": putTTR} {
+		if _, ok := headers[name]; ok {
+			given |= f
+		}
+	}
+	pri, delay, ttr, err = t.limits.Load().limit(pri, delay, ttr, given)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", errBridgeReject, err)
+	}
+	if !tubePutAdmit(ctx, t) {
+		return 0, errors.New("rate limited")
+	}
+	j := makeJob(pri, delay, ttr, uint64(len(body))+2)
+	copy(j.body, body)
+	copy(j.body[len(body):], "\r\n")
+	j.tube = t
+	j.origin = o
+	if err := jobInsert(j, sp); err != nil {
+		bodyFree(j.body)
+		return 0, err
+	}
+	return j.id, nil
+}
+
+// bridgeHeader reads the header name as a 32-bit number, giving def if it
+// is missing.
+func bridgeHeader(headers map[string]any, name string, def uint64) (uint64, error) {
+	v, ok := headers[name]
+	if !ok {
+		return def, nil
+	}
+	var n int64
+	switch v := v.(type) {
+	case int8:
+		n = int64(v)
+	case int16:
+		n = int64(v)
+	case int32:
+		n = int64(v)
+	case int64:
+		n = v
+	case int:
+		n = int64(v)
+	case uint8:
+		n = int64(v)
+	case uint16:
+		n = int64(v)
+	case uint32:
+		n = int64(v)
+	case string:
+		u, ok := protocol.ParseUint([]byte(v), 32)
+		if !ok {
+			return 0, fmt.Errorf("bad %s header %q", name, v)
+		}
+		return u, nil
+	default:
+		return 0, fmt.Errorf("%s header is a %T, not a number", name, v)
+	}
+	if n < 0 || n > math.MaxUint32 {
+		return 0, fmt.Errorf("%s header %d is out of range", name, n)
+	}
+	return uint64(n), nil
+}
+
+// natsJob is a copy of a job to publish to NATS, made when it was put.
+type natsJob struct {
+	subject         string
+	id              uint64
+	tube            string
+	pri, delay, ttr uint64
+	// body is as stored, CRLF included, gzipped if compressed is set.
+	body       []byte
+	compressed bool
+	headers    []jobHeader
+}
+
+// natsQueue holds the jobs waiting to be published. It is nil unless the
+// NATS bridge is running.
+var natsQueue chan *natsJob
+
+// natsPublish queues j, which has just been put, to be published to its
+// tube's subject. The caller must hold jobsMu.
+func natsPublish(j *job) {
+	if natsQueue == nil {
+		return
+	}
+	nj := &natsJob{
+		subject:    j.tube.natsSubject,
+		id:         j.id,
+		tube:       j.tube.name,
+		pri:        j.pri,
+		delay:      j.delay,
+		ttr:        j.ttr,
+		body:       append([]byte(nil), j.body...),
+		compressed: j.compressed,
+		headers:    j.headers,
+	}
+	select {
+	case natsQueue <- nj:
+	default:
+		natsDroppedCount.Add(1)
+	}
+}
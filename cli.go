@@ -0,0 +1,166 @@
+package dispatch
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+
+	"github.com/jkasarherou/dispatch/client"
+)
+
+// The put and stats subcommands are a small client for quick operations
+// work and scripts. They speak the beanstalkd protocol, so they also work
+// against beanstalkd itself. The server address comes from -addr, or else
+// $DISPATCH_ADDR, or else 127.0.0.1:3333. If $DISPATCH_TOKEN is set it is
+// sent with auth first. The connections are those of package client.
+
+func cliFlags(name, usage string) (*flag.FlagSet, *string, *string) {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	addr := os.Getenv("DISPATCH_ADDR")
+	if addr == "" {
+		addr = "127.0.0.1:3333"
+	}
+	a := fs.String("addr", addr, "server `host:port`")
+	t := fs.String("tube", defaultTubeName, "tube to use")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: dispatch %s\n", usage)
+		fs.PrintDefaults()
+	}
+	return fs, a, t
+}
+
+// cliContext is the context of a subcommand, canceled by an interrupt.
+func cliContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt)
+}
+
+// cliDial connects to addr and authenticates with $DISPATCH_TOKEN if it is
+// set.
+func cliDial(ctx context.Context, addr string) (*client.Conn, error) {
+	cc, err := client.Dial(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	if token := os.Getenv("DISPATCH_TOKEN"); token != "" {
+		if err := cc.Auth(ctx, token); err != nil {
+			cc.Abort()
+			return nil, err
+		}
+	}
+	return cc, nil
+}
+
+func cliFail(name string, err error) int {
+	fmt.Fprintf(os.Stderr, "dispatch %s: %v\n", name, err)
+	return 1
+}
+
+func cliPutMain(args []string) int {
+	fs, addr, tube := cliFlags("put", "put [flags] [-f file | body ...]")
+	pri := fs.Uint("pri", 1024, "priority, lower is more urgent")
+	delay := fs.Uint("delay", 0, "seconds before the job is ready")
+	ttr := fs.Uint("ttr", 60, "seconds a worker may hold the job")
+	file := fs.String("f", "", "read the body from this `file`, - for standard input")
+	fs.Parse(args)
+
+	var (
+		body []byte
+		err  error
+	)
+	switch {
+	case *file != "" && fs.NArg() > 0:
+		fs.Usage()
+		return 2
+	case *file == "-", *file == "" && fs.NArg() == 0:
+		body, err = io.ReadAll(os.Stdin)
+	case *file != "":
+		body, err = os.ReadFile(*file)
+	default:
+		body = []byte(strings.Join(fs.Args(), " "))
+	}
+	if err != nil {
+		return cliFail("put", err)
+	}
+
+	ctx, cancel := cliContext()
+	defer cancel()
+	cc, err := cliDial(ctx, *addr)
+	if err != nil {
+		return cliFail("put", err)
+	}
+	defer cc.Close()
+	if err := cc.Use(ctx, *tube); err != nil {
+		return cliFail("put", err)
+	}
+	id, err := cc.Put(ctx, *pri, *delay, *ttr, body)
+	if err != nil {
+		return cliFail("put", err)
+	}
+	fmt.Println(id)
+	return 0
+}
+
+func cliStatsMain(args []string) int {
+	fs, addr, _ := cliFlags("stats", "stats [-json | -raw]")
+	asJSON := fs.Bool("json", false, "print the stats as a JSON object")
+	raw := fs.Bool("raw", false, "print the server's reply as it is")
+	fs.Parse(args)
+	if fs.NArg() != 0 || *asJSON && *raw {
+		fs.Usage()
+		return 2
+	}
+
+	ctx, cancel := cliContext()
+	defer cancel()
+	cc, err := cliDial(ctx, *addr)
+	if err != nil {
+		return cliFail("stats", err)
+	}
+	defer cc.Close()
+	body, err := cliStats(ctx, cc)
+	if err != nil {
+		return cliFail("stats", err)
+	}
+	if *raw {
+		os.Stdout.Write(body)
+		return 0
+	}
+
+	stats := map[string]string{}
+	var keys []string
+	width := 0
+	for _, line := range strings.Split(string(body), "\n") {
+		k, v, ok := strings.Cut(line, ": ")
+		if !ok {
+			continue
+		}
+		stats[k] = strings.Trim(v, `"`)
+		keys = append(keys, k)
+		width = max(width, len(k))
+	}
+	if *asJSON {
+		b, _ := json.MarshalIndent(stats, "", "  ")
+		fmt.Printf("%s\n", b)
+		return 0
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Printf("%-*s  %s\n", width, k, stats[k])
+	}
+	return 0
+}
+
+// cliStats fetches the stats body, framed as OK <bytes>.
+func cliStats(ctx context.Context, cc *client.Conn) ([]byte, error) {
+	reply, err := cc.Expect(ctx, "OK ", cmdStats, nil)
+	if err != nil {
+		return nil, err
+	}
+	return cc.Data(ctx, strings.TrimPrefix(reply, "OK "))
+}
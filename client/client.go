@@ -0,0 +1,178 @@
+// Package client speaks the beanstalkd protocol to a dispatch server, or to
+// beanstalkd itself, for programs that put jobs or handle them:
+//
+//	cc, err := client.Dial(ctx, "127.0.0.1:3333")
+//	if err != nil {
+//		return err
+//	}
+//	defer cc.Close()
+//	id, err := cc.Put(ctx, 1024, 0, 60, []byte("hello"))
+//
+// A Conn is one connection and is not safe for concurrent use; a Pool
+// shares connections among goroutines.
+//
+// Every operation takes a context, which bounds its dial, waits and
+// transfers. An operation the context cuts short leaves the connection
+// in an unknown state in the protocol, so the connection is closed and
+// the context's error returned.
+package client
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jkasarherou/dispatch/protocol"
+)
+
+// DefaultTube is the tube a new connection uses and watches.
+const DefaultTube = "default"
+
+// DialTimeout bounds the dial of Dial, whatever its context allows.
+const DialTimeout = 5 * time.Second
+
+// A Conn is a connection to a server.
+type Conn struct {
+	c net.Conn
+	r *bufio.Reader
+	w *bufio.Writer
+}
+
+// Dial connects to the server at addr, a host:port.
+func Dial(ctx context.Context, addr string) (*Conn, error) {
+	d := net.Dialer{Timeout: DialTimeout}
+	c, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{c: c, r: bufio.NewReader(c), w: bufio.NewWriter(c)}, nil
+}
+
+// Auth authenticates with token, for a server run with -auth-file.
+func (cc *Conn) Auth(ctx context.Context, token string) error {
+	_, err := cc.Expect(ctx, protocol.OK, protocol.Auth+" "+token, nil)
+	return err
+}
+
+// Close says quit and closes the connection.
+func (cc *Conn) Close() error {
+	cc.w.WriteString(protocol.Quit + "\r\n")
+	cc.w.Flush()
+	return cc.c.Close()
+}
+
+// Abort closes the connection without a word, as is right once an
+// operation on it has failed and it may be part way through a command.
+func (cc *Conn) Abort() error {
+	return cc.c.Close()
+}
+
+// begin bounds the I/O of an operation on cc by ctx. The function it
+// returns ends the operation and passes its error through, unless ctx cut
+// it short, in which case cc is closed and ctx's error returned.
+func (cc *Conn) begin(ctx context.Context) func(error) error {
+	if ctx.Done() == nil {
+		return func(err error) error { return err }
+	}
+	d, _ := ctx.Deadline()
+	cc.c.SetDeadline(d)
+	stop := context.AfterFunc(ctx, func() {
+		// Wake any blocked read or write.
+		cc.c.SetDeadline(time.Unix(1, 0))
+	})
+	return func(err error) error {
+		if !stop() || ctx.Err() != nil {
+			cc.c.Close()
+			return ctx.Err()
+		}
+		cc.c.SetDeadline(time.Time{})
+		return err
+	}
+}
+
+// Cmd sends a command line, without its CRLF, and a body if there is one,
+// and returns the first line of the reply without its CRLF.
+func (cc *Conn) Cmd(ctx context.Context, line string, body []byte) (reply string, err error) {
+	end := cc.begin(ctx)
+	defer func() { err = end(err) }()
+	cc.w.WriteString(line + "\r\n")
+	if body != nil {
+		cc.w.Write(body)
+		cc.w.WriteString("\r\n")
+	}
+	if err := cc.w.Flush(); err != nil {
+		return "", err
+	}
+	reply, err = cc.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(reply, "\r\n"), nil
+}
+
+// Expect runs Cmd and fails unless the reply starts with want.
+func (cc *Conn) Expect(ctx context.Context, want, line string, body []byte) (string, error) {
+	reply, err := cc.Cmd(ctx, line, body)
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasPrefix(reply, want) {
+		return "", fmt.Errorf("%s: %s", strings.Fields(line)[0], reply)
+	}
+	return reply, nil
+}
+
+// Data reads the body of n bytes, given in decimal as replies give it, and
+// its CRLF, that follows a reply such as OK <n>.
+func (cc *Conn) Data(ctx context.Context, n string) (_ []byte, err error) {
+	size, err := strconv.Atoi(n)
+	if err != nil {
+		return nil, fmt.Errorf("bad reply size %q", n)
+	}
+	end := cc.begin(ctx)
+	defer func() { err = end(err) }()
+	b := make([]byte, size+2)
+	if _, err := io.ReadFull(cc.r, b); err != nil {
+		return nil, err
+	}
+	return b[:size], nil
+}
+
+// Use switches to tube for the jobs put from now on. Since a new
+// connection uses DefaultTube, nothing is sent for that.
+func (cc *Conn) Use(ctx context.Context, tube string) error {
+	if tube == DefaultTube {
+		return nil
+	}
+	_, err := cc.Expect(ctx, protocol.Using+" ", protocol.Use+" "+tube, nil)
+	return err
+}
+
+// Put puts a job into the tube in use and returns its id. pri is its
+// priority, lower being more urgent, delay the seconds before it is ready
+// and ttr the seconds a worker may hold it.
+func (cc *Conn) Put(ctx context.Context, pri, delay, ttr uint, body []byte) (uint64, error) {
+	reply, err := cc.Cmd(ctx, putLine(pri, delay, ttr, body), body)
+	if err != nil {
+		return 0, err
+	}
+	return putReply(reply)
+}
+
+func putLine(pri, delay, ttr uint, body []byte) string {
+	return fmt.Sprintf("%s %d %d %d %d", protocol.Put, pri, delay, ttr, len(body))
+}
+
+// putReply returns the id in the reply to a put, or the reply as an error.
+func putReply(reply string) (uint64, error) {
+	id, ok := strings.CutPrefix(reply, protocol.Inserted+" ")
+	if !ok {
+		return 0, fmt.Errorf("put: %s", reply)
+	}
+	return strconv.ParseUint(id, 10, 64)
+}
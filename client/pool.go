@@ -0,0 +1,155 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jkasarherou/dispatch/protocol"
+)
+
+// A Pool shares connections among goroutines, so that producers putting
+// concurrently are not serialized behind one connection. A connection is
+// taken for each command and returned when it is done; up to maxIdle of
+// them per address are kept open for reuse. A connection that fails is
+// closed rather than returned, and one that has been idle for
+// PoolCheckAfter is checked before reuse, so that connections the server
+// or the network has dropped are not handed out.
+type Pool struct {
+	// Dial opens the pool's connections; Dial if nil. It is where to
+	// authenticate them.
+	Dial func(ctx context.Context, addr string) (*Conn, error)
+
+	maxIdle int
+
+	mu     sync.Mutex
+	idle   map[string][]poolConn
+	closed bool
+}
+
+// PoolCheckAfter is how long a connection may be idle before a Pool checks
+// it before reuse.
+const PoolCheckAfter = 5 * time.Second
+
+type poolConn struct {
+	cc *Conn
+	// tube is the tube cc is using.
+	tube  string
+	since time.Time
+}
+
+// NewPool returns a pool that keeps up to maxIdle idle connections to each
+// address.
+func NewPool(maxIdle int) *Pool {
+	return &Pool{maxIdle: maxIdle, idle: map[string][]poolConn{}}
+}
+
+// get returns an idle connection to addr, or a new one.
+func (p *Pool) get(ctx context.Context, addr string) (poolConn, error) {
+	for {
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			return poolConn{}, net.ErrClosed
+		}
+		l := p.idle[addr]
+		if len(l) == 0 {
+			p.mu.Unlock()
+			break
+		}
+		// Take the most recently used, which is the likeliest to be alive.
+		pc := l[len(l)-1]
+		p.idle[addr] = l[:len(l)-1]
+		p.mu.Unlock()
+
+		if time.Since(pc.since) < PoolCheckAfter || poolAlive(pc.cc) {
+			return pc, nil
+		}
+		pc.cc.Abort()
+	}
+
+	dial := p.Dial
+	if dial == nil {
+		dial = Dial
+	}
+	cc, err := dial(ctx, addr)
+	if err != nil {
+		return poolConn{}, err
+	}
+	return poolConn{cc: cc, tube: DefaultTube}, nil
+}
+
+// poolAlive reports whether the idle connection cc is still usable. The
+// server sends nothing unasked, so any input, or end of file, means the
+// connection is gone.
+func poolAlive(cc *Conn) bool {
+	cc.c.SetReadDeadline(time.Now().Add(time.Millisecond))
+	_, err := cc.r.Peek(1)
+	cc.c.SetReadDeadline(time.Time{})
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+// release returns pc, which has been used for addr, to the pool, or closes
+// it if it failed or the pool has enough idle connections.
+func (p *Pool) release(addr string, pc poolConn, failed bool) {
+	if failed {
+		pc.cc.Abort()
+		return
+	}
+	pc.since = time.Now()
+	p.mu.Lock()
+	if p.closed || len(p.idle[addr]) >= p.maxIdle {
+		p.mu.Unlock()
+		pc.cc.Close()
+		return
+	}
+	p.idle[addr] = append(p.idle[addr], pc)
+	p.mu.Unlock()
+}
+
+// Put puts a job into tube on the server at addr and returns its id, as
+// Conn.Put does. It is safe to call from many goroutines at once.
+func (p *Pool) Put(ctx context.Context, addr, tube string, pri, delay, ttr uint, body []byte) (uint64, error) {
+	pc, err := p.get(ctx, addr)
+	if err != nil {
+		return 0, err
+	}
+	if pc.tube != tube {
+		reply, err := pc.cc.Cmd(ctx, protocol.Use+" "+tube, nil)
+		if err != nil {
+			p.release(addr, pc, true)
+			return 0, err
+		}
+		if !strings.HasPrefix(reply, protocol.Using+" ") {
+			p.release(addr, pc, false)
+			return 0, fmt.Errorf("use: %s", reply)
+		}
+		pc.tube = tube
+	}
+	reply, err := pc.cc.Cmd(ctx, putLine(pri, delay, ttr, body), body)
+	// A reply other than INSERTED leaves the connection in step; only an
+	// I/O error loses it.
+	p.release(addr, pc, err != nil)
+	if err != nil {
+		return 0, err
+	}
+	return putReply(reply)
+}
+
+// Close closes the idle connections. Connections in use are closed when
+// they are released.
+func (p *Pool) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	for addr, l := range p.idle {
+		for _, pc := range l {
+			pc.cc.Close()
+		}
+		delete(p.idle, addr)
+	}
+}
@@ -0,0 +1,121 @@
+package client_test
+
+import (
+	"context"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jkasarherou/dispatch"
+	"github.com/jkasarherou/dispatch/client"
+)
+
+// addr is that of the server the tests talk to. The server's state is the
+// process's, so there is one for all of them.
+var addr string
+
+func TestMain(m *testing.M) {
+	srv, err := dispatch.NewServer(dispatch.DefaultConfig())
+	if err != nil {
+		log.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	addr = l.Addr().String()
+	go srv.Serve(l)
+	code := m.Run()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	srv.Shutdown(ctx)
+	cancel()
+	os.Exit(code)
+}
+
+func TestConnPut(t *testing.T) {
+	ctx := context.Background()
+	cc, err := client.Dial(ctx, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+	if err := cc.Use(ctx, "conn-put"); err != nil {
+		t.Fatal(err)
+	}
+	a, err := cc.Put(ctx, 1024, 0, 60, []byte("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := cc.Put(ctx, 1024, 0, 60, []byte("b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b <= a {
+		t.Errorf("ids %d then %d", a, b)
+	}
+	if _, err := cc.Put(ctx, 1024, 0, 0, make([]byte, 1<<20)); err == nil {
+		t.Error("put of an oversized job succeeded")
+	}
+	// The refused put leaves the connection usable.
+	if _, err := cc.Put(ctx, 1024, 0, 60, []byte("c")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPoolPut(t *testing.T) {
+	p := client.NewPool(2)
+	defer p.Close()
+
+	var (
+		wg  sync.WaitGroup
+		mu  sync.Mutex
+		ids = map[uint64]bool{}
+	)
+	for i := 0; i < 8; i++ {
+		tube := []string{"default", "pool-a", "pool-b"}[i%3]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for k := 0; k < 20; k++ {
+				id, err := p.Put(context.Background(), addr, tube, 1024, 0, 60, []byte("x"))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				mu.Lock()
+				ids[id] = true
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if len(ids) != 8*20 {
+		t.Errorf("got %d distinct ids, want %d", len(ids), 8*20)
+	}
+
+	p.Close()
+	if _, err := p.Put(context.Background(), addr, "default", 1024, 0, 60, []byte("x")); err == nil {
+		t.Error("put on a closed pool succeeded")
+	}
+}
+
+func TestPoolDial(t *testing.T) {
+	p := client.NewPool(1)
+	defer p.Close()
+	dials := 0
+	p.Dial = func(ctx context.Context, addr string) (*client.Conn, error) {
+		dials++
+		return client.Dial(ctx, addr)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := p.Put(context.Background(), addr, "pool-dial", 1024, 0, 60, []byte("x")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if dials != 1 {
+		t.Errorf("dialed %d times, want 1", dials)
+	}
+}
@@ -0,0 +1,79 @@
+package dispatch
+
+import (
+	"sync"
+	"time"
+)
+
+// The job tables read the time through clock: when jobs are put and their
+// delays end, tube pauses, put-unique windows, job ages in the admin API
+// and metrics, schedules, and the sweeps that expire jobs and delete idle
+// tubes, which tick on it. A program embedding a Server can set
+// Config.Clock to a FakeClock and move time on with Advance to drive all
+// of these without sleeping. Connection deadlines, rate limits and
+// command timings keep to the real time, as do SQS long polls; the
+// visibility timeouts of received messages run on clock.
+
+// A Clock tells the time.
+type Clock interface {
+	Now() time.Time
+	// Tick is like time.Tick.
+	Tick(d time.Duration) <-chan time.Time
+}
+
+// clock is Config.Clock, the real time unless that is set.
+var clock Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                        { return time.Now() }
+func (realClock) Tick(d time.Duration) <-chan time.Time { return time.Tick(d) }
+
+// A FakeClock is a Clock that only moves when told to.
+type FakeClock struct {
+	mu    sync.Mutex
+	now   time.Time
+	ticks []*fakeTick
+}
+
+type fakeTick struct {
+	next time.Time
+	d    time.Duration
+	c    chan time.Time
+}
+
+// NewFakeClock returns a FakeClock set to now.
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *FakeClock) Tick(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTick{next: c.now.Add(d), d: d, c: make(chan time.Time, 1)}
+	c.ticks = append(c.ticks, t)
+	return t.c
+}
+
+// Advance moves c on by d and sends the ticks that have come due. As with
+// a time.Ticker, ticks a slow receiver has not taken are dropped.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	for _, t := range c.ticks {
+		for !t.next.After(c.now) {
+			select {
+			case t.c <- t.next:
+			default:
+			}
+			t.next = t.next.Add(t.d)
+		}
+	}
+}
@@ -0,0 +1,8 @@
+// Command dispatch is the dispatch job server and its tools.
+package main
+
+import "github.com/jkasarherou/dispatch"
+
+func main() {
+	dispatch.Main()
+}
@@ -0,0 +1,67 @@
+package dispatch
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"log/slog"
+)
+
+// A tube can keep large job bodies gzipped, in memory and in storage,
+// trading CPU on put and on reading a body back for less of both on big
+// text payloads:
+//
+//	[tube."reports"]
+//	compress = "gzip"
+//	compress-min = 4096
+//
+// Bodies of at least compress-min bytes (default compressMinDefault) are
+// compressed when they are put, unless that would not make them smaller.
+// Sizes in stats and tube quotas count the stored bytes; -z still limits
+// the body as put. Everything that hands a body back, the admin API and
+// dump, and the SQLite and Redis storages, which keep bodies as put, gets
+// it decompressed. gzip is the only codec; zstd would need a dependency
+// the default build does not take.
+
+const compressMinDefault = 1024
+
+// jobCompress gzips the body of j, which is about to be inserted, if its
+// tube asks for that. It runs without jobsMu, so as not to hold up other
+// connections.
+func jobCompress(j *job) {
+	min := j.tube.compressMin.Load()
+	n := uint64(len(j.body)) - 2
+	if min == 0 || n < min {
+		return
+	}
+	var buf bytes.Buffer
+	buf.Grow(int(n / 2))
+	zw := gzip.NewWriter(&buf)
+	zw.Write(j.body[:n])
+	if err := zw.Close(); err != nil || uint64(buf.Len())+2 >= uint64(len(j.body)) {
+		return
+	}
+	buf.WriteString("\r\n")
+	compressSavedBytes.Add(uint64(len(j.body) - buf.Len()))
+	compressedJobCount.Add(1)
+	bodyFree(j.body)
+	j.body = buf.Bytes()
+	j.bodySize = uint64(len(j.body))
+	j.compressed = true
+}
+
+// jobBody is j's body as it was put, CRLF included.
+func jobBody(j *job) []byte {
+	if !j.compressed {
+		return j.body
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(j.body[:len(j.body)-2]))
+	if err == nil {
+		var b []byte
+		if b, err = io.ReadAll(zr); err == nil {
+			return append(b, "\r\n"...)
+		}
+	}
+	slog.Error("job body does not decompress", "job", j.id, "err", err)
+	return j.body
+}
@@ -0,0 +1,460 @@
+package dispatch
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A config file holds the same settings as the command line, in a TOML
+// subset: [section] headers, key = value lines, and # comments. Values
+// are quoted strings, integers, or true/false. Flags given on the command
+// line override the file.
+//
+//	[listen]
+//	address = "127.0.0.1"
+//	port = 11300
+//
+//	[storage]
+//	kind = "binlog"
+//	path = "/var/lib/dispatch"
+//	fsync-ms = 0
+//
+//	[tube."emails"]
+//	max-job-size = 1048576
+//
+// [schedule."name"] sections define schedules, see schedule.go, and
+// [namespace."identity"] sections namespaces, see namespace.go.
+
+// configKeys maps each section.key to the flag it sets.
+var configKeys = map[string]string{
+	"listen.address":             "l",
+	"listen.port":                "p",
+	"listen.user":                "u",
+	"listen.backlog":             "backlog",
+	"listen.accept-workers":      "accept-workers",
+	"listen.defer-accept":        "defer-accept",
+	"listen.reuseport":           "reuseport",
+	"listen.tcp-nodelay":         "tcp-nodelay",
+	"listen.keepalive":           "keepalive",
+	"listen.keepalive-idle":      "keepalive-idle",
+	"listen.keepalive-interval":  "keepalive-interval",
+	"listen.keepalive-count":     "keepalive-count",
+	"listen.socket-mode":         "socket-mode",
+	"listen.tls-cert":            "tls-cert",
+	"listen.tls-key":             "tls-key",
+	"listen.tls-client-ca":       "tls-client-ca",
+	"listen.tls-reload-interval": "tls-reload-interval",
+	"listen.grpc-address":        "grpc-addr",
+	"listen.sqs-address":         "sqs-addr",
+	"listen.resp-address":        "resp-addr",
+	"listen.restart-timeout":     "restart-timeout",
+	"listen.allow":               "allow",
+	"listen.deny":                "deny",
+	"listen.event-loop":          "event-loop",
+
+	"limits.max-conns":      "max-conns",
+	"limits.max-job-size":   "z",
+	"limits.max-line-size":  "max-line-size",
+	"limits.lenient-eol":    "lenient-eol",
+	"limits.min-ttr":        "min-ttr",
+	"limits.memory-limit":   "memory-limit",
+	"limits.tube-max-jobs":  "tube-max-jobs",
+	"limits.tube-max-bytes": "tube-max-bytes",
+	"limits.job-ttl":        "job-ttl",
+	"limits.dedup-window":   "dedup-window",
+	"limits.tube-idle-ttl":  "tube-idle-ttl",
+	"limits.rate-commands":  "rate-cmds",
+	"limits.rate-bytes":     "rate-bytes",
+
+	"storage.kind":          "storage",
+	"storage.path":          "path",
+	"storage.fsync-ms":      "f",
+	"storage.no-fsync":      "F",
+	"storage.max-file-size": "s",
+	"storage.binlog-key":    "binlog-key",
+
+	"logging.level":             "log-level",
+	"logging.output":            "log-output",
+	"logging.format":            "log-format",
+	"logging.bodies":            "log-bodies",
+	"logging.trace-ops":         "trace-ops",
+	"logging.verbose":           "V",
+	"logging.verbose-rate":      "V-rate",
+	"logging.access-log":        "access-log",
+	"logging.access-log-format": "access-log-format",
+	"logging.audit-log":         "audit-log",
+	"logging.slow-cmd":          "slow-cmd",
+
+	"admin.address":           "admin-addr",
+	"admin.pprof":             "pprof",
+	"admin.metrics-max-tubes": "metrics-max-tubes",
+
+	"tracing.enabled":  "otel",
+	"tracing.endpoint": "otel-endpoint",
+	"tracing.service":  "otel-service",
+
+	"kafka.brokers": "kafka-brokers",
+	"kafka.topic":   "kafka-topic",
+
+	"nats.url":        "nats-url",
+	"nats.put-prefix": "nats-put-prefix",
+
+	"amqp.url":      "amqp-url",
+	"amqp.queue":    "amqp-queue",
+	"amqp.prefetch": "amqp-prefetch",
+
+	"auth.token-file": "auth-file",
+
+	"authz.provider":  "authz",
+	"authz.cache-ttl": "authz-cache-ttl",
+}
+
+// tubeConfig holds the per-tube settings from [tube."name"] sections.
+type tubeConfig struct {
+	maxJobSize uint64
+	maxJobs    int
+	maxBytes   uint64
+	ttl        time.Duration
+	// dedupWindow is 0 unless the file sets it.
+	dedupWindow time.Duration
+	lifo        bool
+	// compressMin is 0 unless the file turns compression on.
+	compressMin uint64
+	// mirror is the address of the server the tube is mirrored to.
+	mirror string
+	// natsSubject is the NATS subject the tube's jobs are published to.
+	natsSubject string
+	// limits.minTTR is 0 unless the file sets it.
+	limits tubeLimits
+	// putRate caps the puts a second, and putReject refuses those over it.
+	putRate   int64
+	putReject bool
+}
+
+// tubeConfigs is filled in before the server starts, and replaced when the
+// config is reloaded. It is guarded by jobsMu once the server is running.
+var tubeConfigs = map[string]*tubeConfig{}
+
+type configEntry struct {
+	line    int
+	section string
+	key     string
+	value   string
+}
+
+// configLoad reads path and applies it to fs, skipping flags that are
+// already set on the command line.
+func configLoad(fs *flag.FlagSet, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	entries, err := configParse(f, path)
+	if err != nil {
+		return err
+	}
+
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	for _, e := range entries {
+		if name, ok := strings.CutPrefix(e.section, "tube."); ok {
+			if err := configTube(tubeConfigs, name, e); err != nil {
+				return fmt.Errorf("%s:%d: %v", path, e.line, err)
+			}
+			continue
+		}
+		if name, ok := strings.CutPrefix(e.section, "schedule."); ok {
+			if err := configSchedule(scheduleConfigs, name, e); err != nil {
+				return fmt.Errorf("%s:%d: %v", path, e.line, err)
+			}
+			continue
+		}
+		if identity, ok := strings.CutPrefix(e.section, "namespace."); ok {
+			if err := configNamespace(namespaces, identity, e); err != nil {
+				return fmt.Errorf("%s:%d: %v", path, e.line, err)
+			}
+			continue
+		}
+
+		name, ok := configKeys[e.section+"."+e.key]
+		if !ok {
+			return fmt.Errorf("%s:%d: unknown setting %s.%s", path, e.line, e.section, e.key)
+		}
+		if set[name] {
+			continue
+		}
+		if err := fs.Set(name, e.value); err != nil {
+			return fmt.Errorf("%s:%d: %s.%s: %v", path, e.line, e.section, e.key, err)
+		}
+	}
+	if err := scheduleCheck(scheduleConfigs); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	if err := nsCheck(namespaces); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	if err := tubeLimitsCheck(tubeConfigs); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return nil
+}
+
+func configTube(tcs map[string]*tubeConfig, name string, e configEntry) error {
+	if name == "" {
+		return fmt.Errorf("tube section without a name")
+	}
+	tc := tcs[name]
+	if tc == nil {
+		tc = &tubeConfig{}
+		tcs[name] = tc
+	}
+	switch e.key {
+	case "max-job-size":
+		n, err := strconv.ParseUint(e.value, 10, 32)
+		if err != nil {
+			return fmt.Errorf("max-job-size: %v", err)
+		}
+		if n > jobSizeMax {
+			return fmt.Errorf("max-job-size: must be at most %d", jobSizeMax)
+		}
+		tc.maxJobSize = n
+	case "max-jobs":
+		n, err := strconv.ParseUint(e.value, 10, 31)
+		if err != nil {
+			return fmt.Errorf("max-jobs: %v", err)
+		}
+		tc.maxJobs = int(n)
+	case "max-bytes":
+		n, err := strconv.ParseUint(e.value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("max-bytes: %v", err)
+		}
+		tc.maxBytes = n
+	case "ttl":
+		d, err := time.ParseDuration(e.value)
+		if err != nil || d < 0 {
+			return fmt.Errorf("ttl: bad duration %q", e.value)
+		}
+		tc.ttl = d
+	case "dedup-window":
+		d, err := time.ParseDuration(e.value)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("dedup-window: bad duration %q", e.value)
+		}
+		tc.dedupWindow = d
+	case "compress":
+		if e.value != "gzip" {
+			return fmt.Errorf("compress: want gzip, not %q", e.value)
+		}
+		if tc.compressMin == 0 {
+			tc.compressMin = compressMinDefault
+		}
+	case "compress-min":
+		n, err := strconv.ParseUint(e.value, 10, 32)
+		if err != nil || n == 0 {
+			return fmt.Errorf("compress-min: bad size %q", e.value)
+		}
+		tc.compressMin = n
+	case "default-ttr", "min-ttr", "max-ttr", "default-delay", "max-delay", "default-pri", "min-pri", "max-pri":
+		n, err := strconv.ParseUint(e.value, 10, 32)
+		if err != nil {
+			return fmt.Errorf("%s: %v", e.key, err)
+		}
+		switch e.key {
+		case "default-ttr":
+			tc.limits.defaultTTR = n
+		case "min-ttr":
+			tc.limits.minTTR = n
+		case "max-ttr":
+			tc.limits.maxTTR = n
+		case "default-delay":
+			tc.limits.defaultDelay = n
+		case "max-delay":
+			tc.limits.maxDelay = n
+		case "default-pri":
+			tc.limits.defaultPri = n
+		case "min-pri":
+			tc.limits.minPri = n
+		default:
+			tc.limits.maxPri = n
+		}
+	case "put-rate":
+		n, err := strconv.ParseUint(e.value, 10, 31)
+		if err != nil {
+			return fmt.Errorf("put-rate: %v", err)
+		}
+		tc.putRate = int64(n)
+	case "put-rate-mode":
+		switch e.value {
+		case "delay", "reject":
+			tc.putReject = e.value == "reject"
+		default:
+			return fmt.Errorf("put-rate-mode: want delay or reject, not %q", e.value)
+		}
+	case "mirror":
+		if _, _, err := net.SplitHostPort(e.value); err != nil {
+			return fmt.Errorf("mirror: bad address %q", e.value)
+		}
+		tc.mirror = e.value
+	case "nats-subject":
+		if e.value == "" || strings.ContainsAny(e.value, " \t\r\n*>") {
+			return fmt.Errorf("nats-subject: bad subject %q", e.value)
+		}
+		tc.natsSubject = e.value
+	case "delivery":
+		switch e.value {
+		case "fifo", "lifo":
+			tc.lifo = e.value == "lifo"
+		default:
+			return fmt.Errorf("delivery: want fifo or lifo, not %q", e.value)
+		}
+	default:
+		return fmt.Errorf("unknown tube setting %s", e.key)
+	}
+	return nil
+}
+
+func configParse(f *os.File, name string) ([]configEntry, error) {
+	var (
+		entries []configEntry
+		section string
+	)
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(configStripComment(sc.Text()))
+		if line == "" {
+			continue
+		}
+
+		if line[0] == '[' {
+			if line[len(line)-1] != ']' {
+				return nil, fmt.Errorf("%s:%d: unterminated section header", name, n)
+			}
+			s, err := configSection(strings.TrimSpace(line[1 : len(line)-1]))
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", name, n, err)
+			}
+			section = s
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if !ok || key == "" || value == "" {
+			return nil, fmt.Errorf("%s:%d: want key = value", name, n)
+		}
+		if section == "" {
+			return nil, fmt.Errorf("%s:%d: %s is outside any section", name, n, key)
+		}
+		if value[0] == '"' {
+			s, err := strconv.Unquote(value)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: bad string %s", name, n, value)
+			}
+			value = s
+		}
+		entries = append(entries, configEntry{line: n, section: section, key: key, value: value})
+	}
+	return entries, sc.Err()
+}
+
+// configSection turns a header such as tube."a.b" into tube.a.b; only the
+// tube, schedule and namespace sections have a second part.
+func configSection(h string) (string, error) {
+	head, rest, ok := strings.Cut(h, ".")
+	if !ok {
+		return h, nil
+	}
+	if head != "tube" && head != "schedule" && head != "namespace" {
+		return "", fmt.Errorf("unknown section [%s]", h)
+	}
+	if strings.HasPrefix(rest, `"`) {
+		s, err := strconv.Unquote(rest)
+		if err != nil {
+			return "", fmt.Errorf("bad %s name %s", head, rest)
+		}
+		rest = s
+	}
+	return head + "." + rest, nil
+}
+
+// configStripComment drops a # comment that is not inside a string.
+func configStripComment(line string) string {
+	quoted := false
+	for i := 0; i < len(line); i++ {
+		switch line[i] {
+		case '\\':
+			if quoted {
+				i++
+			}
+		case '"':
+			quoted = !quoted
+		case '#':
+			if !quoted {
+				return line[:i]
+			}
+		}
+	}
+	return line
+}
+
+// checkSettings reports settings that the server would fail on at startup,
+// or that conflict with each other, without acting on any of them.
+func checkSettings(cfg *Config, listenPort, userName, authzSpec string) []error {
+	errs := cfg.check()
+	if n, err := strconv.Atoi(listenPort); err != nil || n < 0 || n > 65535 {
+		if _, err := net.LookupPort("tcp", listenPort); err != nil {
+			errs = append(errs, fmt.Errorf("bad port %q", listenPort))
+		}
+	}
+	if _, err := strconv.ParseUint(socketMode, 8, 32); err != nil {
+		errs = append(errs, fmt.Errorf("bad socket mode %q", socketMode))
+	}
+	if adminPprof && adminAddr == "" {
+		errs = append(errs, fmt.Errorf("-pprof needs -admin-addr"))
+	}
+	if eventLoop && !evloopSupported {
+		errs = append(errs, fmt.Errorf("-event-loop is only supported on Linux"))
+	}
+	if grpcAddr != "" && !grpcCompiled {
+		errs = append(errs, fmt.Errorf("-grpc-addr needs a build with -tags grpc"))
+	}
+	if metricsMaxTubes < 0 {
+		errs = append(errs, fmt.Errorf("-metrics-max-tubes must not be negative"))
+	}
+	if accessLogFormat != "json" && accessLogFormat != "text" {
+		errs = append(errs, fmt.Errorf("bad access log format %q", accessLogFormat))
+	}
+	if err := logCheck(); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := tlsConfig(); err != nil {
+		errs = append(errs, err)
+	}
+	if userName != "" {
+		if _, err := user.Lookup(userName); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if binlogDir != "" && (cfg.Storage != storageBinlog || (cfg.StoragePath != "" && cfg.StoragePath != binlogDir)) {
+		errs = append(errs, fmt.Errorf("-b cannot be combined with -storage=%s -path=%s", cfg.Storage, cfg.StoragePath))
+	}
+
+	if authzSpec != "" {
+		if _, err := authzOpen(authzSpec); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
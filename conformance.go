@@ -0,0 +1,75 @@
+package dispatch
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jkasarherou/dispatch/conformance"
+)
+
+// dispatch conformance runs the conformance package's protocol checks
+// against a server, this one or any other speaking beanstalkd's protocol,
+// and prints a line per case. -suites picks which to run: core for a
+// producer-only server such as dispatch, with consumer for beanstalkd or
+// the proxy, and extensions for dispatch's own commands. It exits 1 if
+// any case failed.
+
+func conformanceMain(args []string) int {
+	fs := flag.NewFlagSet("conformance", flag.ExitOnError)
+	addr := os.Getenv("DISPATCH_ADDR")
+	if addr == "" {
+		addr = "127.0.0.1:3333"
+	}
+	var cfg conformance.Config
+	fs.StringVar(&cfg.Addr, "addr", addr, "server `host:port`")
+	suites := fs.String("suites", "core,extensions", "comma-separated `suites` to run: core, consumer, extensions or all")
+	fs.StringVar(&cfg.Token, "token", "", "auth `token` to send first")
+	fs.DurationVar(&cfg.Timeout, "timeout", 5*time.Second, "time allowed each case")
+	verbose := fs.Bool("v", false, "print passing cases too")
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		fs.Usage()
+		return 2
+	}
+	for _, s := range strings.Split(*suites, ",") {
+		if s == "all" {
+			cfg.Suites = append(cfg.Suites, conformance.Suites...)
+			continue
+		}
+		if !conformanceSuite(conformance.Suite(s)) {
+			fmt.Fprintf(os.Stderr, "conformance: unknown suite %q\n", s)
+			return 2
+		}
+		cfg.Suites = append(cfg.Suites, conformance.Suite(s))
+	}
+
+	ctx, cancel := cliContext()
+	defer cancel()
+	failed := 0
+	res := conformance.Run(ctx, cfg)
+	for _, r := range res {
+		if r.Err != nil {
+			failed++
+			fmt.Printf("FAIL %s/%s: %v\n", r.Case.Suite, r.Case.Name, r.Err)
+		} else if *verbose {
+			fmt.Printf("ok   %s/%s (%v)\n", r.Case.Suite, r.Case.Name, r.Elapsed.Round(time.Microsecond))
+		}
+	}
+	fmt.Printf("conformance: %d of %d cases passed\n", len(res)-failed, len(res))
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+func conformanceSuite(s conformance.Suite) bool {
+	for _, t := range conformance.Suites {
+		if s == t {
+			return true
+		}
+	}
+	return false
+}
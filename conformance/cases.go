@@ -0,0 +1,560 @@
+package conformance
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/jkasarherou/dispatch/protocol"
+)
+
+// Cases are the exchanges Run can make, in the order it makes them.
+var Cases = []Case{
+	{"use", Core, func(c *Conn) error {
+		_, err := c.Expect("use "+c.Tube, "USING "+c.Tube)
+		return err
+	}},
+	{"use name starting with a hyphen", Core, func(c *Conn) error {
+		_, err := c.Expect("use -"+c.Tube, protocol.BadFormat)
+		return err
+	}},
+	{"use name too long", Core, func(c *Conn) error {
+		_, err := c.Expect("use "+strings.Repeat("a", protocol.TubeNameMax+1), protocol.BadFormat)
+		return err
+	}},
+	{"use name with a bad character", Core, func(c *Conn) error {
+		_, err := c.Expect("use "+c.Tube+"*", protocol.BadFormat)
+		return err
+	}},
+	{"put", Core, func(c *Conn) error {
+		if _, err := c.Expect("use "+c.Tube, "USING "+c.Tube); err != nil {
+			return err
+		}
+		_, err := c.Put(1024, 0, 60, "hello")
+		return err
+	}},
+	{"put empty body", Core, func(c *Conn) error {
+		if _, err := c.Expect("use "+c.Tube, "USING "+c.Tube); err != nil {
+			return err
+		}
+		_, err := c.Put(0, 0, 60, "")
+		return err
+	}},
+	{"put body containing CRLF", Core, func(c *Conn) error {
+		if _, err := c.Expect("use "+c.Tube, "USING "+c.Tube); err != nil {
+			return err
+		}
+		_, err := c.Put(0, 0, 60, "a\r\nput 0 0 1 1\r\nb")
+		return err
+	}},
+	{"put largest priority", Core, func(c *Conn) error {
+		if _, err := c.Expect("use "+c.Tube, "USING "+c.Tube); err != nil {
+			return err
+		}
+		_, err := c.Put(1<<32-1, 0, 60, "x")
+		return err
+	}},
+	{"put priority out of range", Core, func(c *Conn) error {
+		_, err := c.Expect("put 4294967296 0 60 1", protocol.BadFormat)
+		return err
+	}},
+	{"put missing argument", Core, func(c *Conn) error {
+		_, err := c.Expect("put 0 0 60", protocol.BadFormat)
+		return err
+	}},
+	{"put non-numeric argument", Core, func(c *Conn) error {
+		_, err := c.Expect("put 0 x 60 1", protocol.BadFormat)
+		return err
+	}},
+	{"put negative argument", Core, func(c *Conn) error {
+		_, err := c.Expect("put -1 0 60 1", protocol.BadFormat)
+		return err
+	}},
+	{"put body without CRLF", Core, func(c *Conn) error {
+		if _, err := c.Expect("use "+c.Tube, "USING "+c.Tube); err != nil {
+			return err
+		}
+		_, err := c.Expect("put 0 0 60 3\r\nabcde", protocol.ExpectedCRLF)
+		return err
+	}},
+	{"put body too big", Core, func(c *Conn) error {
+		body, err := c.Data("stats")
+		if err != nil {
+			return err
+		}
+		max, err := statsUint(body, "max-job-size")
+		if err != nil {
+			return err
+		}
+		if _, err := c.Expect("use "+c.Tube, "USING "+c.Tube); err != nil {
+			return err
+		}
+		size := max + 1
+		if _, err := c.Expect(fmt.Sprintf("put 0 0 60 %d\r\n%s", size, strings.Repeat("x", int(size))),
+			protocol.JobTooBig); err != nil {
+			return err
+		}
+		// The body was skipped, not read as commands.
+		_, err = c.Expect("use "+c.Tube, "USING "+c.Tube)
+		return err
+	}},
+	{"unknown command", Core, func(c *Conn) error {
+		_, err := c.Expect("frobnicate "+c.Tube, protocol.UnknownCommand)
+		return err
+	}},
+	{"command names are case-sensitive", Core, func(c *Conn) error {
+		_, err := c.Expect("USE "+c.Tube, protocol.UnknownCommand)
+		return err
+	}},
+	{"pipelined commands", Core, func(c *Conn) error {
+		if err := c.Send("use " + c.Tube + "\r\nput 0 0 60 2\r\nhi\r\nput 0 0 60 2\r\nho\r\n"); err != nil {
+			return err
+		}
+		if _, err := c.Reply("USING " + c.Tube); err != nil {
+			return err
+		}
+		a, err := c.Reply("INSERTED %d")
+		if err != nil {
+			return err
+		}
+		b, err := c.Reply("INSERTED %d")
+		if err != nil {
+			return err
+		}
+		if a[0] == b[0] {
+			return fmt.Errorf("two puts got the same id %s", a[0])
+		}
+		return nil
+	}},
+	{"ids increase", Core, func(c *Conn) error {
+		if _, err := c.Expect("use "+c.Tube, "USING "+c.Tube); err != nil {
+			return err
+		}
+		a, err := c.Put(0, 0, 60, "a")
+		if err != nil {
+			return err
+		}
+		b, err := c.Put(0, 0, 60, "b")
+		if err != nil {
+			return err
+		}
+		if !idLess(a, b) {
+			return fmt.Errorf("put after job %s got id %s", a, b)
+		}
+		return nil
+	}},
+	{"stats", Core, func(c *Conn) error {
+		body, err := c.Data("stats")
+		if err != nil {
+			return err
+		}
+		if !bytes.HasPrefix(body, []byte("---\n")) {
+			return fmt.Errorf("stats: body does not start with a YAML document marker")
+		}
+		for _, key := range []string{"current-jobs-ready", "total-jobs", "current-connections", "max-job-size"} {
+			if _, err := statsUint(body, key); err != nil {
+				return err
+			}
+		}
+		return nil
+	}},
+	{"stats counts puts", Core, func(c *Conn) error {
+		body, err := c.Data("stats")
+		if err != nil {
+			return err
+		}
+		before, err := statsUint(body, "total-jobs")
+		if err != nil {
+			return err
+		}
+		if _, err := c.Expect("use "+c.Tube, "USING "+c.Tube); err != nil {
+			return err
+		}
+		if _, err := c.Put(0, 0, 60, "x"); err != nil {
+			return err
+		}
+		if body, err = c.Data("stats"); err != nil {
+			return err
+		}
+		after, err := statsUint(body, "total-jobs")
+		if err != nil {
+			return err
+		}
+		if after <= before {
+			return fmt.Errorf("stats: total-jobs went from %d to %d over a put", before, after)
+		}
+		return nil
+	}},
+	{"quit", Core, func(c *Conn) error {
+		if err := c.Send("quit\r\n"); err != nil {
+			return err
+		}
+		return c.Closed()
+	}},
+
+	{"watch and ignore", Consumer, func(c *Conn) error {
+		if _, err := c.Expect("watch "+c.Tube, "WATCHING 2"); err != nil {
+			return err
+		}
+		if _, err := c.Expect("watch "+c.Tube, "WATCHING 2"); err != nil {
+			return err
+		}
+		if _, err := c.Expect("ignore default", "WATCHING 1"); err != nil {
+			return err
+		}
+		_, err := c.Expect("ignore "+c.Tube, "NOT_IGNORED")
+		return err
+	}},
+	{"list-tube-used", Consumer, func(c *Conn) error {
+		if _, err := c.Expect("list-tube-used", "USING default"); err != nil {
+			return err
+		}
+		if _, err := c.Expect("use "+c.Tube, "USING "+c.Tube); err != nil {
+			return err
+		}
+		_, err := c.Expect("list-tube-used", "USING "+c.Tube)
+		return err
+	}},
+	{"list-tubes-watched", Consumer, func(c *Conn) error {
+		if _, err := c.Expect("watch "+c.Tube, "WATCHING 2"); err != nil {
+			return err
+		}
+		body, err := c.Data("list-tubes-watched")
+		if err != nil {
+			return err
+		}
+		return yamlListHas(body, "default", c.Tube)
+	}},
+	{"list-tubes", Consumer, func(c *Conn) error {
+		if _, err := c.Expect("use "+c.Tube, "USING "+c.Tube); err != nil {
+			return err
+		}
+		body, err := c.Data("list-tubes")
+		if err != nil {
+			return err
+		}
+		return yamlListHas(body, "default", c.Tube)
+	}},
+	{"reserve-with-timeout on an empty tube", Consumer, func(c *Conn) error {
+		if err := c.watchOnly(); err != nil {
+			return err
+		}
+		_, err := c.Expect("reserve-with-timeout 0", "TIMED_OUT")
+		return err
+	}},
+	{"reserve and delete", Consumer, func(c *Conn) error {
+		id, err := c.putOwn("work")
+		if err != nil {
+			return err
+		}
+		if err := c.reserve(id, "work"); err != nil {
+			return err
+		}
+		if _, err := c.Expect("delete "+id, "DELETED"); err != nil {
+			return err
+		}
+		_, err = c.Expect("delete "+id, "NOT_FOUND")
+		return err
+	}},
+	{"reserve in priority order", Consumer, func(c *Conn) error {
+		if _, err := c.Expect("use "+c.Tube, "USING "+c.Tube); err != nil {
+			return err
+		}
+		if _, err := c.Put(100, 0, 60, "later"); err != nil {
+			return err
+		}
+		id, err := c.Put(1, 0, 60, "first")
+		if err != nil {
+			return err
+		}
+		if err := c.watchOnly(); err != nil {
+			return err
+		}
+		return c.reserve(id, "first")
+	}},
+	{"release", Consumer, func(c *Conn) error {
+		id, err := c.putOwn("again")
+		if err != nil {
+			return err
+		}
+		if err := c.reserve(id, "again"); err != nil {
+			return err
+		}
+		if _, err := c.Expect("release "+id+" 0 0", "RELEASED"); err != nil {
+			return err
+		}
+		return c.reserve(id, "again")
+	}},
+	{"bury and kick", Consumer, func(c *Conn) error {
+		id, err := c.putOwn("stuck")
+		if err != nil {
+			return err
+		}
+		if err := c.reserve(id, "stuck"); err != nil {
+			return err
+		}
+		if _, err := c.Expect("bury "+id+" 0", "BURIED"); err != nil {
+			return err
+		}
+		if err := c.found("peek-buried", id, "stuck"); err != nil {
+			return err
+		}
+		if _, err := c.Expect("kick 10", "KICKED 1"); err != nil {
+			return err
+		}
+		return c.found("peek-ready", id, "stuck")
+	}},
+	{"kick-job", Consumer, func(c *Conn) error {
+		if _, err := c.Expect("use "+c.Tube, "USING "+c.Tube); err != nil {
+			return err
+		}
+		id, err := c.Put(0, 3600, 60, "later")
+		if err != nil {
+			return err
+		}
+		if err := c.found("peek-delayed", id, "later"); err != nil {
+			return err
+		}
+		if _, err := c.Expect("kick-job "+id, "KICKED"); err != nil {
+			return err
+		}
+		return c.found("peek-ready", id, "later")
+	}},
+	{"touch", Consumer, func(c *Conn) error {
+		id, err := c.putOwn("slow")
+		if err != nil {
+			return err
+		}
+		if _, err := c.Expect("touch "+id, "NOT_FOUND"); err != nil {
+			return err
+		}
+		if err := c.reserve(id, "slow"); err != nil {
+			return err
+		}
+		_, err = c.Expect("touch "+id, "TOUCHED")
+		return err
+	}},
+	{"peek", Consumer, func(c *Conn) error {
+		id, err := c.putOwn("look")
+		if err != nil {
+			return err
+		}
+		if err := c.found("peek "+id, id, "look"); err != nil {
+			return err
+		}
+		if _, err := c.Expect("peek 0", "NOT_FOUND"); err != nil {
+			return err
+		}
+		_, err = c.Expect("peek x", protocol.BadFormat)
+		return err
+	}},
+	{"peek-ready on an empty tube", Consumer, func(c *Conn) error {
+		if _, err := c.Expect("use "+c.Tube, "USING "+c.Tube); err != nil {
+			return err
+		}
+		_, err := c.Expect("peek-ready", "NOT_FOUND")
+		return err
+	}},
+	{"stats-job", Consumer, func(c *Conn) error {
+		id, err := c.putOwn("job")
+		if err != nil {
+			return err
+		}
+		body, err := c.Data("stats-job " + id)
+		if err != nil {
+			return err
+		}
+		if got, _ := statsValue(body, "tube"); got != c.Tube {
+			return fmt.Errorf("stats-job: tube is %q, want %q", got, c.Tube)
+		}
+		if got, _ := statsValue(body, "state"); got != "ready" {
+			return fmt.Errorf("stats-job: state is %q, want ready", got)
+		}
+		_, err = c.Expect("stats-job 0", "NOT_FOUND")
+		return err
+	}},
+	{"stats-tube", Consumer, func(c *Conn) error {
+		if _, err := c.putOwn("job"); err != nil {
+			return err
+		}
+		body, err := c.Data("stats-tube " + c.Tube)
+		if err != nil {
+			return err
+		}
+		if got, _ := statsValue(body, "name"); got != c.Tube {
+			return fmt.Errorf("stats-tube: name is %q, want %q", got, c.Tube)
+		}
+		if n, err := statsUint(body, "current-jobs-ready"); err != nil || n != 1 {
+			return fmt.Errorf("stats-tube: current-jobs-ready is %d, want 1 (%v)", n, err)
+		}
+		_, err = c.Expect("stats-tube "+c.Tube+"-none", "NOT_FOUND")
+		return err
+	}},
+
+	{"hello", Extensions, func(c *Conn) error {
+		body, err := c.Data("hello conformance 1")
+		if err != nil {
+			return err
+		}
+		if _, ok := statsValue(body, "server"); !ok {
+			return errors.New("hello: no server in the reply")
+		}
+		return nil
+	}},
+	{"format json", Extensions, func(c *Conn) error {
+		if _, err := c.Expect("format json", "FORMAT json"); err != nil {
+			return err
+		}
+		body, err := c.Data("stats")
+		if err != nil {
+			return err
+		}
+		if !bytes.HasPrefix(body, []byte("{")) {
+			return errors.New("stats: body is not a JSON object after format json")
+		}
+		if _, err := c.Expect("format yaml", "FORMAT yaml"); err != nil {
+			return err
+		}
+		_, err = c.Expect("format xml", protocol.BadFormat)
+		return err
+	}},
+	{"mput", Extensions, func(c *Conn) error {
+		if _, err := c.Expect("use "+c.Tube, "USING "+c.Tube); err != nil {
+			return err
+		}
+		_, err := c.Expect("mput 2\r\n0 0 60 1\r\na\r\n0 0 60 2\r\nbc", protocol.InsertedBatch+" %d %d")
+		return err
+	}},
+	{"mput count out of range", Extensions, func(c *Conn) error {
+		if _, err := c.Expect("mput 0", protocol.BadFormat); err != nil {
+			return err
+		}
+		_, err := c.Expect("mput "+strconv.Itoa(protocol.MputMaxJobs+1), protocol.BadFormat)
+		return err
+	}},
+	{"put-unique", Extensions, func(c *Conn) error {
+		if _, err := c.Expect("use "+c.Tube, "USING "+c.Tube); err != nil {
+			return err
+		}
+		a, err := c.Expect("put-unique k1 0 0 60 1\r\na", "INSERTED %d")
+		if err != nil {
+			return err
+		}
+		b, err := c.Expect("put-unique k1 0 0 60 1\r\na", "INSERTED %d")
+		if err != nil {
+			return err
+		}
+		if a[0] != b[0] {
+			return fmt.Errorf("put-unique: same key got ids %s and %s", a[0], b[0])
+		}
+		b, err = c.Expect("put-unique k2 0 0 60 1\r\na", "INSERTED %d")
+		if err != nil {
+			return err
+		}
+		if a[0] == b[0] {
+			return fmt.Errorf("put-unique: different keys got the same id %s", a[0])
+		}
+		return nil
+	}},
+	{"put-after", Extensions, func(c *Conn) error {
+		if _, err := c.Expect("use "+c.Tube, "USING "+c.Tube); err != nil {
+			return err
+		}
+		id, err := c.Put(0, 0, 60, "first")
+		if err != nil {
+			return err
+		}
+		if _, err := c.Expect("put-after "+id+" 0 0 60 4\r\nthen", "INSERTED %d"); err != nil {
+			return err
+		}
+		_, err = c.Expect("put-after x 0 0 60 1", protocol.BadFormat)
+		return err
+	}},
+}
+
+// putOwn puts a job with body into the case's tube, and leaves the
+// connection watching only that tube.
+func (c *Conn) putOwn(body string) (string, error) {
+	if _, err := c.Expect("use "+c.Tube, "USING "+c.Tube); err != nil {
+		return "", err
+	}
+	id, err := c.Put(0, 0, 60, body)
+	if err != nil {
+		return "", err
+	}
+	return id, c.watchOnly()
+}
+
+// watchOnly makes the connection watch the case's tube instead of default.
+func (c *Conn) watchOnly() error {
+	if _, err := c.Expect("watch "+c.Tube, "WATCHING 2"); err != nil {
+		return err
+	}
+	_, err := c.Expect("ignore default", "WATCHING 1")
+	return err
+}
+
+// reserve reserves a job without waiting and checks it is job id with body.
+func (c *Conn) reserve(id, body string) error {
+	return c.job("reserve-with-timeout 0", "RESERVED", id, body)
+}
+
+// found sends a peek command and checks it finds job id with body.
+func (c *Conn) found(cmd, id, body string) error {
+	return c.job(cmd, "FOUND", id, body)
+}
+
+func (c *Conn) job(cmd, word, id, body string) error {
+	vals, err := c.Expect(cmd, word+" %d %d")
+	if err != nil {
+		return err
+	}
+	got, err := c.Body(vals[1])
+	if err != nil {
+		return err
+	}
+	if vals[0] != id || string(got) != body {
+		return fmt.Errorf("%s: got job %s %q, want %s %q", firstWord(cmd), vals[0], got, id, body)
+	}
+	return nil
+}
+
+// statsValue returns the value of key in a YAML stats dictionary.
+func statsValue(body []byte, key string) (string, bool) {
+	for _, line := range strings.Split(string(body), "\n") {
+		if k, v, ok := strings.Cut(line, ": "); ok && k == key {
+			return strings.Trim(v, `"`), true
+		}
+	}
+	return "", false
+}
+
+func statsUint(body []byte, key string) (uint64, error) {
+	v, ok := statsValue(body, key)
+	if !ok {
+		return 0, fmt.Errorf("stats: no %s", key)
+	}
+	n, err := strconv.ParseUint(v, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("stats: %s is %q, not a number", key, v)
+	}
+	return n, nil
+}
+
+// yamlListHas checks that the YAML list body has each of names.
+func yamlListHas(body []byte, names ...string) error {
+	for _, name := range names {
+		if !bytes.Contains(body, []byte("\n- "+name+"\n")) {
+			return fmt.Errorf("list does not have %s", name)
+		}
+	}
+	return nil
+}
+
+func idLess(a, b string) bool {
+	x, _ := strconv.ParseUint(a, 10, 64)
+	y, _ := strconv.ParseUint(b, 10, 64)
+	return x < y
+}
@@ -0,0 +1,268 @@
+// Package conformance checks that a server speaks beanstalkd's protocol.
+// It runs scripted exchanges, valid and invalid, against an address and
+// compares the replies with those beanstalkd gives, so that it can be
+// pointed at dispatch, at beanstalkd itself, or at any server or proxy
+// meant to stand in for them:
+//
+//	for _, r := range conformance.Run(ctx, conformance.Config{Addr: addr}) {
+//		if r.Err != nil {
+//			t.Errorf("%s: %v", r.Case.Name, r.Err)
+//		}
+//	}
+//
+// The cases are grouped in suites, since not every server has every
+// command: Core is what a producer uses, Consumer what a worker uses, and
+// Extensions dispatch's own commands. Each case has a connection and a
+// tube of its own, named conformance-<run>-<n>, so runs do not disturb each
+// other or the server's other tubes; the jobs they leave are small and
+// short-lived. The dispatch command runs them as dispatch conformance.
+package conformance
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A Suite is a group of cases that a server has the commands for or not.
+type Suite string
+
+const (
+	// Core covers use, put, stats and quit, and the errors of malformed
+	// commands and bodies.
+	Core Suite = "core"
+	// Consumer covers watch, ignore, reserve, delete, release, bury, kick,
+	// touch, peek and the stats and list commands about tubes and jobs.
+	Consumer Suite = "consumer"
+	// Extensions covers dispatch's mput, put-unique, put-after, hello and
+	// format.
+	Extensions Suite = "extensions"
+)
+
+// Suites are all the suites, in the order they run.
+var Suites = []Suite{Core, Consumer, Extensions}
+
+// A Case is one scripted exchange. Run returns what it found wrong.
+type Case struct {
+	Name  string
+	Suite Suite
+	Run   func(c *Conn) error
+}
+
+// Config says where and what to run.
+type Config struct {
+	// Addr is the server's host:port.
+	Addr string
+	// Suites are the suites to run; Core alone if empty.
+	Suites []Suite
+	// Token, if set, is sent with auth before each case, for a server
+	// that requires it.
+	Token string
+	// Timeout bounds each case; 5 seconds if zero.
+	Timeout time.Duration
+}
+
+// A Result is the outcome of one case: Err is nil if it passed.
+type Result struct {
+	Case    Case
+	Err     error
+	Elapsed time.Duration
+}
+
+// Run runs the cases of cfg's suites against cfg.Addr, one after another,
+// and returns their results in order. It stops early if ctx is done, and
+// the cases it did not get to fail with ctx's error.
+func Run(ctx context.Context, cfg Config) []Result {
+	suites := cfg.Suites
+	if len(suites) == 0 {
+		suites = []Suite{Core}
+	}
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	var id [4]byte
+	rand.Read(id[:])
+	run := hex.EncodeToString(id[:])
+
+	var res []Result
+	n := 0
+	for _, s := range suites {
+		for _, tc := range Cases {
+			if tc.Suite != s {
+				continue
+			}
+			n++
+			tube := "conformance-" + run + "-" + strconv.Itoa(n)
+			start := time.Now()
+			err := ctx.Err()
+			if err == nil {
+				err = runCase(ctx, &cfg, tc, tube, timeout)
+			}
+			res = append(res, Result{Case: tc, Err: err, Elapsed: time.Since(start)})
+		}
+	}
+	return res
+}
+
+func runCase(ctx context.Context, cfg *Config, tc Case, tube string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	var d net.Dialer
+	nc, err := d.DialContext(ctx, "tcp", cfg.Addr)
+	if err != nil {
+		return err
+	}
+	defer nc.Close()
+	deadline, _ := ctx.Deadline()
+	nc.SetDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() { nc.SetDeadline(time.Now()) })
+	defer stop()
+
+	c := &Conn{Tube: tube, nc: nc, r: bufio.NewReader(nc)}
+	if cfg.Token != "" {
+		if _, err := c.Expect("auth "+cfg.Token, "OK"); err != nil {
+			return fmt.Errorf("auth: %w", err)
+		}
+	}
+	return tc.Run(c)
+}
+
+// A Conn is a case's connection to the server.
+type Conn struct {
+	// Tube is the case's own tube. The connection starts out using and
+	// watching default, as in beanstalkd.
+	Tube string
+
+	nc net.Conn
+	r  *bufio.Reader
+}
+
+// Send writes s to the server as it is.
+func (c *Conn) Send(s string) error {
+	_, err := io.WriteString(c.nc, s)
+	return err
+}
+
+// Line reads a reply line, which must end in CRLF, and returns it without
+// the CRLF.
+func (c *Conn) Line() (string, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return "", fmt.Errorf("reading reply: %w", err)
+	}
+	if !strings.HasSuffix(line, "\r\n") {
+		return "", fmt.Errorf("reply %q does not end in CRLF", line)
+	}
+	return line[:len(line)-2], nil
+}
+
+// Reply reads a reply line and matches it against want, space-separated
+// fields in which %d stands for a number and %s for any word. It returns
+// the fields the verbs matched.
+func (c *Conn) Reply(want string) ([]string, error) {
+	line, err := c.Line()
+	if err != nil {
+		return nil, err
+	}
+	got, wf := strings.Split(line, " "), strings.Split(want, " ")
+	if len(got) != len(wf) {
+		return nil, fmt.Errorf("got %q, want %q", line, want)
+	}
+	var vals []string
+	for i, w := range wf {
+		switch w {
+		case "%d":
+			if _, err := strconv.ParseUint(got[i], 10, 64); err != nil {
+				return nil, fmt.Errorf("got %q, want %q", line, want)
+			}
+			vals = append(vals, got[i])
+		case "%s":
+			if got[i] == "" {
+				return nil, fmt.Errorf("got %q, want %q", line, want)
+			}
+			vals = append(vals, got[i])
+		default:
+			if got[i] != w {
+				return nil, fmt.Errorf("got %q, want %q", line, want)
+			}
+		}
+	}
+	return vals, nil
+}
+
+// Expect sends the command line cmd, to which it adds the CRLF, and
+// matches the reply against want as Reply does.
+func (c *Conn) Expect(cmd, want string) ([]string, error) {
+	if err := c.Send(cmd + "\r\n"); err != nil {
+		return nil, err
+	}
+	vals, err := c.Reply(want)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", firstWord(cmd), err)
+	}
+	return vals, nil
+}
+
+// Put puts a job with body into the tube in use and returns its id. pri is
+// a uint32, as the protocol's priorities are.
+func (c *Conn) Put(pri uint32, delay, ttr int, body string) (string, error) {
+	cmd := fmt.Sprintf("put %d %d %d %d\r\n%s", pri, delay, ttr, len(body), body)
+	vals, err := c.Expect(cmd, "INSERTED %d")
+	if err != nil {
+		return "", err
+	}
+	return vals[0], nil
+}
+
+// Body reads the n bytes and CRLF that follow a reply such as OK <n>.
+func (c *Conn) Body(n string) ([]byte, error) {
+	size, err := strconv.Atoi(n)
+	if err != nil {
+		return nil, fmt.Errorf("bad size %q", n)
+	}
+	b := make([]byte, size+2)
+	if _, err := io.ReadFull(c.r, b); err != nil {
+		return nil, fmt.Errorf("reading body: %w", err)
+	}
+	if string(b[size:]) != "\r\n" {
+		return nil, errors.New("body does not end in CRLF")
+	}
+	return b[:size], nil
+}
+
+// Data sends cmd and reads an OK <bytes> reply and its body.
+func (c *Conn) Data(cmd string) ([]byte, error) {
+	vals, err := c.Expect(cmd, "OK %d")
+	if err != nil {
+		return nil, err
+	}
+	return c.Body(vals[0])
+}
+
+// Closed checks that the server closes the connection without sending
+// anything more.
+func (c *Conn) Closed() error {
+	b, err := c.r.ReadByte()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("want the connection closed: %w", err)
+	}
+	return fmt.Errorf("want the connection closed, got %q", b)
+}
+
+func firstWord(s string) string {
+	s, _, _ = strings.Cut(s, "\r\n")
+	s, _, _ = strings.Cut(s, " ")
+	return s
+}
@@ -0,0 +1,43 @@
+package dispatch
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jkasarherou/dispatch/conformance"
+)
+
+func TestConformance(t *testing.T) {
+	srv, err := NewServer(DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(ctx)
+	})
+
+	// The server takes jobs but does not hand them out over the protocol,
+	// so the consumer suite is not for it.
+	cfg := conformance.Config{
+		Addr:   l.Addr().String(),
+		Suites: []conformance.Suite{conformance.Core, conformance.Extensions},
+	}
+	res := conformance.Run(context.Background(), cfg)
+	if len(res) == 0 {
+		t.Fatal("no cases ran")
+	}
+	for _, r := range res {
+		if r.Err != nil {
+			t.Errorf("%s/%s: %v", r.Case.Suite, r.Case.Name, r.Err)
+		}
+	}
+}
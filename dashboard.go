@@ -0,0 +1,18 @@
+package dispatch
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// The dashboard is a single page served at / on the admin listener. It
+// polls the REST API for tube depths and put rates, and lists a tube's
+// buried jobs with buttons to kick or delete them.
+
+//go:embed dashboard.html
+var dashboardHTML []byte
+
+func adminDashboard(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(dashboardHTML)
+}
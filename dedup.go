@@ -0,0 +1,82 @@
+package dispatch
+
+import (
+	"errors"
+	"time"
+)
+
+// put-unique is an extension for producers that retry a put after a
+// timeout without knowing whether it arrived:
+//
+//	put-unique <key> <pri> <delay> <ttr> <bytes>\r\n
+//	<data>\r\n
+//
+// It is a put, unless the tube has inserted a job for the same key within
+// its dedup window, in which case nothing is inserted and the reply is
+// INSERTED with the id of that job. The window runs from the first put of
+// the key and is -dedup-window, or the tube's own from the config file.
+// Keys are kept in memory only, so a restart forgets them.
+
+const (
+	cmdPutUnique = "put-unique "
+
+	// dedupMaxKey caps the length of a put-unique key.
+	dedupMaxKey = 128
+)
+
+// errDuplicate is returned by jobInsertUnique for a key it has seen.
+var errDuplicate = errors.New("duplicate key")
+
+type dedupEntry struct {
+	key     string
+	id      uint64
+	expires time.Time
+}
+
+// jobInsertUnique is jobInsert for a put-unique with key. If the key is
+// still in j's tube's window it inserts nothing and returns the id of the
+// key's job and errDuplicate.
+func jobInsertUnique(j *job, key string, sp span) (uint64, error) {
+	jobCompress(j)
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+
+	t := j.tube
+	now := clock.Now()
+	dedupPrune(t, now)
+	if e := t.dedup[key]; e != nil && now.Before(e.expires) {
+		dedupCount.Add(1)
+		return e.id, errDuplicate
+	}
+	if err := jobInsertLocked(j, sp); err != nil {
+		return 0, err
+	}
+	if t.dedupWindow > 0 {
+		e := &dedupEntry{key: key, id: j.id, expires: now.Add(t.dedupWindow)}
+		if t.dedup == nil {
+			t.dedup = map[string]*dedupEntry{}
+		}
+		t.dedup[key] = e
+		t.dedupOrder = append(t.dedupOrder, e)
+	}
+	return j.id, nil
+}
+
+// dedupPrune forgets the keys of t whose window ended before now. Keys
+// expire in the order they were added unless the window was changed by a
+// reload, which only delays their pruning. The caller must hold jobsMu.
+func dedupPrune(t *tube, now time.Time) {
+	n := 0
+	for n < len(t.dedupOrder) && !now.Before(t.dedupOrder[n].expires) {
+		e := t.dedupOrder[n]
+		if t.dedup[e.key] == e {
+			delete(t.dedup, e.key)
+		}
+		t.dedupOrder[n] = nil
+		n++
+	}
+	t.dedupOrder = t.dedupOrder[n:]
+	if len(t.dedupOrder) == 0 {
+		t.dedupOrder = nil
+	}
+}
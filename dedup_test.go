@@ -0,0 +1,73 @@
+package dispatch
+
+import (
+	"testing"
+	"time"
+)
+
+func TestJobInsertUnique(t *testing.T) {
+	fc := NewFakeClock(time.Unix(1e9, 0))
+	saved := clock
+	clock = fc
+	serverReset()
+	t.Cleanup(func() {
+		clock = saved
+		serverReset()
+	})
+	tb := tubeFindOrMake("t")
+	jobsMu.Lock()
+	tb.dedupWindow = time.Minute
+	jobsMu.Unlock()
+
+	put := func(key string) (uint64, error) {
+		t.Helper()
+		j := makeJob(0, 0, 60, 3)
+		copy(j.body, "x\r\n")
+		j.tube = tb
+		id, err := jobInsertUnique(j, key, nil)
+		if err != nil {
+			bodyFree(j.body)
+		}
+		return id, err
+	}
+
+	first, err := put("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dups := dedupCount.Load()
+	for _, step := range []struct {
+		name    string
+		advance time.Duration
+		key     string
+		dup     bool
+	}{
+		{"repeat", 0, "a", true},
+		{"other key", 0, "b", false},
+		{"late in the window", 59 * time.Second, "a", true},
+		// The window runs from the first put, not the latest repeat.
+		{"window over", time.Second, "a", false},
+	} {
+		fc.Advance(step.advance)
+		id, err := put(step.key)
+		switch {
+		case step.dup && (err != errDuplicate || id != first):
+			t.Errorf("%s: got %d, %v; want %d, %v", step.name, id, err, first, errDuplicate)
+		case !step.dup && (err != nil || id == first):
+			t.Errorf("%s: got %d, %v; want a new job", step.name, id, err)
+		}
+	}
+	if got := dedupCount.Load() - dups; got != 2 {
+		t.Errorf("counted %d duplicates, want 2", got)
+	}
+
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	if n := len(allJobs); n != 3 {
+		t.Errorf("%d jobs, want 3", n)
+	}
+	// b's window is over too, and only a's new job is remembered.
+	if len(tb.dedup) != 1 || tb.dedup["a"] == nil || tb.dedup["a"].id == first {
+		t.Errorf("remembered %v, want only a's new job", tb.dedup)
+	}
+}
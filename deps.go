@@ -0,0 +1,143 @@
+package dispatch
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/jkasarherou/dispatch/protocol"
+)
+
+// put-after is an extension for simple pipelines, putting a job that waits
+// for others to finish:
+//
+//	put-after <id>[,<id>...] <pri> <delay> <ttr> <bytes>\r\n
+//	<data>\r\n
+//
+// The job is held until every job it names has been deleted, and then
+// becomes ready, or delayed by <delay> from then. Ids of jobs that no
+// longer exist are already done. The reply is INSERTED <id> as for put.
+// Held jobs are counted in current-jobs-held and do not expire.
+//
+// The dependencies are kept in the job's put record, so binlog and bolt
+// storage hold a job back across a restart. SQLite and Redis storage do not
+// keep them, and a held job they recover is released.
+
+const (
+	cmdPutAfter = "put-after "
+
+	// depsMax caps the jobs a put-after may wait for.
+	depsMax = 16
+)
+
+// depWaiters maps a job id to the held jobs waiting for it. Entries for
+// held jobs that have since been deleted are dropped when the job they
+// wait for is. Guarded by jobsMu.
+var depWaiters = map[uint64][]*job{}
+
+// depsParse reads a comma-separated list of job ids.
+func depsParse(b []byte) ([]uint64, bool) {
+	var deps []uint64
+	for len(b) > 0 {
+		i := 0
+		for i < len(b) && b[i] != ',' {
+			i++
+		}
+		id, ok := protocol.ParseUint(b[:i], 64)
+		if !ok || id == 0 || len(deps) == depsMax {
+			return nil, false
+		}
+		deps = append(deps, id)
+		if i == len(b) {
+			break
+		}
+		b = b[i+1:]
+		if len(b) == 0 {
+			return nil, false
+		}
+	}
+	return deps, len(deps) > 0
+}
+
+// depsHold makes j, which is about to be stored, held if any of its
+// dependencies still exist. The caller must hold jobsMu.
+func depsHold(j *job) {
+	j.depsLeft = 0
+	for _, id := range j.deps {
+		if id != j.id && allJobs[id] != nil {
+			j.depsLeft++
+		}
+	}
+	if j.depsLeft > 0 {
+		j.state, j.deadline = jobStateHeld, time.Time{}
+	}
+}
+
+// depsRegister has the held job j, once stored, wait for its dependencies.
+// The caller must hold jobsMu.
+func depsRegister(j *job) {
+	for _, id := range j.deps {
+		if id != j.id && allJobs[id] != nil {
+			depWaiters[id] = append(depWaiters[id], j)
+		}
+	}
+}
+
+// depsDone releases the jobs that were waiting only for id, which has been
+// deleted. The caller must hold jobsMu.
+func depsDone(id uint64) {
+	ws := depWaiters[id]
+	if ws == nil {
+		return
+	}
+	delete(depWaiters, id)
+	for _, w := range ws {
+		if allJobs[w.id] != w || w.state != jobStateHeld {
+			continue
+		}
+		if w.depsLeft--; w.depsLeft == 0 {
+			depsRelease(w)
+		}
+	}
+}
+
+// depsRelease makes the held job j ready, or delayed. The caller must hold
+// jobsMu.
+func depsRelease(j *job) {
+	unstoreJob(j)
+	j.state, j.deadline = jobStateReady, time.Time{}
+	if j.delay > 0 {
+		j.state = jobStateDelayed
+		j.deadline = clock.Now().Add(time.Duration(j.delay) * time.Second)
+	}
+	if err := storeUpdateJob(j); err != nil {
+		// The job is released all the same; after a restart it is
+		// released again if its dependencies are gone.
+		slog.Error("storage write failed", "job", j.id, "err", err)
+	}
+	storeJob(j)
+	if err := traceState(opTrace, j); err != nil {
+		slog.Error("op trace write failed", "err", err)
+	}
+	eventEmit(eventUnblocked, j)
+}
+
+// depsRecover rebuilds depWaiters from the held jobs loaded from storage,
+// releasing those with nothing left to wait for. The caller must hold
+// jobsMu.
+func depsRecover() {
+	var free []*job
+	for _, j := range allJobs {
+		if j.state != jobStateHeld {
+			continue
+		}
+		depsHold(j)
+		if j.depsLeft == 0 {
+			free = append(free, j)
+			continue
+		}
+		depsRegister(j)
+	}
+	for _, j := range free {
+		depsRelease(j)
+	}
+}
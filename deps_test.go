@@ -0,0 +1,135 @@
+package dispatch
+
+import "testing"
+
+// depsTestPut puts a job with delay into the tube t that waits for deps.
+func depsTestPut(t *testing.T, delay uint64, deps ...uint64) *job {
+	t.Helper()
+	j := makeJob(0, delay, 60, 3)
+	copy(j.body, "x\r\n")
+	j.tube = tubeFindOrMake("t")
+	j.deps = deps
+	if err := jobInsert(j, nil); err != nil {
+		t.Fatal(err)
+	}
+	return j
+}
+
+// depsTestDelete deletes the job id.
+func depsTestDelete(t *testing.T, id uint64) {
+	t.Helper()
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	if err := jobDelete(allJobs[id]); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// depsTestState returns the state of the job id.
+func depsTestState(id uint64) jobState {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	return allJobs[id].state
+}
+
+func TestDepsRelease(t *testing.T) {
+	serverReset()
+	t.Cleanup(serverReset)
+
+	a := depsTestPut(t, 0)
+	b := depsTestPut(t, 0)
+	c := depsTestPut(t, 0, a.id, b.id, 999)
+	d := depsTestPut(t, 5, c.id)
+	if s := depsTestState(c.id); s != jobStateHeld {
+		t.Fatalf("c is %v, want held", s)
+	}
+	depsTestDelete(t, a.id)
+	if s := depsTestState(c.id); s != jobStateHeld {
+		t.Errorf("c is %v with b left, want held", s)
+	}
+	depsTestDelete(t, b.id)
+	if s := depsTestState(c.id); s != jobStateReady {
+		t.Errorf("c is %v with nothing left, want ready", s)
+	}
+	// A released job with a delay waits it out from then.
+	depsTestDelete(t, c.id)
+	if s := depsTestState(d.id); s != jobStateDelayed {
+		t.Errorf("d is %v, want delayed", s)
+	}
+	jobsMu.Lock()
+	held := heldCount
+	jobsMu.Unlock()
+	if held != 0 {
+		t.Errorf("%d jobs counted held, want 0", held)
+	}
+}
+
+// depsCrashStorage drops state changes, as a crash just after a delete is
+// written would, before the jobs it releases are.
+type depsCrashStorage struct{ binlogStorage }
+
+func (depsCrashStorage) updateJob(*job) error { return nil }
+
+func TestDepsRecover(t *testing.T) {
+	savedNoSync := binlogNoSync
+	binlogNoSync = true
+	serverReset()
+	t.Cleanup(func() {
+		binlogNoSync = savedNoSync
+		serverReset()
+	})
+	dir := t.TempDir()
+	var w *binlog
+	restart := func() {
+		t.Helper()
+		if w != nil {
+			if err := walClose(w); err != nil {
+				t.Fatal(err)
+			}
+		}
+		serverReset()
+		var err error
+		if w, err = walInit(dir); err != nil {
+			t.Fatal(err)
+		}
+		jobsMu.Lock()
+		jobStore, wal = binlogStorage{w}, w
+		depsRecover()
+		jobsMu.Unlock()
+	}
+	restart()
+	t.Cleanup(func() { walClose(w) })
+
+	a := depsTestPut(t, 0)
+	b := depsTestPut(t, 0, a.id)
+	c := depsTestPut(t, 0)
+	d := depsTestPut(t, 0, c.id)
+
+	// Held jobs stay held across a restart, and are released once their
+	// dependency is deleted after it.
+	restart()
+	if s := depsTestState(b.id); s != jobStateHeld {
+		t.Fatalf("b is %v after a restart, want held", s)
+	}
+	depsTestDelete(t, a.id)
+	if s := depsTestState(b.id); s != jobStateReady {
+		t.Errorf("b is %v after a was deleted, want ready", s)
+	}
+
+	// A job whose dependency was deleted just before a crash, before its
+	// release was written, is released on restart.
+	jobsMu.Lock()
+	jobStore = depsCrashStorage{binlogStorage{w}}
+	jobsMu.Unlock()
+	depsTestDelete(t, c.id)
+	restart()
+	if s := depsTestState(d.id); s != jobStateReady {
+		t.Errorf("d is %v after a restart without c, want ready", s)
+	}
+	jobsMu.Lock()
+	waiting := len(depWaiters)
+	jobsMu.Unlock()
+	if waiting != 0 {
+		t.Errorf("%d jobs still waited for, want none", waiting)
+	}
+}
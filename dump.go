@@ -0,0 +1,330 @@
+package dispatch
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dumpRecord is one line of a dump file. Delay is what remained of a
+// delayed job's delay when it was dumped, in seconds, so that a restore
+// later does not hold it back for the full delay again. The body is
+// base64 and excludes the trailing CRLF.
+type dumpRecord struct {
+	ID    uint64 `json:"id"`
+	Tube  string `json:"tube"`
+	State string `json:"state"`
+	Pri   uint64 `json:"pri"`
+	Delay uint64 `json:"delay"`
+	TTR   uint64 `json:"ttr"`
+	Body  []byte `json:"body"`
+
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// dumpLoad fills the job and tube tables from a storage without changing
+// it. A binlog is replayed the way fsck does, so the server must be
+// stopped; the other storages only read.
+func dumpLoad(kind, path string) error {
+	if kind != storageBinlog {
+		s, err := openStorage(kind, path)
+		if err != nil {
+			return err
+		}
+		return s.close()
+	}
+
+	lock, err := walLockDir(path)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	seqs, err := walSegments(path)
+	if err != nil {
+		return err
+	}
+	aead, err := walKeyLoad(binlogKeySpec)
+	if err != nil {
+		return err
+	}
+	damage, err := walReplay(&binlog{dir: path, aead: aead}, seqs)
+	for _, d := range damage {
+		fmt.Fprintf(os.Stderr, "dump: %s: ignoring tail after %d records: %v\n", walSegmentPath(path, d.seq), d.records, d.err)
+	}
+	return err
+}
+
+func dumpMain(args []string) int {
+	fs := flag.NewFlagSet("dump", flag.ExitOnError)
+	kind := fs.String("storage", storageBinlog, "storage to read: binlog, bolt, sqlite, or redis")
+	path := fs.String("path", "", "binlog directory, database file, or redis address")
+	out := fs.String("o", "", "write to this `file` instead of standard output")
+	fs.StringVar(&binlogKeySpec, "binlog-key", "", "read a binlog encrypted with the key in this `file`, or printed by exec:<command>")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: dispatch dump [-storage kind] -path path [-o file]\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *path == "" || fs.NArg() != 0 {
+		fs.Usage()
+		return 2
+	}
+
+	if err := dumpLoad(*kind, *path); err != nil {
+		fmt.Fprintf(os.Stderr, "dump: %v\n", err)
+		return 1
+	}
+
+	w := os.Stdout
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "dump: %v\n", err)
+			return 1
+		}
+		defer f.Close()
+		w = f
+	}
+
+	jobsMu.Lock()
+	n, err := dumpJobs(w, time.Now())
+	jobsMu.Unlock()
+	if err == nil && w != os.Stdout {
+		err = w.Sync()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "dump: %v\n", err)
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "dumped %d jobs\n", n)
+	return 0
+}
+
+// dumpJobs writes every job in id order. The caller must hold jobsMu.
+func dumpJobs(w io.Writer, now time.Time) (int, error) {
+	ids := make([]uint64, 0, len(allJobs))
+	for id := range allJobs {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(a, b int) bool { return ids[a] < ids[b] })
+
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	for _, id := range ids {
+		r := dumpRecordOf(allJobs[id], now)
+		if err := enc.Encode(&r); err != nil {
+			return 0, err
+		}
+	}
+	return len(ids), bw.Flush()
+}
+
+func dumpRecordOf(j *job, now time.Time) dumpRecord {
+	r := dumpRecord{
+		ID:    j.id,
+		Tube:  j.tube.name,
+		State: jobStateNames[j.state],
+		Pri:   j.pri,
+		TTR:   j.ttr,
+		Body:  sqliteBody(j),
+
+		Headers: headersMap(j.headers),
+	}
+	if j.state == jobStateDelayed {
+		if left := j.deadline.Sub(now); left > 0 {
+			r.Delay = uint64((left + time.Second - 1) / time.Second)
+		}
+	}
+	return r
+}
+
+// restoreMain loads a dump into a storage that no server is using, or
+// into a running server over the protocol. Jobs get new ids either way.
+// Over the protocol every job is put again, so reserved and buried jobs
+// come back ready; a storage keeps buried jobs buried. Reserved jobs come
+// back ready in both cases as no client holds them any more.
+func restoreMain(args []string) int {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	addr := fs.String("addr", "", "put the jobs into the server at this `host:port`")
+	kind := fs.String("storage", storageBinlog, "storage to write: binlog, bolt, sqlite, or redis")
+	path := fs.String("path", "", "binlog directory, database file, or redis address")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: dispatch restore (-addr host:port | [-storage kind] -path path) [dump file]\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if (*addr == "") == (*path == "") || fs.NArg() > 1 {
+		fs.Usage()
+		return 2
+	}
+
+	in := os.Stdin
+	if fs.NArg() == 1 {
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "restore: %v\n", err)
+			return 1
+		}
+		defer f.Close()
+		in = f
+	}
+
+	var (
+		n, demoted int
+		err        error
+	)
+	if *addr != "" {
+		n, demoted, err = restoreToServer(in, *addr)
+	} else {
+		n, demoted, err = restoreToStorage(in, *kind, *path)
+	}
+	fmt.Fprintf(os.Stderr, "restored %d jobs", n)
+	if demoted > 0 {
+		fmt.Fprintf(os.Stderr, ", %d of them as ready", demoted)
+	}
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "restore: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// restoreRead calls fn for each record in a dump.
+func restoreRead(in io.Reader, fn func(r *dumpRecord) error) error {
+	dec := json.NewDecoder(bufio.NewReader(in))
+	for line := 1; ; line++ {
+		var r dumpRecord
+		if err := dec.Decode(&r); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("record %d: %v", line, err)
+		}
+		if r.Tube == "" {
+			return fmt.Errorf("record %d: job %d has no tube", line, r.ID)
+		}
+		if err := fn(&r); err != nil {
+			return fmt.Errorf("record %d: job %d: %v", line, r.ID, err)
+		}
+	}
+}
+
+func restoreToStorage(in io.Reader, kind, path string) (n, demoted int, err error) {
+	s, err := openStorage(kind, path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer s.close()
+
+	states := map[string]jobState{}
+	for st, name := range jobStateNames {
+		states[name] = st
+	}
+
+	now := time.Now()
+	err = restoreRead(in, func(r *dumpRecord) error {
+		st, ok := states[r.State]
+		if !ok {
+			return fmt.Errorf("unknown state %q", r.State)
+		}
+		if st == jobStateReserved || st == jobStateHeld {
+			st = jobStateReady
+			demoted++
+		}
+
+		j := makeJob(r.Pri, r.Delay, r.TTR, uint64(len(r.Body)+2))
+		copy(j.body, r.Body)
+		copy(j.body[len(r.Body):], "\r\n")
+		j.created = now
+		j.headers = headersOfMap(r.Headers)
+		j.state = st
+		if st == jobStateDelayed {
+			j.deadline = now.Add(time.Duration(r.Delay) * time.Second)
+		}
+
+		jobsMu.Lock()
+		defer jobsMu.Unlock()
+		j.tube = tubeFindOrMakeLocked(r.Tube)
+		j.id = nextJobID
+		if err := s.putJob(j); err != nil {
+			return err
+		}
+		nextJobID++
+		storeJob(j)
+		n++
+		return nil
+	})
+	return n, demoted, err
+}
+
+func restoreToServer(in io.Reader, addr string) (n, demoted int, err error) {
+	c, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer c.Close()
+	rd := bufio.NewReader(c)
+	w := bufio.NewWriter(c)
+
+	// roundTrip sends one command and checks that the reply starts with
+	// want.
+	roundTrip := func(want string, cmd string, body []byte) error {
+		w.WriteString(cmd)
+		if body != nil {
+			w.Write(body)
+			w.WriteString("\r\n")
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		reply, err := rd.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		if !strings.HasPrefix(reply, want) {
+			return fmt.Errorf("%s", strings.TrimSpace(reply))
+		}
+		return nil
+	}
+
+	using := defaultTubeName
+	err = restoreRead(in, func(r *dumpRecord) error {
+		if r.Tube != using {
+			if err := roundTrip("USING ", cmdUse+r.Tube+"\r\n", nil); err != nil {
+				return err
+			}
+			using = r.Tube
+		}
+		if r.State != jobStateNames[jobStateReady] && r.State != jobStateNames[jobStateDelayed] {
+			demoted++
+		}
+		cmd := cmdPut
+		if len(r.Headers) > 0 {
+			cmd = cmdPutHeaders + headersFormat(headersOfMap(r.Headers)) + " "
+		}
+		cmd += strconv.FormatUint(r.Pri, 10) + " " +
+			strconv.FormatUint(r.Delay, 10) + " " +
+			strconv.FormatUint(r.TTR, 10) + " " +
+			strconv.Itoa(len(r.Body)) + "\r\n"
+		if err := roundTrip(msgInserted, cmd, r.Body); err != nil {
+			return err
+		}
+		n++
+		return nil
+	})
+	if err == nil {
+		err = roundTrip("", cmdQuit+"\r\n", nil)
+		if err == io.EOF {
+			err = nil
+		}
+	}
+	return n, demoted, err
+}
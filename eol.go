@@ -0,0 +1,81 @@
+package dispatch
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+)
+
+// The protocol ends command lines and job bodies with CRLF, and a body
+// that does not end with one is refused with EXPECTED_CRLF. With
+// -lenient-eol a bare LF is taken in place of the CRLF after a body, as it
+// already is after a command line, so that the server can be poked at by
+// hand with nc or telnet where they send LF alone:
+//
+//	$ nc localhost 3333
+//	use test
+//	USING test
+//	put 0 0 60 5
+//	hello
+//	INSERTED 1
+//
+// The body is stored with CRLF all the same. Replies are still sent with
+// CRLF. Without the flag, which is how a server for real clients should
+// run, a put body is read as exactly its size and two bytes more.
+
+// lenientEOL is -lenient-eol.
+var lenientEOL bool
+
+// bodyRead reads a body into b, which has room for its CRLF, and with
+// -lenient-eol turns a bare LF after it into CRLF.
+func bodyRead(r *bufio.Reader, b []byte) error {
+	if !lenientEOL {
+		_, err := io.ReadFull(r, b)
+		return err
+	}
+	n := len(b)
+	if _, err := io.ReadFull(r, b[:n-1]); err != nil {
+		return err
+	}
+	if b[n-2] == '\n' {
+		b[n-2], b[n-1] = '\r', '\n'
+		return nil
+	}
+	_, err := io.ReadFull(r, b[n-1:])
+	return err
+}
+
+// bodyEnded reports whether b, a body read with its CRLF, ends with one.
+// With -lenient-eol a bare LF has been made a CRLF by then, so this is the
+// one check for EXPECTED_CRLF whichever end of line the client sent.
+func bodyEnded(b []byte) bool {
+	return bytes.HasSuffix(b, []byte("\r\n"))
+}
+
+// bodyDiscard skips a body of size bytes and the CRLF, or with
+// -lenient-eol the bare LF, after it.
+func bodyDiscard(r *bufio.Reader, size uint64) error {
+	if _, err := r.Discard(int(size)); err != nil {
+		return err
+	}
+	return eolDiscard(r)
+}
+
+// eolDiscard skips the CRLF, or with -lenient-eol the bare LF, after a
+// body.
+func eolDiscard(r *bufio.Reader) error {
+	if !lenientEOL {
+		_, err := r.Discard(2)
+		return err
+	}
+	b, err := r.Peek(1)
+	if err != nil {
+		return err
+	}
+	if b[0] == '\r' {
+		_, err = r.Discard(2)
+	} else {
+		_, err = r.Discard(1)
+	}
+	return err
+}
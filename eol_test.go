@@ -0,0 +1,59 @@
+package dispatch
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLenientEOL(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.LenientEOL = true
+	srv, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(ctx)
+		lenientEOL = false
+	})
+
+	nc, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	r := bufio.NewReader(nc)
+	for _, step := range []struct{ send, want string }{
+		{"put 0 0 60 5\nhello\n", "INSERTED "},
+		{"put 0 0 60 5\r\nhello\r\n", "INSERTED "},
+		{"put 0 0 60 5\nhelloX\n", "EXPECTED_CRLF"},
+		{"mput 3\n0 0 60 1\na\n0 0 60 2\r\nbc\r\n0 0 60 0\n\n", "INSERTED_BATCH "},
+		{"mput 1\n0 0 60 1\nab\n", "INSERTED_BATCH EXPECTED_CRLF"},
+	} {
+		nc.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := nc.Write([]byte(step.send)); err != nil {
+			t.Fatal(err)
+		}
+		reply, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("%q: %v", step.send, err)
+		}
+		if !strings.HasPrefix(reply, step.want) {
+			t.Errorf("%q: got %q, want %s", step.send, reply, step.want)
+		}
+		if step.want == "INSERTED_BATCH " && strings.Contains(reply, "EXPECTED_CRLF") {
+			t.Errorf("%q: got %q, want every job inserted", step.send, reply)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package dispatch
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// With -kafka-brokers, built with -tags kafka, the server publishes an
+// event for each change in a job's life to -kafka-topic, so that data
+// pipelines and SLA dashboards can follow the queue without polling stats.
+// Each event is a Kafka message keyed by the job's tube, so that a tube's
+// events stay in order within a partition, whose value is a JSON object:
+//
+//	{"type": "inserted", "job": 12, "tube": "emails", "pri": 1024,
+//	 "delay": 0, "ttr": 60, "size": 312, "origin": "text",
+//	 "state": "ready", "time": "2026-01-02T15:04:05.999Z", "server": "..."}
+//
+// The types are inserted, for a job put or fired by a schedule; deleted;
+// expired, which follows the deleted of a job whose ttl passed; kicked;
+// unblocked, for a put-after job whose dependencies are done, with the
+// state it moved to; reserved, for a job received through the SQS facade,
+// again if its last reservation lapsed; and released, for one whose
+// visibility timeout was set to 0. size is the body's length without its
+// CRLF as stored, and so, as in stats, gzipped in a compressed tube. Jobs
+// are never buried. Jobs recovered from storage at startup are not
+// announced again.
+//
+// Events are sent in the background from a queue of eventQueueSize; if
+// Kafka cannot keep up, later events are dropped rather than slowing
+// commands down. stats count them as events-sent, events-dropped and
+// events-errors. Events are JSON only; Avro would need a schema registry
+// to be of use, which the server does not talk to.
+
+const eventQueueSize = 16384
+
+const (
+	eventInserted  = "inserted"
+	eventDeleted   = "deleted"
+	eventExpired   = "expired"
+	eventKicked    = "kicked"
+	eventUnblocked = "unblocked"
+	eventReserved  = "reserved"
+	eventReleased  = "released"
+)
+
+var (
+	kafkaBrokers string
+	kafkaTopic   = "dispatch-events"
+)
+
+// jobEvent is the JSON form of an event.
+type jobEvent struct {
+	Type   string    `json:"type"`
+	Job    uint64    `json:"job"`
+	Tube   string    `json:"tube"`
+	Pri    uint64    `json:"pri"`
+	Delay  uint64    `json:"delay"`
+	TTR    uint64    `json:"ttr"`
+	Size   uint64    `json:"size"`
+	Origin string    `json:"origin"`
+	State  string    `json:"state"`
+	Time   time.Time `json:"time"`
+	Server string    `json:"server"`
+}
+
+// eventQueue holds the events waiting to be sent. It is nil unless a
+// publisher is running.
+var eventQueue chan *jobEvent
+
+// eventEmit queues an event of type typ about j. The caller must hold
+// jobsMu.
+func eventEmit(typ string, j *job) {
+	if eventQueue == nil {
+		return
+	}
+	e := &jobEvent{
+		Type:   typ,
+		Job:    j.id,
+		Tube:   j.tube.name,
+		Pri:    j.pri,
+		Delay:  j.delay,
+		TTR:    j.ttr,
+		Size:   j.bodySize - 2,
+		Origin: originNames[j.origin],
+		State:  jobStateNames[j.state],
+		Time:   clock.Now(),
+		Server: serverID,
+	}
+	select {
+	case eventQueue <- e:
+	default:
+		eventDroppedCount.Add(1)
+	}
+}
+
+// eventValue is e as the value of a message.
+func eventValue(e *jobEvent) []byte {
+	b, _ := json.Marshal(e)
+	return b
+}
@@ -0,0 +1,191 @@
+//go:build linux
+
+package dispatch
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// With -event-loop a connection waiting for its next command is parked in
+// an epoll set instead of holding a goroutine blocked in read. One poller
+// goroutine waits on the set and starts a goroutine for each connection
+// that becomes readable, which handles commands until the connection is
+// idle again. A connection is idle once it has gone evloopIdleWait without
+// input, so that clients sending command after command keep their
+// goroutine. Hundreds of thousands of mostly idle workers then cost their
+// buffers but no stacks. A connection in the middle of a command, and any
+// TLS connection, whose buffered records epoll cannot see, is handled as
+// in the default model.
+
+const evloopSupported = true
+
+const evloopIdleWait = 20 * time.Millisecond
+
+type evloop struct {
+	epfd int
+	// wake is a pipe in the epoll set that evloopStop writes to, to end
+	// the poller.
+	wake [2]int
+
+	mu     sync.Mutex
+	parked map[int32]*conn
+	// closed is set once the server is draining, after which nothing
+	// more is parked.
+	closed bool
+}
+
+// evl is the event loop, nil unless -event-loop is given.
+var evl atomic.Pointer[evloop]
+
+func evloopStart() error {
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return err
+	}
+	l := &evloop{epfd: epfd, parked: map[int32]*conn{}}
+	if err := syscall.Pipe2(l.wake[:], syscall.O_CLOEXEC|syscall.O_NONBLOCK); err != nil {
+		syscall.Close(epfd)
+		return err
+	}
+	ev := syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(l.wake[0])}
+	if err := syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, l.wake[0], &ev); err != nil {
+		l.closeFds()
+		return err
+	}
+	evl.Store(l)
+	go evloopRun(l)
+	return nil
+}
+
+// evloopStop ends the event loop, once connsDrain has taken every
+// connection back from it, so that another can be started; the
+// benchmarks start one for each server.
+func evloopStop() {
+	l := evl.Swap(nil)
+	if l == nil {
+		return
+	}
+	syscall.Write(l.wake[1], []byte{0})
+}
+
+func (l *evloop) closeFds() {
+	syscall.Close(l.epfd)
+	syscall.Close(l.wake[0])
+	syscall.Close(l.wake[1])
+}
+
+func evloopRun(l *evloop) {
+	defer l.closeFds()
+	events := make([]syscall.EpollEvent, 256)
+	for {
+		n, err := syscall.EpollWait(l.epfd, events, -1)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			slog.Error("event loop failed", "err", err)
+			return
+		}
+		stop := false
+		l.mu.Lock()
+		for _, ev := range events[:n] {
+			if ev.Fd == int32(l.wake[0]) {
+				stop = true
+				continue
+			}
+			if c := l.parked[ev.Fd]; c != nil {
+				delete(l.parked, ev.Fd)
+				go connRun(c, true)
+			}
+		}
+		l.mu.Unlock()
+		if stop {
+			return
+		}
+	}
+}
+
+// evloopPark hands c to the event loop if it stays idle, reporting whether
+// it did. c must have nothing buffered in either direction.
+func evloopPark(c *conn) bool {
+	l := evl.Load()
+	if l == nil {
+		return false
+	}
+	sc, ok := c.conn.(syscall.Conn)
+	if !ok {
+		return false
+	}
+
+	c.conn.SetReadDeadline(time.Now().Add(evloopIdleWait))
+	_, err := c.reader.Peek(1)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		// connsDrain's deadline was overwritten.
+		c.conn.SetReadDeadline(time.Now())
+		return false
+	}
+	c.conn.SetReadDeadline(time.Time{})
+	if ne, ok := err.(net.Error); err == nil || !ok || !ne.Timeout() {
+		// Input, or an error the next read will see.
+		return false
+	}
+
+	if c.pollFd == 0 {
+		rc, err := sc.SyscallConn()
+		if err != nil {
+			return false
+		}
+		rc.Control(func(fd uintptr) { c.pollFd = int(fd) })
+	}
+
+	// Registering under mu keeps the poller from seeing input on c before
+	// c is in parked.
+	ev := syscall.EpollEvent{
+		Events: syscall.EPOLLIN | syscall.EPOLLRDHUP | syscall.EPOLLONESHOT,
+		Fd:     int32(c.pollFd),
+	}
+	err = syscall.EpollCtl(l.epfd, syscall.EPOLL_CTL_MOD, c.pollFd, &ev)
+	if errors.Is(err, syscall.ENOENT) {
+		err = syscall.EpollCtl(l.epfd, syscall.EPOLL_CTL_ADD, c.pollFd, &ev)
+	}
+	if err != nil {
+		slog.Warn("cannot park connection", "remote", c.conn.RemoteAddr().String(), "err", err)
+		return false
+	}
+	l.parked[int32(c.pollFd)] = c
+	return true
+}
+
+// evloopForget removes c, which is about to be closed, from the epoll set.
+func evloopForget(c *conn) {
+	l := evl.Load()
+	if l == nil || c.pollFd == 0 {
+		return
+	}
+	syscall.EpollCtl(l.epfd, syscall.EPOLL_CTL_DEL, c.pollFd, nil)
+}
+
+// evloopWake hands every parked connection back to a goroutine to be
+// closed, for connsDrain.
+func evloopWake() {
+	l := evl.Load()
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closed = true
+	for fd, c := range l.parked {
+		delete(l.parked, fd)
+		c.conn.SetReadDeadline(time.Now())
+		go connRun(c, true)
+	}
+}
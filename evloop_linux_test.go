@@ -0,0 +1,119 @@
+//go:build linux
+
+package dispatch
+
+import (
+	"context"
+	"net"
+	"runtime"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jkasarherou/dispatch/client"
+)
+
+// benchConnServer starts a server for b, in the goroutine-per-connection
+// model or with the event loop, and returns its address.
+func benchConnServer(b *testing.B, eventLoop bool) string {
+	b.Helper()
+	if eventLoop {
+		if err := evloopStart(); err != nil {
+			b.Fatal(err)
+		}
+	}
+	srv, err := NewServer(DefaultConfig())
+	if err != nil {
+		b.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	go srv.Serve(l)
+	b.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(ctx)
+		evloopStop()
+	})
+	return l.Addr().String()
+}
+
+// BenchmarkConnModel puts jobs over active connections while others sit
+// idle, in the goroutine-per-connection model and with -event-loop. Besides
+// the time per put it reports the goroutines the server holds for each idle
+// connection, which the event loop is there to bring to none.
+func BenchmarkConnModel(b *testing.B) {
+	for _, model := range []struct {
+		name      string
+		eventLoop bool
+	}{{"goroutine", false}, {"event-loop", true}} {
+		for _, idle := range []int{0, 1000, 10000} {
+			b.Run(model.name+"/idle="+strconv.Itoa(idle), func(b *testing.B) {
+				benchConnModel(b, model.eventLoop, idle)
+			})
+		}
+	}
+}
+
+func benchConnModel(b *testing.B, eventLoop bool, idle int) {
+	// Each idle connection takes a descriptor at either end.
+	var rl syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rl); err != nil {
+		b.Fatal(err)
+	}
+	if need := uint64(2*idle + 256); rl.Cur < need {
+		rl.Cur = min(need, rl.Max)
+		syscall.Setrlimit(syscall.RLIMIT_NOFILE, &rl)
+		if rl.Cur < need {
+			b.Skipf("%d idle connections need %d descriptors, the limit is %d", idle, need, rl.Cur)
+		}
+	}
+	addr := benchConnServer(b, eventLoop)
+	ctx := context.Background()
+
+	before := runtime.NumGoroutine()
+	conns := make([]net.Conn, 0, idle)
+	defer func() {
+		for _, c := range conns {
+			c.Close()
+		}
+	}()
+	for len(conns) < idle {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			b.Fatalf("idle connection %d: %v", len(conns), err)
+		}
+		conns = append(conns, c)
+	}
+	// Give the server time to take every connection in and, with the
+	// event loop, to park them.
+	for deadline := time.Now().Add(5 * time.Second); curConnCount.Load() < int64(idle) && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(10 * evloopIdleWait)
+	held := runtime.NumGoroutine() - before
+
+	body := make([]byte, 128)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		cc, err := client.Dial(ctx, addr)
+		if err != nil {
+			b.Error(err)
+			return
+		}
+		defer cc.Close()
+		for pb.Next() {
+			if _, err := cc.Put(ctx, 1024, 0, 60, body); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+	b.StopTimer()
+	if idle > 0 {
+		b.ReportMetric(float64(held)/float64(idle), "goroutines/idle-conn")
+	}
+}
@@ -0,0 +1,22 @@
+//go:build !linux
+
+package dispatch
+
+import "errors"
+
+// The event loop is built on epoll, which only Linux has; checkSettings
+// rejects -event-loop elsewhere.
+
+const evloopSupported = false
+
+func evloopStart() error {
+	return errors.New("-event-loop is only supported on Linux")
+}
+
+func evloopPark(c *conn) bool { return false }
+
+func evloopForget(c *conn) {}
+
+func evloopWake() {}
+
+func evloopStop() {}
@@ -0,0 +1,55 @@
+package dispatch
+
+import (
+	"log/slog"
+	"time"
+)
+
+// A job that has waited in a tube with a ttl, ready or delayed, for that
+// long since it was put is deleted, so that the work in abandoned tubes
+// does not pile up for ever. The ttl is -job-ttl, or the tube's own from
+// the config file. Reserved and buried jobs do not expire. Expirations
+// are counted in stats as job-expirations and per tube, and also count as
+// deletes.
+
+// expireInterval is how often jobs are checked for expiry, and so how late
+// a job may expire.
+const expireInterval = time.Second
+
+func expireRun() {
+	for now := range clock.Tick(expireInterval) {
+		jobsMu.Lock()
+		expireSweep(now)
+		jobsMu.Unlock()
+	}
+}
+
+// expireSweep deletes the jobs whose ttl has passed at now. The caller
+// must hold jobsMu.
+func expireSweep(now time.Time) {
+	on := false
+	for _, t := range tubes {
+		if t.ttl > 0 {
+			on = true
+			break
+		}
+	}
+	if !on {
+		return
+	}
+	for _, j := range allJobs {
+		ttl := j.tube.ttl
+		if ttl == 0 || j.state != jobStateReady && j.state != jobStateDelayed || now.Sub(j.created) < ttl {
+			continue
+		}
+		t := j.tube
+		if err := jobDelete(j); err != nil {
+			// Logged by jobDelete; try again next time.
+			continue
+		}
+		t.stat.expired++
+		expiredCount.Add(1)
+		eventEmit(eventExpired, j)
+		slog.Debug("job expired", "job", j.id, "tube", t.name)
+	}
+}
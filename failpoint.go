@@ -0,0 +1,89 @@
+//go:build failpoint
+
+package dispatch
+
+import (
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Built with -tags failpoint, the server takes -failpoints, a
+// comma-separated list of faults to inject, so that recovery can be
+// exercised on purpose rather than waited for:
+//
+//	binlog-drop-write=P    skip writing a binlog record, with probability
+//	                       P, while reporting it written
+//	binlog-torn-write=P    write half a record and exit at once, as if the
+//	                       process were killed mid-write, with probability P
+//	binlog-fsync-delay=D   wait D before every binlog fsync
+//	conn-close-mid-body=P  close the connection, with probability P, when
+//	                       a put's command line has been read but not its
+//	                       body
+//
+// For example, with dispatch soak -spawn driving the server:
+//
+//	dispatch -b /tmp/dsp -failpoints binlog-torn-write=0.001,binlog-fsync-delay=20ms
+//
+// Without the tag the hooks are constant and compile away, and
+// -failpoints is refused.
+
+var failpoints struct {
+	dropWrite, tornWrite, closeMidBody float64
+	fsyncDelay                         time.Duration
+}
+
+func failpointsSet(spec string) error {
+	if spec == "" {
+		return nil
+	}
+	for _, kv := range strings.Split(spec, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(kv), "=")
+		if !ok {
+			return fmt.Errorf("-failpoints: want name=value, got %q", kv)
+		}
+		var err error
+		switch name {
+		case "binlog-drop-write":
+			failpoints.dropWrite, err = failpointProb(value)
+		case "binlog-torn-write":
+			failpoints.tornWrite, err = failpointProb(value)
+		case "conn-close-mid-body":
+			failpoints.closeMidBody, err = failpointProb(value)
+		case "binlog-fsync-delay":
+			failpoints.fsyncDelay, err = time.ParseDuration(value)
+		default:
+			return fmt.Errorf("-failpoints: unknown failpoint %q", name)
+		}
+		if err != nil {
+			return fmt.Errorf("-failpoints: %s: bad value %q", name, value)
+		}
+	}
+	slog.Warn("fault injection is on", "failpoints", spec)
+	return nil
+}
+
+func failpointProb(s string) (float64, error) {
+	p, err := strconv.ParseFloat(s, 64)
+	if err != nil || p < 0 || p > 1 {
+		return 0, fmt.Errorf("bad probability")
+	}
+	return p, nil
+}
+
+func failpointHit(p float64) bool {
+	return p > 0 && rand.Float64() < p
+}
+
+func failDropWrite() bool    { return failpointHit(failpoints.dropWrite) }
+func failTornWrite() bool    { return failpointHit(failpoints.tornWrite) }
+func failCloseMidBody() bool { return failpointHit(failpoints.closeMidBody) }
+
+func failFsyncDelay() {
+	if failpoints.fsyncDelay > 0 {
+		time.Sleep(failpoints.fsyncDelay)
+	}
+}
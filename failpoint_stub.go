@@ -0,0 +1,17 @@
+//go:build !failpoint
+
+package dispatch
+
+import "errors"
+
+func failpointsSet(spec string) error {
+	if spec == "" {
+		return nil
+	}
+	return errors.New("fault injection is not compiled in; build with -tags failpoint")
+}
+
+func failDropWrite() bool    { return false }
+func failTornWrite() bool    { return false }
+func failCloseMidBody() bool { return false }
+func failFsyncDelay()        {}
@@ -0,0 +1,33 @@
+package dispatch
+
+// format is an extension that switches how a connection gets the bodies
+// of stats replies:
+//
+//	format <yaml|json>\r\n
+//
+// is answered FORMAT <name>. YAML, beanstalkd's format, is the default;
+// with json, stats and verify send the same dictionary as a JSON object
+// instead, in the same OK <bytes> framing.
+
+const (
+	cmdFormat = "format "
+	msgFormat = "FORMAT "
+)
+
+func doFormat(c *conn, name []byte) {
+	switch string(name) {
+	case "yaml":
+		c.statsJSON = false
+	case "json":
+		c.statsJSON = true
+	default:
+		replyMsg(c, msgBadFmt)
+		return
+	}
+	opCount[opFormat].Add(1)
+	b := newReply(c)
+	*b = append(*b, msgFormat...)
+	*b = append(*b, name...)
+	*b = append(*b, "\r\n"...)
+	replyBytes(c, b, connStateSendWord)
+}
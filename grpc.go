@@ -0,0 +1,405 @@
+//go:build grpc
+
+package dispatch
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/jkasarherou/dispatch/protocol"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// The gRPC API is the service in dispatch.proto, served on -grpc-addr
+// next to the text protocol and sharing its job table, storage and
+// authorization. Its messages are few and flat, so rather than carry
+// generated code they are encoded by hand with protowire, through a codec
+// forced on this server only. With -tls-cert the API is served over TLS
+// like the text protocol, and client certificates give identities.
+//
+// Reserve, Release and Bury answer Unimplemented: jobs are handed out only
+// through the SQS facade.
+
+const grpcCompiled = true
+
+func grpcServe(l net.Listener, tc *tls.Config) error {
+	opts := []grpc.ServerOption{grpc.ForceServerCodec(grpcCodec{})}
+	if tc != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tc)))
+	}
+	srv := grpc.NewServer(opts...)
+	srv.RegisterService(&grpcServiceDesc, nil)
+	return srv.Serve(l)
+}
+
+var grpcServiceDesc = grpc.ServiceDesc{
+	ServiceName: "dispatch.Dispatch",
+	HandlerType: (*interface{})(nil),
+	Methods: []grpc.MethodDesc{
+		{MethodName: "Put", Handler: grpcHandler(func() grpcMessage { return &grpcPutRequest{} }, grpcPut)},
+		{MethodName: "Delete", Handler: grpcHandler(func() grpcMessage { return &grpcID{} }, grpcDelete)},
+		{MethodName: "Release", Handler: grpcHandler(func() grpcMessage { return &grpcID{} }, grpcUnimplemented)},
+		{MethodName: "Bury", Handler: grpcHandler(func() grpcMessage { return &grpcID{} }, grpcUnimplemented)},
+		{MethodName: "Kick", Handler: grpcHandler(func() grpcMessage { return &grpcID{} }, grpcKick)},
+		{MethodName: "Stats", Handler: grpcHandler(func() grpcMessage { return &grpcEmpty{} }, grpcStats)},
+	},
+	Streams: []grpc.StreamDesc{
+		{StreamName: "Reserve", Handler: grpcReserve, ServerStreams: true},
+	},
+	Metadata: "dispatch.proto",
+}
+
+// grpcHandler adapts h to grpc, decoding its request into newReq().
+func grpcHandler(newReq func() grpcMessage, h func(context.Context, grpcMessage) (grpcMessage, error)) grpc.MethodHandler {
+	return func(_ interface{}, ctx context.Context, dec func(interface{}) error, _ grpc.UnaryServerInterceptor) (interface{}, error) {
+		req := newReq()
+		if err := dec(req); err != nil {
+			return nil, err
+		}
+		return h(ctx, req)
+	}
+}
+
+// grpcPeer returns the address of the caller in ctx and the identity its
+// client certificate gives.
+func grpcPeer(ctx context.Context) (remote, identity string) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return "", ""
+	}
+	if ti, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+		if certs := ti.State.PeerCertificates; len(certs) > 0 {
+			identity = certs[0].Subject.CommonName
+		}
+	}
+	return p.Addr.String(), identity
+}
+
+// grpcAuthorize checks op on tube for the caller in ctx.
+func grpcAuthorize(ctx context.Context, op, tube string) error {
+	r := &authzRequest{ctx: ctx, op: op, tube: tube}
+	r.remote, r.identity = grpcPeer(ctx)
+	if !authorizeReq(r) {
+		return status.Error(codes.PermissionDenied, "forbidden")
+	}
+	return nil
+}
+
+func grpcPut(ctx context.Context, m grpcMessage) (grpcMessage, error) {
+	req := m.(*grpcPutRequest)
+	if req.tube == "" {
+		req.tube = defaultTubeName
+	}
+	_, identity := grpcPeer(ctx)
+	req.tube = nsPrefix(identity) + req.tube
+	if !protocol.ValidTubeName(req.tube) {
+		return nil, status.Error(codes.InvalidArgument, "bad tube name")
+	}
+	sp := spanStart("dispatch.put")
+	defer spanEnd(sp)
+	spanString(sp, "dispatch.tube", req.tube)
+	spanInt(sp, "dispatch.body_size", int64(len(req.body)))
+
+	if err := grpcAuthorize(ctx, "put", req.tube); err != nil {
+		return nil, err
+	}
+	if draining.Load() {
+		return nil, status.Error(codes.Unavailable, "draining")
+	}
+	t := tubeFindOrMake(req.tube)
+	if uint64(len(req.body)) > t.maxJobSize.Load() {
+		return nil, status.Error(codes.InvalidArgument, "job too big")
+	}
+
+	// proto3 sends nothing for a field of 0, so 0 is a field left out.
+	var given putFields
+	if req.pri != 0 {
+		given |= putPri
+	}
+	if req.delay != 0 {
+		given |= putDelay
+	}
+	if req.ttr != 0 {
+		given |= putTTR
+	}
+	pri, delay, ttr, err := t.limits.Load().limit(req.pri, req.delay, req.ttr, given)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if !tubePutAdmit(ctx, t) {
+		return nil, status.Error(codes.ResourceExhausted, "rate limited")
+	}
+	j := makeJob(pri, delay, ttr, uint64(len(req.body))+2)
+	copy(j.body, req.body)
+	copy(j.body[len(req.body):], "\r\n")
+	j.tube = t
+	j.origin = originGRPC
+	if err := jobInsert(j, sp); err != nil {
+		bodyFree(j.body)
+		if err == errTubeFull {
+			return nil, status.Error(codes.ResourceExhausted, "tube full")
+		}
+		return nil, status.Error(codes.Internal, "internal error")
+	}
+	return &grpcID{id: j.id}, nil
+}
+
+// grpcJob finds a job for op, checking that the caller may perform op on
+// the job's tube. Jobs outside the caller's namespace are not found. The
+// caller must hold jobsMu.
+func grpcJob(ctx context.Context, op string, id uint64) (*job, error) {
+	_, identity := grpcPeer(ctx)
+	j := allJobs[id]
+	if j == nil || !strings.HasPrefix(j.tube.name, namespaces[identity]) {
+		return nil, status.Error(codes.NotFound, "not found")
+	}
+	if err := grpcAuthorize(ctx, op, j.tube.name); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+func grpcDelete(ctx context.Context, m grpcMessage) (grpcMessage, error) {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+
+	j, err := grpcJob(ctx, "delete", m.(*grpcID).id)
+	if err != nil {
+		return nil, err
+	}
+	if err := jobDelete(j); err != nil {
+		return nil, status.Error(codes.Internal, "internal error")
+	}
+	remote, identity := grpcPeer(ctx)
+	audit("delete", identity, remote, "job", j.id, "tube", j.tube.name)
+	return &grpcEmpty{}, nil
+}
+
+func grpcKick(ctx context.Context, m grpcMessage) (grpcMessage, error) {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+
+	j, err := grpcJob(ctx, "kick", m.(*grpcID).id)
+	if err != nil {
+		return nil, err
+	}
+	kicked, err := jobKick(j)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "internal error")
+	}
+	if kicked {
+		remote, identity := grpcPeer(ctx)
+		audit("kick", identity, remote, "job", j.id, "tube", j.tube.name)
+		return &grpcID{id: 1}, nil
+	}
+	return &grpcID{}, nil
+}
+
+func grpcStats(ctx context.Context, m grpcMessage) (grpcMessage, error) {
+	if err := grpcAuthorize(ctx, "stats", ""); err != nil {
+		return nil, err
+	}
+	stats := fmtStats
+	_, identity := grpcPeer(ctx)
+	if prefix := nsPrefix(identity); prefix != "" {
+		stats = func() statsDict { return nsStats(prefix) }
+	}
+	res := &grpcStatsResponse{stats: map[string]string{}}
+	for _, f := range stats() {
+		res.stats[f.key] = statsString(f.value)
+	}
+	return res, nil
+}
+
+func grpcUnimplemented(ctx context.Context, m grpcMessage) (grpcMessage, error) {
+	return nil, status.Error(codes.Unimplemented, "dispatch does not hand out jobs yet")
+}
+
+func grpcReserve(_ interface{}, stream grpc.ServerStream) error {
+	return status.Error(codes.Unimplemented, "dispatch does not hand out jobs yet")
+}
+
+// grpcMessage is a message of dispatch.proto.
+type grpcMessage interface {
+	marshal(b []byte) []byte
+	// unmarshal sets the fields found in b, which may hold fields the
+	// message does not know.
+	unmarshal(b []byte) error
+}
+
+type grpcCodec struct{}
+
+func (grpcCodec) Name() string { return "proto" }
+
+func (grpcCodec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(grpcMessage)
+	if !ok {
+		return nil, fmt.Errorf("grpc: cannot marshal %T", v)
+	}
+	return m.marshal(nil), nil
+}
+
+func (grpcCodec) Unmarshal(data []byte, v interface{}) error {
+	m, ok := v.(grpcMessage)
+	if !ok {
+		return fmt.Errorf("grpc: cannot unmarshal into %T", v)
+	}
+	return m.unmarshal(data)
+}
+
+// grpcDecode calls field with each varint and length-delimited field in b,
+// skipping fields of other types.
+func grpcDecode(b []byte, field func(num protowire.Number, v uint64, s []byte)) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		switch typ {
+		case protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			field(num, v, nil)
+			b = b[n:]
+		case protowire.BytesType:
+			s, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			field(num, 0, s)
+			b = b[n:]
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			b = b[n:]
+		}
+	}
+	return nil
+}
+
+type grpcEmpty struct{}
+
+func (*grpcEmpty) marshal(b []byte) []byte { return b }
+func (*grpcEmpty) unmarshal(b []byte) error {
+	return grpcDecode(b, func(protowire.Number, uint64, []byte) {})
+}
+
+// grpcID is any message whose first field is a uint64: PutResponse,
+// DeleteRequest, KickRequest and KickResponse. Release and Bury requests
+// are read as one too, as only their id is looked at.
+type grpcID struct {
+	id uint64
+}
+
+func (m *grpcID) marshal(b []byte) []byte {
+	if m.id != 0 {
+		b = protowire.AppendTag(b, 1, protowire.VarintType)
+		b = protowire.AppendVarint(b, m.id)
+	}
+	return b
+}
+
+func (m *grpcID) unmarshal(b []byte) error {
+	return grpcDecode(b, func(num protowire.Number, v uint64, s []byte) {
+		if num == 1 && s == nil {
+			m.id = v
+		}
+	})
+}
+
+type grpcPutRequest struct {
+	tube            string
+	pri, delay, ttr uint64
+	body            []byte
+}
+
+func (m *grpcPutRequest) marshal(b []byte) []byte {
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	b = protowire.AppendString(b, m.tube)
+	for i, v := range []uint64{m.pri, m.delay, m.ttr} {
+		b = protowire.AppendTag(b, protowire.Number(i+2), protowire.VarintType)
+		b = protowire.AppendVarint(b, v)
+	}
+	b = protowire.AppendTag(b, 5, protowire.BytesType)
+	return protowire.AppendBytes(b, m.body)
+}
+
+func (m *grpcPutRequest) unmarshal(b []byte) error {
+	return grpcDecode(b, func(num protowire.Number, v uint64, s []byte) {
+		switch num {
+		case 1:
+			m.tube = string(s)
+		case 2:
+			m.pri = uint64(uint32(v))
+		case 3:
+			m.delay = uint64(uint32(v))
+		case 4:
+			m.ttr = uint64(uint32(v))
+		case 5:
+			m.body = append([]byte(nil), s...)
+		}
+	})
+}
+
+type grpcStatsResponse struct {
+	stats map[string]string
+}
+
+func (m *grpcStatsResponse) marshal(b []byte) []byte {
+	keys := make([]string, 0, len(m.stats))
+	for k := range m.stats {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		var e []byte
+		e = protowire.AppendTag(e, 1, protowire.BytesType)
+		e = protowire.AppendString(e, k)
+		e = protowire.AppendTag(e, 2, protowire.BytesType)
+		e = protowire.AppendString(e, m.stats[k])
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, e)
+	}
+	return b
+}
+
+func (m *grpcStatsResponse) unmarshal(b []byte) error {
+	m.stats = map[string]string{}
+	var err error
+	decodeErr := grpcDecode(b, func(num protowire.Number, v uint64, s []byte) {
+		if num != 1 || s == nil {
+			return
+		}
+		var k, val string
+		if e := grpcDecode(s, func(num protowire.Number, v uint64, s []byte) {
+			switch num {
+			case 1:
+				k = string(s)
+			case 2:
+				val = string(s)
+			}
+		}); e != nil && err == nil {
+			err = e
+		}
+		m.stats[k] = val
+	})
+	if decodeErr != nil {
+		return decodeErr
+	}
+	return err
+}
@@ -0,0 +1,15 @@
+//go:build !grpc
+
+package dispatch
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+)
+
+const grpcCompiled = false
+
+func grpcServe(l net.Listener, tc *tls.Config) error {
+	return errors.New("the gRPC API is not compiled in; build with -tags grpc")
+}
@@ -0,0 +1,115 @@
+package dispatch
+
+import (
+	"sort"
+	"strings"
+)
+
+// put-headers is an extension that puts a job with a few key=value headers
+// kept beside its body, such as a trace id or a content type:
+//
+//	put-headers <key>=<value>[,<key>=<value>...] <pri> <delay> <ttr> <bytes>\r\n
+//	<data>\r\n
+//
+// Keys are letters, digits, '-', '_' and '.'; values are any printable
+// characters but space and ','. The reply is INSERTED <id> as for put.
+// The admin API shows a job's headers, and dump and restore keep them.
+// Like put-after's dependencies they are kept in the job's put record, so
+// binlog and bolt storage keep them across a restart and SQLite and Redis
+// storage do not.
+
+const (
+	cmdPutHeaders = "put-headers "
+
+	// headersMax caps the headers of a job, and headerMaxKey and
+	// headerMaxValue their lengths.
+	headersMax     = 8
+	headerMaxKey   = 32
+	headerMaxValue = 128
+)
+
+type jobHeader struct {
+	key, value string
+}
+
+// headersParse reads a comma-separated list of key=value headers.
+func headersParse(b []byte) ([]jobHeader, bool) {
+	var hs []jobHeader
+	for _, kv := range strings.Split(string(b), ",") {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok || !headerKeyOK(k) || !headerValueOK(v) || len(hs) == headersMax {
+			return nil, false
+		}
+		for _, h := range hs {
+			if h.key == k {
+				return nil, false
+			}
+		}
+		hs = append(hs, jobHeader{k, v})
+	}
+	return hs, true
+}
+
+func headerKeyOK(k string) bool {
+	if k == "" || len(k) > headerMaxKey {
+		return false
+	}
+	for i := 0; i < len(k); i++ {
+		c := k[i]
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+func headerValueOK(v string) bool {
+	if v == "" || len(v) > headerMaxValue {
+		return false
+	}
+	for i := 0; i < len(v); i++ {
+		if v[i] <= ' ' || v[i] >= 0x7f || v[i] == ',' {
+			return false
+		}
+	}
+	return true
+}
+
+// headersMap is hs as a map for JSON, or nil if there are none.
+func headersMap(hs []jobHeader) map[string]string {
+	if len(hs) == 0 {
+		return nil
+	}
+	m := make(map[string]string, len(hs))
+	for _, h := range hs {
+		m[h.key] = h.value
+	}
+	return m
+}
+
+// headersOfMap is the reverse of headersMap, in key order.
+func headersOfMap(m map[string]string) []jobHeader {
+	if len(m) == 0 {
+		return nil
+	}
+	hs := make([]jobHeader, 0, len(m))
+	for k, v := range m {
+		hs = append(hs, jobHeader{k, v})
+	}
+	sort.Slice(hs, func(i, k int) bool { return hs[i].key < hs[k].key })
+	return hs
+}
+
+// headersFormat is hs the way put-headers takes them.
+func headersFormat(hs []jobHeader) string {
+	var b strings.Builder
+	for i, h := range hs {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(h.key)
+		b.WriteByte('=')
+		b.WriteString(h.value)
+	}
+	return b.String()
+}
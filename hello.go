@@ -0,0 +1,39 @@
+package dispatch
+
+// hello is an extension through which a client names itself and learns
+// which extensions the server has, instead of trying commands to see:
+//
+//	hello <client> <version>\r\n
+//
+// is answered, like stats, with OK <bytes> and a dictionary giving the
+// server's name and version, whether the connection still has to auth,
+// and the extensions in helloExtensions. It is allowed before auth. The
+// client's name and version go into the access log.
+
+const cmdHello = "hello "
+
+// helloExtensions names the extensions a client can detect with hello.
+var helloExtensions = []string{
+	"mput",
+	"format-json",
+	"put-unique",
+	"put-after",
+	"put-headers",
+	"binary",
+	"verify",
+	"snapshot",
+	"shutdown",
+}
+
+func doHello(c *conn, client, clientVersion []byte) {
+	opCount[opHello].Add(1)
+	c.client = string(client) + "/" + string(clientVersion)
+	doStats(c, func() statsDict {
+		var d statsDict
+		d.add("server", "dispatch")
+		d.add("version", version)
+		d.add("auth-required", authRequired(c))
+		d.add("extensions", helloExtensions)
+		return d
+	})
+}
@@ -0,0 +1,103 @@
+package dispatch
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+)
+
+// -allow and -deny take comma-separated lists of addresses and CIDR
+// prefixes, such as 10.0.0.0/8,192.168.1.7. A TCP client whose address is
+// in -deny, or with -allow is not in it, is closed as soon as it is
+// accepted, before the TLS handshake or any command, and counted in the
+// denied-connections stat. -deny wins over -allow. Unix socket clients are
+// not filtered, nor are those of -admin-addr and -grpc-addr; those of
+// -resp-addr and -sqs-addr are. Both lists are reloaded on SIGHUP.
+
+type ipFilter struct {
+	allow, deny []netip.Prefix
+}
+
+// ipFilterActive is the filter the accept loops apply, nil for none.
+var ipFilterActive atomic.Pointer[ipFilter]
+
+var deniedConnCount atomic.Uint64
+
+// ipFilterParse makes the filter for the allow and deny lists, nil if both
+// are empty.
+func ipFilterParse(allow, deny []string) (*ipFilter, error) {
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil, nil
+	}
+	f := &ipFilter{}
+	var err error
+	if f.allow, err = ipParsePrefixes("-allow", allow); err != nil {
+		return nil, err
+	}
+	if f.deny, err = ipParsePrefixes("-deny", deny); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func ipParsePrefixes(name string, l []string) ([]netip.Prefix, error) {
+	var ps []netip.Prefix
+	for _, s := range l {
+		s = strings.TrimSpace(s)
+		if strings.Contains(s, "/") {
+			p, err := netip.ParsePrefix(s)
+			if err != nil {
+				return nil, fmt.Errorf("%s: bad prefix %q", name, s)
+			}
+			ps = append(ps, p.Masked())
+			continue
+		}
+		a, err := netip.ParseAddr(s)
+		if err != nil {
+			return nil, fmt.Errorf("%s: bad address %q", name, s)
+		}
+		a = a.Unmap()
+		ps = append(ps, netip.PrefixFrom(a, a.BitLen()))
+	}
+	return ps, nil
+}
+
+// ipSplit splits a comma-separated flag value.
+func ipSplit(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+// admit reports whether f lets a client from addr in.
+func (f *ipFilter) admit(addr net.Addr) bool {
+	if f == nil {
+		return true
+	}
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return true
+	}
+	ip, ok := netip.AddrFromSlice(tcp.IP)
+	if !ok {
+		return false
+	}
+	ip = ip.Unmap()
+	for _, p := range f.deny {
+		if p.Contains(ip) {
+			return false
+		}
+	}
+	if len(f.allow) == 0 {
+		return true
+	}
+	for _, p := range f.allow {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,102 @@
+//go:build kafka
+
+package dispatch
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+const (
+	// kafkaBatchSize is the most events sent in one request.
+	kafkaBatchSize = 500
+
+	// kafkaFlushTimeout bounds how long stopping waits for the events
+	// still queued to be sent.
+	kafkaFlushTimeout = 5 * time.Second
+)
+
+// kafkaStart starts publishing the events described in events.go. The
+// returned function stops it, sending what is queued first.
+func kafkaStart() (func(), error) {
+	var addrs []string
+	for _, a := range strings.Split(kafkaBrokers, ",") {
+		if a = strings.TrimSpace(a); a != "" {
+			addrs = append(addrs, a)
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, errors.New("-kafka-brokers names no broker")
+	}
+	w := &kafka.Writer{
+		Addr:         kafka.TCP(addrs...),
+		Topic:        kafkaTopic,
+		Balancer:     &kafka.Hash{},
+		BatchSize:    kafkaBatchSize,
+		BatchTimeout: 50 * time.Millisecond,
+		RequiredAcks: kafka.RequireOne,
+	}
+	q := make(chan *jobEvent, eventQueueSize)
+	jobsMu.Lock()
+	eventQueue = q
+	jobsMu.Unlock()
+	slog.Info("publishing job events", "brokers", addrs, "topic", kafkaTopic)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		kafkaRun(ctx, w, q)
+	}()
+	return func() {
+		jobsMu.Lock()
+		eventQueue = nil
+		jobsMu.Unlock()
+		close(q)
+		select {
+		case <-done:
+		case <-time.After(kafkaFlushTimeout):
+			slog.Warn("job events not all sent", "queued", len(q))
+		}
+		cancel()
+		w.Close()
+	}, nil
+}
+
+// kafkaRun sends the events from q in batches until q is closed. A batch
+// Kafka refuses is dropped, so that a broker outage does not hold up the
+// events after it for longer than the writer's own retries.
+func kafkaRun(ctx context.Context, w *kafka.Writer, q chan *jobEvent) {
+	batch := make([]kafka.Message, 0, kafkaBatchSize)
+	for e := range q {
+		batch = append(batch[:0], kafkaMessage(e))
+	fill:
+		for len(batch) < kafkaBatchSize {
+			select {
+			case e, ok := <-q:
+				if !ok {
+					break fill
+				}
+				batch = append(batch, kafkaMessage(e))
+			default:
+				break fill
+			}
+		}
+		if err := w.WriteMessages(ctx, batch...); err != nil {
+			eventErrorCount.Add(1)
+			eventDroppedCount.Add(uint64(len(batch)))
+			slog.Warn("job events not published", "count", len(batch), "err", err)
+			continue
+		}
+		eventSentCount.Add(uint64(len(batch)))
+	}
+}
+
+func kafkaMessage(e *jobEvent) kafka.Message {
+	return kafka.Message{Key: []byte(e.Tube), Value: eventValue(e), Time: e.Time}
+}
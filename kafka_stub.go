@@ -0,0 +1,9 @@
+//go:build !kafka
+
+package dispatch
+
+import "errors"
+
+func kafkaStart() (func(), error) {
+	return nil, errors.New("Kafka event publishing is not compiled in; build with -tags kafka")
+}
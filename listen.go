@@ -0,0 +1,468 @@
+package dispatch
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Listener tuning, set from flags in main.
+var (
+	acceptWorkers = 1
+	listenBacklog int
+	deferAccept   time.Duration
+	maxConns      int
+	socketMode    = "0660"
+	eventLoop     bool
+
+	reusePort         bool
+	tcpNoDelay        = true
+	tcpKeepAlive      = true
+	tcpKeepAliveIdle  time.Duration
+	tcpKeepAliveIntvl time.Duration
+	tcpKeepAliveCount int
+
+	tlsCert     string
+	tlsKey      string
+	tlsClientCA string
+
+	// tlsReloadInterval is how often the TLS files are checked for
+	// changes, 0 for never.
+	tlsReloadInterval = time.Minute
+
+	// grpcAddr is where the gRPC API listens, if anywhere.
+	grpcAddr string
+)
+
+// tlsHandshakeTimeout bounds how long a client may take to present its
+// certificate.
+const tlsHandshakeTimeout = 10 * time.Second
+
+// unixPrefix marks a -l address as the path of a Unix domain socket.
+const unixPrefix = "unix://"
+
+var (
+	acceptErrorCount atomic.Uint64
+	refusedConnCount atomic.Uint64
+
+	// serving is set while the accept loops run.
+	serving atomic.Bool
+
+	tlsHandshakeErrorCount atomic.Uint64
+	tlsReloadCount         atomic.Uint64
+	// authConnCount counts open connections that have an identity.
+	authConnCount atomic.Int64
+)
+
+const maxAcceptBackoff = time.Second
+
+// listenConfig holds the options common to every platform's listenTCP.
+// Zero keepalive settings leave the system defaults.
+func listenConfig() net.ListenConfig {
+	ka := net.KeepAliveConfig{
+		Enable:   tcpKeepAlive,
+		Idle:     tcpKeepAliveIdle,
+		Interval: tcpKeepAliveIntvl,
+		Count:    tcpKeepAliveCount,
+	}
+	if !tcpKeepAlive {
+		ka = net.KeepAliveConfig{Idle: -1, Interval: -1, Count: -1}
+	}
+	return net.ListenConfig{KeepAliveConfig: ka}
+}
+
+// tuneConn applies the per-connection socket options that cannot be set
+// on the listener.
+func tuneConn(c net.Conn) {
+	if tc, ok := c.(*tls.Conn); ok {
+		c = tc.NetConn()
+	}
+	if tc, ok := c.(*net.TCPConn); ok && !tcpNoDelay {
+		tc.SetNoDelay(false)
+	}
+}
+
+// listenUnix listens on a Unix domain socket at path with the permission
+// bits in socketMode. A socket left behind by a server that is no longer
+// running is replaced.
+func listenUnix(path string) (net.Listener, error) {
+	mode, err := strconv.ParseUint(socketMode, 8, 32)
+	if err != nil {
+		return nil, fmt.Errorf("bad socket mode %q", socketMode)
+	}
+
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if c, err := net.Dial("unix", path); err == nil {
+			c.Close()
+			return nil, fmt.Errorf("%s is in use by another server", path)
+		}
+		os.Remove(path)
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, os.FileMode(mode)); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// listenFdsStart is the first file descriptor systemd passes to a
+// socket-activated service.
+const listenFdsStart = 3
+
+// activationListeners returns the sockets passed in by systemd socket
+// activation or by a restart, or none if there are none. Sockets named
+// "admin" or "grpc" in LISTEN_FDNAMES are returned in named, the rest in
+// ls. The environment variables are cleared so that children do not
+// inherit them.
+func activationListeners() (ls []net.Listener, named map[string]net.Listener, err error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+	defer os.Unsetenv(restartFdsEnv)
+
+	var n int
+	if s := os.Getenv(restartFdsEnv); s != "" {
+		n, err = strconv.Atoi(s)
+		if err != nil {
+			return nil, nil, fmt.Errorf("bad %s %q", restartFdsEnv, s)
+		}
+		restarted = true
+	} else {
+		pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+		if err != nil || pid != os.Getpid() {
+			return nil, nil, nil
+		}
+		n, err = strconv.Atoi(os.Getenv("LISTEN_FDS"))
+		if err != nil || n < 1 {
+			return nil, nil, nil
+		}
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	named = map[string]net.Listener{}
+	for i := 0; i < n; i++ {
+		fd := listenFdsStart + i
+		f := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, l := range ls {
+				l.Close()
+			}
+			for _, l := range named {
+				l.Close()
+			}
+			return nil, nil, fmt.Errorf("inherited fd %d: %v", fd, err)
+		}
+		name := ""
+		if i < len(names) {
+			name = names[i]
+		}
+		switch name {
+		case listenNameAdmin, listenNameGRPC, listenNameSQS, listenNameRESP:
+			named[name] = l
+		default:
+			ls = append(ls, l)
+		}
+	}
+	return ls, named, nil
+}
+
+// tlsConfig loads the -tls-cert and -tls-key pair, or returns nil if TLS is
+// not configured. With -tls-client-ca, clients must present a certificate
+// signed by one of the CAs in that file.
+func tlsConfig() (*tls.Config, error) {
+	return tlsLoad(tlsCert, tlsKey, tlsClientCA)
+}
+
+func tlsLoad(certFile, keyFile, caFile string) (*tls.Config, error) {
+	if certFile == "" && keyFile == "" {
+		if caFile != "" {
+			return nil, errors.New("-tls-client-ca needs -tls-cert and -tls-key")
+		}
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("-tls-cert and -tls-key must be given together")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	tc := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", caFile)
+		}
+		tc.ClientCAs = pool
+		tc.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tc, nil
+}
+
+// tlsActive is the TLS config new connections get. It is replaced when the
+// config is reloaded or the TLS files change; connections already made keep
+// theirs.
+var tlsActive atomic.Pointer[tls.Config]
+
+// tlsMu guards tlsCert, tlsKey and tlsClientCA once the server runs.
+var tlsMu sync.Mutex
+
+// tlsReload loads the TLS files again and makes them the active config.
+// It does nothing if TLS is off.
+func tlsReload() error {
+	if tlsActive.Load() == nil {
+		return nil
+	}
+	tlsMu.Lock()
+	tc, err := tlsLoad(tlsCert, tlsKey, tlsClientCA)
+	tlsMu.Unlock()
+	if err != nil {
+		return err
+	}
+	tlsActive.Store(tc)
+	tlsReloadCount.Add(1)
+	return nil
+}
+
+// tlsWatch reloads the TLS files every interval in which one of them
+// changed, so that certificates can be rotated without a restart. A pair
+// caught half written fails to load and is logged; the old certificate is
+// kept until the files change again.
+func tlsWatch(interval time.Duration) {
+	stamp := tlsStamp()
+	for range time.Tick(interval) {
+		s := tlsStamp()
+		if s == stamp {
+			continue
+		}
+		stamp = s
+		if err := tlsReload(); err != nil {
+			slog.Error("TLS reload failed, keeping the old certificate", "err", err)
+			continue
+		}
+		slog.Info("TLS certificate reloaded")
+	}
+}
+
+// tlsStamp describes the TLS files by their modification times and sizes.
+func tlsStamp() string {
+	tlsMu.Lock()
+	files := []string{tlsCert, tlsKey, tlsClientCA}
+	tlsMu.Unlock()
+	var b strings.Builder
+	for _, name := range files {
+		if fi, err := os.Stat(name); err == nil {
+			fmt.Fprintf(&b, "%s %d %d\n", name, fi.ModTime().UnixNano(), fi.Size())
+		} else {
+			fmt.Fprintf(&b, "%s -\n", name)
+		}
+	}
+	return b.String()
+}
+
+// tlsServerConfig makes tc the active config and returns the one to serve
+// with, which hands each new connection whatever config is active.
+func tlsServerConfig(tc *tls.Config) *tls.Config {
+	tlsActive.Store(tc)
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return tlsActive.Load(), nil
+		},
+	}
+}
+
+// connHandshake completes a TLS handshake and takes the identity of the
+// connection from the client certificate's common name. Plain connections
+// are left alone.
+func connHandshake(c *conn) error {
+	tc, ok := c.conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	tc.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	if err := tc.Handshake(); err != nil {
+		return err
+	}
+	tc.SetDeadline(time.Time{})
+
+	if certs := tc.ConnectionState().PeerCertificates; len(certs) > 0 {
+		c.identity = certs[0].Subject.CommonName
+	}
+	return nil
+}
+
+// listenerOrigin tells TCP and Unix socket listeners apart.
+func listenerOrigin(l net.Listener) origin {
+	if l.Addr().Network() == "unix" {
+		return originUnix
+	}
+	return originText
+}
+
+// serve runs acceptWorkers accept loops on l and returns once l is closed.
+// Connections and the jobs put through them are counted under o, and
+// their contexts are ctx's.
+func serve(ctx context.Context, l net.Listener, o origin) {
+	n := acceptWorkers
+	if n < 1 {
+		n = 1
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			acceptLoop(ctx, l, o)
+		}()
+	}
+	wg.Wait()
+}
+
+func acceptLoop(ctx context.Context, l net.Listener, o origin) {
+	acceptConns(ctx, l, func(conn net.Conn) {
+		c := makeConn(ctx, conn, connStateWantCommand, o)
+		go handleConn(c)
+	})
+}
+
+// acceptConns accepts connections on l until it is closed, and passes
+// those that -allow, -deny and -max-conns admit to handle, counted by
+// connAdmit.
+func acceptConns(ctx context.Context, l net.Listener, handle func(net.Conn)) {
+	var backoff time.Duration
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			acceptErrorCount.Add(1)
+			slog.Warn("failed to accept", "err", err)
+
+			// Errors such as EMFILE persist until some connections go
+			// away; don't spin on them.
+			if backoff == 0 {
+				backoff = 5 * time.Millisecond
+			} else if backoff *= 2; backoff > maxAcceptBackoff {
+				backoff = maxAcceptBackoff
+			}
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+		backoff = 0
+		if !acceptFiltered(conn) {
+			continue
+		}
+		tuneConn(conn)
+
+		if !connAdmit() {
+			refusedConnCount.Add(1)
+			conn.Close()
+			continue
+		}
+		handle(conn)
+	}
+}
+
+// acceptFiltered applies -allow and -deny to a connection just accepted,
+// closing it if it is refused.
+func acceptFiltered(conn net.Conn) bool {
+	if !ipFilterActive.Load().admit(conn.RemoteAddr()) {
+		deniedConnCount.Add(1)
+		conn.Close()
+		return false
+	}
+	return true
+}
+
+// filteredListener applies -allow and -deny to the connections accepted
+// by listeners served with net/http.
+type filteredListener struct {
+	net.Listener
+}
+
+func (l filteredListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil || acceptFiltered(conn) {
+			return conn, err
+		}
+	}
+}
+
+// conns holds the connections being handled, so that they can be wound
+// down when the server stops.
+var (
+	connsMu sync.Mutex
+	conns   = map[*conn]struct{}{}
+)
+
+// connsDrain makes every connection close once it has handled the commands
+// it has already read, and waits up to timeout for them to go. RESP
+// clients, which are counted but not in conns, close themselves once the
+// server's context is done.
+func connsDrain(timeout time.Duration) {
+	connsMu.Lock()
+	for c := range conns {
+		c.conn.SetReadDeadline(time.Now())
+	}
+	connsMu.Unlock()
+	evloopWake()
+	n := curConnCount.Load()
+	if n == 0 {
+		return
+	}
+
+	slog.Info("closing connections", "count", n)
+	deadline := time.Now().Add(timeout)
+	for curConnCount.Load() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// connLimit is maxConns, kept apart from the flag so that reloading the
+// config can change it while connections are being accepted.
+var connLimit atomic.Int64
+
+// connAdmit counts a new connection, unless that would exceed connLimit.
+func connAdmit() bool {
+	for {
+		n := curConnCount.Load()
+		if limit := connLimit.Load(); limit > 0 && n >= limit {
+			return false
+		}
+		if curConnCount.CompareAndSwap(n, n+1) {
+			return true
+		}
+	}
+}
@@ -0,0 +1,64 @@
+//go:build linux
+
+package dispatch
+
+import (
+	"context"
+	"net"
+	"syscall"
+)
+
+func listenTCP(addr string) (net.Listener, error) {
+	lc := listenConfig()
+	lc.Control = func(network, address string, rc syscall.RawConn) error {
+		var serr error
+		err := rc.Control(func(fd uintptr) {
+			if reusePort {
+				// Several processes can bind the same port and the
+				// kernel spreads connections across them.
+				serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+				if serr != nil {
+					return
+				}
+			}
+			if deferAccept > 0 {
+				secs := int(deferAccept.Seconds())
+				if secs < 1 {
+					secs = 1
+				}
+				serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_DEFER_ACCEPT, secs)
+			}
+		})
+		if err != nil {
+			return err
+		}
+		return serr
+	}
+
+	l, err := lc.Listen(context.Background(), "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if listenBacklog > 0 {
+		// The runtime listens with the system maximum; calling listen
+		// again on the bound socket replaces the backlog.
+		rc, err := l.(*net.TCPListener).SyscallConn()
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+		var serr error
+		err = rc.Control(func(fd uintptr) {
+			serr = syscall.Listen(int(fd), listenBacklog)
+		})
+		if err == nil {
+			err = serr
+		}
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	return l, nil
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+
+package dispatch
+
+import (
+	"context"
+	"log/slog"
+	"net"
+)
+
+// listenTCP ignores the backlog, deferred-accept and SO_REUSEPORT options,
+// which are only implemented on Linux.
+func listenTCP(addr string) (net.Listener, error) {
+	if listenBacklog > 0 || deferAccept > 0 || reusePort {
+		slog.Warn("ignoring -backlog, -defer-accept and -reuseport on this platform")
+	}
+	lc := listenConfig()
+	return lc.Listen(context.Background(), "tcp", addr)
+}
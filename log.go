@@ -0,0 +1,133 @@
+package dispatch
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Logging settings, set from flags in main.
+var (
+	logLevel  = "info"
+	logOutput = "stderr"
+	logFormat = "text"
+	// logBodies puts job bodies in the debug log. They are left out by
+	// default since they often hold data that should not end up in logs.
+	logBodies bool
+
+	// logLevelVar is the level in effect, which can change when the
+	// config is reloaded.
+	logLevelVar slog.LevelVar
+
+	// slowCmd is the handling time, including reading a put's body, past
+	// which a command is logged as slow. Zero turns the check off.
+	slowCmd time.Duration
+)
+
+func logParseLevel(s string) (slog.Level, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(s)); err != nil {
+		return 0, fmt.Errorf("bad log level %q", s)
+	}
+	return l, nil
+}
+
+// logCheck reports logging settings that logSetup would reject.
+func logCheck() error {
+	if _, err := logParseLevel(logLevel); err != nil {
+		return err
+	}
+	if logFormat != "text" && logFormat != "json" {
+		return fmt.Errorf("bad log format %q", logFormat)
+	}
+	return nil
+}
+
+// logSetup installs the default logger. The returned file, if any, is the
+// log file and should be closed on exit.
+func logSetup() (*os.File, error) {
+	if err := logCheck(); err != nil {
+		return nil, err
+	}
+	level, _ := logParseLevel(logLevel)
+
+	var (
+		w io.Writer
+		f *os.File
+	)
+	switch logOutput {
+	case "stderr":
+		w = os.Stderr
+	case "stdout":
+		w = os.Stdout
+	default:
+		var err error
+		f, err = os.OpenFile(logOutput, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o640)
+		if err != nil {
+			return nil, err
+		}
+		w = f
+	}
+
+	logLevelVar.Set(level)
+	opts := &slog.HandlerOptions{Level: &logLevelVar}
+	var h slog.Handler
+	if logFormat == "json" {
+		h = slog.NewJSONHandler(w, opts)
+	} else {
+		h = slog.NewTextHandler(w, opts)
+	}
+	slog.SetDefault(slog.New(h))
+	return f, nil
+}
+
+// logDebug reports whether debug messages are logged, so that the per
+// command ones can skip formatting their attributes.
+func logDebug() bool {
+	return slog.Default().Enabled(context.Background(), slog.LevelDebug)
+}
+
+// logBody is the attribute for a job body: the body itself with
+// -log-bodies, otherwise just its size.
+func logBody(b []byte) slog.Attr {
+	if logBodies {
+		return slog.String("body", string(b))
+	}
+	return slog.String("body", "<"+strconv.Itoa(len(b))+" bytes>")
+}
+
+// logReplyLine trims a reply to its first line, so that stats output and
+// job bodies sent back to clients stay out of the log.
+func logReplyLine(b []byte) string {
+	if i := bytes.IndexByte(b, '\n'); i >= 0 {
+		b = b[:i]
+	}
+	return string(bytes.TrimSuffix(b, []byte("\r")))
+}
+
+// logSlowCmd warns about the command c has just handled if it took longer
+// than slowCmd since start.
+func logSlowCmd(c *conn, start time.Time) {
+	took := time.Since(start)
+	if took < slowCmd {
+		return
+	}
+	attrs := []any{
+		"conn", c.id,
+		"remote", c.conn.RemoteAddr().String(),
+		"identity", c.identity,
+		"cmd", strings.TrimSpace(opNames[whichCmd(c.cmd)]),
+		"tube", c.use.name,
+	}
+	if op, fields := whichCmd(c.cmd), bytes.Fields(c.cmd); op == opPut && len(fields) == 5 || (op == opPutUnique || op == opPutAfter || op == opPutHeaders) && len(fields) == 6 {
+		attrs = append(attrs, "bytes", string(fields[len(fields)-1]))
+	}
+	attrs = append(attrs, "took", took)
+	slog.Warn("slow command", attrs...)
+}
@@ -1,22 +1,56 @@
-package main
+package dispatch
 
 import (
 	"bufio"
 	"bytes"
+	"container/heap"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"flag"
 	"fmt"
+	"log/slog"
 	"net"
 	"os"
+	"os/user"
+	"runtime"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jkasarherou/dispatch/protocol"
 )
 
 const (
-	msgInsertedFmt = "INSERTED %d\r\n"
-	msgBadFmt      = "BAD_FORMAT\r\n"
+	msgInserted = protocol.Inserted + " "
+	msgOK       = protocol.OK + " "
+	msgUsing    = protocol.Using + " "
+	msgBadFmt   = protocol.BadFormat + "\r\n"
 
-	msgUnknownCommand = "UNKNOWN_COMMAND\r\n"
-	msgExpectedCRLF   = "EXPECTED_CRLF\r\n"
+	msgUnknownCommand = protocol.UnknownCommand + "\r\n"
+	msgExpectedCRLF   = protocol.ExpectedCRLF + "\r\n"
+	msgInternalError  = protocol.InternalError + "\r\n"
+	msgNoBinlog       = protocol.NoBinlog + "\r\n"
+	msgForbidden      = protocol.Forbidden + "\r\n"
+	msgJobTooBig      = protocol.JobTooBig + "\r\n"
+	msgDraining       = protocol.Draining + "\r\n"
+	msgTubeFull       = protocol.TubeFull + "\r\n"
+	msgDelayTooLong   = protocol.DelayTooLong + "\r\n"
+	msgRateLimited    = protocol.RateLimited + "\r\n"
 )
 
+const defaultTubeName = "default"
+
+// jobSizeMax caps -z and the tubes' max-job-size, as beanstalkd caps -z,
+// so that a binlog record has a size it cannot be over whatever the
+// settings it was written with.
+const jobSizeMax = 1 << 30
+
 type opType int
 
 const (
@@ -24,33 +58,153 @@ const (
 	opStats
 	opUse
 	opQuit
+	opVerify
+	opSnapshot
+	opAuth
+	opMput
+	opFormat
+	opPutUnique
+	opPutAfter
+	opPutHeaders
+	opHello
+	opShutdown
 	opUnknown
 )
 
 var (
-	cmdUse    = "use "
-	cmdUseLen = len(cmdUse)
-	cmdPut    = "put "
-	cmdStats  = "stats"
-	cmdQuit   = "quit"
+	cmdUse      = "use "
+	cmdUseLen   = len(cmdUse)
+	cmdPut      = "put "
+	cmdStats    = "stats"
+	cmdQuit     = "quit"
+	cmdVerify   = "verify"
+	cmdSnapshot = "snapshot"
+	cmdAuth     = "auth "
 
 	opNames = map[opType]string{
-		opPut:     cmdPut,
-		opStats:   cmdStats,
-		opUse:     cmdUse,
-		opQuit:    cmdQuit,
-		opUnknown: "<unknown>",
+		opPut:        cmdPut,
+		opStats:      cmdStats,
+		opUse:        cmdUse,
+		opQuit:       cmdQuit,
+		opVerify:     cmdVerify,
+		opSnapshot:   cmdSnapshot,
+		opAuth:       cmdAuth,
+		opMput:       cmdMput,
+		opFormat:     cmdFormat,
+		opPutUnique:  cmdPutUnique,
+		opPutAfter:   cmdPutAfter,
+		opPutHeaders: cmdPutHeaders,
+		opHello:      cmdHello,
+		opShutdown:   cmdShutdown,
+		opUnknown:    "<unknown>",
 	}
 
-	opCount = map[opType]uint64{}
+	// opCount counts the commands handled, by type.
+	opCount [opUnknown + 1]atomic.Uint64
+
+	curConnCount atomic.Int64
+	nextConnID   atomic.Uint64
 
-	curConnCount = 0
+	totalConnCount atomic.Uint64
+	// producerCount counts open connections that have put a job.
+	producerCount atomic.Int64
+
+	// draining is set to refuse new jobs while the server is emptied.
+	draining atomic.Bool
+
+	startTime   = time.Now()
+	serverID    = newServerID()
+	hostname, _ = os.Hostname()
 
 	readyCount = 0
 
+	delayedCount uint
+
+	// heldCount counts put-after jobs waiting for others.
+	heldCount int
+
 	globalStat = stats{}
+
+	binlogDir string
+
+	// maxJobSize is the default limit on job bodies; tubes can have their
+	// own in the config file. Neither may be above jobSizeMax.
+	maxJobSize uint64 = 65535
+
+	// tubeMaxJobs and tubeMaxBytes are the default tube quotas, 0 for
+	// none; tubes can have their own in the config file.
+	tubeMaxJobs  int
+	tubeMaxBytes uint64
+
+	// tubeFullCount counts puts refused by a tube quota.
+	tubeFullCount atomic.Uint64
+
+	// jobTTL is how long a job may wait before it expires, 0 for ever;
+	// tubes can have their own in the config file.
+	jobTTL time.Duration
+
+	// expiredCount counts jobs deleted by expiry.
+	expiredCount atomic.Uint64
+
+	// tubeIdleTTL is how long an empty, unused tube is kept, 0 for ever.
+	tubeIdleTTL time.Duration
+
+	// tubeDeletedCount counts tubes deleted for being idle.
+	tubeDeletedCount atomic.Uint64
+
+	// binaryConnCount counts connections that chose the binary framing.
+	binaryConnCount atomic.Uint64
+
+	// compressedJobCount counts bodies compressed, and compressSavedBytes
+	// the bytes that saved.
+	compressedJobCount atomic.Uint64
+	compressSavedBytes atomic.Uint64
+
+	// mirrorSentCount, mirrorDroppedCount and mirrorErrorCount count the
+	// copies of jobs sent to mirrors, those dropped, and failures to
+	// reach a mirror.
+	mirrorSentCount    atomic.Uint64
+	mirrorDroppedCount atomic.Uint64
+	mirrorErrorCount   atomic.Uint64
+
+	// eventSentCount, eventDroppedCount and eventErrorCount count the job
+	// events published, those dropped, and failures to publish them.
+	eventSentCount    atomic.Uint64
+	eventDroppedCount atomic.Uint64
+	eventErrorCount   atomic.Uint64
+
+	// natsPublishedCount and natsDroppedCount count the jobs published to
+	// NATS and those dropped, and natsErrorCount the NATS messages not
+	// put and the jobs NATS refused.
+	natsPublishedCount atomic.Uint64
+	natsDroppedCount   atomic.Uint64
+	natsErrorCount     atomic.Uint64
+
+	// dedupWindow is how long a put-unique key is remembered; tubes can
+	// have their own in the config file.
+	dedupWindow = 5 * time.Minute
+
+	// dedupCount counts put-unique commands that found their key.
+	dedupCount atomic.Uint64
+
+	// scheduleFireCount and scheduleMissCount count the ticks of schedules
+	// that put a job, and that did not.
+	scheduleFireCount atomic.Uint64
+	scheduleMissCount atomic.Uint64
 )
 
+// version is set at build time with -ldflags
+// "-X github.com/jkasarherou/dispatch.version=...".
+var version = "devel"
+
+// newServerID makes the random id stats reports, telling apart servers
+// that share a hostname.
+func newServerID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
 type stats struct {
 	urgentCount    uint
 	waitingCount   uint
@@ -58,75 +212,669 @@ type stats struct {
 	reservedCount  uint
 	pauseCount     uint
 	totalJobsCount uint64
+	// timeoutCount counts reservations that lapsed before the job was
+	// deleted or released.
+	timeoutCount uint64
 }
 
-func main() {
-	hostPort := ":3333"
-	l, err := net.Listen("tcp", hostPort)
+// Main runs the dispatch command, the server or one of its subcommands, as
+// os.Args asks, and does not return if that fails.
+func Main() {
+	if len(os.Args) > 1 && os.Args[1] == "soak" {
+		os.Exit(soakMain(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "sim" {
+		os.Exit(simMain(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "bench" {
+		os.Exit(benchMain(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "conformance" {
+		os.Exit(conformanceMain(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "fsck" {
+		os.Exit(fsckMain(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		os.Exit(replayMain(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "dump" {
+		os.Exit(dumpMain(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "restore" {
+		os.Exit(restoreMain(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "put" {
+		os.Exit(cliPutMain(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "stats" {
+		os.Exit(cliStatsMain(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "proxy" {
+		os.Exit(proxyMain(os.Args[2:]))
+	}
+
+	cfg := DefaultConfig()
+	listenAddr := flag.String("l", "", "listen on `addr` (default all interfaces), or on a Unix socket given as unix:///path")
+	flag.StringVar(&socketMode, "socket-mode", socketMode, "permission bits, in octal, for a Unix socket given to -l")
+	listenPort := flag.String("p", "3333", "listen on `port`")
+	flag.StringVar(&tlsCert, "tls-cert", "", "serve TCP clients over TLS with the certificate in this `file`")
+	flag.StringVar(&tlsKey, "tls-key", "", "private key `file` for -tls-cert")
+	flag.StringVar(&tlsClientCA, "tls-client-ca", "", "require TLS clients to present a certificate signed by a CA in this `file`")
+	flag.DurationVar(&tlsReloadInterval, "tls-reload-interval", tlsReloadInterval, "check the TLS files for changes this often and reload them, 0 for never")
+	userName := flag.String("u", "", "become `user` and its group after binding the port")
+	flag.StringVar(&binlogDir, "b", "", "write-ahead log directory (same as -storage=binlog -path=dir)")
+	flag.StringVar(&cfg.Storage, "storage", cfg.Storage, "persistence backend: binlog, bolt, sqlite, or redis")
+	flag.StringVar(&cfg.StoragePath, "path", "", "binlog directory, database file, or redis address for -storage")
+	syncMs := flag.Int("f", int(cfg.FsyncInterval/time.Millisecond), "fsync the binlog at most every `ms` milliseconds (0 to fsync every write)")
+	flag.BoolVar(&cfg.NoFsync, "F", false, "never fsync the binlog")
+	flag.Int64Var(&cfg.BinlogMaxSize, "s", cfg.BinlogMaxSize, "start a new binlog file after this many `bytes`")
+	flag.StringVar(&cfg.BinlogKey, "binlog-key", "", "encrypt the binlog with the key in this `file`, or printed by exec:<command>")
+	flag.BoolVar(&eventLoop, "event-loop", false, "wait for idle connections' input with epoll rather than a goroutine each (Linux)")
+	flag.IntVar(&acceptWorkers, "accept-workers", acceptWorkers, "number of goroutines accepting connections")
+	flag.IntVar(&listenBacklog, "backlog", 0, "listen backlog (0 for the system default)")
+	flag.DurationVar(&deferAccept, "defer-accept", 0, "wake the accept loop only once a client has sent data, waiting at most this long (Linux)")
+	flag.BoolVar(&reusePort, "reuseport", false, "set SO_REUSEPORT so several servers can share the port (Linux)")
+	flag.BoolVar(&tcpNoDelay, "tcp-nodelay", tcpNoDelay, "set TCP_NODELAY on client connections")
+	flag.BoolVar(&tcpKeepAlive, "keepalive", tcpKeepAlive, "send TCP keepalives on client connections")
+	flag.DurationVar(&tcpKeepAliveIdle, "keepalive-idle", 0, "idle time before the first keepalive (0 for the system default)")
+	flag.DurationVar(&tcpKeepAliveIntvl, "keepalive-interval", 0, "time between keepalives (0 for the system default)")
+	flag.IntVar(&tcpKeepAliveCount, "keepalive-count", 0, "unanswered keepalives before the connection is dropped (0 for the system default)")
+	flag.IntVar(&cfg.MaxConns, "max-conns", 0, "refuse connections beyond this many (0 for no limit)")
+	flag.IntVar(&cfg.RateCommands, "rate-cmds", 0, "delay each client to at most this many commands per second (0 for no limit)")
+	flag.IntVar(&cfg.RateBytes, "rate-bytes", 0, "delay each client to sending at most this many bytes per second (0 for no limit)")
+	allow := flag.String("allow", "", "accept TCP clients only from these comma-separated `addresses` and CIDR prefixes")
+	deny := flag.String("deny", "", "turn away TCP clients from these comma-separated `addresses` and CIDR prefixes")
+	tracePath := flag.String("trace-ops", "", "record every state change to this `file` for dispatch replay")
+	flag.Uint64Var(&cfg.MaxJobSize, "z", cfg.MaxJobSize, "maximum job body size in `bytes`")
+	flag.IntVar(&cfg.MaxLineSize, "max-line-size", cfg.MaxLineSize, "longest command line accepted, in `bytes`")
+	flag.BoolVar(&cfg.LenientEOL, "lenient-eol", false, "accept a bare LF after job bodies, for typing commands with nc or telnet")
+	flag.Uint64Var(&cfg.MinTTR, "min-ttr", cfg.MinTTR, "TTR given to jobs put with a smaller one")
+	flag.Int64Var(&cfg.MemoryLimit, "memory-limit", 0, "soft limit on the memory the server uses, in `bytes` (0 for none)")
+	flag.IntVar(&cfg.TubeMaxJobs, "tube-max-jobs", 0, "refuse puts into a tube holding this many jobs (0 for no limit)")
+	flag.Uint64Var(&cfg.TubeMaxBytes, "tube-max-bytes", 0, "refuse puts that would take a tube's job bodies past this many `bytes` (0 for no limit)")
+	flag.DurationVar(&cfg.JobTTL, "job-ttl", 0, "delete jobs still ready or delayed this long after they were put (0 to keep them)")
+	flag.DurationVar(&cfg.DedupWindow, "dedup-window", cfg.DedupWindow, "how long put-unique remembers a key")
+	flag.DurationVar(&cfg.TubeIdleTTL, "tube-idle-ttl", 0, "delete tubes left empty and unused this long (0 to keep them)")
+	configPath := flag.String("config", "", "read settings from this `file`; flags override it")
+	validate := flag.Bool("validate", false, "check the settings and exit without starting the server")
+	flag.StringVar(&cfg.AuthFile, "auth-file", "", "require clients to send auth with a token listed in this `file`")
+	authzSpec := flag.String("authz", "", "authorize commands with `provider`: file:<path> or an http(s) policy URL")
+	flag.DurationVar(&authzCacheTTL, "authz-cache-ttl", authzCacheTTL, "how long to cache decisions from an http(s) -authz provider")
+	flag.StringVar(&logLevel, "log-level", logLevel, "log at this `level`: debug, info, warn, or error")
+	flag.StringVar(&logOutput, "log-output", logOutput, "write the log to stderr, stdout, or this `file`")
+	flag.StringVar(&logFormat, "log-format", logFormat, "log as text or json")
+	flag.BoolVar(&logBodies, "log-bodies", false, "include job bodies in the debug log")
+	flag.StringVar(&accessLogPath, "access-log", "", "record every command to this `file`, or to stdout or stderr")
+	flag.StringVar(&accessLogFormat, "access-log-format", accessLogFormat, "write the access log as json or text")
+	flag.StringVar(&auditLogPath, "audit-log", "", "append a record of every administrative action to this `file`, or to stdout or stderr")
+	flag.DurationVar(&slowCmd, "slow-cmd", 0, "log commands that take longer than this to handle, body included (0 to turn off)")
+	flag.BoolVar(&protoTraceOn, "V", false, "log every command with its fields, reply and timing")
+	flag.IntVar(&protoTraceRate, "V-rate", protoTraceRate, "log at most this many -V lines per second")
+	flag.StringVar(&adminAddr, "admin-addr", "", "serve the admin HTTP endpoints on this `host:port`")
+	flag.BoolVar(&adminPprof, "pprof", false, "expose net/http/pprof profiles under /debug/pprof/ on -admin-addr")
+	flag.DurationVar(&cfg.DrainTimeout, "restart-timeout", cfg.DrainTimeout, "on SIGUSR2, how long the old process waits for clients to finish and the new one for storage")
+	flag.StringVar(&grpcAddr, "grpc-addr", "", "serve the gRPC API on this `host:port` (needs -tags grpc)")
+	flag.StringVar(&sqsAddr, "sqs-addr", "", "serve an SQS-compatible API for putting and receiving jobs on this `host:port`")
+	flag.StringVar(&respAddr, "resp-addr", "", "serve Redis list clients, pushing and popping jobs, on this `host:port`")
+	flag.IntVar(&metricsMaxTubes, "metrics-max-tubes", metricsMaxTubes, "export per-tube metrics for at most this many tubes, the deepest first")
+	flag.BoolVar(&otelEnabled, "otel", false, "trace command handling with OpenTelemetry, exported over OTLP/HTTP")
+	flag.StringVar(&otelEndpoint, "otel-endpoint", "", "OTLP/HTTP traces `URL` (default from OTEL_EXPORTER_OTLP_* variables)")
+	flag.StringVar(&otelService, "otel-service", otelService, "service name to report spans under")
+	flag.StringVar(&kafkaBrokers, "kafka-brokers", "", "publish job events to the Kafka brokers at these comma-separated `host:port`s (needs -tags kafka)")
+	flag.StringVar(&kafkaTopic, "kafka-topic", kafkaTopic, "Kafka `topic` to publish job events to")
+	flag.StringVar(&natsURL, "nats-url", "", "connect to the NATS servers at this comma-separated nats:// `URL` list (needs -tags nats)")
+	flag.StringVar(&natsPutPrefix, "nats-put-prefix", "", "put the NATS messages sent to <`prefix`>.<tube> into tubes")
+	flag.StringVar(&amqpURL, "amqp-url", "", "put the messages of a RabbitMQ queue at this amqp:// `URL` into tubes (needs -tags amqp)")
+	flag.StringVar(&amqpQueue, "amqp-queue", amqpQueue, "RabbitMQ `queue` to consume with -amqp-url")
+	flag.IntVar(&amqpPrefetch, "amqp-prefetch", amqpPrefetch, "unacked RabbitMQ messages to hold at once")
+	failpointSpec := flag.String("failpoints", "", "inject faults, as name=value,... (needs -tags failpoint)")
+	flag.Parse()
+	cmdLine := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { cmdLine[f.Name] = true })
+	if *configPath != "" {
+		if err := configLoad(flag.CommandLine, *configPath); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(-1)
+		}
+	}
+	cfg.FsyncInterval = time.Duration(*syncMs) * time.Millisecond
+	cfg.Allow, cfg.Deny = ipSplit(*allow), ipSplit(*deny)
+
+	if errs := checkSettings(&cfg, *listenPort, *userName, *authzSpec); len(errs) > 0 {
+		for _, err := range errs {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+		}
+		os.Exit(-1)
+	}
+	if *validate {
+		fmt.Printf("settings ok\n")
+		return
+	}
+	configApply(&cfg)
+
+	logFile, err := logSetup()
 	if err != nil {
-		fmt.Printf("Failed to listen: %v\n", err)
+		fmt.Fprintf(os.Stderr, "Failed to open log: %v\n", err)
 		os.Exit(-1)
 	}
+	if logFile != nil {
+		defer logFile.Close()
+	}
+
+	// Bind before dropping privileges so that -u can be combined with a
+	// low port, and open everything else after so that files belong to
+	// the user the server runs as.
+	//
+	// Under systemd socket activation, and after a restart, the sockets
+	// are inherited instead and -l and -p are ignored.
+	ls, named, err := activationListeners()
+	if err != nil {
+		slog.Error("failed to use inherited sockets", "err", err)
+		os.Exit(-1)
+	}
+	socketPath, unix := strings.CutPrefix(*listenAddr, unixPrefix)
+	if len(ls) > 0 {
+		unix = false
+	} else {
+		var l net.Listener
+		if unix {
+			l, err = listenUnix(socketPath)
+		} else {
+			l, err = listenTCP(net.JoinHostPort(*listenAddr, *listenPort))
+		}
+		if err != nil {
+			slog.Error("failed to listen", "err", err)
+			os.Exit(-1)
+		}
+		ls = append(ls, l)
+	}
+	for _, l := range ls {
+		defer l.Close()
+	}
+
+	var adminL net.Listener
+	if adminAddr != "" {
+		adminL = named[listenNameAdmin]
+		if adminL == nil {
+			adminL, err = adminListen()
+			if err != nil {
+				slog.Error("failed to listen for admin", "err", err)
+				os.Exit(-1)
+			}
+		}
+		defer adminL.Close()
+	}
+
+	var grpcL net.Listener
+	if grpcAddr != "" {
+		grpcL = named[listenNameGRPC]
+		if grpcL == nil {
+			grpcL, err = net.Listen("tcp", grpcAddr)
+			if err != nil {
+				slog.Error("failed to listen for gRPC", "err", err)
+				os.Exit(-1)
+			}
+		}
+		defer grpcL.Close()
+	}
+
+	var sqsL net.Listener
+	if sqsAddr != "" {
+		sqsL = named[listenNameSQS]
+		if sqsL == nil {
+			sqsL, err = net.Listen("tcp", sqsAddr)
+			if err != nil {
+				slog.Error("failed to listen for SQS", "err", err)
+				os.Exit(-1)
+			}
+		}
+		defer sqsL.Close()
+	}
+
+	var respL net.Listener
+	if respAddr != "" {
+		respL = named[listenNameRESP]
+		if respL == nil {
+			respL, err = net.Listen("tcp", respAddr)
+			if err != nil {
+				slog.Error("failed to listen for RESP", "err", err)
+				os.Exit(-1)
+			}
+		}
+		defer respL.Close()
+	}
+
+	// Unix sockets are local and left in the clear. The handshake runs on
+	// the connection's first read, outside the accept loop.
+	rawLs := append([]net.Listener(nil), ls...)
+	tc, err := tlsConfig()
+	if err != nil {
+		slog.Error("failed to set up TLS", "err", err)
+		os.Exit(-1)
+	}
+	if tc != nil {
+		tc = tlsServerConfig(tc)
+		if tlsReloadInterval > 0 {
+			go tlsWatch(tlsReloadInterval)
+		}
+		for i, l := range ls {
+			if listenerOrigin(l) != originUnix {
+				ls[i] = tls.NewListener(l, tc)
+			}
+		}
+	}
+
+	if *userName != "" {
+		if unix {
+			if err := suChown(socketPath, *userName); err != nil {
+				slog.Error("failed to chown socket", "path", socketPath, "user", *userName, "err", err)
+				os.Exit(-1)
+			}
+		}
+		if err := su(*userName); err != nil {
+			slog.Error("failed to switch user", "user", *userName, "err", err)
+			os.Exit(-1)
+		}
+	}
+
+	if binlogDir != "" {
+		storagePath = binlogDir
+	}
+	if storagePath != "" {
+		open := openStorage
+		if restarted {
+			open = restartOpenStorage
+		}
+		s, err := open(storageKind, storagePath)
+		if err != nil {
+			slog.Error("failed to open storage", "storage", storageKind, "err", err)
+			os.Exit(-1)
+		}
+		defer s.close()
+		jobStore = s
+		if wal != nil {
+			snapshotOnSignal(wal)
+		}
+		jobsMu.Lock()
+		depsRecover()
+		jobsMu.Unlock()
+	}
+
+	if authFile != "" {
+		tokens, err := authLoadFile(authFile)
+		if err != nil {
+			slog.Error("failed to load auth tokens", "err", err)
+			os.Exit(-1)
+		}
+		authTokens = tokens
+	}
+	if *authzSpec != "" {
+		a, err := authzOpen(*authzSpec)
+		if err != nil {
+			slog.Error("failed to set up authorization", "err", err)
+			os.Exit(-1)
+		}
+		authz = a
+	}
+
+	if eventLoop {
+		if err := evloopStart(); err != nil {
+			slog.Error("failed to start the event loop", "err", err)
+			os.Exit(-1)
+		}
+	}
+
+	if err := failpointsSet(*failpointSpec); err != nil {
+		slog.Error("failed to set failpoints", "err", err)
+		os.Exit(-1)
+	}
+
+	if otelEnabled {
+		flush, err := otelSetup()
+		if err != nil {
+			slog.Error("failed to set up tracing", "err", err)
+			os.Exit(-1)
+		}
+		defer flush()
+	}
+
+	if accessLogPath != "" {
+		f, err := accessLogOpen()
+		if err != nil {
+			slog.Error("failed to open access log", "err", err)
+			os.Exit(-1)
+		}
+		if f != nil {
+			defer f.Close()
+		}
+	}
 
-	defer l.Close()
-	fmt.Printf("Listening on %v\n", hostPort)
+	if auditLogPath != "" {
+		f, err := auditLogOpen()
+		if err != nil {
+			slog.Error("failed to open audit log", "err", err)
+			os.Exit(-1)
+		}
+		if f != nil {
+			defer f.Close()
+		}
+	}
 
-	for {
-		conn, err := l.Accept()
+	if *tracePath != "" {
+		jobsMu.Lock()
+		t, err := traceOpen(*tracePath)
+		jobsMu.Unlock()
 		if err != nil {
-			fmt.Printf("Failed to accept: %v\n", err)
-			continue
+			slog.Error("failed to open op trace", "err", err)
+			os.Exit(-1)
 		}
+		defer traceClose(t)
+		opTrace = t
+	}
+
+	// ctx is the context of the clients of every listener but admin and
+	// gRPC. It is canceled once the listeners are closed.
+	ctx, cancel := context.WithCancel(context.Background())
 
-		c := makeConn(conn, connStateWantCommand)
-		go handleConn(c)
+	if adminL != nil {
+		go adminServe(adminL)
+	}
+	if grpcL != nil {
+		slog.Info("gRPC listening", "addr", grpcL.Addr().String())
+		go func() {
+			if err := grpcServe(grpcL, tc); err != nil && !errors.Is(err, net.ErrClosed) {
+				slog.Error("gRPC server failed", "err", err)
+			}
+		}()
+	}
+	if sqsL != nil {
+		go sqsServe(ctx, filteredListener{sqsL})
+	}
+	if respL != nil {
+		go respServe(ctx, respL)
+	}
+
+	handoff := map[string]net.Listener{}
+	if adminL != nil {
+		handoff[listenNameAdmin] = adminL
+	}
+	if grpcL != nil {
+		handoff[listenNameGRPC] = grpcL
+	}
+	if sqsL != nil {
+		handoff[listenNameSQS] = sqsL
 	}
+	if respL != nil {
+		handoff[listenNameRESP] = respL
+	}
+	reloadOnSignal(*configPath, cmdLine)
+	go expireRun()
+	go tubeGCRun()
+	jobsMu.Lock()
+	scheduleReplaceConfig(scheduleConfigs, clock.Now())
+	jobsMu.Unlock()
+	go scheduleRun()
+	if kafkaBrokers != "" {
+		stop, err := kafkaStart()
+		if err != nil {
+			slog.Error("failed to start publishing job events", "err", err)
+			os.Exit(-1)
+		}
+		defer stop()
+	}
+	if natsURL != "" {
+		stop, err := natsStart()
+		if err != nil {
+			slog.Error("failed to start the NATS bridge", "err", err)
+			os.Exit(-1)
+		}
+		defer stop()
+	}
+	if amqpURL != "" {
+		stop, err := amqpStart()
+		if err != nil {
+			slog.Error("failed to start the AMQP bridge", "err", err)
+			os.Exit(-1)
+		}
+		defer stop()
+	}
+	restartOnSignal(rawLs, handoff, func() {
+		for _, l := range rawLs {
+			restartClose(l)
+		}
+		for _, l := range handoff {
+			l.Close()
+		}
+	})
+
+	shutdownMu.Lock()
+	shutdownStop = func() {
+		for _, l := range rawLs {
+			l.Close()
+		}
+		for _, l := range handoff {
+			l.Close()
+		}
+	}
+	shutdownMu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, l := range ls {
+		slog.Info("listening", "addr", l.Addr().String())
+		wg.Add(1)
+		go func(l net.Listener) {
+			defer wg.Done()
+			serve(ctx, l, listenerOrigin(l))
+		}(l)
+	}
+	serving.Store(true)
+	wg.Wait()
+	serving.Store(false)
+	cancel()
+	connsDrain(shutdownDrainTimeout())
+}
+
+func lookupUser(name string) (uid, gid int, err error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return 0, 0, err
+	}
+	if uid, err = strconv.Atoi(u.Uid); err != nil {
+		return 0, 0, err
+	}
+	if gid, err = strconv.Atoi(u.Gid); err != nil {
+		return 0, 0, err
+	}
+	return uid, gid, nil
+}
+
+// su switches the process to user and the user's primary group.
+func su(name string) error {
+	uid, gid, err := lookupUser(name)
+	if err != nil {
+		return err
+	}
+	if os.Getuid() == uid && os.Getgid() == gid {
+		// Already switched, as after a restart.
+		return nil
+	}
+	return suSwitch(uid, gid)
+}
+
+// suChown gives path to user, so that the user can still remove it after
+// su.
+func suChown(path, name string) error {
+	uid, gid, err := lookupUser(name)
+	if err != nil {
+		return err
+	}
+	return os.Chown(path, uid, gid)
 }
 
 type connState int
 
 const (
 	connStateWantCommand connState = iota
+	connStateWantData
 	connStateSendWord
 	connStateSendJob
 	connStateClose
 )
 
-const (
-	lineBufSize = 224
-)
+// lineBufSize is the longest command line accepted, CRLF included, 224 as
+// in beanstalkd unless Config.MaxLineSize says otherwise.
+var lineBufSize = 224
+
+// minTTR is the TTR jobs put with a smaller one are given.
+var minTTR uint64 = 1
 
 type conn struct {
+	// id tells connections apart in logs.
+	id    uint64
 	conn  net.Conn
 	state connState
 
+	// ctx is done once the server stops or c is closed, and bounds what
+	// handling c's commands waits for.
+	ctx    context.Context
+	cancel context.CancelFunc
+
 	reader *bufio.Reader
+	// writer holds replies until connFlush sends them.
+	writer *bufio.Writer
+
+	// cmd is the command line being handled, CRLF included. Its buffer
+	// is reused for the next one.
+	cmd []byte
 
-	cmd     []byte
-	cmdLen  int
-	cmdRead int
+	reply    string
+	replyBuf *[]byte
+	// out is the buffer replies are built in, reused from one reply to
+	// the next.
+	out []byte
+	// statsJSON is set by format json.
+	statsJSON bool
 
-	reply string
+	// protoKnown is set once the first byte has told which framing c
+	// uses, and binary if it is the binary one. binPut holds the fields
+	// of a put frame, in binPutBuf, and is nil for other commands.
+	protoKnown bool
+	binary     bool
+	binPut     *binPutArgs
+	binPutBuf  binPutArgs
+	// replyBody is the job body sent after the reply line, CRLF included,
+	// in connStateSendJob.
+	replyBody []byte
 
+	// inJob is the job whose body is being read, of which inJobRead
+	// bytes have arrived.
 	inJobRead int
 	inJob     *job
+	// inKey is the key of a put-unique, or empty, and inDeps the
+	// dependencies of a put-after.
+	inKey  string
+	inDeps []uint64
+	// inHeaders are the headers of a put-headers.
+	inHeaders []jobHeader
+
+	// cmdStart is when the command being handled was read.
+	cmdStart time.Time
+
+	// pollFd is c's descriptor once the event loop has parked it.
+	pollFd int
+
+	use *tube
+
+	origin origin
+
+	// identity is who the client authenticated as, empty if it has not.
+	identity string
+
+	// client is the name/version a client gave in hello, or empty.
+	client string
+
+	// producer is set once the client has put a job.
+	producer bool
+
+	// cmdJob is the job the current command made or acted on, 0 if none.
+	cmdJob uint64
+
+	// span traces the command being handled, nil unless tracing is on.
+	span span
+
+	// cmdBucket limits the commands read to connRateCmds per second.
+	cmdBucket rateBucket
 }
 
-func makeConn(c net.Conn, initialState connState) *conn {
-	curConnCount++
+// makeConn wraps an accepted connection that has already been counted by
+// connAdmit.
+func makeConn(ctx context.Context, c net.Conn, initialState connState, o origin) *conn {
+	totalConnCount.Add(1)
+	ctx, cancel := context.WithCancel(ctx)
 	return &conn{
+		id:     nextConnID.Add(1),
 		conn:   c,
-		reader: bufio.NewReader(c),
+		ctx:    ctx,
+		cancel: cancel,
+		reader: bufio.NewReader(&rateReader{ctx: ctx, r: c}),
+		writer: bufio.NewWriter(c),
 		state:  initialState,
+		use:    tubeUse(nil, defaultTubeName),
+		origin: o,
 	}
 }
 
+type jobState uint8
+
+const (
+	jobStateInvalid jobState = iota
+	jobStateReady
+	jobStateReserved
+	jobStateBuried
+	jobStateDelayed
+	jobStateHeld
+)
+
 type job struct {
+	id       uint64
+	state    jobState
 	pri      uint64
 	delay    uint64
 	ttr      uint64
 	bodySize uint64
 	body     []byte
+
+	created  time.Time
+	deadline time.Time
+
+	// reserves counts the times the job has been reserved. An SQS receipt
+	// handle names one of them.
+	reserves uint64
+
+	// deps are the jobs a put-after job waits for, and depsLeft how many
+	// of them still exist while it is held.
+	deps     []uint64
+	depsLeft int
+
+	// headers are those given by put-headers.
+	headers []jobHeader
+
+	// compressed is set when body, but for its CRLF, is gzipped.
+	compressed bool
+
+	tube   *tube
+	origin origin
+
+	// walSeg is the binlog segment holding the job's latest put record,
+	// which is walSize bytes long.
+	walSeg  *walSegment
+	walSize int64
+
+	// heap is the heap of its tube's index the job is on, nil for none,
+	// and heapIndex its place there; see ready.go. Guarded by jobsMu.
+	heap      *jobHeap
+	heapIndex int
 }
 
 func makeJob(pri, delay, ttr, bodySize uint64) *job {
@@ -135,13 +883,272 @@ func makeJob(pri, delay, ttr, bodySize uint64) *job {
 		delay:    delay,
 		ttr:      ttr,
 		bodySize: bodySize,
-		body:     make([]byte, bodySize),
+		body:     bodyAlloc(bodySize),
+	}
+}
+
+type tube struct {
+	name string
+
+	// maxJobSize and limits change when the config is reloaded.
+	maxJobSize atomic.Uint64
+	limits     atomic.Pointer[tubeLimits]
+	// compressMin is the size from which bodies are compressed, 0 for
+	// none. It changes when the config is reloaded.
+	compressMin atomic.Uint64
+	// putRate caps the puts a second, 0 for no cap, and putReject tells
+	// whether puts over it are refused rather than delayed. They change
+	// when the config is reloaded. putBucket is guarded by putMu.
+	putRate   atomic.Int64
+	putReject atomic.Bool
+	putMu     sync.Mutex
+	putBucket rateBucket
+
+	// maxJobs and maxBytes cap the jobs the tube holds and their total
+	// body size, 0 for no cap. Guarded by jobsMu.
+	maxJobs  int
+	maxBytes uint64
+	// ttl is how long the tube's jobs may wait before they expire, 0 for
+	// ever. Guarded by jobsMu.
+	ttl time.Duration
+
+	// dedup holds the put-unique keys seen within dedupWindow, which
+	// dedupOrder lists oldest first. Guarded by jobsMu.
+	dedupWindow time.Duration
+	dedup       map[string]*dedupEntry
+	dedupOrder  []*dedupEntry
+
+	// stat is guarded by jobsMu.
+	stat tubeStats
+
+	// lifo is set for a tube that delivers the newest of its ready jobs
+	// of equal priority first. Guarded by jobsMu.
+	lifo bool
+
+	// ready and timed index the jobs the tube could hand out, and wake is
+	// closed to wake those waiting for one; see ready.go. Guarded by
+	// jobsMu.
+	ready, timed jobHeap
+	wake         chan struct{}
+
+	// mirror is the address of the server the tube's jobs are copied to,
+	// empty for none. Guarded by jobsMu.
+	mirror string
+
+	// natsSubject is the NATS subject the tube's jobs are published to,
+	// empty for none. Guarded by jobsMu.
+	natsSubject string
+
+	// pauseDelay is how long the tube was last paused for, and
+	// pauseDeadline when that pause ends. Guarded by jobsMu.
+	pauseDelay    time.Duration
+	pauseDeadline time.Time
+
+	// users counts the connections using the tube, and idleSince is when
+	// it was first seen idle, zero while it is not; gone is set once it
+	// has been deleted for being idle. Guarded by jobsMu.
+	users     int
+	idleSince time.Time
+	gone      bool
+}
+
+type tubeStats struct {
+	// Jobs currently in the tube, by state, and the size of their bodies
+	// with their CRLFs.
+	ready, delayed, reserved, buried, held int
+	bytes                                  uint64
+
+	// Totals since the server started.
+	puts, deletes, timeouts, expired uint64
+}
+
+// tubeStatsAdd adds n to the count of jobs in state st.
+func tubeStatsAdd(s *tubeStats, st jobState, n int) {
+	switch st {
+	case jobStateReady:
+		s.ready += n
+	case jobStateDelayed:
+		s.delayed += n
+	case jobStateReserved:
+		s.reserved += n
+	case jobStateBuried:
+		s.buried += n
+	case jobStateHeld:
+		s.held += n
+	}
+}
+
+var (
+	// jobsMu guards the job and tube tables and keeps binlog records in
+	// the same order as the changes they describe.
+	jobsMu sync.Mutex
+
+	nextJobID uint64 = 1
+	allJobs          = map[uint64]*job{}
+	tubes            = map[string]*tube{}
+)
+
+func tubeFindOrMake(name string) *tube {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	return tubeFindOrMakeLocked(name)
+}
+
+// tubeConfigure applies the settings for t's tube from the config file, or
+// the defaults. The caller must hold jobsMu.
+func tubeConfigure(t *tube) {
+	size := maxJobSize
+	var compressMin uint64
+	t.maxJobs, t.maxBytes = tubeMaxJobs, tubeMaxBytes
+	t.ttl = jobTTL
+	t.dedupWindow = dedupWindow
+	t.lifo = false
+	t.mirror = ""
+	t.natsSubject = ""
+	limits := tubeLimits{}
+	var putRate int64
+	putReject := false
+	if tc := tubeConfigs[t.name]; tc != nil {
+		if tc.maxJobSize > 0 {
+			size = tc.maxJobSize
+		}
+		if tc.maxJobs > 0 {
+			t.maxJobs = tc.maxJobs
+		}
+		if tc.maxBytes > 0 {
+			t.maxBytes = tc.maxBytes
+		}
+		if tc.ttl > 0 {
+			t.ttl = tc.ttl
+		}
+		if tc.dedupWindow > 0 {
+			t.dedupWindow = tc.dedupWindow
+		}
+		t.lifo = tc.lifo
+		t.mirror = tc.mirror
+		t.natsSubject = tc.natsSubject
+		compressMin = tc.compressMin
+		limits = tc.limits
+		putRate, putReject = tc.putRate, tc.putReject
+	}
+	if limits.minTTR == 0 {
+		limits.minTTR = minTTR
+	}
+	// A change of lifo reorders the ready jobs.
+	heap.Init(&t.ready)
+	t.maxJobSize.Store(size)
+	t.compressMin.Store(compressMin)
+	t.limits.Store(&limits)
+	t.putRate.Store(putRate)
+	t.putReject.Store(putReject)
+}
+
+// jobDeliveredBefore reports whether the ready job a goes to a consumer
+// before b from their tube: the most urgent first, then the oldest, or in
+// a lifo tube the newest. The caller must hold jobsMu.
+func jobDeliveredBefore(a, b *job) bool {
+	if a.pri != b.pri {
+		return a.pri < b.pri
+	}
+	if a.tube.lifo {
+		return a.id > b.id
+	}
+	return a.id < b.id
+}
+
+// tubeFull reports whether t has no room for a job of size bytes. The
+// caller must hold jobsMu.
+func tubeFull(t *tube, size uint64) bool {
+	s := &t.stat
+	if t.maxJobs > 0 && s.ready+s.delayed+s.reserved+s.buried+s.held >= t.maxJobs {
+		return true
+	}
+	return t.maxBytes > 0 && s.bytes+size > t.maxBytes
+}
+
+func tubeFindOrMakeLocked(name string) *tube {
+	t, ok := tubes[name]
+	if !ok {
+		t = &tube{name: name, timed: jobHeap{byDeadline: true}}
+		tubeConfigure(t)
+		tubes[name] = t
+		if err := traceTube(opTrace, t); err != nil {
+			slog.Error("op trace write failed", "err", err)
+		}
+	}
+	return t
+}
+
+// storeJob makes j known to the server. The caller must hold jobsMu.
+func storeJob(j *job) {
+	allJobs[j.id] = j
+	tubeStatsAdd(&j.tube.stat, j.state, 1)
+	j.tube.stat.bytes += uint64(len(j.body))
+	tubeIndexAdd(j)
+	switch j.state {
+	case jobStateReady:
+		readyCount++
+	case jobStateDelayed:
+		delayedCount++
+	case jobStateReserved:
+		globalStat.reservedCount++
+	case jobStateHeld:
+		heldCount++
+	}
+}
+
+// unstoreJob removes j from the job table. The caller must hold jobsMu.
+func unstoreJob(j *job) {
+	delete(allJobs, j.id)
+	tubeStatsAdd(&j.tube.stat, j.state, -1)
+	j.tube.stat.bytes -= uint64(len(j.body))
+	tubeIndexRemove(j)
+	switch j.state {
+	case jobStateReady:
+		readyCount--
+	case jobStateDelayed:
+		delayedCount--
+	case jobStateReserved:
+		globalStat.reservedCount--
+	case jobStateHeld:
+		heldCount--
 	}
 }
 
 func handleConn(c *conn) {
-	for {
-		connData(c)
+	connsMu.Lock()
+	conns[c] = struct{}{}
+	connsMu.Unlock()
+
+	if err := connHandshake(c); err != nil {
+		tlsHandshakeErrorCount.Add(1)
+		slog.Warn("TLS handshake failed", "remote", c.conn.RemoteAddr().String(), "err", err)
+		connClose(c)
+		return
+	}
+	if c.identity != "" {
+		authConnCount.Add(1)
+		nsEnter(c)
+		slog.Info("client authenticated", "remote", c.conn.RemoteAddr().String(), "identity", c.identity)
+	}
+	connRun(c, false)
+}
+
+// connRun handles c's commands until it is closed, or until it has no
+// input waiting and the event loop takes it over. readable tells that the
+// event loop has just seen input on c.
+func connRun(c *conn, readable bool) {
+	for ; ; readable = false {
+		if c.state == connStateWantCommand && c.reader.Buffered() == 0 && !readable {
+			if err := connFlush(c); err != nil {
+				c.state = connStateClose
+			} else if evloopPark(c) {
+				return
+			}
+		}
+		if c.state != connStateClose {
+			connData(c)
+		}
 
 		if c.state == connStateClose {
 			connClose(c)
@@ -153,19 +1160,98 @@ func handleConn(c *conn) {
 func connData(c *conn) {
 	switch c.state {
 	case connStateWantCommand:
-		r, err := c.reader.ReadBytes('\n')
+		if !c.protoKnown {
+			if err := binDetect(c); err != nil {
+				c.state = connStateClose
+				return
+			}
+		}
+		if c.binary && !binBuffered(c) {
+			if err := connFlush(c); err != nil {
+				c.state = connStateClose
+				return
+			}
+		} else if buf, _ := c.reader.Peek(c.reader.Buffered()); !c.binary && bytes.IndexByte(buf, '\n') < 0 {
+			if err := connFlush(c); err != nil {
+				c.state = connStateClose
+				return
+			}
+		}
+		rateWait(c.ctx, &c.cmdBucket, connRateCmds.Load(), 1)
+		var err error
+		if c.binary {
+			err = binReadFrame(c)
+		} else {
+			err = connReadLine(c)
+		}
+		if err == errLineTooLong || err == errBinNoBody {
+			replyMsg(c, msgBadFmt)
+			return
+		}
 		if err != nil {
 			c.state = connStateClose
 			return
 		}
-		c.cmd = r
-		// TODO handle large job
+		c.cmdStart = time.Now()
+		c.cmdJob = 0
 		doCmd(c)
-		return
-
-		break
+		if c.state != connStateWantData {
+			cmdDone(c)
+		}
+	case connStateWantData:
+		if c.inJobRead == 0 && failCloseMidBody() {
+			bodyFree(c.inJob.body)
+			c.inJob = nil
+			c.state = connStateClose
+			cmdDone(c)
+			return
+		}
+		// A binary put's body comes without its CRLF, which putBegin
+		// has already added.
+		want := len(c.inJob.body)
+		if c.binary {
+			want -= 2
+		}
+		if c.reader.Buffered() < want-c.inJobRead {
+			if err := connFlush(c); err != nil {
+				bodyFree(c.inJob.body)
+				c.inJob = nil
+				c.state = connStateClose
+				return
+			}
+		}
+		// Bodies arrive in as many reads as the network splits them into.
+		// With -lenient-eol the last byte is read on its own, once the one
+		// before it is known not to be a bare LF ending the body.
+		end := want
+		lenient := lenientEOL && !c.binary
+		if lenient && c.inJobRead < want-1 {
+			end = want - 1
+		}
+		n, err := c.reader.Read(c.inJob.body[c.inJobRead:end])
+		c.inJobRead += n
+		if lenient && c.inJobRead == want-1 && c.inJob.body[want-2] == '\n' {
+			c.inJob.body[want-2], c.inJob.body[want-1] = '\r', '\n'
+			c.inJobRead = want
+		}
+		if c.inJobRead < want {
+			if err != nil {
+				// A body cut short, by the client or a read deadline, is
+				// dropped with the connection.
+				bodyFree(c.inJob.body)
+				c.inJob = nil
+				c.state = connStateClose
+				cmdDone(c)
+			}
+			return
+		}
+		if logDebug() {
+			slog.Debug("job body", "remote", c.conn.RemoteAddr().String(), logBody(c.inJob.body[:len(c.inJob.body)-2]))
+		}
+		enqueueIncomingJob(c)
+		cmdDone(c)
 	case connStateSendWord:
-		_, err := c.conn.Write([]byte(c.reply))
+		err := writeReply(c)
 		if err != nil {
 			// TODO log error
 			c.state = connStateClose
@@ -174,7 +1260,7 @@ func connData(c *conn) {
 		resetConn(c)
 		break
 	case connStateSendJob:
-		_, err := c.conn.Write([]byte(c.reply))
+		err := writeReply(c)
 
 		if err != nil {
 			// TODO log error
@@ -187,136 +1273,588 @@ func connData(c *conn) {
 	}
 }
 
+// writeReply buffers c's reply, and the body of a job being sent.
+func writeReply(c *conn) error {
+	var err error
+	if c.binary {
+		var size [4]byte
+		binary.BigEndian.PutUint32(size[:], binReplySize(c))
+		c.writer.Write(size[:])
+	}
+	if c.replyBuf == nil {
+		_, err = c.writer.WriteString(c.reply)
+	} else {
+		_, err = c.writer.Write(*c.replyBuf)
+		if cap(c.out) > maxReplyBuf {
+			// Don't hold on to the buffer of a large stats reply.
+			c.out = nil
+		}
+		c.replyBuf = nil
+	}
+	if err == nil && c.state == connStateSendJob {
+		// Large bodies go straight to the connection from the job.
+		_, err = c.writer.Write(c.replyBody)
+	}
+	c.replyBody = nil
+	return err
+}
+
+// connFlush sends the replies c.writer holds. It is called before reading
+// whenever the read could block, so that pipelined commands have their
+// replies sent together while a client waiting for a reply gets it.
+func connFlush(c *conn) error {
+	if c.writer.Buffered() == 0 {
+		return nil
+	}
+	return c.writer.Flush()
+}
+
+// cmdDone ends the span of the command c has just handled and logs it.
+func cmdDone(c *conn) {
+	spanEnd(c.span)
+	c.span = nil
+	if protoTraceOn {
+		protoTrace(c, c.cmdStart)
+	}
+	if accessLog != nil {
+		accessLogCmd(c, c.cmdStart)
+	}
+	if slowCmd > 0 {
+		logSlowCmd(c, c.cmdStart)
+	}
+}
+
 func resetConn(c *conn) {
 	c.state = connStateWantCommand
 }
 
-func wantCommand(c *conn) bool {
-	return c.state == connStateWantCommand
+var errLineTooLong = errors.New("line too long")
+
+// connReadLine reads the next command line into c.cmd. Commands may arrive
+// several to a read or split across reads; the reader keeps whatever
+// follows the line for the next call. A line longer than lineBufSize is
+// skipped through its end and errLineTooLong returned, so that a client
+// cannot make the server buffer without bound.
+func connReadLine(c *conn) error {
+	line, err := readLine(c.reader, lineBufSize)
+	if err != nil {
+		c.cmd = c.cmd[:0]
+		return err
+	}
+	c.cmd = append(c.cmd[:0], line...)
+	return nil
 }
 
-func cmdDataReady(c *conn) bool {
-	return wantCommand(c) && c.cmdRead > 0
+// readLine reads a line of at most max bytes from r, which holds it only
+// until the next read. A longer line is skipped through its end and
+// errLineTooLong returned.
+func readLine(r *bufio.Reader, max int) ([]byte, error) {
+	line, err := r.ReadSlice('\n')
+	if err == nil && len(line) <= max {
+		return line, nil
+	}
+	if err != nil && err != bufio.ErrBufferFull {
+		return nil, err
+	}
+	for err == bufio.ErrBufferFull {
+		_, err = r.ReadSlice('\n')
+	}
+	if err != nil {
+		return nil, err
+	}
+	return nil, errLineTooLong
 }
 
 func doCmd(c *conn) {
 	msgType := whichCmd(c.cmd)
-	fmt.Printf("command %s\n", opNames[msgType])
+	if cmdTracer != nil {
+		op := strings.TrimSpace(opNames[msgType])
+		// cmdDone ends the span, which for put is once the body is in.
+		c.span = spanStart("dispatch." + op)
+		spanString(c.span, "dispatch.command", op)
+	}
+	if logDebug() {
+		slog.Debug("command", "remote", c.conn.RemoteAddr().String(), "op", strings.TrimSpace(opNames[msgType]))
+	}
+
+	if authRequired(c) && msgType != opAuth && msgType != opQuit && msgType != opHello {
+		if c.binPut != nil {
+			c.reader.Discard(int(c.binPut.size))
+		} else if msgType == opPut || msgType == opPutUnique || msgType == opPutAfter || msgType == opPutHeaders {
+			// Skip the body so that it is not read as commands.
+			if cmd, err := protocol.ParseCommand(c.cmd); err == nil {
+				bodyDiscard(c.reader, cmd.Size)
+			}
+		}
+		if msgType == opMput {
+			cmd, err := protocol.ParseCommand(c.cmd)
+			if err != nil || !mputSkip(c, cmd.Count) {
+				c.state = connStateClose
+				return
+			}
+		}
+		replyMsg(c, msgUnauthorized)
+		return
+	}
+
+	if p := c.binPut; p != nil {
+		putBegin(c, msgType, p.pri, p.delay, p.ttr, p.size, "", nil, nil)
+		return
+	}
+	cmd, err := protocol.ParseCommand(c.cmd)
+	if err == protocol.ErrUnknownCommand {
+		opCount[opUnknown].Add(1)
+		replyMsg(c, msgUnknownCommand)
+		return
+	}
+	if err != nil {
+		replyMsg(c, msgBadFmt)
+		return
+	}
 
 	switch msgType {
-	case opPut:
-		fields := bytes.Fields(c.cmd)
-		if len(fields) != 5 {
-			replyMsg(c, msgBadFmt)
+	case opPut, opPutUnique, opPutAfter, opPutHeaders:
+		key := ""
+		var deps []uint64
+		var headers []jobHeader
+		var ok bool
+		switch msgType {
+		case opPutUnique:
+			if len(cmd.Args[0]) > dedupMaxKey {
+				replyMsg(c, msgBadFmt)
+				return
+			}
+			key = string(cmd.Args[0])
+		case opPutAfter:
+			if deps, ok = depsParse(cmd.Args[0]); !ok {
+				replyMsg(c, msgBadFmt)
+				return
+			}
+		case opPutHeaders:
+			if headers, ok = headersParse(cmd.Args[0]); !ok {
+				replyMsg(c, msgBadFmt)
+				return
+			}
+		}
+		putBegin(c, msgType, cmd.Pri, cmd.Delay, cmd.TTR, cmd.Size, key, deps, headers)
+		return
+	case opStats:
+		if !authorizeCmd(c, msgType, "") {
+			replyMsg(c, msgForbidden)
 			return
 		}
-
-		pri, err := strconv.ParseUint(string(fields[1]), 10, 32)
-		if err != nil {
+		opCount[msgType].Add(1)
+		if prefix := nsPrefix(c.identity); prefix != "" {
+			doStats(c, func() statsDict { return nsStats(prefix) })
+			break
+		}
+		doStats(c, fmtStats)
+		break
+	case opUse:
+		name := cmd.Args[0]
+		full := nsPrefix(c.identity) + string(name)
+		if !protocol.ValidTubeName(full) {
 			replyMsg(c, msgBadFmt)
 			return
 		}
-
-		delay, err := strconv.ParseUint(string(fields[2]), 10, 32)
-		if err != nil {
-			replyMsg(c, msgBadFmt)
+		if !authorizeCmd(c, msgType, full) {
+			replyMsg(c, msgForbidden)
 			return
 		}
-
-		ttr, err := strconv.ParseUint(string(fields[3]), 10, 32)
-		if err != nil {
-			replyMsg(c, msgBadFmt)
+		opCount[msgType].Add(1)
+		spanString(c.span, "dispatch.tube", full)
+		c.use = tubeUse(c.use, full)
+		b := newReply(c)
+		*b = protocol.AppendReply(*b, protocol.Using, name)
+		replyBytes(c, b, connStateSendWord)
+		break
+	case opQuit:
+		opCount[msgType].Add(1)
+		c.state = connStateClose
+		break
+	case opVerify:
+		if !authorizeCmd(c, msgType, "") {
+			replyMsg(c, msgForbidden)
 			return
 		}
-
-		bodySize, err := strconv.ParseUint(string(fields[4]), 10, 32)
-		if err != nil {
-			replyMsg(c, msgBadFmt)
+		opCount[msgType].Add(1)
+		doVerify(c, cmd.NArgs == 1)
+	case opSnapshot:
+		if !authorizeCmd(c, msgType, "") {
+			replyMsg(c, msgForbidden)
 			return
 		}
+		opCount[msgType].Add(1)
+		doSnapshot(c)
+	case opAuth:
+		opCount[msgType].Add(1)
+		doAuth(c, cmd.Args[0])
+	case opMput:
+		doMput(c, cmd.Count)
+	case opFormat:
+		doFormat(c, cmd.Args[0])
+	case opHello:
+		doHello(c, cmd.Args[0], cmd.Args[1])
+	case opShutdown:
+		if c.identity == "" || !authorizeCmd(c, msgType, "") {
+			replyMsg(c, msgForbidden)
+			return
+		}
+		opCount[msgType].Add(1)
+		doShutdown(c, cmd.NArgs == 1 && string(cmd.Args[0]) == "now")
+	default:
+		opCount[opUnknown].Add(1)
+		replyMsg(c, msgUnknownCommand)
+		return
+	}
+}
 
-		opCount[msgType]++
-
-		// TODO check max job size
+// putBegin starts reading the body of a put whose arguments have been
+// parsed, or refuses it and skips the body.
+func putBegin(c *conn, msgType opType, pri, delay, ttr, bodySize uint64, key string, deps []uint64, headers []jobHeader) {
+	opCount[msgType].Add(1)
 
-		if ttr < 1000000000 {
-			ttr = 1000000000
+	// A binary put's body comes without its CRLF.
+	skip := func() {
+		if c.binary {
+			c.reader.Discard(int(bodySize))
+		} else {
+			bodyDiscard(c.reader, bodySize)
 		}
+	}
+
+	if bodySize > c.use.maxJobSize.Load() {
+		skip()
+		replyMsg(c, msgJobTooBig)
+		return
+	}
 
-		c.inJob = makeJob(pri, delay, ttr, bodySize+2)
+	if draining.Load() {
+		skip()
+		replyMsg(c, msgDraining)
+		return
+	}
 
-		nbRead, err := c.reader.Read(c.inJob.body)
-		if nbRead != len(c.inJob.body) {
-			replyMsg(c, msgBadFmt)
-			return
+	pri, delay, ttr, err := c.use.limits.Load().limit(pri, delay, ttr, putAll)
+	if err != nil {
+		skip()
+		if err == errDelayTooLong {
+			replyMsg(c, msgDelayTooLong)
+		} else {
+			replyMsg(c, msgInternalError)
 		}
-		fmt.Printf("body %s\n", string(c.inJob.body))
-		enqueueIncomingJob(c)
 		return
+	}
 
-		break
-	case opStats:
-		// TODO verify no trailing garbage
-		opCount[msgType]++
-		doStats(c, fmtStats)
-		break
-	case opUse:
-		name := c.cmd[cmdUseLen:]
-		// TODO verify name
-		opCount[msgType]++
-		replyLine(c, connStateSendWord, "USING %s\r\n", name)
-		break
-	case opQuit:
-		c.state = connStateClose
-		break
-	default:
-		replyMsg(c, msgUnknownCommand)
+	if !authorizeCmd(c, opPut, c.use.name) {
+		// Skip the body so the next command is read from the right place.
+		skip()
+		replyMsg(c, msgForbidden)
+		return
+	}
+
+	if !tubePutAdmit(c.ctx, c.use) {
+		skip()
+		replyMsg(c, msgRateLimited)
 		return
 	}
+
+	spanString(c.span, "dispatch.tube", c.use.name)
+	spanInt(c.span, "dispatch.body_size", int64(bodySize))
+	c.inJob = makeJob(pri, delay, ttr, bodySize+2)
+	c.inJobRead = 0
+	if c.binary {
+		copy(c.inJob.body[bodySize:], "\r\n")
+	}
+	c.inKey = key
+	c.inDeps = deps
+	c.inHeaders = headers
+	c.state = connStateWantData
+}
+
+// cmdPrefix reports whether line starts with the command name p.
+func cmdPrefix(line []byte, p string) bool {
+	return len(line) >= len(p) && string(line[:len(p)]) == p
 }
 
 func whichCmd(cmd []byte) opType {
-	if bytes.HasPrefix(cmd, []byte(cmdPut)) {
+	if cmdPrefix(cmd, cmdPut) {
 		return opPut
 	}
-	if bytes.HasPrefix(cmd, []byte(cmdStats)) {
+	if cmdPrefix(cmd, cmdStats) {
 		return opStats
 	}
-	if bytes.HasPrefix(cmd, []byte(cmdUse)) {
+	if cmdPrefix(cmd, cmdUse) {
 		return opUse
 	}
-	if bytes.HasPrefix(cmd, []byte(cmdQuit)) {
+	if cmdPrefix(cmd, cmdQuit) {
 		return opQuit
 	}
+	if cmdPrefix(cmd, cmdVerify) {
+		return opVerify
+	}
+	if cmdPrefix(cmd, cmdSnapshot) {
+		return opSnapshot
+	}
+	if cmdPrefix(cmd, cmdAuth) {
+		return opAuth
+	}
+	if cmdPrefix(cmd, cmdMput) {
+		return opMput
+	}
+	if cmdPrefix(cmd, cmdFormat) {
+		return opFormat
+	}
+	if cmdPrefix(cmd, cmdPutUnique) {
+		return opPutUnique
+	}
+	if cmdPrefix(cmd, cmdPutAfter) {
+		return opPutAfter
+	}
+	if cmdPrefix(cmd, cmdPutHeaders) {
+		return opPutHeaders
+	}
+	if cmdPrefix(cmd, cmdHello) {
+		return opHello
+	}
+	if cmdPrefix(cmd, cmdShutdown) {
+		return opShutdown
+	}
 	return opUnknown
 }
 
 func enqueueIncomingJob(c *conn) {
 	j := c.inJob
 	c.inJob = nil
-	if !bytes.HasSuffix(j.body, []byte("\r\n")) {
+	if !bodyEnded(j.body) {
+		bodyFree(j.body)
 		replyMsg(c, msgExpectedCRLF)
 		return
 	}
 	// TODO log new job
-	// XXX do something with job
-	_ = j
+	j.tube = c.use
+	j.origin = c.origin
+	j.deps, c.inDeps = c.inDeps, nil
+	j.headers, c.inHeaders = c.inHeaders, nil
+	var err error
+	if c.inKey != "" {
+		var id uint64
+		id, err = jobInsertUnique(j, c.inKey, c.span)
+		c.inKey = ""
+		if err == errDuplicate {
+			bodyFree(j.body)
+			c.cmdJob = id
+			replyInserted(c, id)
+			return
+		}
+	} else {
+		err = jobInsert(j, c.span)
+	}
+	if err != nil {
+		bodyFree(j.body)
+		if err == errTubeFull {
+			replyMsg(c, msgTubeFull)
+		} else {
+			replyMsg(c, msgInternalError)
+		}
+		return
+	}
+	c.cmdJob = j.id
+
+	if !c.producer {
+		c.producer = true
+		producerCount.Add(1)
+	}
+	replyInserted(c, j.id)
+}
+
+var errTubeFull = errors.New("tube full")
 
+// jobInsert gives j, whose tube and origin are set, an id and makes it
+// ready or delayed, or returns errTubeFull if its tube is at its quota.
+// Storage errors are logged and recorded on sp, the span of the command
+// that created the job.
+func jobInsert(j *job, sp span) error {
+	jobCompress(j)
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	return jobInsertLocked(j, sp)
+}
+
+// jobInsertLocked is jobInsert for a caller holding jobsMu.
+func jobInsertLocked(j *job, sp span) error {
+	if j.tube.gone {
+		// Deleted while idle since the caller looked it up.
+		j.tube = tubeFindOrMakeLocked(j.tube.name)
+	}
+	j.created = clock.Now()
+	j.state = jobStateReady
+	if j.delay > 0 {
+		j.state = jobStateDelayed
+		j.deadline = j.created.Add(time.Duration(j.delay) * time.Second)
+	}
+
+	if tubeFull(j.tube, uint64(len(j.body))) {
+		tubeFullCount.Add(1)
+		return errTubeFull
+	}
+	j.id = nextJobID
+	if j.deps != nil {
+		depsHold(j)
+	}
+	spanInt(sp, "dispatch.job_id", int64(j.id))
+	ss := spanChild(sp, "storage.put")
+	err := storePutJob(j)
+	if err != nil {
+		spanFail(ss, err)
+	}
+	spanEnd(ss)
+	if err != nil {
+		spanFail(sp, err)
+		slog.Error("storage write failed", "job", j.id, "err", err)
+		return err
+	}
+	nextJobID++
+	storeJob(j)
+	if j.state == jobStateHeld {
+		depsRegister(j)
+	}
+	j.tube.stat.puts++
+	if j.tube.mirror != "" {
+		mirrorPut(j)
+	}
+	if j.tube.natsSubject != "" {
+		natsPublish(j)
+	}
+	if err := tracePut(opTrace, j); err != nil {
+		slog.Error("op trace write failed", "err", err)
+	}
 	globalStat.totalJobsCount++
-	// TODO increase tube stats
-	id := 1
-	replyLine(c, connStateSendWord, msgInsertedFmt, id)
+	originJobCount[j.origin].Add(1)
+	eventEmit(eventInserted, j)
+	return nil
+}
+
+// jobDelete removes j from storage and the server. The caller must hold
+// jobsMu.
+func jobDelete(j *job) error {
+	if err := storeDeleteJob(j); err != nil {
+		slog.Error("storage write failed", "job", j.id, "err", err)
+		return err
+	}
+	unstoreJob(j)
+	eventEmit(eventDeleted, j)
+	depsDone(j.id)
+	j.tube.stat.deletes++
+	if err := traceDelete(opTrace, j); err != nil {
+		slog.Error("op trace write failed", "err", err)
+	}
+	bodyFree(j.body)
+	j.body = nil
+	return nil
+}
+
+// jobKick makes a buried or delayed job ready, reporting whether it was
+// either. The caller must hold jobsMu.
+func jobKick(j *job) (bool, error) {
+	if j.state != jobStateBuried && j.state != jobStateDelayed {
+		return false, nil
+	}
+
+	unstoreJob(j)
+	state, deadline := j.state, j.deadline
+	j.state, j.deadline = jobStateReady, time.Time{}
+	if err := storeUpdateJob(j); err != nil {
+		j.state, j.deadline = state, deadline
+		storeJob(j)
+		slog.Error("storage write failed", "job", j.id, "err", err)
+		return false, err
+	}
+	storeJob(j)
+	if err := traceState(opTrace, j); err != nil {
+		slog.Error("op trace write failed", "err", err)
+	}
+	eventEmit(eventKicked, j)
+	return true, nil
+}
+
+// jobMove puts j in state with deadline, in storage first, leaving it as
+// it was if storage fails. The caller must hold jobsMu.
+func jobMove(j *job, state jobState, deadline time.Time) error {
+	unstoreJob(j)
+	oldState, oldDeadline := j.state, j.deadline
+	j.state, j.deadline = state, deadline
+	if err := storeUpdateJob(j); err != nil {
+		j.state, j.deadline = oldState, oldDeadline
+		storeJob(j)
+		slog.Error("storage write failed", "job", j.id, "err", err)
+		return err
+	}
+	storeJob(j)
+	if err := traceState(opTrace, j); err != nil {
+		slog.Error("op trace write failed", "err", err)
+	}
+	return nil
+}
+
+// Replies that carry a number or a name are built by appending into the
+// connection's reply buffer rather than with fmt.Sprintf, which showed up
+// as the main cost of put-heavy workloads. Replies without arguments are
+// the msg constants and are written as they are.
+const (
+	replyBufSize = 64
+	maxReplyBuf  = 64 * 1024
+)
+
+// newReply returns c's reply buffer, emptied. It must be passed to
+// replyBytes before c's next reply is built.
+func newReply(c *conn) *[]byte {
+	if c == nil {
+		b := make([]byte, 0, replyBufSize)
+		return &b
+	}
+	if c.out == nil {
+		c.out = make([]byte, 0, replyBufSize)
+	}
+	c.out = c.out[:0]
+	return &c.out
 }
 
-func replyLine(c *conn, state connState, f string, data ...interface{}) {
-	r := fmt.Sprintf(f, data...)
-	reply(c, r, state)
+// replyWord replies word followed by n, as in "INSERTED <id>".
+func replyWord(c *conn, word string, n uint64) {
+	b := newReply(c)
+	*b = protocol.AppendReplyUint(*b, word, n)
+	replyBytes(c, b, connStateSendWord)
+}
+
+func replyInserted(c *conn, id uint64) {
+	replyWord(c, protocol.Inserted, id)
+}
+
+// replyBytes is like reply for a buffer obtained from newReply.
+func replyBytes(c *conn, b *[]byte, state connState) {
+	if c == nil {
+		return
+	}
+	c.replyBuf = b
+	c.state = state
+
+	if logDebug() {
+		slog.Debug("reply", "remote", c.conn.RemoteAddr().String(), "reply", logReplyLine(*b))
+	}
 }
 
 func replyMsg(c *conn, msg string) {
 	reply(c, msg, connStateSendWord)
 }
 
+// replyJob sends line and then body, which is sent from the job's own
+// buffer and must end in CRLF.
+func replyJob(c *conn, line string, body []byte) {
+	c.replyBody = body
+	reply(c, line, connStateSendJob)
+}
+
 func reply(c *conn, msg string, state connState) {
 	if c == nil {
 		return
@@ -324,55 +1862,145 @@ func reply(c *conn, msg string, state connState) {
 	c.reply = msg
 	c.state = state
 
-	fmt.Printf("reply %s\n", msg)
+	if logDebug() {
+		slog.Debug("reply", "remote", c.conn.RemoteAddr().String(), "reply", logReplyLine([]byte(msg)))
+	}
 }
 
 func countCurConns() int {
-	return curConnCount
+	return int(curConnCount.Load())
 }
 
-func getDelayedJobCount() uint {
-	// FIXME
-	return 0
-}
+// fmtStats lists beanstalkd's stats fields in beanstalkd's order, then
+// the ones only dispatch has. The counters of commands dispatch does not
+// implement, and current-workers, which counts connections that have
+// reserved, are left out rather than always 0. current-waiting counts the
+// SQS receives and RESP pops waiting for a job.
+func fmtStats() statsDict {
+	ws := walStats(wal)
 
-type fmtFunc func(data ...interface{}) string
+	utime, stime := rusage()
 
-var statsFmt = "---\n" +
-	"current-jobs-urgent: %d\n" +
-	"current-jobs-ready: %d\n" +
-	"current-jobs-reserved: %d\n" +
-	"current-jobs-delayed: %d\n" +
-	"current-jobs-buried: %d\n" +
-	"cmd-put: %d\n" +
-	"cmd-use: %d\n" +
-	"cmd-stats: %d\n" +
-	"current-connections: %d\n"
+	jobsMu.Lock()
+	gs, ready, delayed := globalStat, readyCount, delayedCount
+	tubeCount := len(tubes)
+	maxSize := maxJobSize
+	held, scheduleCount := heldCount, len(schedules)
+	jobsMu.Unlock()
 
-func fmtStats(data ...interface{}) string {
-	return fmt.Sprintf(statsFmt,
-		globalStat.urgentCount,
-		readyCount,
-		globalStat.reservedCount,
-		getDelayedJobCount(),
-		globalStat.buriedCount,
-		opCount[opPut],
-		opCount[opUse],
-		opCount[opStats],
-		countCurConns(),
-	)
+	var d statsDict
+	d.add("current-jobs-urgent", gs.urgentCount)
+	d.add("current-jobs-ready", ready)
+	d.add("current-jobs-reserved", gs.reservedCount)
+	d.add("current-jobs-delayed", delayed)
+	d.add("current-jobs-buried", gs.buriedCount)
+	d.add("cmd-put", opCount[opPut].Load())
+	d.add("cmd-use", opCount[opUse].Load())
+	d.add("cmd-stats", opCount[opStats].Load())
+	d.add("job-timeouts", gs.timeoutCount)
+	d.add("total-jobs", gs.totalJobsCount)
+	d.add("max-job-size", maxSize)
+	d.add("current-tubes", tubeCount)
+	d.add("current-connections", countCurConns())
+	d.add("current-producers", producerCount.Load())
+	d.add("current-waiting", awaitCount.Load())
+	d.add("total-connections", totalConnCount.Load())
+	d.add("pid", os.Getpid())
+	d.add("version", version)
+	d.add("rusage-utime", utime)
+	d.add("rusage-stime", stime)
+	d.add("uptime", int64(time.Since(startTime).Seconds()))
+	d.add("binlog-oldest-index", ws.oldestIndex)
+	d.add("binlog-current-index", ws.currentIndex)
+	d.add("binlog-records-migrated", ws.recordsMigrated)
+	d.add("binlog-records-written", ws.recordsWritten)
+	d.add("binlog-max-size", ws.maxSize)
+	d.add("draining", draining.Load())
+	d.add("id", serverID)
+	d.add("hostname", hostname)
+	d.add("os", runtime.GOOS)
+	d.add("platform", runtime.GOARCH)
+	d.add("cmd-verify", opCount[opVerify].Load())
+	d.add("cmd-snapshot", opCount[opSnapshot].Load())
+	d.add("accept-errors", acceptErrorCount.Load())
+	d.add("refused-connections", refusedConnCount.Load())
+	d.add("tls-handshake-errors", tlsHandshakeErrorCount.Load())
+	d.add("current-authenticated-connections", authConnCount.Load())
+	d.add("binlog-fsync-policy", walSyncPolicy())
+	d.add("binlog-fsync-interval-ms", binlogSyncRate.Milliseconds())
+	d.add("throttled-reads", throttledCount.Load())
+	d.add("auth-failures", authFailCount.Load())
+	d.add("tube-full-rejections", tubeFullCount.Load())
+	d.add("job-expirations", expiredCount.Load())
+	d.add("cmd-put-unique", opCount[opPutUnique].Load())
+	d.add("put-duplicates", dedupCount.Load())
+	d.add("current-jobs-held", held)
+	d.add("cmd-put-after", opCount[opPutAfter].Load())
+	d.add("cmd-put-headers", opCount[opPutHeaders].Load())
+	d.add("cmd-hello", opCount[opHello].Load())
+	d.add("cmd-shutdown", opCount[opShutdown].Load())
+	d.add("current-schedules", scheduleCount)
+	d.add("schedule-fires", scheduleFireCount.Load())
+	d.add("schedule-misses", scheduleMissCount.Load())
+	d.add("tubes-deleted", tubeDeletedCount.Load())
+	d.add("total-binary-connections", binaryConnCount.Load())
+	d.add("total-jobs-compressed", compressedJobCount.Load())
+	d.add("compress-saved-bytes", compressSavedBytes.Load())
+	d.add("mirror-sent", mirrorSentCount.Load())
+	d.add("mirror-dropped", mirrorDroppedCount.Load())
+	d.add("mirror-errors", mirrorErrorCount.Load())
+	d.add("nats-published", natsPublishedCount.Load())
+	d.add("nats-dropped", natsDroppedCount.Load())
+	d.add("nats-errors", natsErrorCount.Load())
+	d.add("events-sent", eventSentCount.Load())
+	d.add("events-dropped", eventDroppedCount.Load())
+	d.add("events-errors", eventErrorCount.Load())
+	d.add("tls-reloads", tlsReloadCount.Load())
+	d.add("denied-connections", deniedConnCount.Load())
+	d.add("put-rate-delays", putDelayedCount.Load())
+	d.add("put-rate-rejections", putRejectedCount.Load())
+	originStats(&d)
+	return d
 }
 
-func doStats(c *conn, fmtFn fmtFunc, data ...interface{}) {
-	res := fmtFn(data)
-	replyLine(c, connStateSendJob, "OK %s\r\n", res)
+// doStats replies the dictionary fn returns, framed as OK <bytes>.
+func doStats(c *conn, fn statsFunc) {
+	d := fn()
+	var res []byte
+	if c != nil && c.statsJSON {
+		res = d.json()
+	} else {
+		res = d.yaml()
+	}
+	b := newReply(c)
+	*b = append(*b, msgOK...)
+	*b = strconv.AppendInt(*b, int64(len(res)), 10)
+	*b = append(*b, "\r\n"...)
+	*b = append(*b, res...)
+	*b = append(*b, "\r\n"...)
+	replyBytes(c, b, connStateSendJob)
 }
 
 func connClose(c *conn) {
+	connFlush(c)
+	evloopForget(c)
+	c.cancel()
 	if err := c.conn.Close(); err != nil {
 		// TODO log error
 	}
-	curConnCount = curConnCount - 1
+	curConnCount.Add(-1)
+	connsMu.Lock()
+	delete(conns, c)
+	connsMu.Unlock()
+	if c.identity != "" {
+		authConnCount.Add(-1)
+	}
+	if c.producer {
+		producerCount.Add(-1)
+	}
+	jobsMu.Lock()
+	c.use.users--
+	jobsMu.Unlock()
 	// TODO clean
 
 }
@@ -0,0 +1,129 @@
+package dispatch
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// /metrics on the admin listener exports the server's counters in the
+// Prometheus text format, globally and per tube. Servers can have many
+// thousands of tubes, so only the -metrics-max-tubes deepest are exported
+// per tube; dispatch_metrics_tubes_omitted says how many were left out.
+
+var metricsMaxTubes = 1000
+
+type metricsTube struct {
+	name string
+	stat tubeStats
+	// pauseLeft is the number of seconds the tube remains paused for.
+	pauseLeft int64
+}
+
+func adminMetrics(w http.ResponseWriter, r *http.Request) {
+	now := clock.Now()
+	jobsMu.Lock()
+	all := make([]metricsTube, 0, len(tubes))
+	for _, t := range tubes {
+		all = append(all, metricsTube{t.name, t.stat, apiTubeOf(t, now).PauseTimeLeft})
+	}
+	ready, delayed := readyCount, delayedCount
+	reserved, buried := globalStat.reservedCount, globalStat.buriedCount
+	held := heldCount
+	totalJobs := globalStat.totalJobsCount
+	jobsMu.Unlock()
+
+	sort.Slice(all, func(i, k int) bool {
+		di, dk := metricsDepth(&all[i].stat), metricsDepth(&all[k].stat)
+		if di != dk {
+			return di > dk
+		}
+		return all[i].name < all[k].name
+	})
+	omitted := 0
+	if len(all) > metricsMaxTubes {
+		omitted = len(all) - metricsMaxTubes
+		all = all[:metricsMaxTubes]
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	metricsHead(w, "dispatch_jobs", "gauge", "Jobs by state.")
+	fmt.Fprintf(w, "dispatch_jobs{state=\"ready\"} %d\n", ready)
+	fmt.Fprintf(w, "dispatch_jobs{state=\"delayed\"} %d\n", delayed)
+	fmt.Fprintf(w, "dispatch_jobs{state=\"reserved\"} %d\n", reserved)
+	fmt.Fprintf(w, "dispatch_jobs{state=\"buried\"} %d\n", buried)
+	fmt.Fprintf(w, "dispatch_jobs{state=\"held\"} %d\n", held)
+
+	metricsHead(w, "dispatch_jobs_total", "counter", "Jobs created.")
+	fmt.Fprintf(w, "dispatch_jobs_total %d\n", totalJobs)
+
+	metricsHead(w, "dispatch_commands_total", "counter", "Commands handled, by command.")
+	for op := opType(0); op < opUnknown; op++ {
+		fmt.Fprintf(w, "dispatch_commands_total{cmd=\"%s\"} %d\n", strings.TrimSpace(opNames[op]), opCount[op].Load())
+	}
+
+	metricsHead(w, "dispatch_connections", "gauge", "Open connections.")
+	fmt.Fprintf(w, "dispatch_connections %d\n", countCurConns())
+	metricsHead(w, "dispatch_connections_total", "counter", "Connections accepted.")
+	fmt.Fprintf(w, "dispatch_connections_total %d\n", totalConnCount.Load())
+
+	metricsHead(w, "dispatch_uptime_seconds", "gauge", "Seconds since the server started.")
+	fmt.Fprintf(w, "dispatch_uptime_seconds %d\n", int64(time.Since(startTime).Seconds()))
+
+	metricsHead(w, "dispatch_tubes", "gauge", "Tubes in existence.")
+	fmt.Fprintf(w, "dispatch_tubes %d\n", len(all)+omitted)
+	metricsHead(w, "dispatch_metrics_tubes_omitted", "gauge", "Tubes left out of the per-tube metrics by -metrics-max-tubes.")
+	fmt.Fprintf(w, "dispatch_metrics_tubes_omitted %d\n", omitted)
+
+	metricsHead(w, "dispatch_tube_jobs", "gauge", "Jobs in the tube, by state.")
+	for _, t := range all {
+		name := metricsLabel(t.name)
+		fmt.Fprintf(w, "dispatch_tube_jobs{tube=\"%s\",state=\"ready\"} %d\n", name, t.stat.ready)
+		fmt.Fprintf(w, "dispatch_tube_jobs{tube=\"%s\",state=\"delayed\"} %d\n", name, t.stat.delayed)
+		fmt.Fprintf(w, "dispatch_tube_jobs{tube=\"%s\",state=\"reserved\"} %d\n", name, t.stat.reserved)
+		fmt.Fprintf(w, "dispatch_tube_jobs{tube=\"%s\",state=\"buried\"} %d\n", name, t.stat.buried)
+		fmt.Fprintf(w, "dispatch_tube_jobs{tube=\"%s\",state=\"held\"} %d\n", name, t.stat.held)
+	}
+	// SQS long polls are not counted, and there is no other way to wait
+	// for a job, so this is always 0; it is exported so that dashboards
+	// need not change when there is.
+	metricsHead(w, "dispatch_tube_waiting", "gauge", "Clients waiting to reserve from the tube.")
+	metricsTubeValues(w, "dispatch_tube_waiting", all, func(t *metricsTube) uint64 { return 0 })
+	metricsHead(w, "dispatch_tube_pause_remaining_seconds", "gauge", "Seconds until the tube is unpaused.")
+	metricsTubeValues(w, "dispatch_tube_pause_remaining_seconds", all, func(t *metricsTube) uint64 { return uint64(t.pauseLeft) })
+
+	metricsHead(w, "dispatch_tube_puts_total", "counter", "Jobs put into the tube.")
+	metricsTubeValues(w, "dispatch_tube_puts_total", all, func(t *metricsTube) uint64 { return t.stat.puts })
+	metricsHead(w, "dispatch_tube_deletes_total", "counter", "Jobs deleted from the tube.")
+	metricsTubeValues(w, "dispatch_tube_deletes_total", all, func(t *metricsTube) uint64 { return t.stat.deletes })
+	metricsHead(w, "dispatch_tube_timeouts_total", "counter", "Reservations in the tube that timed out.")
+	metricsTubeValues(w, "dispatch_tube_timeouts_total", all, func(t *metricsTube) uint64 { return t.stat.timeouts })
+	metricsHead(w, "dispatch_tube_expired_total", "counter", "Jobs in the tube deleted by expiry.")
+	metricsTubeValues(w, "dispatch_tube_expired_total", all, func(t *metricsTube) uint64 { return t.stat.expired })
+}
+
+func metricsDepth(s *tubeStats) int {
+	return s.ready + s.delayed + s.reserved + s.buried + s.held
+}
+
+func metricsHead(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func metricsTubeValues(w io.Writer, name string, all []metricsTube, value func(*metricsTube) uint64) {
+	for i := range all {
+		fmt.Fprintf(w, "%s{tube=\"%s\"} %d\n", name, metricsLabel(all[i].name), value(&all[i]))
+	}
+}
+
+var metricsLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// metricsLabel escapes a label value. Tube names are restricted by the
+// protocol, but tubes loaded from storage or config are not checked.
+func metricsLabel(s string) string {
+	return metricsLabelEscaper.Replace(s)
+}
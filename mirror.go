@@ -0,0 +1,145 @@
+package dispatch
+
+import (
+	"context"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jkasarherou/dispatch/client"
+)
+
+// A tube can be mirrored to another server, dispatch or beanstalkd, which
+// is then sent a copy of each job put into it:
+//
+//	[tube."orders"]
+//	mirror = "dc2.example.com:3333"
+//
+// This fans jobs out to another datacenter, or lets producers move to a
+// new server while their consumers still drain the old one. Copies are
+// sent in the background, in the order they were put, into the tube of
+// the same name with the job's priority, delay and TTR; headers are kept
+// and put-after's dependencies, which name jobs of this server, are not.
+// If the remote server is down the copies wait for it in a queue of
+// mirrorQueueSize jobs per remote, and once that is full later copies
+// are dropped; a copy the remote server refuses is dropped too. stats
+// count copies as mirror-sent, mirror-dropped and mirror-errors. The
+// mirror authenticates with $DISPATCH_TOKEN, as the client subcommands
+// do. A tube must not be mirrored back to the server it is mirrored from,
+// or its jobs go round for ever.
+
+const (
+	// mirrorQueueSize is the number of copies waiting for a remote server
+	// at most.
+	mirrorQueueSize = 4096
+
+	// mirrorRetryMax caps the wait between attempts to reach a remote.
+	mirrorRetryMax = 30 * time.Second
+)
+
+// mirrorJob is a copy of a job, made when it was put.
+type mirrorJob struct {
+	tube            string
+	pri, delay, ttr uint64
+	// body is as stored, CRLF included, gzipped if compressed is set.
+	body       []byte
+	compressed bool
+	headers    []jobHeader
+}
+
+// mirror sends the copies for one remote server.
+type mirror struct {
+	addr string
+	q    chan *mirrorJob
+}
+
+// mirrors are by remote address. A mirror is made when a job is first put
+// into a tube mirrored to its address, and kept until the server exits.
+// Guarded by jobsMu.
+var mirrors = map[string]*mirror{}
+
+// mirrorPut queues a copy of j, which has just been put, for the remote
+// server of its tube. The caller must hold jobsMu.
+func mirrorPut(j *job) {
+	m := mirrors[j.tube.mirror]
+	if m == nil {
+		m = &mirror{addr: j.tube.mirror, q: make(chan *mirrorJob, mirrorQueueSize)}
+		mirrors[m.addr] = m
+		go m.run()
+	}
+	mj := &mirrorJob{
+		tube:       j.tube.name,
+		pri:        j.pri,
+		delay:      j.delay,
+		ttr:        j.ttr,
+		body:       append([]byte(nil), j.body...),
+		compressed: j.compressed,
+		headers:    j.headers,
+	}
+	select {
+	case m.q <- mj:
+	default:
+		mirrorDroppedCount.Add(1)
+	}
+}
+
+func (m *mirror) run() {
+	ctx := context.Background()
+	var cc *client.Conn
+	var use string
+	retry := time.Second
+	for mj := range m.q {
+		for {
+			if cc == nil {
+				var err error
+				if cc, err = cliDial(ctx, m.addr); err != nil {
+					mirrorErrorCount.Add(1)
+					slog.Warn("mirror unreachable", "addr", m.addr, "err", err, "retry", retry)
+					time.Sleep(retry)
+					retry = min(retry*2, mirrorRetryMax)
+					continue
+				}
+				use = defaultTubeName
+			}
+			reply, err := m.send(ctx, cc, &use, mj)
+			if err != nil {
+				mirrorErrorCount.Add(1)
+				slog.Warn("mirror failed", "addr", m.addr, "err", err)
+				cc.Abort()
+				cc = nil
+				continue
+			}
+			retry = time.Second
+			if strings.HasPrefix(reply, "INSERTED ") {
+				mirrorSentCount.Add(1)
+			} else {
+				mirrorDroppedCount.Add(1)
+				slog.Warn("mirror refused job", "addr", m.addr, "tube", mj.tube, "reply", reply)
+			}
+			break
+		}
+	}
+}
+
+// send puts mj on cc, which uses the tube *use, and returns the reply.
+func (m *mirror) send(ctx context.Context, cc *client.Conn, use *string, mj *mirrorJob) (string, error) {
+	if *use != mj.tube {
+		if _, err := cc.Expect(ctx, "USING ", cmdUse+mj.tube, nil); err != nil {
+			return "", err
+		}
+		*use = mj.tube
+	}
+	body := mj.body
+	if mj.compressed {
+		body = jobBody(&job{body: body, compressed: true})
+	}
+	body = body[:len(body)-2]
+	line := cmdPut
+	if len(mj.headers) > 0 {
+		line = cmdPutHeaders + headersFormat(mj.headers) + " "
+	}
+	line += strconv.FormatUint(mj.pri, 10) + " " + strconv.FormatUint(mj.delay, 10) + " " +
+		strconv.FormatUint(mj.ttr, 10) + " " + strconv.Itoa(len(body))
+	return cc.Cmd(ctx, line, body)
+}
@@ -0,0 +1,191 @@
+package dispatch
+
+import (
+	"io"
+	"strconv"
+
+	"github.com/jkasarherou/dispatch/protocol"
+)
+
+// mput is an extension for bulk producers: one command carries many jobs
+// and gets one reply, saving a round trip per job.
+//
+//	mput <count>\r\n
+//	<pri> <delay> <ttr> <bytes>\r\n
+//	<data>\r\n
+//	... count times
+//
+// The jobs go into the tube in use. The reply gives, in order, each job's
+// id or the reason it was refused (JOB_TOO_BIG, DELAY_TOO_LONG,
+// RATE_LIMITED, EXPECTED_CRLF, TUBE_FULL or INTERNAL_ERROR):
+//
+//	INSERTED_BATCH <id-or-reason> ...\r\n
+//
+// A job line that does not parse loses the framing, so it is answered
+// BAD_FORMAT and the connection is closed. Standard clients never send
+// mput and are unaffected.
+
+const cmdMput = "mput "
+
+// mputJob is a job read from an mput, or why it was refused.
+type mputJob struct {
+	j      *job
+	refuse string
+}
+
+// mputRead reads the n jobs of an mput. It fails if their framing is lost.
+func mputRead(c *conn, n int) ([]mputJob, error) {
+	jobs := make([]mputJob, 0, n)
+	for i := 0; i < n; i++ {
+		// A job line too long to be one loses the framing.
+		line, err := readLine(c.reader, lineBufSize)
+		if err != nil {
+			mputFree(jobs)
+			return nil, err
+		}
+		pri, delay, ttr, size, err := protocol.ParseJobLine(line)
+		if err != nil {
+			mputFree(jobs)
+			return nil, err
+		}
+
+		if size > c.use.maxJobSize.Load() {
+			if err := bodyDiscard(c.reader, size); err != nil {
+				mputFree(jobs)
+				return nil, err
+			}
+			jobs = append(jobs, mputJob{refuse: protocol.JobTooBig})
+			continue
+		}
+		pri, delay, ttr, err = c.use.limits.Load().limit(pri, delay, ttr, putAll)
+		if err != nil {
+			refuse := protocol.InternalError
+			if err == errDelayTooLong {
+				refuse = protocol.DelayTooLong
+			}
+			if err := bodyDiscard(c.reader, size); err != nil {
+				mputFree(jobs)
+				return nil, err
+			}
+			jobs = append(jobs, mputJob{refuse: refuse})
+			continue
+		}
+		if !tubePutAdmit(c.ctx, c.use) {
+			if err := bodyDiscard(c.reader, size); err != nil {
+				mputFree(jobs)
+				return nil, err
+			}
+			jobs = append(jobs, mputJob{refuse: protocol.RateLimited})
+			continue
+		}
+		j := makeJob(pri, delay, ttr, size+2)
+		if err := bodyRead(c.reader, j.body); err != nil {
+			bodyFree(j.body)
+			mputFree(jobs)
+			return nil, err
+		}
+		if !bodyEnded(j.body) {
+			bodyFree(j.body)
+			jobs = append(jobs, mputJob{refuse: protocol.ExpectedCRLF})
+			continue
+		}
+		jobs = append(jobs, mputJob{j: j})
+	}
+	return jobs, nil
+}
+
+func mputFree(jobs []mputJob) {
+	for _, mj := range jobs {
+		if mj.j != nil {
+			bodyFree(mj.j.body)
+		}
+	}
+}
+
+// mputSkip reads and drops the n jobs of an mput that is refused as a
+// whole, so that the next command is read from the right place. Nothing is
+// allocated for the bodies, and a body larger than the tube allows loses
+// the framing, so a refused client cannot make the server hold or read
+// more than n jobs of the largest size. It reports whether the framing
+// held.
+func mputSkip(c *conn, n int) bool {
+	for i := 0; i < n; i++ {
+		line, err := readLine(c.reader, lineBufSize)
+		if err != nil {
+			return false
+		}
+		_, _, _, size, err := protocol.ParseJobLine(line)
+		if err != nil || size > c.use.maxJobSize.Load() {
+			return false
+		}
+		if _, err := io.CopyN(io.Discard, c.reader, int64(size)); err != nil {
+			return false
+		}
+		if err := eolDiscard(c.reader); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func doMput(c *conn, n int) {
+	opCount[opMput].Add(1)
+	spanString(c.span, "dispatch.tube", c.use.name)
+	spanInt(c.span, "dispatch.jobs", int64(n))
+
+	// Refuse before reading a body, so that a refused client neither
+	// has bodies allocated for it nor spends the tube's put rate.
+	refuse := ""
+	if draining.Load() {
+		refuse = msgDraining
+	} else if !authorizeCmd(c, opPut, c.use.name) {
+		refuse = msgForbidden
+	}
+	if refuse != "" {
+		if !mputSkip(c, n) {
+			replyMsg(c, msgBadFmt)
+			c.state = connStateClose
+			return
+		}
+		replyMsg(c, refuse)
+		return
+	}
+
+	jobs, err := mputRead(c, n)
+	if err != nil {
+		replyMsg(c, msgBadFmt)
+		c.state = connStateClose
+		return
+	}
+
+	b := newReply(c)
+	*b = append(*b, protocol.InsertedBatch...)
+	for _, mj := range jobs {
+		*b = append(*b, ' ')
+		if mj.j == nil {
+			*b = append(*b, mj.refuse...)
+			continue
+		}
+		j := mj.j
+		j.tube = c.use
+		j.origin = c.origin
+		if err := jobInsert(j, c.span); err != nil {
+			bodyFree(j.body)
+			if err == errTubeFull {
+				*b = append(*b, protocol.TubeFull...)
+			} else {
+				*b = append(*b, protocol.InternalError...)
+			}
+			continue
+		}
+		*b = strconv.AppendUint(*b, j.id, 10)
+		c.cmdJob = j.id
+	}
+	*b = append(*b, "\r\n"...)
+
+	if !c.producer {
+		c.producer = true
+		producerCount.Add(1)
+	}
+	replyBytes(c, b, connStateSendWord)
+}
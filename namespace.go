@@ -0,0 +1,116 @@
+package dispatch
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/jkasarherou/dispatch/protocol"
+)
+
+// [namespace."identity"] sections of the config file confine an
+// authenticated identity to the tubes whose names start with a prefix, so
+// that teams can share a server without their tube names colliding:
+//
+//	[namespace."billing"]
+//	prefix = "billing."
+//
+// The prefix is added to the tube names the identity's clients give and
+// left out of those they are told: a billing client that uses "emails"
+// puts into "billing.emails", and is moved to "billing.default" once it
+// has authenticated. Its stats count only the jobs and tubes of its
+// namespace, and through gRPC it cannot reach the jobs of other tubes by
+// id. -authz rules and [tube."name"] sections see full tube names.
+// Identities without a namespace see every tube, as before. Identities may
+// share a prefix, but no prefix may start another, as "billing" would
+// "billing2": every tube of the second namespace would be in the first.
+
+// namespaces maps identities to their prefixes. It is filled in before the
+// server starts, and replaced when the config is reloaded. It is guarded by
+// jobsMu once the server is running.
+var namespaces = map[string]string{}
+
+func configNamespace(nss map[string]string, identity string, e configEntry) error {
+	if identity == "" {
+		return fmt.Errorf("namespace section without an identity")
+	}
+	switch e.key {
+	case "prefix":
+		if !protocol.ValidTubeName(e.value) {
+			return fmt.Errorf("prefix: bad prefix %q", e.value)
+		}
+		nss[identity] = e.value
+	default:
+		return fmt.Errorf("unknown namespace setting %s", e.key)
+	}
+	return nil
+}
+
+// nsCheck reports two namespaces in nss whose prefixes overlap.
+func nsCheck(nss map[string]string) error {
+	identities := make([]string, 0, len(nss))
+	for identity := range nss {
+		identities = append(identities, identity)
+	}
+	sort.Strings(identities)
+	for _, a := range identities {
+		for _, b := range identities {
+			if nss[a] != nss[b] && strings.HasPrefix(nss[b], nss[a]) {
+				return fmt.Errorf("namespace %q: prefix %q starts the prefix %q of namespace %q", a, nss[a], nss[b], b)
+			}
+		}
+	}
+	return nil
+}
+
+// nsPrefix returns the prefix of identity's namespace, empty if it has
+// none.
+func nsPrefix(identity string) string {
+	if identity == "" {
+		return ""
+	}
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	return namespaces[identity]
+}
+
+// nsEnter moves c, which has just authenticated, to the default tube of
+// its namespace, or to the default tube if it has none, so that nothing of
+// an earlier identity's namespace stays with it.
+func nsEnter(c *conn) {
+	c.use = tubeUse(c.use, nsPrefix(c.identity)+defaultTubeName)
+}
+
+// nsStats lists the stats of the tubes in the namespace prefix: the jobs
+// in them by state, how many there are, and the jobs put into them.
+func nsStats(prefix string) statsDict {
+	var s tubeStats
+	tubeCount := 0
+	jobsMu.Lock()
+	for name, t := range tubes {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		tubeCount++
+		s.ready += t.stat.ready
+		s.reserved += t.stat.reserved
+		s.delayed += t.stat.delayed
+		s.buried += t.stat.buried
+		s.held += t.stat.held
+		s.puts += t.stat.puts
+	}
+	jobsMu.Unlock()
+
+	var d statsDict
+	d.add("current-jobs-ready", s.ready)
+	d.add("current-jobs-reserved", s.reserved)
+	d.add("current-jobs-delayed", s.delayed)
+	d.add("current-jobs-buried", s.buried)
+	d.add("current-jobs-held", s.held)
+	d.add("current-tubes", tubeCount)
+	d.add("total-jobs", s.puts)
+	d.add("version", version)
+	d.add("id", serverID)
+	d.add("namespace", prefix)
+	return d
+}
@@ -0,0 +1,51 @@
+package dispatch
+
+import "testing"
+
+func TestNsCheck(t *testing.T) {
+	tests := []struct {
+		name string
+		nss  map[string]string
+		ok   bool
+	}{
+		{"none", map[string]string{}, true},
+		{"apart", map[string]string{"a": "billing.", "b": "search."}, true},
+		{"shared", map[string]string{"a": "billing.", "b": "billing."}, true},
+		{"overlapping", map[string]string{"a": "a", "b": "ab"}, false},
+		{"overlapping other way", map[string]string{"a": "ab", "b": "a"}, false},
+		{"overlapping with separator", map[string]string{"a": "billing.", "b": "billing.eu."}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := nsCheck(tt.nss)
+			if (err == nil) != tt.ok {
+				t.Errorf("got %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestNsEnter(t *testing.T) {
+	serverReset()
+	t.Cleanup(serverReset)
+	saved := namespaces
+	namespaces = map[string]string{"billing": "billing."}
+	t.Cleanup(func() { namespaces = saved })
+
+	c := &conn{}
+	c.use = tubeUse(nil, defaultTubeName)
+	for _, step := range []struct{ identity, want string }{
+		{"billing", "billing.default"},
+		{"ops", "default"},
+		{"billing", "billing.default"},
+	} {
+		c.identity = step.identity
+		nsEnter(c)
+		if c.use.name != step.want {
+			t.Errorf("as %s: using %q, want %q", step.identity, c.use.name, step.want)
+		}
+	}
+	if u := tubes["billing.default"].users; u != 1 {
+		t.Errorf("billing.default has %d users, want 1", u)
+	}
+}
@@ -0,0 +1,141 @@
+//go:build nats
+
+package dispatch
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// natsFlushTimeout bounds how long stopping the bridge waits for the jobs
+// still queued to be published.
+const natsFlushTimeout = 5 * time.Second
+
+// natsStart starts the bridge described in bridge.go. The returned
+// function stops it, publishing what is queued first.
+func natsStart() (func(), error) {
+	if natsPutPrefix != "" && (strings.ContainsAny(natsPutPrefix, " \t*>") || strings.HasSuffix(natsPutPrefix, ".")) {
+		return nil, errors.New("-nats-put-prefix must be a subject without wildcards")
+	}
+	nc, err := nats.Connect(natsURL,
+		nats.Name("dispatch "+serverID),
+		nats.RetryOnFailedConnect(true),
+		nats.MaxReconnects(-1),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			if err != nil {
+				slog.Warn("NATS bridge disconnected", "err", err)
+			}
+		}),
+		nats.ReconnectHandler(func(nc *nats.Conn) {
+			slog.Info("NATS bridge reconnected", "server", nc.ConnectedUrlRedacted())
+		}),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	var sub *nats.Subscription
+	ctx, cancel := context.WithCancel(context.Background())
+	if natsPutPrefix != "" {
+		sub, err = nc.QueueSubscribe(natsPutPrefix+".>", natsQueueGroup, func(m *nats.Msg) {
+			natsDeliver(ctx, m)
+		})
+		if err != nil {
+			cancel()
+			nc.Close()
+			return nil, err
+		}
+	}
+	slog.Info("NATS bridge started", "put-prefix", natsPutPrefix)
+
+	q := make(chan *natsJob, natsQueueSize)
+	jobsMu.Lock()
+	natsQueue = q
+	jobsMu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		natsRun(nc, q)
+	}()
+
+	return func() {
+		if sub != nil {
+			sub.Drain()
+		}
+		jobsMu.Lock()
+		natsQueue = nil
+		jobsMu.Unlock()
+		close(q)
+		select {
+		case <-done:
+		case <-time.After(natsFlushTimeout):
+			slog.Warn("jobs not all published to NATS", "queued", len(q))
+		}
+		nc.FlushTimeout(natsFlushTimeout)
+		cancel()
+		nc.Close()
+	}, nil
+}
+
+// natsDeliver puts the message m and answers it if it is a request.
+func natsDeliver(ctx context.Context, m *nats.Msg) {
+	headers := make(map[string]any, len(m.Header))
+	for k, v := range m.Header {
+		if len(v) > 0 {
+			headers[strings.ToLower(k)] = v[0]
+		}
+	}
+	tube := strings.TrimPrefix(m.Subject, natsPutPrefix+".")
+	id, err := bridgePut(ctx, originNATS, tube, headers, m.Data)
+	var reply string
+	switch {
+	case err == nil:
+		reply = "INSERTED " + strconv.FormatUint(id, 10)
+	case errors.Is(err, errBridgeReject):
+		natsErrorCount.Add(1)
+		slog.Warn("NATS message rejected", "subject", m.Subject, "err", err)
+		reply = "REJECTED " + strings.TrimPrefix(err.Error(), errBridgeReject.Error()+": ")
+	default:
+		natsErrorCount.Add(1)
+		slog.Warn("NATS message not put", "subject", m.Subject, "err", err)
+		reply = "ERROR " + err.Error()
+	}
+	if m.Reply != "" {
+		m.Respond([]byte(reply))
+	}
+}
+
+// natsRun publishes the jobs from q until q is closed. While NATS is
+// unreachable the client buffers what is published, and refuses it once
+// its buffer is full.
+func natsRun(nc *nats.Conn, q chan *natsJob) {
+	for nj := range q {
+		body := nj.body
+		if nj.compressed {
+			body = jobBody(&job{body: body, compressed: true})
+		}
+		m := nats.NewMsg(nj.subject)
+		m.Data = body[:len(body)-2]
+		for _, h := range nj.headers {
+			m.Header.Set(h.key, h.value)
+		}
+		m.Header.Set("Dispatch-Job", strconv.FormatUint(nj.id, 10))
+		m.Header.Set("Dispatch-Tube", nj.tube)
+		m.Header.Set("Dispatch-Pri", strconv.FormatUint(nj.pri, 10))
+		m.Header.Set("Dispatch-Delay", strconv.FormatUint(nj.delay, 10))
+		m.Header.Set("Dispatch-TTR", strconv.FormatUint(nj.ttr, 10))
+		if err := nc.PublishMsg(m); err != nil {
+			natsErrorCount.Add(1)
+			natsDroppedCount.Add(1)
+			slog.Warn("job not published to NATS", "job", nj.id, "subject", nj.subject, "err", err)
+			continue
+		}
+		natsPublishedCount.Add(1)
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !nats
+
+package dispatch
+
+import "errors"
+
+func natsStart() (func(), error) {
+	return nil, errors.New("the NATS bridge is not compiled in; build with -tags nats")
+}
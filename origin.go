@@ -0,0 +1,43 @@
+package dispatch
+
+import "sync/atomic"
+
+// origin identifies the listener a connection, and the jobs put through
+// it, arrived on. Jobs recovered from storage have originUnknown.
+type origin uint8
+
+const (
+	originUnknown origin = iota
+	originText
+	originUnix
+	originHTTP
+	originGRPC
+	originSchedule
+	originAMQP
+	originNATS
+	originSQS
+	originRESP
+	originCount
+)
+
+var originNames = [originCount]string{
+	originUnknown:  "unknown",
+	originText:     "text",
+	originUnix:     "unix",
+	originHTTP:     "http",
+	originGRPC:     "grpc",
+	originSchedule: "schedule",
+	originAMQP:     "amqp",
+	originNATS:     "nats",
+	originSQS:      "sqs",
+	originRESP:     "resp",
+}
+
+var originJobCount [originCount]atomic.Uint64
+
+// originStats adds a total-jobs-<origin> count per origin to the stats.
+func originStats(d *statsDict) {
+	for o := originText; o < originCount; o++ {
+		d.add("total-jobs-"+originNames[o], originJobCount[o].Load())
+	}
+}
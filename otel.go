@@ -0,0 +1,65 @@
+//go:build otel
+
+package dispatch
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// otelSetup exports spans over OTLP/HTTP, to -otel-endpoint or else to
+// wherever the standard OTEL_EXPORTER_OTLP_* variables point. The returned
+// function flushes pending spans.
+func otelSetup() (func(), error) {
+	var opts []otlptracehttp.Option
+	if otelEndpoint != "" {
+		opts = append(opts, otlptracehttp.WithEndpointURL(otelEndpoint))
+	}
+	exp, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", otelService))),
+	)
+	cmdTracer = otelTracer{tp.Tracer("dispatch")}
+	return func() { tp.Shutdown(context.Background()) }, nil
+}
+
+type otelTracer struct {
+	t trace.Tracer
+}
+
+func (t otelTracer) start(name string) span {
+	ctx, s := t.t.Start(context.Background(), name)
+	return &otelSpan{t: t.t, ctx: ctx, s: s}
+}
+
+type otelSpan struct {
+	t   trace.Tracer
+	ctx context.Context
+	s   trace.Span
+}
+
+func (s *otelSpan) child(name string) span {
+	ctx, c := s.t.Start(s.ctx, name)
+	return &otelSpan{t: s.t, ctx: ctx, s: c}
+}
+
+func (s *otelSpan) setString(key, val string)    { s.s.SetAttributes(attribute.String(key, val)) }
+func (s *otelSpan) setInt(key string, val int64) { s.s.SetAttributes(attribute.Int64(key, val)) }
+
+func (s *otelSpan) fail(err error) {
+	s.s.RecordError(err)
+	s.s.SetStatus(codes.Error, err.Error())
+}
+
+func (s *otelSpan) end() { s.s.End() }
@@ -0,0 +1,9 @@
+//go:build !otel
+
+package dispatch
+
+import "errors"
+
+func otelSetup() (func(), error) {
+	return nil, errors.New("OpenTelemetry tracing is not compiled in; build with -tags otel")
+}
@@ -0,0 +1,151 @@
+package protocol
+
+import (
+	"errors"
+	"strconv"
+)
+
+// The commands a dispatch server takes. The put commands and mput are
+// followed by job bodies, which are not part of the command line.
+const (
+	Put        = "put"
+	PutUnique  = "put-unique"
+	PutAfter   = "put-after"
+	PutHeaders = "put-headers"
+	Mput       = "mput"
+	Use        = "use"
+	Stats      = "stats"
+	Quit       = "quit"
+	Verify     = "verify"
+	Snapshot   = "snapshot"
+	Auth       = "auth"
+	Format     = "format"
+	Hello      = "hello"
+	Shutdown   = "shutdown"
+)
+
+// MaxArgs is the most arguments a command has besides a put's numbers.
+const MaxArgs = 2
+
+// MputMaxJobs caps the jobs in one mput.
+const MputMaxJobs = 1000
+
+var (
+	ErrUnknownCommand = errors.New(UnknownCommand)
+	ErrBadFormat      = errors.New(BadFormat)
+)
+
+// A Cmd is a parsed command line. Its arguments are slices of the line,
+// valid only as long as the line is.
+type Cmd struct {
+	// Name is the command, one of the constants above.
+	Name string
+
+	// Args are the arguments other than a put's numbers: the tube of
+	// use, the key of put-unique, the ids of put-after, the headers of
+	// put-headers, the token of auth, the format of format, the client
+	// and version of hello, repair for verify and the mode of shutdown if
+	// they are given. Only the first NArgs are set.
+	Args  [MaxArgs][]byte
+	NArgs int
+
+	// Pri, Delay, TTR and Size are the numbers of the put commands.
+	Pri, Delay, TTR, Size uint64
+
+	// Count is the number of jobs that follow an mput.
+	Count int
+}
+
+// grammar gives each command its name, the number of arguments it takes
+// besides a put's numbers, and whether it is a put.
+var grammar = map[string]struct {
+	name     string
+	min, max int
+	put      bool
+}{
+	Put:        {Put, 0, 0, true},
+	PutUnique:  {PutUnique, 1, 1, true},
+	PutAfter:   {PutAfter, 1, 1, true},
+	PutHeaders: {PutHeaders, 1, 1, true},
+	Mput:       {Mput, 1, 1, false},
+	Use:        {Use, 1, 1, false},
+	Stats:      {Stats, 0, 0, false},
+	Quit:       {Quit, 0, 0, false},
+	Verify:     {Verify, 0, 1, false},
+	Snapshot:   {Snapshot, 0, 0, false},
+	Auth:       {Auth, 1, 1, false},
+	Format:     {Format, 1, 1, false},
+	Hello:      {Hello, 2, 2, false},
+	Shutdown:   {Shutdown, 0, 1, false},
+}
+
+// ParseCommand parses a command line, CRLF or not. It returns
+// ErrUnknownCommand for a command it does not know and ErrBadFormat for
+// one with the wrong arguments, as the server replies. Arguments the
+// grammar leaves open, such as put-after's ids, are left to the caller to
+// read.
+func ParseCommand(line []byte) (Cmd, error) {
+	var c Cmd
+	var f [1 + MaxArgs + 4][]byte
+	n := Split(line, f[:])
+	if n == 0 {
+		return c, ErrUnknownCommand
+	}
+	g, ok := grammar[string(f[0])]
+	if !ok {
+		return c, ErrUnknownCommand
+	}
+	c.Name = g.name
+	args := n - 1
+	if g.put {
+		args -= 4
+	}
+	if n < 0 || args < g.min || args > g.max {
+		return c, ErrBadFormat
+	}
+	copy(c.Args[:], f[1:1+args])
+	c.NArgs = args
+	if g.put {
+		var ok bool
+		if c.Pri, c.Delay, c.TTR, c.Size, ok = putArgs(f[1+args : n]); !ok {
+			return c, ErrBadFormat
+		}
+	}
+
+	switch c.Name {
+	case Use:
+		if !ValidTubeName(string(c.Args[0])) {
+			return c, ErrBadFormat
+		}
+	case Mput:
+		count, ok := ParseUint(c.Args[0], 32)
+		if !ok || count < 1 || count > MputMaxJobs {
+			return c, ErrBadFormat
+		}
+		c.Count = int(count)
+	case Verify:
+		if c.NArgs == 1 && string(c.Args[0]) != "repair" {
+			return c, ErrBadFormat
+		}
+	case Shutdown:
+		if c.NArgs == 1 && string(c.Args[0]) != "graceful" && string(c.Args[0]) != "now" {
+			return c, ErrBadFormat
+		}
+	}
+	return c, nil
+}
+
+// AppendPut appends a put command line, CRLF included, for a body of size
+// bytes.
+func AppendPut(b []byte, pri, delay, ttr, size uint64) []byte {
+	b = append(b, Put...)
+	b = append(b, ' ')
+	b = strconv.AppendUint(b, pri, 10)
+	b = append(b, ' ')
+	b = strconv.AppendUint(b, delay, 10)
+	b = append(b, ' ')
+	b = strconv.AppendUint(b, ttr, 10)
+	b = append(b, ' ')
+	b = strconv.AppendUint(b, size, 10)
+	return append(b, "\r\n"...)
+}
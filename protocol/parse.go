@@ -0,0 +1,111 @@
+// Package protocol parses the command lines of dispatch's text protocol,
+// beanstalkd's with dispatch's extensions, and formats its lines. It does
+// no I/O and keeps no state, so the server, the dispatch tools and other
+// clients can share it, and it can be tested and fuzzed apart from any
+// connection.
+//
+// Command lines are parsed in place: fields are slices of the line and
+// numbers are read straight from its bytes, so that parsing a put
+// allocates nothing.
+package protocol
+
+import "strings"
+
+// Split stores the space-separated fields of line, whose CRLF is ignored,
+// in fields and returns how many there are, or -1 if there are more than
+// fit.
+func Split(line []byte, fields [][]byte) int {
+	n := 0
+	i := 0
+	for {
+		for i < len(line) && isSpace(line[i]) {
+			i++
+		}
+		if i == len(line) {
+			return n
+		}
+		j := i
+		for j < len(line) && !isSpace(line[j]) {
+			j++
+		}
+		if n == len(fields) {
+			return -1
+		}
+		fields[n] = line[i:j]
+		n++
+		i = j
+	}
+}
+
+func isSpace(b byte) bool {
+	return b == ' ' || b == '\t' || b == '\r' || b == '\n'
+}
+
+// ParseUint reads b as a decimal number of at most bits bits.
+func ParseUint(b []byte, bits uint) (uint64, bool) {
+	if len(b) == 0 {
+		return 0, false
+	}
+	max := uint64(1)<<bits - 1
+	var n uint64
+	for _, ch := range b {
+		if ch < '0' || ch > '9' {
+			return 0, false
+		}
+		d := uint64(ch - '0')
+		if n > (max-d)/10 {
+			return 0, false
+		}
+		n = n*10 + d
+	}
+	return n, true
+}
+
+// TubeNameMax is the longest tube name, in bytes.
+const TubeNameMax = 200
+
+// ValidTubeName reports whether name is a tube name beanstalkd would
+// take: 1 to TubeNameMax letters, digits and -+/;.$_() that do not start
+// with a -.
+func ValidTubeName(name string) bool {
+	if len(name) == 0 || len(name) > TubeNameMax || name[0] == '-' {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		switch ch := name[i]; {
+		case 'a' <= ch && ch <= 'z', 'A' <= ch && ch <= 'Z', '0' <= ch && ch <= '9':
+		case strings.IndexByte("-+/;.$_()", ch) >= 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// ParseJobLine reads the pri, delay, ttr and size of a job in an mput from
+// its line.
+func ParseJobLine(line []byte) (pri, delay, ttr, size uint64, err error) {
+	var f [4][]byte
+	if Split(line, f[:]) != len(f) {
+		return 0, 0, 0, 0, ErrBadFormat
+	}
+	if pri, delay, ttr, size, ok := putArgs(f[:]); ok {
+		return pri, delay, ttr, size, nil
+	}
+	return 0, 0, 0, 0, ErrBadFormat
+}
+
+// putArgs reads the pri, delay, ttr and size of a put from fields.
+func putArgs(fields [][]byte) (pri, delay, ttr, size uint64, ok bool) {
+	if pri, ok = ParseUint(fields[0], 32); !ok {
+		return
+	}
+	if delay, ok = ParseUint(fields[1], 32); !ok {
+		return
+	}
+	if ttr, ok = ParseUint(fields[2], 32); !ok {
+		return
+	}
+	size, ok = ParseUint(fields[3], 32)
+	return
+}
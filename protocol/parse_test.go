@@ -0,0 +1,168 @@
+package protocol
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseUint(t *testing.T) {
+	tests := []struct {
+		in     string
+		bits   uint
+		want   uint64
+		wantOK bool
+	}{
+		{"0", 32, 0, true},
+		{"1024", 32, 1024, true},
+		{"007", 32, 7, true},
+		{"4294967295", 32, 1<<32 - 1, true},
+		{"4294967296", 32, 0, false},
+		{"42949672950", 32, 0, false},
+		{"18446744073709551615", 64, 1<<64 - 1, true},
+		{"18446744073709551616", 64, 0, false},
+		{"99999999999999999999", 64, 0, false},
+		{"255", 8, 255, true},
+		{"256", 8, 0, false},
+		{"", 32, 0, false},
+		{"-1", 32, 0, false},
+		{"+1", 32, 0, false},
+		{"1x", 32, 0, false},
+		{" 1", 32, 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := ParseUint([]byte(tt.in), tt.bits)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("ParseUint(%q, %d) = %d, %v, want %d, %v", tt.in, tt.bits, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestSplit(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		max  int
+		want []string // nil for -1
+	}{
+		{"empty", "", 4, []string{}},
+		{"CRLF only", "\r\n", 4, []string{}},
+		{"spaces only", "   \t ", 4, []string{}},
+		{"one", "stats\r\n", 4, []string{"stats"}},
+		{"empty fields", "put  0 \t0   60 5\r\n", 5, []string{"put", "0", "0", "60", "5"}},
+		{"leading and trailing", "  use t  \r\n", 4, []string{"use", "t"}},
+		{"no CRLF", "use t", 4, []string{"use", "t"}},
+		{"exactly max", "a b c d", 4, []string{"a", "b", "c", "d"}},
+		{"max with trailing space", "a b c d \r\n", 4, []string{"a", "b", "c", "d"}},
+		{"over max", "a b c d e", 4, nil},
+		{"no room", "a", 0, nil},
+		{"no room empty", "\r\n", 0, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fields := make([][]byte, tt.max)
+			n := Split([]byte(tt.in), fields)
+			if tt.want == nil {
+				if n != -1 {
+					t.Fatalf("got %d fields, want -1", n)
+				}
+				return
+			}
+			if n != len(tt.want) {
+				t.Fatalf("got %d fields, want %d", n, len(tt.want))
+			}
+			for i, w := range tt.want {
+				if string(fields[i]) != w {
+					t.Errorf("field %d: got %q, want %q", i, fields[i], w)
+				}
+			}
+		})
+	}
+}
+
+func TestSplitInPlace(t *testing.T) {
+	line := []byte("use t\r\n")
+	var f [2][]byte
+	Split(line, f[:])
+	line[4] = 'u'
+	if string(f[1]) != "u" {
+		t.Errorf("fields are not slices of the line: got %q", f[1])
+	}
+}
+
+func TestParseCommand(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Cmd
+		wantErr error
+	}{
+		{"put 1 2 3 4\r\n", Cmd{Name: Put, Pri: 1, Delay: 2, TTR: 3, Size: 4}, nil},
+		{"put-unique k 1 2 3 4", Cmd{Name: PutUnique, NArgs: 1, Pri: 1, Delay: 2, TTR: 3, Size: 4}, nil},
+		{"hello c 1.0", Cmd{Name: Hello, NArgs: 2}, nil},
+		{"mput 1000", Cmd{Name: Mput, NArgs: 1, Count: 1000}, nil},
+		{"put 4294967296 0 60 5", Cmd{}, ErrBadFormat},
+		{"put 0 0 60", Cmd{}, ErrBadFormat},
+		{"put 0 0 60 5 6", Cmd{}, ErrBadFormat},
+		{"hello a b c d e f g", Cmd{}, ErrBadFormat},
+		{"put-unique k 0 0 60 5 a b c d", Cmd{}, ErrBadFormat},
+		{"mput 0", Cmd{}, ErrBadFormat},
+		{"mput 1001", Cmd{}, ErrBadFormat},
+		{"use -t", Cmd{}, ErrBadFormat},
+		{"\r\n", Cmd{}, ErrUnknownCommand},
+		{"reserve", Cmd{}, ErrUnknownCommand},
+	}
+	for _, tt := range tests {
+		c, err := ParseCommand([]byte(tt.in))
+		if err != tt.wantErr {
+			t.Errorf("ParseCommand(%q): got error %v, want %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if c.Name != tt.want.Name || c.NArgs != tt.want.NArgs || c.Count != tt.want.Count ||
+			c.Pri != tt.want.Pri || c.Delay != tt.want.Delay || c.TTR != tt.want.TTR || c.Size != tt.want.Size {
+			t.Errorf("ParseCommand(%q) = %+v, want %+v", tt.in, c, tt.want)
+		}
+	}
+}
+
+func TestParseJobLine(t *testing.T) {
+	pri, delay, ttr, size, err := ParseJobLine([]byte("1024 0 60 5\r\n"))
+	if err != nil || pri != 1024 || delay != 0 || ttr != 60 || size != 5 {
+		t.Errorf("got %d %d %d %d %v", pri, delay, ttr, size, err)
+	}
+	for _, in := range []string{"", "1 2 3", "1 2 3 4 5", "1 2 3 x", "1 2 3 4294967296"} {
+		if _, _, _, _, err := ParseJobLine([]byte(in)); err != ErrBadFormat {
+			t.Errorf("ParseJobLine(%q): got %v, want %v", in, err, ErrBadFormat)
+		}
+	}
+}
+
+func BenchmarkParseCommand(b *testing.B) {
+	for _, line := range []string{
+		"put 1024 0 60 100\r\n",
+		"put-unique order-" + strings.Repeat("7", 32) + " 1024 0 60 100\r\n",
+		"use emails\r\n",
+	} {
+		in := []byte(line)
+		name, _, _ := strings.Cut(line, " ")
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := ParseCommand(in); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkParseJobLine(b *testing.B) {
+	in := []byte("1024 0 60 100\r\n")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, _, _, _, err := ParseJobLine(in); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package protocol
+
+import "strconv"
+
+// The words replies start with. The errors are sent as they are, followed
+// only by CRLF.
+const (
+	Inserted      = "INSERTED"
+	InsertedBatch = "INSERTED_BATCH"
+	Using         = "USING"
+	OK            = "OK"
+
+	BadFormat      = "BAD_FORMAT"
+	UnknownCommand = "UNKNOWN_COMMAND"
+	ExpectedCRLF   = "EXPECTED_CRLF"
+	InternalError  = "INTERNAL_ERROR"
+	JobTooBig      = "JOB_TOO_BIG"
+	DelayTooLong   = "DELAY_TOO_LONG"
+	RateLimited    = "RATE_LIMITED"
+	TubeFull       = "TUBE_FULL"
+	Draining       = "DRAINING"
+	Forbidden      = "FORBIDDEN"
+	NoBinlog       = "NO_BINLOG"
+)
+
+// AppendReply appends a reply line: word, then each of args after a
+// space, then CRLF.
+func AppendReply(b []byte, word string, args ...[]byte) []byte {
+	b = append(b, word...)
+	for _, a := range args {
+		b = append(b, ' ')
+		b = append(b, a...)
+	}
+	return append(b, "\r\n"...)
+}
+
+// AppendReplyUint appends a reply line of word and the number n, as in
+// "INSERTED 12".
+func AppendReplyUint(b []byte, word string, n uint64) []byte {
+	b = append(b, word...)
+	b = append(b, ' ')
+	b = strconv.AppendUint(b, n, 10)
+	return append(b, "\r\n"...)
+}
@@ -0,0 +1,122 @@
+package dispatch
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With -V every command is logged with its parsed fields, its reply and
+// how long it took to handle, tagged with a per-connection id. Lines beyond
+// -V-rate per second are dropped and counted, and the count is logged with
+// the next line that gets through, so a busy server cannot fill the disk.
+
+var (
+	protoTraceOn   bool
+	protoTraceRate = 100
+)
+
+// protoTraceMaxLine caps how much of an unknown command is logged.
+const protoTraceMaxLine = 128
+
+var protoTraceLimit struct {
+	mu         sync.Mutex
+	tokens     float64
+	last       time.Time
+	suppressed uint64
+}
+
+// protoTraceAllow takes a token from the bucket, returning how many lines
+// were suppressed since the last one allowed.
+func protoTraceAllow(now time.Time) (ok bool, suppressed uint64) {
+	l := &protoTraceLimit
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	rate := float64(protoTraceRate)
+	if l.last.IsZero() {
+		l.tokens = rate
+	} else {
+		l.tokens += now.Sub(l.last).Seconds() * rate
+		if l.tokens > rate {
+			l.tokens = rate
+		}
+	}
+	l.last = now
+
+	if l.tokens < 1 {
+		l.suppressed++
+		return false, 0
+	}
+	l.tokens--
+	suppressed, l.suppressed = l.suppressed, 0
+	return true, suppressed
+}
+
+// protoTrace logs the command c has just handled, which it started on at
+// start.
+func protoTrace(c *conn, start time.Time) {
+	now := time.Now()
+	ok, suppressed := protoTraceAllow(now)
+	if !ok {
+		return
+	}
+	if suppressed > 0 {
+		slog.Info("trace lines suppressed", "count", suppressed)
+	}
+
+	fields := bytes.Fields(c.cmd)
+	op := whichCmd(c.cmd)
+	attrs := []any{
+		"conn", c.id,
+		"op", strings.TrimSpace(opNames[op]),
+	}
+	attrs = append(attrs, protoTraceFields(op, fields)...)
+
+	var reply string
+	if c.state == connStateClose {
+		// quit has no reply.
+	} else if c.replyBuf != nil {
+		reply = logReplyLine(*c.replyBuf)
+	} else {
+		reply = logReplyLine([]byte(c.reply))
+	}
+	attrs = append(attrs, "reply", reply, "took", now.Sub(start))
+	slog.Info("trace", attrs...)
+}
+
+// protoTraceFields names the arguments of a command, or lists them if
+// they do not parse.
+func protoTraceFields(op opType, fields [][]byte) []any {
+	args := make([]string, 0, len(fields))
+	for _, f := range fields[min(1, len(fields)):] {
+		args = append(args, string(f))
+	}
+
+	switch {
+	case op == opPut && len(args) == 4:
+		return []any{"pri", args[0], "delay", args[1], "ttr", args[2], "bytes", args[3]}
+	case op == opPutUnique && len(args) == 5:
+		return []any{"key", args[0], "pri", args[1], "delay", args[2], "ttr", args[3], "bytes", args[4]}
+	case op == opPutAfter && len(args) == 5:
+		return []any{"after", args[0], "pri", args[1], "delay", args[2], "ttr", args[3], "bytes", args[4]}
+	case op == opPutHeaders && len(args) == 5:
+		return []any{"headers", args[0], "pri", args[1], "delay", args[2], "ttr", args[3], "bytes", args[4]}
+	case op == opUse && len(args) == 1:
+		return []any{"tube", args[0]}
+	case op == opAuth:
+		// Never log the token.
+		return nil
+	case op == opUnknown:
+		line := bytes.Join(fields, []byte(" "))
+		if len(line) > protoTraceMaxLine {
+			line = line[:protoTraceMaxLine]
+		}
+		return []any{"line", string(line)}
+	case len(args) > 0:
+		return []any{"args", args}
+	}
+	return nil
+}
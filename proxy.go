@@ -0,0 +1,698 @@
+package dispatch
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jkasarherou/dispatch/client"
+	"github.com/jkasarherou/dispatch/protocol"
+)
+
+// dispatch proxy fronts several servers, dispatch or beanstalkd, so that
+// clients see one:
+//
+//	dispatch proxy -l :3333 -backends 10.0.0.1:3333,10.0.0.2:3333
+//
+// Each tube lives on one backend, picked by consistent hashing of its
+// name, so adding a backend moves only about 1/n of the tubes. put and
+// the commands that name a tube go to that tube's backend. reserve polls
+// the backends of the watched tubes in turn until one has a job. Job ids
+// are made unique across backends by multiplying them by proxySlots and
+// adding the backend's slot. stats sums the integer fields of every
+// backend and list-tubes merges their tubes. The backends may come and
+// go while the proxy runs; see proxymember.go.
+//
+// Each client gets its own connection to each backend it needs, opened
+// when first needed. A backend that fails is answered INTERNAL_ERROR and
+// redialed on next use. mput is not proxied, and put-after is only when
+// all the jobs it names are on the tube's backend.
+//
+// The proxy adds
+//
+//	watch-pattern <pattern>\r\n
+//
+// which watches every tube whose name matches pattern, where * matches
+// any run of characters, as in -authz rules. It is answered WATCHING with
+// the count of tubes and patterns watched, and undone by ignore with the
+// same pattern. reserve lists the backends' tubes to find those matching,
+// and again every proxyPatternRefresh while it waits, so tubes made after
+// the watch are reserved from too. Each reserve starts polling at the
+// backend after the one the last job came from, so that a busy backend
+// does not starve the others.
+
+const (
+	// proxyVnodes is the number of points each backend has on the ring.
+	proxyVnodes = 64
+
+	// proxyPollInterval is how long reserve waits between rounds of the
+	// backends when none had a job.
+	proxyPollInterval = 100 * time.Millisecond
+
+	// proxyPatternRefresh is how often a waiting reserve looks for new
+	// tubes matching the watched patterns.
+	proxyPatternRefresh = time.Second
+)
+
+var errProxyBadID = errors.New("job id of no backend")
+
+// backendOf is the slot of the backend that holds tube, or false if no
+// backend is up.
+func (p *proxy) backendOf(tube string) (int, bool) {
+	r := p.ring.Load()
+	if len(r.points) == 0 {
+		return 0, false
+	}
+	h := crc32.ChecksumIEEE([]byte(tube))
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.points[i].slot, true
+}
+
+// jobID is the id clients see for job id on backend b.
+func (p *proxy) jobID(b int, id uint64) uint64 {
+	return id*proxySlots + uint64(b)
+}
+
+// backendID is the reverse of jobID.
+func (p *proxy) backendID(s string) (int, uint64, error) {
+	id, err := strconv.ParseUint(s, 10, 64)
+	if err != nil || id < proxySlots || p.addr(int(id%proxySlots)) == "" {
+		return 0, 0, errProxyBadID
+	}
+	return int(id % proxySlots), id / proxySlots, nil
+}
+
+func proxyMain(args []string) int {
+	fs := flag.NewFlagSet("proxy", flag.ExitOnError)
+	listen := fs.String("l", ":3333", "listen on `addr`")
+	backends := fs.String("backends", "", "comma-separated backend `host:port` list")
+	file := fs.String("backends-file", "", "read backends from `path`, one a line")
+	dns := fs.String("dns", "", "backends from DNS: `host:port`, or an SRV name starting with _")
+	refresh := fs.Duration("refresh", 30*time.Second, "read -backends-file and -dns again this often")
+	health := fs.Duration("health-interval", 5*time.Second, "health check backends this often")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: dispatch proxy [-l addr] [-backends host:port,...] [-backends-file path] [-dns name]\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *backends == "" && *file == "" && *dns == "" || fs.NArg() != 0 || *refresh <= 0 || *health <= 0 {
+		fs.Usage()
+		return 2
+	}
+	var static []string
+	if *backends != "" {
+		static = strings.Split(*backends, ",")
+	}
+	p := newProxy(static, *file, *dns)
+
+	ctx, cancel := cliContext()
+	defer cancel()
+	l, err := net.Listen("tcp", *listen)
+	if err != nil {
+		return cliFail("proxy", err)
+	}
+	context.AfterFunc(ctx, func() { l.Close() })
+	go p.run(ctx, *refresh, *health)
+	slog.Info("proxying", "addr", l.Addr().String())
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return 0
+			}
+			return cliFail("proxy", err)
+		}
+		go p.serve(ctx, c)
+	}
+}
+
+// proxyClient is a client connection and its connections to the backends.
+type proxyClient struct {
+	p   *proxy
+	ctx context.Context
+	r   *bufio.Reader
+	w   *bufio.Writer
+
+	use      string
+	watched  []string
+	patterns []string
+	// next is where in the backends of its tubes reserve starts polling.
+	next int
+
+	// conns are the connections to the backends by slot, and bUse and
+	// bWatched the tube each uses and those it watches.
+	conns    map[int]*client.Conn
+	bUse     map[int]string
+	bWatched map[int][]string
+}
+
+func (p *proxy) serve(ctx context.Context, c net.Conn) {
+	defer c.Close()
+	pc := &proxyClient{
+		p:        p,
+		ctx:      ctx,
+		r:        bufio.NewReader(c),
+		w:        bufio.NewWriter(c),
+		use:      defaultTubeName,
+		watched:  []string{defaultTubeName},
+		conns:    map[int]*client.Conn{},
+		bUse:     map[int]string{},
+		bWatched: map[int][]string{},
+	}
+	defer func() {
+		for _, cc := range pc.conns {
+			cc.Close()
+		}
+	}()
+	for {
+		line, err := readLine(pc.r, lineBufSize)
+		if err != nil && err != errLineTooLong {
+			return
+		}
+		f := strings.Fields(string(line))
+		if err == errLineTooLong {
+			pc.reply("BAD_FORMAT")
+		} else if len(f) == 0 {
+			pc.reply("UNKNOWN_COMMAND")
+		} else if f[0] == "quit" {
+			return
+		} else if err := pc.cmd(f); err != nil {
+			// The client's framing is lost.
+			return
+		}
+		if pc.r.Buffered() == 0 {
+			if err := pc.w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (pc *proxyClient) reply(line string) {
+	pc.w.WriteString(line)
+	pc.w.WriteString("\r\n")
+}
+
+// replyData sends line and then body and its CRLF.
+func (pc *proxyClient) replyData(line string, body []byte) {
+	pc.reply(line)
+	pc.w.Write(body)
+	pc.w.WriteString("\r\n")
+}
+
+// conn is the connection to backend b, using and watching no particular
+// tubes until told to.
+func (pc *proxyClient) conn(b int) (*client.Conn, error) {
+	if cc := pc.conns[b]; cc != nil {
+		return cc, nil
+	}
+	cc, err := cliDial(pc.ctx, pc.p.addr(b))
+	if err != nil {
+		return nil, err
+	}
+	pc.conns[b] = cc
+	pc.bUse[b] = defaultTubeName
+	pc.bWatched[b] = []string{defaultTubeName}
+	return cc, nil
+}
+
+// drop forgets backend b's connection after it failed.
+func (pc *proxyClient) drop(b int, err error) {
+	slog.Warn("backend failed", "backend", pc.p.addr(b), "err", err)
+	if cc := pc.conns[b]; cc != nil {
+		cc.Abort()
+	}
+	delete(pc.conns, b)
+}
+
+// send sends a command to backend b, after making it use tube if tube is
+// not empty, and returns the reply line and the body of a reply with one.
+func (pc *proxyClient) send(b int, tube, line string, body []byte) (string, []byte, error) {
+	cc, err := pc.conn(b)
+	if err != nil {
+		return "", nil, err
+	}
+	if tube != "" && pc.bUse[b] != tube {
+		if _, err := cc.Expect(pc.ctx, "USING ", cmdUse+tube, nil); err != nil {
+			pc.drop(b, err)
+			return "", nil, err
+		}
+		pc.bUse[b] = tube
+	}
+	reply, err := cc.Cmd(pc.ctx, line, body)
+	if err != nil {
+		pc.drop(b, err)
+		return "", nil, err
+	}
+	f := strings.Fields(reply)
+	switch {
+	case len(f) == 3 && (f[0] == "RESERVED" || f[0] == "FOUND"),
+		len(f) == 2 && f[0] == "OK":
+		data, err := cc.Data(pc.ctx, f[len(f)-1])
+		if err != nil {
+			pc.drop(b, err)
+			return "", nil, err
+		}
+		return reply, data, nil
+	}
+	return reply, nil, nil
+}
+
+// relay sends a command to backend b and passes the reply on, with its
+// job id made the client's.
+func (pc *proxyClient) relay(b int, tube, line string, body []byte) {
+	reply, data, err := pc.send(b, tube, line, body)
+	if err != nil {
+		pc.reply("INTERNAL_ERROR")
+		return
+	}
+	f := strings.Fields(reply)
+	if len(f) >= 2 {
+		switch f[0] {
+		case "INSERTED", "BURIED", "RESERVED", "FOUND":
+			if id, err := strconv.ParseUint(f[1], 10, 64); err == nil {
+				f[1] = strconv.FormatUint(pc.p.jobID(b, id), 10)
+				reply = strings.Join(f, " ")
+			}
+		}
+	}
+	if data != nil {
+		pc.replyData(reply, data)
+		return
+	}
+	pc.reply(reply)
+}
+
+// relayTube relays a command to the backend of tube.
+func (pc *proxyClient) relayTube(tube, use, line string, body []byte) {
+	b, ok := pc.p.backendOf(tube)
+	if !ok {
+		pc.reply("INTERNAL_ERROR")
+		return
+	}
+	pc.relay(b, use, line, body)
+}
+
+func (pc *proxyClient) cmd(f []string) error {
+	switch f[0] {
+	case "put", "put-unique", "put-headers", "put-after":
+		return pc.put(f)
+	case "use":
+		if len(f) != 2 || !protocol.ValidTubeName(f[1]) {
+			pc.reply("BAD_FORMAT")
+			return nil
+		}
+		pc.use = f[1]
+		pc.reply("USING " + f[1])
+	case "watch":
+		if len(f) != 2 || !protocol.ValidTubeName(f[1]) {
+			pc.reply("BAD_FORMAT")
+			return nil
+		}
+		if !proxyHas(pc.watched, f[1]) {
+			pc.watched = append(pc.watched, f[1])
+		}
+		pc.replyWatching()
+	case "watch-pattern":
+		if len(f) != 2 || !protocol.ValidTubeName(strings.ReplaceAll(f[1], "*", "x")) {
+			pc.reply("BAD_FORMAT")
+			return nil
+		}
+		if !proxyHas(pc.patterns, f[1]) {
+			pc.patterns = append(pc.patterns, f[1])
+		}
+		pc.replyWatching()
+	case "ignore":
+		if len(f) != 2 || !protocol.ValidTubeName(strings.ReplaceAll(f[1], "*", "x")) {
+			pc.reply("BAD_FORMAT")
+			return nil
+		}
+		if (proxyHas(pc.watched, f[1]) || proxyHas(pc.patterns, f[1])) && len(pc.watched)+len(pc.patterns) == 1 {
+			pc.reply("NOT_IGNORED")
+			return nil
+		}
+		pc.watched = proxyRemove(pc.watched, f[1])
+		pc.patterns = proxyRemove(pc.patterns, f[1])
+		pc.replyWatching()
+	case "list-tube-used":
+		pc.reply("USING " + pc.use)
+	case "list-tubes-watched":
+		pc.replyList(append(append([]string(nil), pc.watched...), pc.patterns...))
+	case "list-tubes":
+		pc.listTubes()
+	case "stats":
+		pc.stats()
+	case "reserve", "reserve-with-timeout":
+		pc.reserve(f)
+	case "delete", "release", "bury", "touch", "peek", "stats-job", "kick-job":
+		if len(f) < 2 {
+			pc.reply("BAD_FORMAT")
+			return nil
+		}
+		b, id, err := pc.p.backendID(f[1])
+		if err != nil {
+			pc.reply("NOT_FOUND")
+			return nil
+		}
+		f[1] = strconv.FormatUint(id, 10)
+		pc.relay(b, "", strings.Join(f, " "), nil)
+	case "peek-ready", "peek-delayed", "peek-buried", "kick":
+		pc.relayTube(pc.use, pc.use, strings.Join(f, " "), nil)
+	case "stats-tube", "pause-tube":
+		if len(f) < 2 || !protocol.ValidTubeName(f[1]) {
+			pc.reply("BAD_FORMAT")
+			return nil
+		}
+		pc.relayTube(f[1], "", strings.Join(f, " "), nil)
+	default:
+		pc.reply("UNKNOWN_COMMAND")
+	}
+	return nil
+}
+
+func (pc *proxyClient) put(f []string) error {
+	if len(f) < 5 {
+		pc.reply("BAD_FORMAT")
+		return nil
+	}
+	size, err := strconv.Atoi(f[len(f)-1])
+	if err != nil || size < 0 {
+		pc.reply("BAD_FORMAT")
+		return nil
+	}
+	body := make([]byte, size+2)
+	if _, err := io.ReadFull(pc.r, body); err != nil {
+		return err
+	}
+	if string(body[size:]) != "\r\n" {
+		pc.reply("EXPECTED_CRLF")
+		return nil
+	}
+
+	b, ok := pc.p.backendOf(pc.use)
+	if !ok {
+		pc.reply("INTERNAL_ERROR")
+		return nil
+	}
+	if f[0] == "put-after" && len(f) == 6 {
+		ids := strings.Split(f[1], ",")
+		for i, s := range ids {
+			db, id, err := pc.p.backendID(s)
+			if err != nil || db != b {
+				pc.reply("BAD_FORMAT")
+				return nil
+			}
+			ids[i] = strconv.FormatUint(id, 10)
+		}
+		f[1] = strings.Join(ids, ",")
+	}
+	pc.relay(b, pc.use, strings.Join(f, " "), body[:size])
+	return nil
+}
+
+// reserve polls the backends of the watched tubes until one gives a job
+// or the timeout passes.
+func (pc *proxyClient) reserve(f []string) {
+	var deadline time.Time
+	switch {
+	case f[0] == "reserve" && len(f) == 1:
+	case f[0] == "reserve-with-timeout" && len(f) == 2:
+		secs, err := strconv.ParseUint(f[1], 10, 32)
+		if err != nil {
+			pc.reply("BAD_FORMAT")
+			return
+		}
+		deadline = time.Now().Add(time.Duration(secs) * time.Second)
+	default:
+		pc.reply("BAD_FORMAT")
+		return
+	}
+
+	bs, err := pc.watchBackends()
+	if err != nil {
+		pc.reply("INTERNAL_ERROR")
+		return
+	}
+	refreshed := time.Now()
+
+	pc.w.Flush()
+	for {
+		if len(pc.patterns) > 0 && time.Since(refreshed) >= proxyPatternRefresh {
+			if bs, err = pc.watchBackends(); err != nil {
+				pc.reply("INTERNAL_ERROR")
+				return
+			}
+			refreshed = time.Now()
+		}
+		for i := range bs {
+			b := bs[(pc.next+i)%len(bs)]
+			reply, data, err := pc.send(b, "", "reserve-with-timeout 0", nil)
+			if err != nil {
+				pc.reply("INTERNAL_ERROR")
+				return
+			}
+			if reply == "TIMED_OUT" {
+				continue
+			}
+			pc.next = (pc.next + i + 1) % len(bs)
+			if data != nil {
+				pc.replyJob(b, reply, data)
+			} else {
+				pc.reply(reply)
+			}
+			return
+		}
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			pc.reply("TIMED_OUT")
+			return
+		}
+		select {
+		case <-pc.ctx.Done():
+			pc.reply("INTERNAL_ERROR")
+			return
+		case <-time.After(proxyPollInterval):
+		}
+	}
+}
+
+// watchBackends makes each backend watch the watched tubes it holds, and
+// those matching the watched patterns, and returns the backends that hold
+// any.
+func (pc *proxyClient) watchBackends() ([]int, error) {
+	tubes := pc.watched
+	if len(pc.patterns) > 0 {
+		all, err := pc.allTubes()
+		if err != nil {
+			return nil, err
+		}
+		tubes = append([]string(nil), pc.watched...)
+		for _, t := range all {
+			if !proxyHas(tubes, t) && proxyMatchAny(pc.patterns, t) {
+				tubes = append(tubes, t)
+			}
+		}
+	}
+	want := map[int][]string{}
+	for _, t := range tubes {
+		if b, ok := pc.p.backendOf(t); ok {
+			want[b] = append(want[b], t)
+		}
+	}
+	var bs []int
+	for b := range want {
+		bs = append(bs, b)
+	}
+	sort.Ints(bs)
+	for _, b := range bs {
+		if err := pc.watch(b, want[b]); err != nil {
+			return nil, err
+		}
+	}
+	return bs, nil
+}
+
+func proxyMatchAny(patterns []string, tube string) bool {
+	for _, p := range patterns {
+		if globMatch(p, tube) {
+			return true
+		}
+	}
+	return false
+}
+
+func (pc *proxyClient) replyWatching() {
+	pc.reply("WATCHING " + strconv.Itoa(len(pc.watched)+len(pc.patterns)))
+}
+
+// replyJob passes on a RESERVED reply from backend b.
+func (pc *proxyClient) replyJob(b int, reply string, data []byte) {
+	f := strings.Fields(reply)
+	if id, err := strconv.ParseUint(f[1], 10, 64); err == nil {
+		f[1] = strconv.FormatUint(pc.p.jobID(b, id), 10)
+	}
+	pc.replyData(strings.Join(f, " "), data)
+}
+
+// watch makes backend b's connection watch exactly tubes.
+func (pc *proxyClient) watch(b int, tubes []string) error {
+	cc, err := pc.conn(b)
+	if err != nil {
+		return err
+	}
+	for _, t := range tubes {
+		if proxyHas(pc.bWatched[b], t) {
+			continue
+		}
+		if _, err := cc.Expect(pc.ctx, "WATCHING ", "watch "+t, nil); err != nil {
+			pc.drop(b, err)
+			return err
+		}
+		pc.bWatched[b] = append(pc.bWatched[b], t)
+	}
+	for _, t := range append([]string(nil), pc.bWatched[b]...) {
+		if proxyHas(tubes, t) {
+			continue
+		}
+		if _, err := cc.Expect(pc.ctx, "WATCHING ", "ignore "+t, nil); err != nil {
+			pc.drop(b, err)
+			return err
+		}
+		pc.bWatched[b] = proxyRemove(pc.bWatched[b], t)
+	}
+	return nil
+}
+
+// proxyStatsFirst are the integer stats that are not counts, which stats
+// gives as the first backend has them rather than summed.
+var proxyStatsFirst = map[string]bool{
+	"pid":                      true,
+	"uptime":                   true,
+	"max-job-size":             true,
+	"binlog-oldest-index":      true,
+	"binlog-current-index":     true,
+	"binlog-max-size":          true,
+	"binlog-fsync-interval-ms": true,
+}
+
+// stats sums the integer stats of every backend, and gives the others as
+// the first backend has them.
+func (pc *proxyClient) stats() {
+	var d statsDict
+	index := map[string]int{}
+	r := pc.p.ring.Load()
+	for _, b := range r.slots {
+		reply, data, err := pc.send(b, "", cmdStats, nil)
+		if err != nil {
+			pc.reply("INTERNAL_ERROR")
+			return
+		}
+		if data == nil {
+			pc.reply(reply)
+			return
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			k, v, ok := strings.Cut(line, ": ")
+			if !ok {
+				continue
+			}
+			n, err := strconv.ParseUint(v, 10, 64)
+			i, seen := index[k]
+			switch {
+			case !seen && err == nil:
+				index[k] = len(d)
+				d.add(k, n)
+			case !seen:
+				if u, err := strconv.Unquote(v); err == nil {
+					v = u
+				}
+				index[k] = len(d)
+				d.add(k, v)
+			case err == nil && !proxyStatsFirst[k]:
+				if sum, ok := d[i].value.(uint64); ok {
+					d[i].value = sum + n
+				}
+			}
+		}
+	}
+	d.add("proxy-backends", len(r.slots))
+	d.add("proxy-backends-down", pc.p.down())
+	pc.replyOK(d.yaml())
+}
+
+// listTubes merges the tubes of every backend.
+func (pc *proxyClient) listTubes() {
+	all, err := pc.allTubes()
+	if err != nil {
+		pc.reply("INTERNAL_ERROR")
+		return
+	}
+	pc.replyList(all)
+}
+
+// allTubes merges the tubes of every backend, in order.
+func (pc *proxyClient) allTubes() ([]string, error) {
+	var all []string
+	for _, b := range pc.p.ring.Load().slots {
+		reply, data, err := pc.send(b, "", "list-tubes", nil)
+		if err != nil {
+			return nil, err
+		}
+		if data == nil {
+			return nil, fmt.Errorf("list-tubes: %s", reply)
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			if t, ok := strings.CutPrefix(line, "- "); ok && !proxyHas(all, t) {
+				all = append(all, t)
+			}
+		}
+	}
+	sort.Strings(all)
+	return all, nil
+}
+
+// replyList sends l as a bare YAML list, as list-tubes has it.
+func (pc *proxyClient) replyList(l []string) {
+	b := []byte("---\n")
+	for _, s := range l {
+		b = append(b, "- "...)
+		b = yamlString(b, s)
+		b = append(b, '\n')
+	}
+	pc.replyOK(b)
+}
+
+func (pc *proxyClient) replyOK(b []byte) {
+	pc.replyData("OK "+strconv.Itoa(len(b)), b)
+}
+
+func proxyHas(l []string, s string) bool {
+	for _, x := range l {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+func proxyRemove(l []string, s string) []string {
+	out := l[:0]
+	for _, x := range l {
+		if x != s {
+			out = append(out, x)
+		}
+	}
+	return out
+}
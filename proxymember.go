@@ -0,0 +1,312 @@
+package dispatch
+
+import (
+	"context"
+	"hash/crc32"
+	"log/slog"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The proxy's backends can change while it runs. They are the union of
+//
+//	-backends         a fixed list
+//	-backends-file    a file of addresses, one a line, '#' for comments
+//	-dns              host:port, for each address host resolves to, or an
+//	                  SRV name such as _dispatch._tcp.example.com
+//
+// of which the file and DNS are read again every -refresh. A backend is
+// health checked every -health-interval by dialing it and sending a
+// command; after proxyDownAfter failed checks in a row it leaves the ring,
+// so its tubes move to the other backends, and it comes back with its
+// first good check. If the file or DNS cannot be read, the backends they
+// gave last time are kept rather than dropped.
+//
+// Each address is given a slot the first time it is seen, and keeps it
+// while the proxy runs, even while it is down or gone. Job ids carry the
+// slot, so an id given out before a backend left still reaches it if it
+// comes back. There are proxySlots slots, and addresses past that are
+// logged and not used.
+
+const (
+	proxySlots = 64
+
+	// proxyDownAfter is how many health checks in a row a backend fails
+	// before it leaves the ring.
+	proxyDownAfter = 2
+
+	proxyHealthTimeout = 2 * time.Second
+)
+
+type proxyPoint struct {
+	hash uint32
+	slot int
+}
+
+// proxyRing is the consistent hash ring of the backends that are up. A
+// ring is not changed once made.
+type proxyRing struct {
+	points []proxyPoint
+	// slots are those of the backends in the ring, in order.
+	slots []int
+}
+
+type proxyMember struct {
+	addr  string
+	slot  int
+	up    bool
+	fails int
+}
+
+type proxy struct {
+	static []string
+	file   string
+	dns    string
+
+	ring atomic.Pointer[proxyRing]
+
+	// mu guards what follows.
+	mu sync.Mutex
+	// addrs are the addresses by slot, and slots the reverse.
+	addrs [proxySlots]string
+	slots map[string]int
+	// members are the current backends by address, and fileAddrs and
+	// dnsAddrs what the file and DNS last gave.
+	members   map[string]*proxyMember
+	fileAddrs []string
+	dnsAddrs  []string
+}
+
+func newProxy(static []string, file, dns string) *proxy {
+	p := &proxy{
+		static:  static,
+		file:    file,
+		dns:     dns,
+		slots:   map[string]int{},
+		members: map[string]*proxyMember{},
+	}
+	p.ring.Store(&proxyRing{})
+	return p
+}
+
+// run discovers backends and checks their health until ctx is done.
+func (p *proxy) run(ctx context.Context, refresh, health time.Duration) {
+	p.refresh(ctx)
+	p.checkAll(ctx)
+	rt := time.NewTicker(refresh)
+	defer rt.Stop()
+	ht := time.NewTicker(health)
+	defer ht.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-rt.C:
+			p.refresh(ctx)
+		case <-ht.C:
+			p.checkAll(ctx)
+		}
+	}
+}
+
+// refresh reads the file and DNS again and updates the members to match.
+func (p *proxy) refresh(ctx context.Context) {
+	var fileAddrs, dnsAddrs []string
+	fileOK, dnsOK := true, true
+	if p.file != "" {
+		b, err := os.ReadFile(p.file)
+		if err != nil {
+			slog.Warn("backends file not read", "path", p.file, "err", err)
+			fileOK = false
+		}
+		for _, line := range strings.Split(string(b), "\n") {
+			line, _, _ = strings.Cut(line, "#")
+			if line = strings.TrimSpace(line); line != "" {
+				fileAddrs = append(fileAddrs, line)
+			}
+		}
+	}
+	if p.dns != "" {
+		var err error
+		if dnsAddrs, err = proxyResolve(ctx, p.dns); err != nil {
+			slog.Warn("backends not resolved", "name", p.dns, "err", err)
+			dnsOK = false
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if fileOK {
+		p.fileAddrs = fileAddrs
+	}
+	if dnsOK {
+		p.dnsAddrs = dnsAddrs
+	}
+	want := map[string]bool{}
+	for _, l := range [][]string{p.static, p.fileAddrs, p.dnsAddrs} {
+		for _, a := range l {
+			want[a] = true
+		}
+	}
+	for a := range want {
+		if p.members[a] != nil {
+			continue
+		}
+		slot, ok := p.slots[a]
+		if !ok {
+			if len(p.slots) == proxySlots {
+				slog.Error("too many backends, not using", "backend", a)
+				continue
+			}
+			slot = len(p.slots)
+			p.slots[a] = slot
+			p.addrs[slot] = a
+		}
+		// Up until a check says otherwise.
+		p.members[a] = &proxyMember{addr: a, slot: slot, up: true}
+		slog.Info("backend added", "backend", a)
+	}
+	for a := range p.members {
+		if !want[a] {
+			delete(p.members, a)
+			slog.Info("backend removed", "backend", a)
+		}
+	}
+	p.rebuild()
+}
+
+// proxyResolve gives the backend addresses name stands for.
+func proxyResolve(ctx context.Context, name string) ([]string, error) {
+	var r net.Resolver
+	if strings.HasPrefix(name, "_") {
+		_, srvs, err := r.LookupSRV(ctx, "", "", name)
+		if err != nil {
+			return nil, err
+		}
+		addrs := make([]string, len(srvs))
+		for i, s := range srvs {
+			addrs[i] = net.JoinHostPort(strings.TrimSuffix(s.Target, "."), strconv.Itoa(int(s.Port)))
+		}
+		return addrs, nil
+	}
+	host, port, err := net.SplitHostPort(name)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := r.LookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]string, len(ips))
+	for i, ip := range ips {
+		addrs[i] = net.JoinHostPort(ip, port)
+	}
+	return addrs, nil
+}
+
+// checkAll health checks every member, and takes those that fail out of
+// the ring and puts those that recover back.
+func (p *proxy) checkAll(ctx context.Context) {
+	p.mu.Lock()
+	addrs := make([]string, 0, len(p.members))
+	for a := range p.members {
+		addrs = append(addrs, a)
+	}
+	p.mu.Unlock()
+
+	ok := make([]bool, len(addrs))
+	var wg sync.WaitGroup
+	for i, a := range addrs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ok[i] = proxyCheck(ctx, a)
+		}()
+	}
+	wg.Wait()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	changed := false
+	for i, a := range addrs {
+		m := p.members[a]
+		if m == nil {
+			continue
+		}
+		if ok[i] {
+			m.fails = 0
+			if !m.up {
+				m.up, changed = true, true
+				slog.Info("backend up", "backend", a)
+			}
+			continue
+		}
+		m.fails++
+		if m.up && m.fails >= proxyDownAfter {
+			m.up, changed = false, true
+			slog.Warn("backend down", "backend", a)
+		}
+	}
+	if changed {
+		p.rebuild()
+	}
+}
+
+// proxyCheck reports whether the backend at addr answers a command.
+func proxyCheck(ctx context.Context, addr string) bool {
+	ctx, cancel := context.WithTimeout(ctx, proxyHealthTimeout)
+	defer cancel()
+	cc, err := cliDial(ctx, addr)
+	if err != nil {
+		return false
+	}
+	defer cc.Close()
+	// Any reply will do; dispatch does not know list-tube-used.
+	_, err = cc.Cmd(ctx, "list-tube-used", nil)
+	return err == nil
+}
+
+// rebuild makes the ring of the members that are up. The caller must hold
+// p.mu.
+func (p *proxy) rebuild() {
+	r := &proxyRing{}
+	for _, m := range p.members {
+		if !m.up {
+			continue
+		}
+		r.slots = append(r.slots, m.slot)
+		for v := 0; v < proxyVnodes; v++ {
+			h := crc32.ChecksumIEEE([]byte(m.addr + "#" + strconv.Itoa(v)))
+			r.points = append(r.points, proxyPoint{h, m.slot})
+		}
+	}
+	sort.Ints(r.slots)
+	sort.Slice(r.points, func(i, k int) bool { return r.points[i].hash < r.points[k].hash })
+	p.ring.Store(r)
+}
+
+// addr is the address of the backend in slot, or "" if there is none.
+func (p *proxy) addr(slot int) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.addrs[slot]
+}
+
+// down is the number of members out of the ring.
+func (p *proxy) down() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := 0
+	for _, m := range p.members {
+		if !m.up {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,126 @@
+package dispatch
+
+import (
+	"context"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// With -rate-cmds or -rate-bytes each connection gets token buckets that
+// refill at that many commands or bytes per second and hold at most a
+// second's worth. A client that runs its buckets dry is not refused; its
+// reads are delayed until they refill, so a runaway producer only slows
+// itself down.
+//
+// A tube's section of the config file can cap the puts into it:
+//
+//	[tube."emails"]
+//	put-rate = 100
+//	put-rate-mode = "reject"
+//
+// The tube gets a bucket of its own, shared by all its producers, that
+// refills at put-rate puts per second. With put-rate-mode "delay", the
+// default, a put that finds it empty waits for it to refill, holding up its
+// connection; with "reject" it is refused with RATE_LIMITED and its body
+// skipped.
+
+// Per-connection limits, set from flags in main; 0 means no limit.
+var (
+	rateCmds  int
+	rateBytes int
+)
+
+// connRateCmds and connRateBytes are the limits in effect, which reloading
+// the config can change while connections are open.
+var (
+	connRateCmds  atomic.Int64
+	connRateBytes atomic.Int64
+
+	throttledCount atomic.Uint64
+
+	putDelayedCount  atomic.Uint64
+	putRejectedCount atomic.Uint64
+)
+
+type rateBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateTake takes n tokens from b, which refills at rate per second, and
+// returns how long to wait until b is out of debt.
+func rateTake(b *rateBucket, rate, n float64, now time.Time) time.Duration {
+	if b.last.IsZero() {
+		b.tokens = rate
+	} else {
+		b.tokens = min(rate, b.tokens+now.Sub(b.last).Seconds()*rate)
+	}
+	b.last = now
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / rate * float64(time.Second))
+}
+
+// rateWait sleeps off taking n tokens from b at rate, if rate is set, or
+// until ctx is done.
+func rateWait(ctx context.Context, b *rateBucket, rate int64, n int) {
+	if rate <= 0 {
+		return
+	}
+	if d := rateTake(b, float64(rate), float64(n), time.Now()); d > 0 {
+		throttledCount.Add(1)
+		rateSleep(ctx, d)
+	}
+}
+
+// rateSleep sleeps for d or until ctx is done.
+func rateSleep(ctx context.Context, d time.Duration) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-ctx.Done():
+	}
+}
+
+// tubePutAdmit takes a put from t's bucket, waiting off the debt or until
+// ctx is done. It returns false if the put is to be refused.
+func tubePutAdmit(ctx context.Context, t *tube) bool {
+	rate := t.putRate.Load()
+	if rate <= 0 {
+		return true
+	}
+	t.putMu.Lock()
+	d := rateTake(&t.putBucket, float64(rate), 1, time.Now())
+	if d > 0 && t.putReject.Load() {
+		// A refused put takes nothing.
+		t.putBucket.tokens++
+		t.putMu.Unlock()
+		putRejectedCount.Add(1)
+		return false
+	}
+	t.putMu.Unlock()
+	if d > 0 {
+		putDelayedCount.Add(1)
+		rateSleep(ctx, d)
+	}
+	return true
+}
+
+// rateReader limits the bytes read through it to connRateBytes per second.
+type rateReader struct {
+	ctx context.Context
+	r   io.Reader
+	b   rateBucket
+}
+
+func (rr *rateReader) Read(p []byte) (int, error) {
+	n, err := rr.r.Read(p)
+	if n > 0 {
+		rateWait(rr.ctx, &rr.b, connRateBytes.Load(), n)
+	}
+	return n, err
+}
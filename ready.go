@@ -0,0 +1,186 @@
+package dispatch
+
+import (
+	"container/heap"
+	"context"
+	"reflect"
+	"sync/atomic"
+	"time"
+)
+
+// Each tube indexes the jobs it could hand out, so that finding the next
+// of them does not mean going through every job under jobsMu. ready holds,
+// in delivery order, the tube's ready jobs and those of its delayed and
+// reserved jobs whose deadlines have been seen to pass; timed holds its
+// other delayed and reserved jobs, soonest deadline first, and tubeDue
+// moves them across once their deadlines pass. A job keeps its state as it
+// moves: a delayed job whose delay is over counts as delayed until it is
+// handed out, as it always has.
+//
+// Whoever waits for a job of a tube, such as an SQS receive with
+// WaitTimeSeconds or a RESP BRPOP, waits on the tube's wake channel, which
+// is closed when a job is made ready, when a deadline comes sooner than
+// the soonest the waiters knew of, when the tube's pause changes and when
+// the tube is deleted, and until the soonest deadline or the end of the
+// pause, rather than looking again and again.
+
+// jobHeap is a heap of jobs, by delivery order or, if byDeadline is set,
+// by deadline. Each job records the heap it is on and its place there.
+type jobHeap struct {
+	jobs       []*job
+	byDeadline bool
+}
+
+func (h *jobHeap) Len() int { return len(h.jobs) }
+
+func (h *jobHeap) Less(i, k int) bool {
+	a, b := h.jobs[i], h.jobs[k]
+	if !h.byDeadline {
+		return jobDeliveredBefore(a, b)
+	}
+	if !a.deadline.Equal(b.deadline) {
+		return a.deadline.Before(b.deadline)
+	}
+	return a.id < b.id
+}
+
+func (h *jobHeap) Swap(i, k int) {
+	h.jobs[i], h.jobs[k] = h.jobs[k], h.jobs[i]
+	h.jobs[i].heapIndex = i
+	h.jobs[k].heapIndex = k
+}
+
+func (h *jobHeap) Push(x any) {
+	j := x.(*job)
+	j.heap, j.heapIndex = h, len(h.jobs)
+	h.jobs = append(h.jobs, j)
+}
+
+func (h *jobHeap) Pop() any {
+	n := len(h.jobs) - 1
+	j := h.jobs[n]
+	h.jobs[n] = nil
+	h.jobs = h.jobs[:n]
+	j.heap, j.heapIndex = nil, -1
+	return j
+}
+
+// tubeIndexAdd indexes j, which storeJob has just stored, in its tube. The
+// caller must hold jobsMu.
+func tubeIndexAdd(j *job) {
+	t := j.tube
+	switch j.state {
+	case jobStateReady:
+		heap.Push(&t.ready, j)
+		tubeWake(t)
+	case jobStateDelayed, jobStateReserved:
+		heap.Push(&t.timed, j)
+		if j.heapIndex == 0 {
+			tubeWake(t)
+		}
+	}
+}
+
+// tubeIndexRemove takes j, which unstoreJob is removing, out of its tube's
+// index. The caller must hold jobsMu.
+func tubeIndexRemove(j *job) {
+	if j.heap != nil {
+		heap.Remove(j.heap, j.heapIndex)
+	}
+}
+
+// tubeReindex builds every tube's index anew, after verify has repaired
+// jobs in place. The caller must hold jobsMu.
+func tubeReindex() {
+	for _, t := range tubes {
+		t.ready = jobHeap{}
+		t.timed = jobHeap{byDeadline: true}
+	}
+	for _, j := range allJobs {
+		j.heap = nil
+		if j.tube != nil {
+			tubeIndexAdd(j)
+		}
+	}
+}
+
+// tubeDue moves those of t's delayed and reserved jobs whose deadlines
+// have passed at now across to its ready ones. The caller must hold
+// jobsMu.
+func tubeDue(t *tube, now time.Time) {
+	for len(t.timed.jobs) > 0 && !now.Before(t.timed.jobs[0].deadline) {
+		heap.Push(&t.ready, heap.Pop(&t.timed))
+	}
+}
+
+// tubeNext returns the job t is to hand out next, or nil if there is none,
+// as of the last tubeDue. It is left where it is. The caller must hold
+// jobsMu.
+func tubeNext(t *tube) *job {
+	if len(t.ready.jobs) == 0 {
+		return nil
+	}
+	return t.ready.jobs[0]
+}
+
+// tubeWake wakes those waiting for a job of t. The caller must hold
+// jobsMu.
+func tubeWake(t *tube) {
+	if t.wake != nil {
+		close(t.wake)
+		t.wake = nil
+	}
+}
+
+// awaitCount counts those waiting in tubeAwait, for current-waiting.
+var awaitCount atomic.Int64
+
+// tubeAwait calls take with the time until it reports that it took what
+// it wanted or fails, or ctx is done. take is called with jobsMu held, and
+// is called again only once one of the tubes names may have more to hand
+// out. tubeAwait returns take's error, or nil once ctx is done.
+func tubeAwait(ctx context.Context, names []string, take func(now time.Time) (bool, error)) error {
+	for {
+		jobsMu.Lock()
+		now := clock.Now()
+		done, err := take(now)
+		if done || err != nil || ctx.Err() != nil {
+			jobsMu.Unlock()
+			return err
+		}
+		cases := []reflect.SelectCase{{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ctx.Done())}}
+		var next time.Time
+		for _, name := range names {
+			// A tube is made if there is none, so that a put can wake the
+			// wait.
+			t := tubeFindOrMakeLocked(name)
+			if t.wake == nil {
+				t.wake = make(chan struct{})
+			}
+			cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(t.wake)})
+			due := t.pauseDeadline
+			if !now.Before(due) && len(t.timed.jobs) > 0 {
+				due = t.timed.jobs[0].deadline
+			}
+			if now.Before(due) && (next.IsZero() || due.Before(next)) {
+				next = due
+			}
+		}
+		jobsMu.Unlock()
+
+		var timer *time.Timer
+		if !next.IsZero() {
+			timer = time.NewTimer(next.Sub(now))
+			cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(timer.C)})
+		}
+		awaitCount.Add(1)
+		reflect.Select(cases)
+		awaitCount.Add(-1)
+		if timer != nil {
+			timer.Stop()
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,407 @@
+package dispatch
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The redis storage keeps jobs in a Redis server, for installations that
+// already run one and want a warm standby: a second dispatch started with
+// the same -path loads the jobs the first one left behind. The keys are
+//
+//	dispatch:tubes      set of tube names
+//	dispatch:jobs       set of job ids
+//	dispatch:job:<id>   hash of tube, state, pri, delay, ttr, created,
+//	                    deadline and body (without its CRLF)
+//	dispatch:delayed    sorted set of delayed job ids, scored by deadline
+//
+// Times are nanoseconds since the epoch, 0 for none. Each change is one
+// MULTI/EXEC transaction, and one not answered within redisTimeout fails
+// as any other storage error does. Durability is whatever the Redis server
+// is configured for; -f and -F do not apply.
+//
+// -path is host:port or redis://[:password@]host:port[/db].
+
+const redisPrefix = "dispatch:"
+
+// redisTimeout bounds each round trip to the server, which is made with
+// jobsMu held.
+const redisTimeout = 5 * time.Second
+
+// redisLoadBatch is how many jobs are read a round trip at startup.
+const redisLoadBatch = 1000
+
+type redisStorage struct {
+	addr     string
+	password string
+	db       int
+
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+}
+
+// redisError is an error reply from the server. Unlike network errors it
+// leaves the connection usable.
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+func redisOpen(path string) (storage, error) {
+	s := &redisStorage{addr: path}
+	if strings.Contains(path, "://") {
+		u, err := url.Parse(path)
+		if err != nil {
+			return nil, err
+		}
+		if u.Scheme != "redis" {
+			return nil, fmt.Errorf("redis: unsupported scheme %q", u.Scheme)
+		}
+		s.addr = u.Host
+		if p, ok := u.User.Password(); ok {
+			s.password = p
+		}
+		if db := strings.TrimPrefix(u.Path, "/"); db != "" {
+			n, err := strconv.Atoi(db)
+			if err != nil {
+				return nil, fmt.Errorf("redis: bad database %q", db)
+			}
+			s.db = n
+		}
+	}
+	if _, _, err := net.SplitHostPort(s.addr); err != nil {
+		s.addr = net.JoinHostPort(s.addr, "6379")
+	}
+
+	if err := redisLoad(s); err != nil {
+		s.close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func redisDial(s *redisStorage) error {
+	c, err := net.DialTimeout("tcp", s.addr, redisTimeout)
+	if err != nil {
+		return err
+	}
+	s.conn = c
+	s.r = bufio.NewReader(c)
+	s.w = bufio.NewWriter(c)
+
+	var setup [][]string
+	if s.password != "" {
+		setup = append(setup, []string{"AUTH", s.password})
+	}
+	if s.db != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(s.db)})
+	}
+	if len(setup) > 0 {
+		if _, err := redisPipeline(s, setup); err != nil {
+			s.close()
+			return err
+		}
+	}
+	return nil
+}
+
+// redisPipeline sends cmds and reads one reply for each, dialing first if
+// there is no connection. After a network error the connection is dropped
+// so that the next call starts afresh.
+func redisPipeline(s *redisStorage, cmds [][]string) ([]interface{}, error) {
+	if s.conn == nil {
+		if err := redisDial(s); err != nil {
+			return nil, err
+		}
+	}
+	s.conn.SetDeadline(time.Now().Add(redisTimeout))
+
+	for _, args := range cmds {
+		fmt.Fprintf(s.w, "*%d\r\n", len(args))
+		for _, a := range args {
+			fmt.Fprintf(s.w, "$%d\r\n%s\r\n", len(a), a)
+		}
+	}
+	if err := s.w.Flush(); err != nil {
+		s.close()
+		return nil, err
+	}
+
+	replies := make([]interface{}, len(cmds))
+	var firstErr error
+	for i := range cmds {
+		v, err := redisRead(s.r)
+		if err != nil {
+			var re redisError
+			if !errors.As(err, &re) {
+				s.close()
+				return nil, err
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+		replies[i] = v
+	}
+	return replies, firstErr
+}
+
+// redisTx runs cmds in a MULTI/EXEC transaction.
+func redisTx(s *redisStorage, cmds ...[]string) error {
+	tx := make([][]string, 0, len(cmds)+2)
+	tx = append(tx, []string{"MULTI"})
+	tx = append(tx, cmds...)
+	tx = append(tx, []string{"EXEC"})
+
+	replies, err := redisPipeline(s, tx)
+	if err != nil {
+		return err
+	}
+	// EXEC answers with an array of the queued commands' replies, which
+	// holds any error raised while executing them.
+	results, _ := replies[len(replies)-1].([]interface{})
+	for _, r := range results {
+		if e, ok := r.(redisError); ok {
+			return e
+		}
+	}
+	return nil
+}
+
+// redisRead reads one RESP reply: a string for simple strings, int64 for
+// integers, []byte for bulk strings, []interface{} for arrays, and nil for
+// null replies. Error replies are returned as a redisError.
+func redisRead(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("redis: malformed reply %q", line)
+	}
+	kind, line := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return line, nil
+	case '-':
+		return nil, redisError(line)
+	case ':':
+		return strconv.ParseInt(line, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		a := make([]interface{}, n)
+		for i := range a {
+			a[i], err = redisRead(r)
+			var re redisError
+			if errors.As(err, &re) {
+				// Inside EXEC results an error belongs to one command.
+				a[i] = re
+			} else if err != nil {
+				return nil, err
+			}
+		}
+		return a, nil
+	}
+	return nil, fmt.Errorf("redis: unknown reply type %q", kind)
+}
+
+func redisJobKey(id uint64) string {
+	return redisPrefix + "job:" + strconv.FormatUint(id, 10)
+}
+
+func redisTime(t time.Time) string {
+	return strconv.FormatUint(walTime(t), 10)
+}
+
+// redisDelayed keeps dispatch:delayed in step with the job's state.
+func redisDelayed(j *job) []string {
+	id := strconv.FormatUint(j.id, 10)
+	if j.state == jobStateDelayed {
+		return []string{"ZADD", redisPrefix + "delayed", redisTime(j.deadline), id}
+	}
+	return []string{"ZREM", redisPrefix + "delayed", id}
+}
+
+func (s *redisStorage) putJob(j *job) error {
+	id := strconv.FormatUint(j.id, 10)
+	return redisTx(s,
+		[]string{"SADD", redisPrefix + "tubes", j.tube.name},
+		[]string{"HSET", redisJobKey(j.id),
+			"tube", j.tube.name,
+			"state", jobStateNames[j.state],
+			"pri", strconv.FormatUint(j.pri, 10),
+			"delay", strconv.FormatUint(j.delay, 10),
+			"ttr", strconv.FormatUint(j.ttr, 10),
+			"created", redisTime(j.created),
+			"deadline", redisTime(j.deadline),
+			"body", string(sqliteBody(j)),
+		},
+		[]string{"SADD", redisPrefix + "jobs", id},
+		redisDelayed(j),
+	)
+}
+
+func (s *redisStorage) updateJob(j *job) error {
+	return redisTx(s,
+		[]string{"HSET", redisJobKey(j.id),
+			"state", jobStateNames[j.state],
+			"pri", strconv.FormatUint(j.pri, 10),
+			"delay", strconv.FormatUint(j.delay, 10),
+			"deadline", redisTime(j.deadline),
+		},
+		redisDelayed(j),
+	)
+}
+
+func (s *redisStorage) deleteJob(j *job) error {
+	id := strconv.FormatUint(j.id, 10)
+	return redisTx(s,
+		[]string{"DEL", redisJobKey(j.id)},
+		[]string{"SREM", redisPrefix + "jobs", id},
+		[]string{"ZREM", redisPrefix + "delayed", id},
+	)
+}
+
+func (s *redisStorage) check() error {
+	_, err := redisPipeline(s, [][]string{{"PING"}})
+	return err
+}
+
+func (s *redisStorage) close() error {
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+func redisLoad(s *redisStorage) error {
+	replies, err := redisPipeline(s, [][]string{
+		{"SMEMBERS", redisPrefix + "tubes"},
+		{"SMEMBERS", redisPrefix + "jobs"},
+	})
+	if err != nil {
+		return err
+	}
+	names, _ := replies[0].([]interface{})
+	ids, _ := replies[1].([]interface{})
+
+	cmds := make([][]string, len(ids))
+	for i, id := range ids {
+		b, _ := id.([]byte)
+		cmds[i] = []string{"HGETALL", redisPrefix + "job:" + string(b)}
+	}
+	// The jobs are read in batches so that each round trip fits in
+	// redisTimeout however many there are.
+	var hashes []interface{}
+	for len(cmds) > 0 {
+		n := min(len(cmds), redisLoadBatch)
+		h, err := redisPipeline(s, cmds[:n])
+		if err != nil {
+			return err
+		}
+		hashes = append(hashes, h...)
+		cmds = cmds[n:]
+	}
+
+	states := map[string]jobState{}
+	for st, name := range jobStateNames {
+		states[name] = st
+	}
+
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+
+	for _, n := range names {
+		b, _ := n.([]byte)
+		tubeFindOrMakeLocked(string(b))
+	}
+
+	for i, h := range hashes {
+		id, _ := ids[i].([]byte)
+		fields, _ := h.([]interface{})
+		if len(fields) == 0 {
+			// Listed but gone; nothing to restore.
+			continue
+		}
+		m := map[string]string{}
+		for k := 0; k+1 < len(fields); k += 2 {
+			key, _ := fields[k].([]byte)
+			val, _ := fields[k+1].([]byte)
+			m[string(key)] = string(val)
+		}
+
+		j, err := redisDecodeJob(string(id), m, states)
+		if err != nil {
+			return err
+		}
+		storeJob(j)
+		if j.id >= nextJobID {
+			nextJobID = j.id + 1
+		}
+	}
+	return nil
+}
+
+func redisDecodeJob(id string, m map[string]string, states map[string]jobState) (*job, error) {
+	var (
+		j   job
+		err error
+	)
+	num := func(field string) uint64 {
+		if err != nil {
+			return 0
+		}
+		var n uint64
+		n, err = strconv.ParseUint(m[field], 10, 64)
+		if err != nil {
+			err = fmt.Errorf("redis: job %s: bad %s %q", id, field, m[field])
+		}
+		return n
+	}
+
+	j.id, err = strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("redis: bad job id %q", id)
+	}
+	j.pri = num("pri")
+	j.delay = num("delay")
+	j.ttr = num("ttr")
+	j.created = walTimeDecode(num("created"))
+	j.deadline = walTimeDecode(num("deadline"))
+	if err != nil {
+		return nil, err
+	}
+
+	st, ok := states[m["state"]]
+	if !ok {
+		return nil, fmt.Errorf("redis: job %s has unknown state %q", id, m["state"])
+	}
+	j.state = st
+	j.body = append([]byte(m["body"]), "\r\n"...)
+	j.bodySize = uint64(len(j.body))
+	j.tube = tubeFindOrMakeLocked(m["tube"])
+	return &j, nil
+}
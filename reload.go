@@ -0,0 +1,231 @@
+package dispatch
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// On SIGHUP the server rereads -config and applies the settings that can
+// change while it runs: job size limits, tube quotas, the job ttl, the
+// put-unique window, the idle tube ttl, per-tube settings, schedules,
+// namespaces, the connection limit, the client address filters, the
+// per-connection rate limits, the log level, the -V rate and the TLS
+// certificate files. If the new file does not parse, or a setting in it is
+// invalid, it is rejected as a whole and the old settings stay in effect.
+// Flags given on the command line still win over the file. Other settings
+// that changed are logged as needing a restart. Without -config, SIGHUP reloads only the TLS files, which are
+// also reloaded when they change, every -tls-reload-interval.
+
+// reloadFlags are the flags a reload applies.
+var reloadFlags = []string{"z", "tube-max-jobs", "tube-max-bytes", "job-ttl", "dedup-window", "tube-idle-ttl", "max-conns", "rate-cmds", "rate-bytes", "allow", "deny", "log-level", "V-rate", "tls-cert", "tls-key", "tls-client-ca"}
+
+// reloadOnSignal reloads path on SIGHUP. cmdLine holds the flags given on
+// the command line, which the file does not override.
+func reloadOnSignal(path string, cmdLine map[string]bool) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	go func() {
+		for range ch {
+			if path == "" {
+				if tlsActive.Load() == nil {
+					slog.Warn("SIGHUP ignored: no -config file to reload")
+					continue
+				}
+				if err := tlsReload(); err != nil {
+					slog.Error("TLS reload failed, keeping the old certificate", "err", err)
+					continue
+				}
+				slog.Info("TLS certificate reloaded")
+				continue
+			}
+			if err := reloadConfig(path, cmdLine); err != nil {
+				slog.Error("config reload failed, keeping the old settings", "path", path, "err", err)
+				continue
+			}
+			slog.Info("config reloaded", "path", path)
+			audit("reload", "", "", "path", path)
+		}
+	}()
+}
+
+func reloadConfig(path string, cmdLine map[string]bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	entries, err := configParse(f, path)
+	if err != nil {
+		return err
+	}
+
+	// Stage the reloadable settings in a flag set of their own, starting
+	// from their defaults, or their current values where the command line
+	// gave them, so that a setting removed from the file reverts.
+	fs := flag.NewFlagSet("reload", flag.ContinueOnError)
+	for _, name := range reloadFlags {
+		cur := flag.Lookup(name)
+		v := cur.DefValue
+		if cmdLine[name] {
+			v = cur.Value.String()
+		}
+		fs.String(name, v, "")
+	}
+	tcs := map[string]*tubeConfig{}
+	scs := map[string]*schedule{}
+	nss := map[string]string{}
+	for _, e := range entries {
+		if name, ok := strings.CutPrefix(e.section, "tube."); ok {
+			if err := configTube(tcs, name, e); err != nil {
+				return fmt.Errorf("%s:%d: %v", path, e.line, err)
+			}
+			continue
+		}
+		if name, ok := strings.CutPrefix(e.section, "schedule."); ok {
+			if err := configSchedule(scs, name, e); err != nil {
+				return fmt.Errorf("%s:%d: %v", path, e.line, err)
+			}
+			continue
+		}
+		if identity, ok := strings.CutPrefix(e.section, "namespace."); ok {
+			if err := configNamespace(nss, identity, e); err != nil {
+				return fmt.Errorf("%s:%d: %v", path, e.line, err)
+			}
+			continue
+		}
+		name, ok := configKeys[e.section+"."+e.key]
+		if !ok {
+			return fmt.Errorf("%s:%d: unknown setting %s.%s", path, e.line, e.section, e.key)
+		}
+		if cmdLine[name] {
+			continue
+		}
+		if fs.Lookup(name) == nil {
+			if cur := flag.Lookup(name); cur.Value.String() != e.value {
+				slog.Warn("setting changed, restart to apply it", "setting", e.section+"."+e.key)
+			}
+			continue
+		}
+		fs.Set(name, e.value)
+	}
+
+	// Check everything before applying anything.
+	if err := scheduleCheck(scs); err != nil {
+		return err
+	}
+	if err := nsCheck(nss); err != nil {
+		return err
+	}
+	if err := tubeLimitsCheck(tcs); err != nil {
+		return err
+	}
+	var (
+		newMaxJobSize uint64
+		newMaxJobs    int
+		newMaxBytes   uint64
+		newMaxConns   int
+		newRateCmds   int
+		newRateBytes  int
+		newTraceRate  int
+	)
+	for _, s := range []struct {
+		name string
+		v    interface{}
+	}{{"z", &newMaxJobSize}, {"tube-max-jobs", &newMaxJobs}, {"tube-max-bytes", &newMaxBytes}, {"max-conns", &newMaxConns},
+		{"rate-cmds", &newRateCmds}, {"rate-bytes", &newRateBytes}, {"V-rate", &newTraceRate}} {
+		if _, err := fmt.Sscan(fs.Lookup(s.name).Value.String(), s.v); err != nil {
+			return fmt.Errorf("-%s: %v", s.name, err)
+		}
+	}
+	if newMaxJobSize > jobSizeMax {
+		return fmt.Errorf("-z must be at most %d", jobSizeMax)
+	}
+	if newMaxJobs < 0 {
+		return fmt.Errorf("-tube-max-jobs must not be negative")
+	}
+	newJobTTL, err := time.ParseDuration(fs.Lookup("job-ttl").Value.String())
+	if err != nil || newJobTTL < 0 {
+		return fmt.Errorf("-job-ttl: bad duration %q", fs.Lookup("job-ttl").Value.String())
+	}
+	newDedupWindow, err := time.ParseDuration(fs.Lookup("dedup-window").Value.String())
+	if err != nil || newDedupWindow < 0 {
+		return fmt.Errorf("-dedup-window: bad duration %q", fs.Lookup("dedup-window").Value.String())
+	}
+	newTubeIdleTTL, err := time.ParseDuration(fs.Lookup("tube-idle-ttl").Value.String())
+	if err != nil || newTubeIdleTTL < 0 {
+		return fmt.Errorf("-tube-idle-ttl: bad duration %q", fs.Lookup("tube-idle-ttl").Value.String())
+	}
+	if newMaxConns < 0 {
+		return fmt.Errorf("-max-conns must not be negative")
+	}
+	if newRateCmds < 0 || newRateBytes < 0 {
+		return fmt.Errorf("-rate-cmds and -rate-bytes must not be negative")
+	}
+	newFilter, err := ipFilterParse(ipSplit(fs.Lookup("allow").Value.String()), ipSplit(fs.Lookup("deny").Value.String()))
+	if err != nil {
+		return err
+	}
+	if newTraceRate < 1 {
+		return fmt.Errorf("-V-rate must be at least 1")
+	}
+	newLogLevel := fs.Lookup("log-level").Value.String()
+	level, err := logParseLevel(newLogLevel)
+	if err != nil {
+		return err
+	}
+	newCert := fs.Lookup("tls-cert").Value.String()
+	newKey := fs.Lookup("tls-key").Value.String()
+	newCA := fs.Lookup("tls-client-ca").Value.String()
+	tc, err := tlsLoad(newCert, newKey, newCA)
+	if err != nil {
+		return err
+	}
+	switch {
+	case tc != nil && tlsActive.Load() == nil:
+		slog.Warn("TLS was not enabled at start, restart to enable it")
+	case tc == nil && tlsActive.Load() != nil:
+		slog.Warn("TLS cannot be turned off by a reload, keeping the old certificate")
+	case tc != nil:
+		tlsMu.Lock()
+		tlsCert, tlsKey, tlsClientCA = newCert, newKey, newCA
+		tlsMu.Unlock()
+		tlsActive.Store(tc)
+		tlsReloadCount.Add(1)
+	}
+
+	jobsMu.Lock()
+	maxJobSize = newMaxJobSize
+	tubeMaxJobs, tubeMaxBytes = newMaxJobs, newMaxBytes
+	jobTTL = newJobTTL
+	dedupWindow = newDedupWindow
+	tubeIdleTTL = newTubeIdleTTL
+	tubeConfigs = tcs
+	namespaces = nss
+	for _, t := range tubes {
+		tubeConfigure(t)
+	}
+	respLimitsUpdate()
+	scheduleReplaceConfig(scs, clock.Now())
+	jobsMu.Unlock()
+
+	maxConns = newMaxConns
+	connLimit.Store(int64(newMaxConns))
+	rateCmds, rateBytes = newRateCmds, newRateBytes
+	connRateCmds.Store(int64(newRateCmds))
+	connRateBytes.Store(int64(newRateBytes))
+	ipFilterActive.Store(newFilter)
+
+	logLevel = newLogLevel
+	logLevelVar.Set(level)
+
+	protoTraceLimit.mu.Lock()
+	protoTraceRate = newTraceRate
+	protoTraceLimit.mu.Unlock()
+	return nil
+}
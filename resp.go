@@ -0,0 +1,835 @@
+package dispatch
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/jkasarherou/dispatch/protocol"
+)
+
+// The RESP listener, on -resp-addr, speaks enough of the Redis protocol
+// for the clients of Redis list queues to produce into and consume from
+// dispatch without a new driver. A list is a tube:
+//
+//	LPUSH <tube> <body> [<body> ...]       put a job per body
+//	RPUSH <tube> <body> [<body> ...]       the same
+//	LLEN <tube>                            the tube's ready jobs
+//	LPOP <tube> [<count>]                  take the next job, or count
+//	RPOP <tube> [<count>]                  the same
+//	LMPOP <n> <tube> ... LEFT|RIGHT [COUNT <count>]
+//	BLPOP <tube> [<tube> ...] <timeout>    take the next job, waiting
+//	BRPOP <tube> [<tube> ...] <timeout>    the same
+//	BLMPOP <timeout> <n> <tube> ... LEFT|RIGHT [COUNT <count>]
+//	LMOVE <from> <to> LEFT|RIGHT LEFT|RIGHT
+//	RPOPLPUSH <from> <to>                  take a job and put its body
+//	BLMOVE <from> <to> LEFT|RIGHT LEFT|RIGHT <timeout>
+//	BRPOPLPUSH <from> <to> <timeout>
+//
+// Pushes answer the tube's ready jobs after them, as Redis answers the
+// list's length. Unlike in Redis a push is not atomic: one refused part
+// way, say for a body too big, has put the bodies before it. Jobs take
+// priority 1024, no delay and a TTR of 60 seconds, and are handed out in
+// the tube's order whichever end they were pushed to or are popped from.
+//
+// A pop hands out the jobs the tube would, as an SQS receive does, and
+// deletes them, since a Redis client does not acknowledge what it pops: a
+// job popped by a client that then fails is gone, as an element would be.
+// It takes at most respMaxPop jobs at once. A blocking pop waits for a job
+// on any of its tubes, taking from the first that has one, until its
+// timeout in seconds, 0 for no limit, the server stops or the client hangs
+// up. A move pops a job as a pop does, but deletes it only once its body
+// has been put into the destination tube, and makes it ready again if that
+// put is refused.
+//
+// With -auth-file a client must first send AUTH <token>, or AUTH <name>
+// <token> with any name. As with the text protocol's auth, the token gives
+// the identity, its namespace and what -authz allows it, which is put for
+// pushes, stats-tube for LLEN, and reserve and delete for pops, with put
+// on the destination of a move. PING, ECHO, SELECT 0, CLIENT and QUIT
+// are answered so that clients can set up their connections; anything
+// else is an unknown command.
+
+const (
+	// respMaxArgs caps a command's arguments, and respMaxInline the length
+	// of an inline command. An argument may be as long as the largest body
+	// a tube takes, and all of a command's together as long as that and
+	// respArgAllowance more for each, for the command's name, its keys and
+	// its counts; a push of several bodies has to fit in that too.
+	respMaxArgs      = 64 << 10
+	respMaxInline    = 64 << 10
+	respArgAllowance = 64
+
+	// respReadChunk is the buffer an argument is first read into, which
+	// doubles as more of it arrives, so that what a client is given
+	// memory for is what it has sent.
+	respReadChunk = 4 << 10
+
+	// respMaxPop caps the jobs one pop takes.
+	respMaxPop = 1000
+)
+
+var respAddr string
+
+// respMaxBulk is the largest body any tube takes, set by respLimitsUpdate.
+var respMaxBulk atomic.Uint64
+
+// respErrProtocol is a malformed command, after which the connection is
+// closed.
+type respErrProtocol string
+
+func (e respErrProtocol) Error() string { return "Protocol error: " + string(e) }
+
+// respConn is a client of the RESP listener.
+type respConn struct {
+	conn     net.Conn
+	r        *bufio.Reader
+	w        *bufio.Writer
+	identity string
+
+	// ctx is done once the server stops or c is closed, and bounds what
+	// its commands wait for.
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// respServe accepts clients on l, admitted as those of the text protocol
+// are, until l is closed. Once ctx is done each client is closed after
+// the command it is on.
+func respServe(ctx context.Context, l net.Listener) {
+	slog.Info("RESP listening", "addr", l.Addr().String())
+	jobsMu.Lock()
+	respLimitsUpdate()
+	jobsMu.Unlock()
+	acceptConns(ctx, l, func(nc net.Conn) {
+		totalConnCount.Add(1)
+		ctx, cancel := context.WithCancel(ctx)
+		go respHandle(&respConn{
+			conn:   nc,
+			r:      bufio.NewReaderSize(nc, respMaxInline),
+			w:      bufio.NewWriter(nc),
+			ctx:    ctx,
+			cancel: cancel,
+		})
+	})
+}
+
+func respHandle(c *respConn) {
+	stop := context.AfterFunc(c.ctx, func() { c.conn.SetReadDeadline(time.Now()) })
+	defer func() {
+		stop()
+		c.cancel()
+		c.conn.Close()
+		curConnCount.Add(-1)
+		if c.identity != "" {
+			authConnCount.Add(-1)
+		}
+	}()
+	for {
+		args, err := respReadCommand(c.r, respMaxBulk.Load())
+		if err != nil {
+			var pe respErrProtocol
+			if errors.As(err, &pe) {
+				respError(c, "ERR "+pe.Error())
+				c.w.Flush()
+			}
+			return
+		}
+		if len(args) > 0 && !respDo(c, args) {
+			c.w.Flush()
+			return
+		}
+		// Pipelined commands are answered together.
+		if c.r.Buffered() == 0 {
+			if err := c.w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// respReadCommand reads a command as an array of bulk strings, or inline
+// as words on a line. maxBulk is the largest body a tube takes.
+func respReadCommand(r *bufio.Reader, maxBulk uint64) ([][]byte, error) {
+	line, err := respReadLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '*' {
+		var args [][]byte
+		for _, f := range bytes.Fields(line) {
+			args = append(args, append([]byte(nil), f...))
+		}
+		return args, nil
+	}
+	n, err := strconv.Atoi(string(line[1:]))
+	if err != nil || n > respMaxArgs {
+		return nil, respErrProtocol("invalid multibulk length")
+	}
+	if n <= 0 {
+		return nil, nil
+	}
+	limit := maxBulk + uint64(n)*respArgAllowance
+	var total uint64
+	args := make([][]byte, 0, min(n, 64))
+	for i := 0; i < n; i++ {
+		line, err := respReadLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, respErrProtocol(fmt.Sprintf("expected '$', got '%.1s'", line))
+		}
+		size, err := strconv.Atoi(string(line[1:]))
+		if err != nil || size < 0 || uint64(size) > maxBulk {
+			return nil, respErrProtocol("invalid bulk length")
+		}
+		if total += uint64(size); total > limit {
+			return nil, respErrProtocol("command too big")
+		}
+		b, err := respReadBulk(r, size+2)
+		if err != nil {
+			return nil, err
+		}
+		if b[size] != '\r' || b[size+1] != '\n' {
+			return nil, respErrProtocol("bulk string not terminated by CRLF")
+		}
+		args = append(args, b[:size])
+	}
+	return args, nil
+}
+
+// respReadBulk reads n bytes.
+func respReadBulk(r *bufio.Reader, n int) ([]byte, error) {
+	b := make([]byte, 0, min(n, respReadChunk))
+	for len(b) < n {
+		if len(b) == cap(b) {
+			b = slices.Grow(b, min(cap(b), n-len(b)))
+		}
+		k, err := r.Read(b[len(b):min(cap(b), n)])
+		b = b[:len(b)+k]
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// respLimitsUpdate sets respMaxBulk from -max-job-size and the tubes'
+// settings, when the listener starts and when they are reloaded. The
+// caller must hold jobsMu.
+func respLimitsUpdate() {
+	n := maxJobSize
+	for _, tc := range tubeConfigs {
+		n = max(n, tc.maxJobSize)
+	}
+	respMaxBulk.Store(n)
+}
+
+// respReadLine reads a line without its CRLF. The line is only good until
+// the next read.
+func respReadLine(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return nil, respErrProtocol("too big inline request")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(line[:len(line)-1], []byte{'\r'}), nil
+}
+
+func respSimple(c *respConn, s string) {
+	c.w.WriteString("+" + s + "\r\n")
+}
+
+func respError(c *respConn, s string) {
+	c.w.WriteString("-" + s + "\r\n")
+}
+
+func respInt(c *respConn, n int) {
+	c.w.WriteString(":" + strconv.Itoa(n) + "\r\n")
+}
+
+func respBulk(c *respConn, b []byte) {
+	c.w.WriteString("$" + strconv.Itoa(len(b)) + "\r\n")
+	c.w.Write(b)
+	c.w.WriteString("\r\n")
+}
+
+// respArray starts an array of n elements, which the caller then writes.
+func respArray(c *respConn, n int) {
+	c.w.WriteString("*" + strconv.Itoa(n) + "\r\n")
+}
+
+func respNullBulk(c *respConn) {
+	c.w.WriteString("$-1\r\n")
+}
+
+func respNullArray(c *respConn) {
+	c.w.WriteString("*-1\r\n")
+}
+
+// respDo runs the command args and reports whether to read another.
+func respDo(c *respConn, args [][]byte) bool {
+	name := strings.ToUpper(string(args[0]))
+	argc := len(args) - 1
+	wrongArgs := func() {
+		respError(c, "ERR wrong number of arguments for '"+strings.ToLower(name)+"' command")
+	}
+
+	switch name {
+	case "QUIT":
+		respSimple(c, "OK")
+		return false
+	case "AUTH":
+		if argc < 1 || argc > 2 {
+			wrongArgs()
+			return true
+		}
+		respAuth(c, args[argc])
+		return true
+	}
+	if authTokens != nil && c.identity == "" {
+		respError(c, "NOAUTH Authentication required.")
+		return true
+	}
+
+	switch name {
+	case "PING":
+		switch argc {
+		case 0:
+			respSimple(c, "PONG")
+		case 1:
+			respBulk(c, args[1])
+		default:
+			wrongArgs()
+		}
+	case "ECHO":
+		if argc != 1 {
+			wrongArgs()
+			return true
+		}
+		respBulk(c, args[1])
+	case "SELECT":
+		if argc != 1 {
+			wrongArgs()
+		} else if string(args[1]) != "0" {
+			respError(c, "ERR DB index is out of range")
+		} else {
+			respSimple(c, "OK")
+		}
+	case "CLIENT":
+		respSimple(c, "OK")
+	case "LPUSH", "RPUSH":
+		if argc < 2 {
+			wrongArgs()
+			return true
+		}
+		respPush(c, string(args[1]), args[2:])
+	case "LLEN":
+		if argc != 1 {
+			wrongArgs()
+			return true
+		}
+		respLen(c, string(args[1]))
+	case "LPOP", "RPOP":
+		if argc < 1 || argc > 2 {
+			wrongArgs()
+			return true
+		}
+		count := -1
+		if argc == 2 {
+			n, err := strconv.Atoi(string(args[2]))
+			if err != nil || n < 0 {
+				respError(c, "ERR value is out of range, must be positive")
+				return true
+			}
+			count = n
+		}
+		respPopCmd(c, args[1], count)
+	case "BLPOP", "BRPOP":
+		if argc < 2 {
+			wrongArgs()
+			return true
+		}
+		timeout, ok := respTimeout(c, args[argc])
+		if !ok {
+			return true
+		}
+		respBlockingPop(c, args[1:argc], timeout)
+	case "LMPOP", "BLMPOP":
+		var timeout time.Duration
+		if name == "BLMPOP" {
+			if argc < 1 {
+				wrongArgs()
+				return true
+			}
+			var ok bool
+			if timeout, ok = respTimeout(c, args[1]); !ok {
+				return true
+			}
+			args = args[1:]
+		}
+		respMpop(c, name, args[1:], name == "BLMPOP", timeout)
+	case "RPOPLPUSH", "LMOVE", "BRPOPLPUSH", "BLMOVE":
+		want := map[string]int{"RPOPLPUSH": 2, "LMOVE": 4, "BRPOPLPUSH": 3, "BLMOVE": 5}[name]
+		if argc != want {
+			wrongArgs()
+			return true
+		}
+		if name == "LMOVE" || name == "BLMOVE" {
+			if !respWhere(args[3]) || !respWhere(args[4]) {
+				respError(c, "ERR syntax error")
+				return true
+			}
+		}
+		block := name == "BRPOPLPUSH" || name == "BLMOVE"
+		var timeout time.Duration
+		if block {
+			var ok bool
+			if timeout, ok = respTimeout(c, args[argc]); !ok {
+				return true
+			}
+		}
+		respMove(c, args[1], args[2], block, timeout)
+	default:
+		respError(c, "ERR unknown command '"+string(args[0])+"'")
+	}
+	return true
+}
+
+func respAuth(c *respConn, token []byte) {
+	remote := c.conn.RemoteAddr().String()
+	if authTokens == nil {
+		respError(c, "ERR AUTH called without any password configured")
+		return
+	}
+	identity, ok := authCheck(token)
+	if !ok {
+		authFailCount.Add(1)
+		audit("auth-failure", c.identity, remote)
+		respError(c, "WRONGPASS invalid username-password pair or user is disabled.")
+		return
+	}
+	if c.identity == "" {
+		authConnCount.Add(1)
+	}
+	c.identity = identity
+	slog.Info("client authenticated", "remote", remote, "identity", identity)
+	respSimple(c, "OK")
+}
+
+// respTube gives the tube a command names, in c's namespace, checking ops
+// on it. It answers c itself if there is none.
+func respTube(c *respConn, key string, ops ...string) (string, bool) {
+	name := nsPrefix(c.identity) + key
+	if !protocol.ValidTubeName(name) {
+		respError(c, "ERR bad tube name")
+		return "", false
+	}
+	for _, op := range ops {
+		r := &authzRequest{ctx: c.ctx, identity: c.identity, remote: c.conn.RemoteAddr().String(), op: op, tube: name}
+		if !authorizeReq(r) {
+			respError(c, "NOPERM forbidden")
+			return "", false
+		}
+	}
+	return name, true
+}
+
+func respPush(c *respConn, key string, bodies [][]byte) {
+	name, ok := respTube(c, key, "put")
+	if !ok {
+		return
+	}
+	for _, body := range bodies {
+		if c.ctx.Err() != nil {
+			// The server is stopping: the rest of the push is not put.
+			respError(c, "ERR draining")
+			return
+		}
+		if err := respPut(c.ctx, name, body); err != nil {
+			respError(c, "ERR "+err.Error())
+			return
+		}
+	}
+	respInt(c, respReady(name))
+}
+
+// respPut puts a job with body into the tube name. ctx bounds the wait for
+// the tube's put rate.
+func respPut(ctx context.Context, name string, body []byte) error {
+	sp := spanStart("dispatch.put")
+	defer spanEnd(sp)
+	spanString(sp, "dispatch.tube", name)
+	spanInt(sp, "dispatch.body_size", int64(len(body)))
+
+	if draining.Load() {
+		return errors.New("draining")
+	}
+	t := tubeFindOrMake(name)
+	if uint64(len(body)) > t.maxJobSize.Load() {
+		return errors.New("job too big")
+	}
+	pri, delay, ttr, err := t.limits.Load().limit(bridgePri, 0, bridgeTTR, 0)
+	if err != nil {
+		return err
+	}
+	if !tubePutAdmit(ctx, t) {
+		return errors.New("rate limited")
+	}
+	j := makeJob(pri, delay, ttr, uint64(len(body))+2)
+	copy(j.body, body)
+	copy(j.body[len(body):], "\r\n")
+	j.tube = t
+	j.origin = originRESP
+	if err := jobInsert(j, sp); err != nil {
+		bodyFree(j.body)
+		if err == errTubeFull {
+			return err
+		}
+		return errors.New("internal error")
+	}
+	return nil
+}
+
+func respLen(c *respConn, key string) {
+	name, ok := respTube(c, key, "stats-tube")
+	if !ok {
+		return
+	}
+	respInt(c, respReady(name))
+}
+
+// respReady counts the ready jobs in the tube name.
+func respReady(name string) int {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	if t := tubes[name]; t != nil {
+		return t.stat.ready
+	}
+	return 0
+}
+
+// respWhere reports whether b names an end of a list, which dispatch does
+// not tell apart.
+func respWhere(b []byte) bool {
+	w := strings.ToUpper(string(b))
+	return w == "LEFT" || w == "RIGHT"
+}
+
+// respTimeout reads the timeout of a blocking command, in seconds, and
+// answers c itself if it is bad.
+func respTimeout(c *respConn, b []byte) (time.Duration, bool) {
+	f, err := strconv.ParseFloat(string(b), 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) || f > float64(math.MaxInt64/int64(time.Second)) {
+		respError(c, "ERR timeout is not a float or out of range")
+		return 0, false
+	}
+	if f < 0 {
+		respError(c, "ERR timeout is negative")
+		return 0, false
+	}
+	return time.Duration(f * float64(time.Second)), true
+}
+
+// respPopTubes gives the tubes keys name, checking that c may reserve and
+// delete their jobs. It answers c itself if it may not.
+func respPopTubes(c *respConn, keys [][]byte) ([]string, bool) {
+	names := make([]string, len(keys))
+	for i, key := range keys {
+		name, ok := respTube(c, string(key), "reserve", "delete")
+		if !ok {
+			return nil, false
+		}
+		names[i] = name
+	}
+	return names, true
+}
+
+// respPopCmd is LPOP and RPOP: one job, answered as a bulk string, or with
+// count >= 0 up to count of them, answered as an array.
+func respPopCmd(c *respConn, key []byte, count int) {
+	names, ok := respPopTubes(c, [][]byte{key})
+	if !ok {
+		return
+	}
+	n := count
+	if n < 0 {
+		n = 1
+	}
+	_, bodies, err := respPop(c, names, n, false, 0)
+	switch {
+	case err != nil:
+		respError(c, "ERR "+err.Error())
+	case count < 0 && len(bodies) == 0:
+		respNullBulk(c)
+	case count < 0:
+		respBulk(c, bodies[0])
+	case len(bodies) == 0:
+		respNullArray(c)
+	default:
+		respArray(c, len(bodies))
+		for _, b := range bodies {
+			respBulk(c, b)
+		}
+	}
+}
+
+// respBlockingPop is BLPOP and BRPOP, answered with the key popped from and
+// the job's body, or a null array once timeout is up.
+func respBlockingPop(c *respConn, keys [][]byte, timeout time.Duration) {
+	names, ok := respPopTubes(c, keys)
+	if !ok {
+		return
+	}
+	i, bodies, err := respPop(c, names, 1, true, timeout)
+	switch {
+	case err != nil:
+		respError(c, "ERR "+err.Error())
+	case len(bodies) == 0:
+		respNullArray(c)
+	default:
+		respArray(c, 2)
+		respBulk(c, keys[i])
+		respBulk(c, bodies[0])
+	}
+}
+
+// respMpop is LMPOP and BLMPOP, whose arguments from numkeys on are args,
+// answered with the key popped from and an array of the bodies, or a null
+// array if there were none.
+func respMpop(c *respConn, name string, args [][]byte, block bool, timeout time.Duration) {
+	if len(args) < 1 {
+		respError(c, "ERR wrong number of arguments for '"+strings.ToLower(name)+"' command")
+		return
+	}
+	numkeys, err := strconv.Atoi(string(args[0]))
+	if err != nil || numkeys <= 0 {
+		respError(c, "ERR numkeys should be greater than 0")
+		return
+	}
+	if len(args) < 1+numkeys+1 {
+		respError(c, "ERR syntax error")
+		return
+	}
+	keys, rest := args[1:1+numkeys], args[1+numkeys:]
+	if !respWhere(rest[0]) {
+		respError(c, "ERR syntax error")
+		return
+	}
+	count := 1
+	switch {
+	case len(rest) == 1:
+	case len(rest) == 3 && strings.EqualFold(string(rest[1]), "COUNT"):
+		count, err = strconv.Atoi(string(rest[2]))
+		if err != nil || count <= 0 {
+			respError(c, "ERR count should be greater than 0")
+			return
+		}
+	default:
+		respError(c, "ERR syntax error")
+		return
+	}
+	names, ok := respPopTubes(c, keys)
+	if !ok {
+		return
+	}
+	i, bodies, err := respPop(c, names, count, block, timeout)
+	switch {
+	case err != nil:
+		respError(c, "ERR "+err.Error())
+	case len(bodies) == 0:
+		respNullArray(c)
+	default:
+		respArray(c, 2)
+		respBulk(c, keys[i])
+		respArray(c, len(bodies))
+		for _, b := range bodies {
+			respBulk(c, b)
+		}
+	}
+}
+
+// respMove is RPOPLPUSH, LMOVE and their blocking forms, answered with the
+// body moved, or nil if there was none.
+func respMove(c *respConn, from, to []byte, block bool, timeout time.Duration) {
+	names, ok := respPopTubes(c, [][]byte{from})
+	if !ok {
+		return
+	}
+	dest, ok := respTube(c, string(to), "put")
+	if !ok {
+		return
+	}
+	var j *job
+	var body []byte
+	take := func(now time.Time) (bool, error) {
+		jobs, bodies, err := respReserve(tubes[names[0]], now, 1)
+		if len(jobs) > 0 {
+			j, body = jobs[0], bodies[0]
+		}
+		return j != nil, err
+	}
+	err := respAwait(c, names, block, timeout, take)
+	switch {
+	case err != nil:
+		respError(c, "ERR "+err.Error())
+		return
+	case j == nil && block:
+		respNullArray(c)
+		return
+	case j == nil:
+		respNullBulk(c)
+		return
+	}
+
+	perr := respPut(c.ctx, dest, body)
+	jobsMu.Lock()
+	// The job is still ours unless its reservation lapsed meanwhile and it
+	// was handed out again.
+	if allJobs[j.id] == j && j.state == jobStateReserved {
+		if perr == nil {
+			err = jobDelete(j)
+		} else if err = jobMove(j, jobStateReady, time.Time{}); err == nil {
+			eventEmit(eventReleased, j)
+		}
+	}
+	jobsMu.Unlock()
+	switch {
+	case perr != nil:
+		respError(c, "ERR "+perr.Error())
+	case err != nil:
+		respError(c, "ERR internal error")
+	default:
+		respBulk(c, body)
+	}
+}
+
+// respPop takes up to n jobs from the first of the tubes names that has
+// any, waiting up to timeout for one if block is set, and deletes them. It
+// returns which tube it took from and the jobs' bodies.
+func respPop(c *respConn, names []string, n int, block bool, timeout time.Duration) (int, [][]byte, error) {
+	var from int
+	var bodies [][]byte
+	take := func(now time.Time) (bool, error) {
+		for i, name := range names {
+			jobs, b, err := respReserve(tubes[name], now, n)
+			for _, j := range jobs {
+				if derr := jobDelete(j); derr != nil && err == nil {
+					err = derr
+				}
+			}
+			if len(jobs) > 0 || err != nil {
+				from, bodies = i, b
+				return true, err
+			}
+		}
+		return false, nil
+	}
+	err := respAwait(c, names, block, timeout, take)
+	if err != nil && len(bodies) == 0 {
+		return 0, nil, errors.New("internal error")
+	}
+	// Those taken before any failure are handed out.
+	return from, bodies, nil
+}
+
+// respAwait calls take once, or if block is set waits with tubeAwait for
+// it to take something from the tubes names, until timeout, 0 for none, or
+// c's context is done or its client hangs up.
+func respAwait(c *respConn, names []string, block bool, timeout time.Duration, take func(time.Time) (bool, error)) error {
+	if !block {
+		jobsMu.Lock()
+		defer jobsMu.Unlock()
+		_, err := take(clock.Now())
+		return err
+	}
+	// The replies to commands pipelined before this one are not held back
+	// while it waits.
+	if err := c.w.Flush(); err != nil {
+		return nil
+	}
+	ctx, cancel := c.ctx, context.CancelFunc(func() {})
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	}
+	defer cancel()
+	ctx, stop := respWatch(c, ctx)
+	defer stop()
+	return tubeAwait(ctx, names, take)
+}
+
+// respWatch returns a context that is done as ctx is or once c's client
+// hangs up, so that a blocking pop does not hand a job to a client that is
+// gone, and a function to stop watching, which must be called before c is
+// read from again.
+func respWatch(c *respConn, ctx context.Context) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// Input from the client, pipelined behind the pop, is left to be
+		// read as the next command.
+		if _, err := c.r.Peek(1); err != nil {
+			cancel()
+		}
+	}()
+	return ctx, func() {
+		cancel()
+		c.conn.SetReadDeadline(time.Now())
+		<-done
+		c.conn.SetReadDeadline(time.Time{})
+		if c.ctx.Err() != nil {
+			// The server stopped meanwhile, and its deadline was undone.
+			c.conn.SetReadDeadline(time.Now())
+		}
+	}
+}
+
+// respReserve reserves up to n of the jobs the tube t, nil if there is
+// none, is to hand out at now, for their TTRs, and returns them with
+// copies of their bodies. The caller must hold jobsMu.
+func respReserve(t *tube, now time.Time, n int) ([]*job, [][]byte, error) {
+	if t == nil || now.Before(t.pauseDeadline) {
+		return nil, nil, nil
+	}
+	n = min(n, respMaxPop)
+	tubeDue(t, now)
+	var jobs []*job
+	var bodies [][]byte
+	for len(jobs) < n {
+		j := tubeNext(t)
+		if j == nil {
+			break
+		}
+		lapsed := j.state == jobStateReserved
+		if err := jobMove(j, jobStateReserved, now.Add(time.Duration(j.ttr)*time.Second)); err != nil {
+			return jobs, bodies, err
+		}
+		if lapsed {
+			t.stat.timeouts++
+			globalStat.timeoutCount++
+		}
+		j.reserves++
+		eventEmit(eventReserved, j)
+		b := jobBody(j)
+		jobs = append(jobs, j)
+		bodies = append(bodies, append([]byte(nil), b[:len(b)-2]...))
+	}
+	return jobs, bodies, nil
+}
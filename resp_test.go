@@ -0,0 +1,190 @@
+package dispatch
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRespReadCommand(t *testing.T) {
+	big := strings.Repeat("x", 3*respReadChunk+17)
+	tests := []struct {
+		name    string
+		in      string
+		want    []string
+		wantErr bool
+	}{
+		{"inline", "LPUSH q a\r\n", []string{"LPUSH", "q", "a"}, false},
+		{"inline LF", "PING\n", []string{"PING"}, false},
+		{"array", "*2\r\n$4\r\nLLEN\r\n$1\r\nq\r\n", []string{"LLEN", "q"}, false},
+		{"empty bulk", "*2\r\n$4\r\nECHO\r\n$0\r\n\r\n", []string{"ECHO", ""}, false},
+		{"CRLF in bulk", "*2\r\n$4\r\nECHO\r\n$4\r\na\r\nb\r\n", []string{"ECHO", "a\r\nb"}, false},
+		{"several chunks", fmt.Sprintf("*2\r\n$4\r\nECHO\r\n$%d\r\n%s\r\n", len(big), big), []string{"ECHO", big}, false},
+		{"too long", fmt.Sprintf("*1\r\n$%d\r\n", maxJobSize+1), nil, true},
+		{"negative bulk", "*1\r\n$-1\r\n", nil, true},
+		{"too many args", fmt.Sprintf("*%d\r\n", respMaxArgs+1), nil, true},
+		{"largest body", fmt.Sprintf("*3\r\n$5\r\nLPUSH\r\n$1\r\nq\r\n$%d\r\n%s\r\n", maxJobSize, strings.Repeat("x", int(maxJobSize))),
+			[]string{"LPUSH", "q", strings.Repeat("x", int(maxJobSize))}, false},
+		{"too big in all", fmt.Sprintf("*4\r\n$5\r\nLPUSH\r\n$1\r\nq\r\n$%d\r\n%s\r\n$%[1]d\r\n%[2]s\r\n", maxJobSize, strings.Repeat("x", int(maxJobSize))), nil, true},
+		{"not a bulk", "*1\r\n:1\r\n", nil, true},
+		{"unterminated", "*1\r\n$2\r\nabcd", nil, true},
+		{"cut short", "*1\r\n$10\r\nabc", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args, err := respReadCommand(bufio.NewReaderSize(strings.NewReader(tt.in), respMaxInline), maxJobSize)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got %q, want an error", args)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(args) != len(tt.want) {
+				t.Fatalf("got %d args, want %d", len(args), len(tt.want))
+			}
+			for i := range args {
+				if string(args[i]) != tt.want[i] {
+					t.Errorf("arg %d: got %.20q, want %.20q", i, args[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestRespReadCommandCutShort(t *testing.T) {
+	_, err := respReadCommand(bufio.NewReader(strings.NewReader("*1\r\n$10\r\nabc")), maxJobSize)
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("got %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+func TestRespReadBulkGrows(t *testing.T) {
+	// A client that claims a large argument and sends little of it is
+	// given memory for what it sent, not for what it claimed.
+	r := bufio.NewReader(io.MultiReader(bytes.NewReader(make([]byte, 100)), errReader{}))
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	if _, err := respReadBulk(r, 64<<20); err == nil {
+		t.Fatal("want an error")
+	}
+	runtime.ReadMemStats(&after)
+	if n := after.TotalAlloc - before.TotalAlloc; n > 1<<20 {
+		t.Errorf("allocated %d bytes for 100 sent", n)
+	}
+}
+
+type errReader struct{}
+
+func (errReader) Read([]byte) (int, error) { return 0, io.ErrClosedPipe }
+
+// respTestConn is a RESP client whose replies are collected in out.
+func respTestConn(t *testing.T) (*respConn, *bytes.Buffer) {
+	t.Helper()
+	server, client := net.Pipe()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(func() {
+		cancel()
+		server.Close()
+		client.Close()
+	})
+	out := &bytes.Buffer{}
+	return &respConn{conn: server, r: bufio.NewReader(server), w: bufio.NewWriter(out), ctx: ctx, cancel: cancel}, out
+}
+
+// respTestDo runs the command made of args on c and returns its reply.
+func respTestDo(c *respConn, out *bytes.Buffer, args ...string) string {
+	var b [][]byte
+	for _, a := range args {
+		b = append(b, []byte(a))
+	}
+	respDo(c, b)
+	c.w.Flush()
+	s := out.String()
+	out.Reset()
+	return s
+}
+
+func TestRespPop(t *testing.T) {
+	serverReset()
+	t.Cleanup(serverReset)
+	c, out := respTestConn(t)
+
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"RPUSH", "q", "a", "b", "c"}, ":3\r\n"},
+		{[]string{"LPOP", "q"}, "$1\r\na\r\n"},
+		{[]string{"RPOP", "q", "5"}, "*2\r\n$1\r\nb\r\n$1\r\nc\r\n"},
+		{[]string{"RPOP", "q"}, "$-1\r\n"},
+		{[]string{"RPOP", "q", "2"}, "*-1\r\n"},
+		{[]string{"RPOP", "q", "-1"}, "-ERR value is out of range, must be positive\r\n"},
+		{[]string{"LPUSH", "r", "x"}, ":1\r\n"},
+		{[]string{"LMPOP", "2", "q", "r", "LEFT", "COUNT", "3"}, "*2\r\n$1\r\nr\r\n*1\r\n$1\r\nx\r\n"},
+		{[]string{"LMPOP", "1", "q", "UP"}, "-ERR syntax error\r\n"},
+		{[]string{"BRPOP", "q", "r", "0.05"}, "*-1\r\n"},
+		{[]string{"BRPOP", "q", "-1"}, "-ERR timeout is negative\r\n"},
+		{[]string{"LPUSH", "from", "m"}, ":1\r\n"},
+		{[]string{"RPOPLPUSH", "from", "to"}, "$1\r\nm\r\n"},
+		{[]string{"LLEN", "from"}, ":0\r\n"},
+		{[]string{"LLEN", "to"}, ":1\r\n"},
+		{[]string{"LMOVE", "from", "to", "LEFT", "RIGHT"}, "$-1\r\n"},
+		{[]string{"BLMOVE", "from", "to", "LEFT", "RIGHT", "0.05"}, "*-1\r\n"},
+	}
+	for _, tt := range tests {
+		if got := respTestDo(c, out, tt.args...); got != tt.want {
+			t.Errorf("%q: got %q, want %q", tt.args, got, tt.want)
+		}
+	}
+	jobsMu.Lock()
+	n := len(allJobs)
+	jobsMu.Unlock()
+	if n != 1 {
+		t.Errorf("%d jobs left, want the one moved", n)
+	}
+}
+
+func TestRespBlockingPopWoken(t *testing.T) {
+	serverReset()
+	t.Cleanup(serverReset)
+	c, out := respTestConn(t)
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		respPut(context.Background(), "q2", []byte("late"))
+	}()
+	start := time.Now()
+	if got, want := respTestDo(c, out, "BLPOP", "q1", "q2", "5"), "*2\r\n$2\r\nq2\r\n$4\r\nlate\r\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("woken after %v", d)
+	}
+}
+
+func TestRespBlockingPopHangUp(t *testing.T) {
+	serverReset()
+	t.Cleanup(serverReset)
+	c, out := respTestConn(t)
+
+	// The connection goes while the pop waits with no timeout, and the
+	// pop gives up rather than take a job for no one.
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		c.conn.Close()
+	}()
+	if got := respTestDo(c, out, "BRPOP", "q", "0"); got != "*-1\r\n" {
+		t.Errorf("got %q", got)
+	}
+}
@@ -0,0 +1,146 @@
+package dispatch
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// On SIGUSR2 the server starts a new copy of its executable with the same
+// arguments, handing it the listening sockets, so that an upgrade never
+// refuses a connection. The old process then stops accepting, lets every
+// connection finish the command it is handling, closes them, and exits,
+// releasing storage. The new process waits for storage, loads it, and
+// accepts the connections that queued up on the sockets meanwhile.
+//
+// Sockets are passed like systemd passes them, from fd 3, with their roles
+// in LISTEN_FDNAMES, but counted in restartFdsEnv since LISTEN_PID cannot
+// name a process that does not exist yet.
+
+const restartFdsEnv = "DISPATCH_LISTEN_FDS"
+
+// restartTimeout bounds how long the old process waits for its connections
+// and the new one for storage.
+var restartTimeout = 30 * time.Second
+
+// restarted is set in a process started by a restart.
+var restarted bool
+
+// Names of inherited sockets that are not for the text protocol.
+const (
+	listenNameAdmin = "admin"
+	listenNameGRPC  = "grpc"
+	listenNameSQS   = "sqs"
+	listenNameRESP  = "resp"
+	listenNameText  = "dispatch"
+)
+
+// restartOnSignal hands ls, and the sockets in named, to a new process on
+// SIGUSR2, where there is one, then calls stop to shut this one down.
+func restartOnSignal(ls []net.Listener, named map[string]net.Listener, stop func()) {
+	if restartSignal == nil {
+		return
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, restartSignal)
+	go func() {
+		for range ch {
+			pid, err := restartExec(ls, named)
+			if err != nil {
+				slog.Error("restart failed", "err", err)
+				continue
+			}
+			slog.Info("restarting", "pid", pid)
+			stop()
+			return
+		}
+	}()
+}
+
+func restartExec(ls []net.Listener, named map[string]net.Listener) (int, error) {
+	var (
+		files []*os.File
+		names []string
+	)
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	add := func(l net.Listener, name string) error {
+		fl, ok := l.(interface{ File() (*os.File, error) })
+		if !ok {
+			return errors.New("cannot hand over a " + l.Addr().Network() + " listener")
+		}
+		f, err := fl.File()
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+		names = append(names, name)
+		return nil
+	}
+	for _, l := range ls {
+		if err := add(l, listenNameText); err != nil {
+			return 0, err
+		}
+	}
+	for name, l := range named {
+		if err := add(l, name); err != nil {
+			return 0, err
+		}
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+	var env []string
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, "LISTEN_") && !strings.HasPrefix(kv, restartFdsEnv+"=") {
+			env = append(env, kv)
+		}
+	}
+	env = append(env,
+		restartFdsEnv+"="+strconv.Itoa(len(files)),
+		"LISTEN_FDNAMES="+strings.Join(names, ":"),
+	)
+
+	p, err := os.StartProcess(exe, os.Args, &os.ProcAttr{
+		Env:   env,
+		Files: append([]*os.File{os.Stdin, os.Stdout, os.Stderr}, files...),
+	})
+	if err != nil {
+		return 0, err
+	}
+	pid := p.Pid
+	p.Release()
+	return pid, nil
+}
+
+// restartClose closes l without removing its Unix socket, which the new
+// process is serving.
+func restartClose(l net.Listener) {
+	if ul, ok := l.(*net.UnixListener); ok {
+		ul.SetUnlinkOnClose(false)
+	}
+	l.Close()
+}
+
+// restartOpenStorage is openStorage for a process started by a restart,
+// which waits for the old process to let go of the storage.
+func restartOpenStorage(kind, path string) (storage, error) {
+	deadline := time.Now().Add(restartTimeout)
+	for {
+		s, err := openStorage(kind, path)
+		if err == nil || time.Now().After(deadline) {
+			return s, err
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package dispatch
+
+import "time"
+
+// rusage reports no CPU time where getrusage(2) is missing.
+func rusage() (utime, stime time.Duration) { return 0, 0 }
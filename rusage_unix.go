@@ -0,0 +1,19 @@
+//go:build unix
+
+package dispatch
+
+import (
+	"syscall"
+	"time"
+)
+
+// rusage returns the user and system CPU time the process has used.
+func rusage() (utime, stime time.Duration) {
+	var ru syscall.Rusage
+	syscall.Getrusage(syscall.RUSAGE_SELF, &ru)
+	return timevalDuration(ru.Utime), timevalDuration(ru.Stime)
+}
+
+func timevalDuration(tv syscall.Timeval) time.Duration {
+	return time.Duration(tv.Sec)*time.Second + time.Duration(tv.Usec)*time.Microsecond
+}
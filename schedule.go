@@ -0,0 +1,441 @@
+package dispatch
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jkasarherou/dispatch/protocol"
+)
+
+// A schedule puts a fresh copy of a template job each time its cron
+// expression fires. Schedules come from [schedule."name"] sections of the
+// config file,
+//
+//	[schedule."nightly-report"]
+//	cron = "30 2 * * *"
+//	tube = "reports"
+//	body = "{\"kind\": \"nightly\"}"
+//	pri = 100
+//	ttr = 600
+//
+// which a reload replaces, or from the admin API:
+//
+//	GET    /api/schedules          all schedules
+//	PUT    /api/schedules/{name}   add or replace a schedule from
+//	                               {"cron", "tube", "pri", "delay", "ttr",
+//	                               "body"}, body in base64
+//	DELETE /api/schedules/{name}   remove a schedule
+//
+// Schedules added through the API are kept in memory only. The cron
+// expression has the usual five fields, minute hour day-of-month month
+// day-of-week, each *, a number, a range a-b, a step */n or a-b/n, or a
+// comma-separated list of those, and is read in local time; @hourly,
+// @daily, @weekly and @monthly stand for the obvious expressions. A tick
+// that comes while the server is draining or the tube is full is missed,
+// not made up later, and so are ticks while the server is down.
+
+// scheduleInterval is how often schedules are checked, and so how late a
+// job may be put.
+const scheduleInterval = time.Second
+
+type schedule struct {
+	name  string
+	spec  string
+	cron  *cronSpec
+	tube  string
+	pri   uint64
+	delay uint64
+	ttr   uint64
+	body  []byte
+
+	// given says which of pri, delay and ttr the schedule sets; the tube's
+	// defaults stand in for the others.
+	given putFields
+
+	// fromConfig is set for schedules from the config file, which a
+	// reload replaces.
+	fromConfig bool
+
+	last, next    time.Time
+	fires, misses uint64
+}
+
+// schedules maps each schedule's name to it. Guarded by jobsMu once the
+// server is running.
+var schedules = map[string]*schedule{}
+
+// scheduleConfigs holds the schedules read from the config file until the
+// server starts.
+var scheduleConfigs = map[string]*schedule{}
+
+func configSchedule(scs map[string]*schedule, name string, e configEntry) error {
+	if name == "" {
+		return fmt.Errorf("schedule section without a name")
+	}
+	s := scs[name]
+	if s == nil {
+		s = &schedule{name: name, tube: defaultTubeName, ttr: 120, fromConfig: true}
+		scs[name] = s
+	}
+	switch e.key {
+	case "cron":
+		c, err := cronParse(e.value)
+		if err != nil {
+			return fmt.Errorf("cron: %v", err)
+		}
+		s.spec, s.cron = e.value, c
+	case "tube":
+		if !protocol.ValidTubeName(e.value) {
+			return fmt.Errorf("tube: bad name %q", e.value)
+		}
+		s.tube = e.value
+	case "body":
+		s.body = []byte(e.value)
+	case "pri", "delay", "ttr":
+		n, err := strconv.ParseUint(e.value, 10, 32)
+		if err != nil {
+			return fmt.Errorf("%s: %v", e.key, err)
+		}
+		switch e.key {
+		case "pri":
+			s.pri = n
+			s.given |= putPri
+		case "delay":
+			s.delay = n
+			s.given |= putDelay
+		default:
+			s.ttr = n
+			s.given |= putTTR
+		}
+	default:
+		return fmt.Errorf("unknown schedule setting %s", e.key)
+	}
+	return nil
+}
+
+// scheduleCheck reports a schedule in scs without a cron expression.
+func scheduleCheck(scs map[string]*schedule) error {
+	for _, s := range scs {
+		if s.cron == nil {
+			return fmt.Errorf("schedule %q has no cron expression", s.name)
+		}
+	}
+	return nil
+}
+
+// scheduleReplaceConfig puts the schedules from the config file in place
+// of the ones it held before, keeping the times and counts of those that
+// are unchanged. The caller must hold jobsMu.
+func scheduleReplaceConfig(scs map[string]*schedule, now time.Time) {
+	for name, s := range schedules {
+		if s.fromConfig && scs[name] == nil {
+			delete(schedules, name)
+		}
+	}
+	for name, s := range scs {
+		if old := schedules[name]; old != nil && old.fromConfig && old.same(s) {
+			continue
+		}
+		s.next = s.cron.next(now)
+		schedules[name] = s
+	}
+}
+
+func (s *schedule) same(o *schedule) bool {
+	return s.spec == o.spec && s.tube == o.tube && s.pri == o.pri && s.delay == o.delay &&
+		s.ttr == o.ttr && s.given == o.given && string(s.body) == string(o.body)
+}
+
+func scheduleRun() {
+	for now := range clock.Tick(scheduleInterval) {
+		jobsMu.Lock()
+		scheduleFire(now)
+		jobsMu.Unlock()
+	}
+}
+
+// scheduleFire puts the jobs of the schedules that are due at now. The
+// caller must hold jobsMu.
+func scheduleFire(now time.Time) {
+	for _, s := range schedules {
+		if s.next.IsZero() || now.Before(s.next) {
+			continue
+		}
+		s.next = s.cron.next(now)
+		if err := schedulePut(s); err != nil {
+			s.misses++
+			scheduleMissCount.Add(1)
+			slog.Warn("scheduled job not put", "schedule", s.name, "tube", s.tube, "err", err)
+			continue
+		}
+		s.last = now
+		s.fires++
+		scheduleFireCount.Add(1)
+	}
+}
+
+func schedulePut(s *schedule) error {
+	if draining.Load() {
+		return errors.New("draining")
+	}
+	t := tubeFindOrMakeLocked(s.tube)
+	if uint64(len(s.body)) > t.maxJobSize.Load() {
+		return errors.New("job too big")
+	}
+	pri, delay, ttr, err := t.limits.Load().limit(s.pri, s.delay, s.ttr, s.given)
+	if err != nil {
+		return err
+	}
+	j := makeJob(pri, delay, ttr, uint64(len(s.body))+2)
+	copy(j.body, s.body)
+	copy(j.body[len(s.body):], "\r\n")
+	j.tube = t
+	j.origin = originSchedule
+	jobCompress(j)
+	if err := jobInsertLocked(j, nil); err != nil {
+		bodyFree(j.body)
+		return err
+	}
+	return nil
+}
+
+type apiSchedule struct {
+	Name   string `json:"name"`
+	Cron   string `json:"cron"`
+	Tube   string `json:"tube"`
+	Pri    uint64 `json:"pri"`
+	Delay  uint64 `json:"delay"`
+	TTR    uint64 `json:"ttr"`
+	Body   []byte `json:"body"`
+	Config bool   `json:"config"`
+	// LastFire and NextFire are Unix times, 0 for never.
+	LastFire int64  `json:"last_fire"`
+	NextFire int64  `json:"next_fire"`
+	Fires    uint64 `json:"fires"`
+	Misses   uint64 `json:"misses"`
+}
+
+func apiScheduleOf(s *schedule) apiSchedule {
+	a := apiSchedule{
+		Name:   s.name,
+		Cron:   s.spec,
+		Tube:   s.tube,
+		Pri:    s.pri,
+		Delay:  s.delay,
+		TTR:    s.ttr,
+		Body:   s.body,
+		Config: s.fromConfig,
+		Fires:  s.fires,
+		Misses: s.misses,
+	}
+	if !s.last.IsZero() {
+		a.LastFire = s.last.Unix()
+	}
+	if !s.next.IsZero() {
+		a.NextFire = s.next.Unix()
+	}
+	return a
+}
+
+func apiSchedules(w http.ResponseWriter, r *http.Request) {
+	jobsMu.Lock()
+	all := make([]apiSchedule, 0, len(schedules))
+	for _, s := range schedules {
+		all = append(all, apiScheduleOf(s))
+	}
+	jobsMu.Unlock()
+
+	sort.Slice(all, func(i, k int) bool { return all[i].Name < all[k].Name })
+	apiReply(w, http.StatusOK, all)
+}
+
+func apiSchedulePut(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Cron  string  `json:"cron"`
+		Tube  string  `json:"tube"`
+		Pri   *uint32 `json:"pri"`
+		Delay *uint32 `json:"delay"`
+		TTR   *uint32 `json:"ttr"`
+		Body  []byte  `json:"body"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		apiError(w, http.StatusBadRequest, err)
+		return
+	}
+	c, err := cronParse(req.Cron)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, fmt.Errorf("cron: %v", err))
+		return
+	}
+	s := &schedule{name: r.PathValue("name"), spec: req.Cron, cron: c, tube: req.Tube, ttr: 120, body: req.Body}
+	if s.tube == "" {
+		s.tube = defaultTubeName
+	}
+	if !protocol.ValidTubeName(s.tube) {
+		apiError(w, http.StatusBadRequest, fmt.Errorf("bad tube name %q", s.tube))
+		return
+	}
+	if req.Pri != nil {
+		s.pri = uint64(*req.Pri)
+		s.given |= putPri
+	}
+	if req.Delay != nil {
+		s.delay = uint64(*req.Delay)
+		s.given |= putDelay
+	}
+	if req.TTR != nil {
+		s.ttr = uint64(*req.TTR)
+		s.given |= putTTR
+	}
+
+	jobsMu.Lock()
+	s.next = c.next(clock.Now())
+	schedules[s.name] = s
+	a := apiScheduleOf(s)
+	jobsMu.Unlock()
+
+	slog.Info("schedule set", "schedule", s.name, "cron", s.spec, "tube", s.tube, "remote", r.RemoteAddr)
+	audit("schedule-set", "", r.RemoteAddr, "schedule", s.name, "cron", s.spec, "tube", s.tube)
+	apiReply(w, http.StatusOK, a)
+}
+
+func apiScheduleDelete(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	jobsMu.Lock()
+	s := schedules[name]
+	var a apiSchedule
+	if s != nil {
+		a = apiScheduleOf(s)
+		delete(schedules, name)
+	}
+	jobsMu.Unlock()
+
+	if s == nil {
+		apiError(w, http.StatusNotFound, errAPINotFound)
+		return
+	}
+	slog.Info("schedule deleted", "schedule", name, "remote", r.RemoteAddr)
+	audit("schedule-delete", "", r.RemoteAddr, "schedule", name)
+	apiReply(w, http.StatusOK, a)
+}
+
+// cronSpec is a parsed cron expression, with a bit set for each value a
+// field matches.
+type cronSpec struct {
+	minute, hour, dom, month, dow uint64
+	// domAny and dowAny are set when the field is *; a day matches if
+	// either day field does unless one of them is *.
+	domAny, dowAny bool
+}
+
+var cronMacros = map[string]string{
+	"@hourly":  "0 * * * *",
+	"@daily":   "0 0 * * *",
+	"@weekly":  "0 0 * * 0",
+	"@monthly": "0 0 1 * *",
+}
+
+func cronParse(expr string) (*cronSpec, error) {
+	if m, ok := cronMacros[expr]; ok {
+		expr = m
+	}
+	f := strings.Fields(expr)
+	if len(f) != 5 {
+		return nil, fmt.Errorf("want 5 fields, got %d", len(f))
+	}
+	c := &cronSpec{domAny: f[2] == "*", dowAny: f[4] == "*"}
+	var err error
+	for _, p := range []struct {
+		bits     *uint64
+		s        string
+		min, max int
+	}{{&c.minute, f[0], 0, 59}, {&c.hour, f[1], 0, 23}, {&c.dom, f[2], 1, 31}, {&c.month, f[3], 1, 12}, {&c.dow, f[4], 0, 7}} {
+		if *p.bits, err = cronField(p.s, p.min, p.max); err != nil {
+			return nil, err
+		}
+	}
+	// Sunday is 0 or 7.
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	if c.next(clock.Now()).IsZero() {
+		return nil, fmt.Errorf("%q never fires", expr)
+	}
+	return c, nil
+}
+
+func cronField(s string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(s, ",") {
+		r, step, hasStep := strings.Cut(part, "/")
+		lo, hi := min, max
+		if r != "*" {
+			a, b, isRange := strings.Cut(r, "-")
+			var err error
+			if lo, err = strconv.Atoi(a); err != nil {
+				return 0, fmt.Errorf("bad value %q", part)
+			}
+			hi = lo
+			if isRange {
+				if hi, err = strconv.Atoi(b); err != nil {
+					return 0, fmt.Errorf("bad value %q", part)
+				}
+			} else if hasStep {
+				hi = max
+			}
+		}
+		n := 1
+		if hasStep {
+			var err error
+			if n, err = strconv.Atoi(step); err != nil || n < 1 {
+				return 0, fmt.Errorf("bad step %q", part)
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("%q is out of range %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += n {
+			bits |= 1 << v
+		}
+	}
+	return bits, nil
+}
+
+// next is the first time after t at which c fires, or the zero time if
+// there is none within five years.
+func (c *cronSpec) next(t time.Time) time.Time {
+	loc := t.Location()
+	t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute()+1, 0, 0, loc)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case c.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+		case !c.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+		case c.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+		case c.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func (c *cronSpec) dayMatches(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.domAny || c.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
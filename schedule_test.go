@@ -0,0 +1,117 @@
+package dispatch
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronField(t *testing.T) {
+	// bitsOf sets a bit for each of vs.
+	bitsOf := func(vs ...int) uint64 {
+		var b uint64
+		for _, v := range vs {
+			b |= 1 << v
+		}
+		return b
+	}
+	tests := []struct {
+		s        string
+		min, max int
+		want     uint64
+		ok       bool
+	}{
+		{"*", 1, 12, bitsOf(1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12), true},
+		{"5", 0, 59, bitsOf(5), true},
+		{"1-5", 0, 6, bitsOf(1, 2, 3, 4, 5), true},
+		{"1,3,5", 0, 6, bitsOf(1, 3, 5), true},
+		{"*/15", 0, 59, bitsOf(0, 15, 30, 45), true},
+		{"10/20", 0, 59, bitsOf(10, 30, 50), true},
+		{"1-10/3", 1, 31, bitsOf(1, 4, 7, 10), true},
+		{"0-4,20-23/2", 0, 23, bitsOf(0, 1, 2, 3, 4, 20, 22), true},
+		{"60", 0, 59, 0, false},
+		{"0", 1, 31, 0, false},
+		{"5-1", 0, 59, 0, false},
+		{"*/0", 0, 59, 0, false},
+		{"1-", 0, 59, 0, false},
+		{"a", 0, 59, 0, false},
+		{"", 0, 59, 0, false},
+	}
+	for _, tt := range tests {
+		got, err := cronField(tt.s, tt.min, tt.max)
+		if (err == nil) != tt.ok {
+			t.Errorf("cronField(%q, %d, %d): got %v, want ok %v", tt.s, tt.min, tt.max, err, tt.ok)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("cronField(%q, %d, %d) = %b, want %b", tt.s, tt.min, tt.max, got, tt.want)
+		}
+	}
+}
+
+func TestCronParse(t *testing.T) {
+	tests := []struct {
+		expr string
+		ok   bool
+	}{
+		{"* * * * *", true},
+		{"@daily", true},
+		{"0 0 29 2 *", true},
+		{"* * * *", false},
+		{"* * * * * *", false},
+		{"@yearly", false},
+		{"0 24 * * *", false},
+		{"0 0 * * 8", false},
+		// February has no 30th or 31st, so these never fire.
+		{"0 0 30 2 *", false},
+		{"0 0 31 2,4,6 *", false},
+		// Unless the day of the week lets them.
+		{"0 0 30 2 1", true},
+	}
+	for _, tt := range tests {
+		_, err := cronParse(tt.expr)
+		if (err == nil) != tt.ok {
+			t.Errorf("cronParse(%q): got %v, want ok %v", tt.expr, err, tt.ok)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	at := func(s string) time.Time {
+		t.Helper()
+		v, err := time.Parse("2006-01-02 15:04", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	tests := []struct {
+		name, expr, from, want string
+	}{
+		{"every minute", "* * * * *", "2026-10-16 10:07", "2026-10-16 10:08"},
+		{"step", "*/15 * * * *", "2026-10-16 10:07", "2026-10-16 10:15"},
+		{"strictly after", "0 * * * *", "2026-10-16 10:00", "2026-10-16 11:00"},
+		{"hour rollover", "30 9 * * *", "2026-10-16 09:31", "2026-10-17 09:30"},
+		{"weekday range", "30 9 * * 1-5", "2026-10-16 10:00", "2026-10-19 09:30"},
+		{"7 is Sunday", "0 0 * * 7", "2026-10-16 10:00", "2026-10-18 00:00"},
+		{"0 is Sunday", "0 0 * * 0", "2026-10-16 10:00", "2026-10-18 00:00"},
+		{"dow alone", "0 0 * * 5", "2026-10-17 00:00", "2026-10-23 00:00"},
+		{"dom alone", "0 0 13 * *", "2026-10-17 00:00", "2026-11-13 00:00"},
+		{"dom or dow, dom first", "0 0 20 * 5", "2026-10-17 00:00", "2026-10-20 00:00"},
+		{"dom or dow, dow first", "0 0 13 * 5", "2026-10-17 00:00", "2026-10-23 00:00"},
+		{"month rollover", "0 0 31 * *", "2026-11-01 00:00", "2026-12-31 00:00"},
+		{"year rollover", "0 0 1 1 *", "2026-12-31 23:59", "2027-01-01 00:00"},
+		{"leap day", "0 0 29 2 *", "2026-03-01 00:00", "2028-02-29 00:00"},
+		{"month list", "0 12 1 3,9 *", "2026-10-16 10:00", "2027-03-01 12:00"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := cronParse(tt.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := c.next(at(tt.from)), at(tt.want); !got.Equal(want) {
+				t.Errorf("%q after %s: got %s, want %s", tt.expr, tt.from, got.Format("2006-01-02 15:04 Mon"), want.Format("2006-01-02 15:04 Mon"))
+			}
+		})
+	}
+}
@@ -0,0 +1,339 @@
+package dispatch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A Server runs dispatch inside another Go program, such as a test suite
+// or an application that wants an in-process queue:
+//
+//	cfg := dispatch.DefaultConfig()
+//	cfg.StoragePath = dir
+//	srv, err := dispatch.NewServer(cfg)
+//	...
+//	go srv.Serve(l)
+//	...
+//	srv.Shutdown(ctx)
+//
+// Clients connect to the listeners given to Serve as they would to the
+// dispatch command. The server's state is the package's, so a program has
+// one Server at a time; NewServer fails while another is open, and starts
+// with no jobs or tubes once the last is shut down. The command's signal
+// handling, its config file, admin and gRPC listeners are not part of a
+// Server.
+type Server struct {
+	// ctx is the context of the server's connections, canceled by
+	// Shutdown to cut short what their commands wait for.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu     sync.Mutex
+	ls     map[net.Listener]struct{}
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// Config holds the settings of the server. The command's flags and config
+// file fill one in, starting from DefaultConfig, as a program embedding a
+// Server does. Zero means no limit for the limits that have no default.
+type Config struct {
+	// MaxJobSize caps job bodies, in bytes, at most 1 GiB; tubes can have
+	// their own in the config file.
+	MaxJobSize uint64
+	// MaxLineSize is the longest command line accepted, CRLF included.
+	MaxLineSize int
+	// LenientEOL lets a bare LF end job bodies as well as CRLF; see
+	// eol.go.
+	LenientEOL bool
+	// MinTTR is the TTR jobs put with a smaller one are given.
+	MinTTR uint64
+	// MemoryLimit is a soft limit on the memory the process uses, in
+	// bytes, as for runtime/debug.SetMemoryLimit. Being near it makes the
+	// garbage collector work harder rather than refusing jobs.
+	MemoryLimit int64
+
+	// Storage is binlog, bolt, sqlite or redis, and StoragePath where it
+	// keeps the jobs. Jobs are kept in memory only if StoragePath is
+	// empty.
+	Storage     string
+	StoragePath string
+	// FsyncInterval is how often at most the binlog is fsynced, 0 for
+	// every write, unless NoFsync turns that off. BinlogMaxSize is the size
+	// at which a new binlog file is started.
+	FsyncInterval time.Duration
+	NoFsync       bool
+	BinlogMaxSize int64
+	// BinlogKey, if set, is a key file or exec:<command> giving the key
+	// the binlog is encrypted with; see binlogcrypt.go.
+	BinlogKey string
+
+	// MaxConns caps the connections, and RateCommands and RateBytes the
+	// commands and bytes a second each may send.
+	MaxConns     int
+	RateCommands int
+	RateBytes    int
+	// Allow and Deny are the addresses and CIDR prefixes TCP clients are
+	// let in from and turned away from; see ipfilter.go.
+	Allow []string
+	Deny  []string
+
+	// TubeMaxJobs and TubeMaxBytes are the default tube quotas, JobTTL
+	// how long a job may wait before it expires, DedupWindow how long
+	// put-unique remembers a key, and TubeIdleTTL how long an empty,
+	// unused tube is kept.
+	TubeMaxJobs  int
+	TubeMaxBytes uint64
+	JobTTL       time.Duration
+	DedupWindow  time.Duration
+	TubeIdleTTL  time.Duration
+
+	// DrainTimeout bounds how long the server waits for connections to
+	// finish when it stops or restarts.
+	DrainTimeout time.Duration
+
+	// AuthFile, if set, lists the tokens clients must auth with.
+	AuthFile string
+
+	// Clock, if set, is the time the job tables go by, such as a
+	// FakeClock in tests; see clock.go.
+	Clock Clock
+}
+
+// DefaultConfig is the configuration of the dispatch command run without
+// flags.
+func DefaultConfig() Config {
+	return Config{
+		MaxJobSize:    65535,
+		MaxLineSize:   224,
+		MinTTR:        1,
+		Storage:       storageBinlog,
+		FsyncInterval: 50 * time.Millisecond,
+		BinlogMaxSize: 10 << 20,
+		DedupWindow:   5 * time.Minute,
+		DrainTimeout:  30 * time.Second,
+	}
+}
+
+// check returns what is wrong with cfg, using the command's flag names.
+func (cfg *Config) check() []error {
+	var errs []error
+	if cfg.MaxJobSize > jobSizeMax {
+		errs = append(errs, fmt.Errorf("-z must be at most %d", jobSizeMax))
+	}
+	if cfg.MaxLineSize < configMinLineSize {
+		errs = append(errs, fmt.Errorf("-max-line-size must be at least %d", configMinLineSize))
+	}
+	if cfg.MemoryLimit < 0 {
+		errs = append(errs, fmt.Errorf("-memory-limit must not be negative"))
+	}
+	switch cfg.Storage {
+	case storageBinlog, storageBolt, storageSQLite, storageRedis:
+	default:
+		errs = append(errs, fmt.Errorf("unknown storage %q", cfg.Storage))
+	}
+	if cfg.BinlogKey != "" && cfg.Storage != storageBinlog {
+		errs = append(errs, fmt.Errorf("-binlog-key needs -storage binlog"))
+	}
+	if cfg.FsyncInterval < 0 {
+		errs = append(errs, fmt.Errorf("-f must not be negative"))
+	}
+	if cfg.MaxConns < 0 {
+		errs = append(errs, fmt.Errorf("-max-conns must not be negative"))
+	}
+	if cfg.RateCommands < 0 || cfg.RateBytes < 0 {
+		errs = append(errs, fmt.Errorf("-rate-cmds and -rate-bytes must not be negative"))
+	}
+	if _, err := ipFilterParse(cfg.Allow, cfg.Deny); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.TubeMaxJobs < 0 {
+		errs = append(errs, fmt.Errorf("-tube-max-jobs must not be negative"))
+	}
+	if cfg.JobTTL < 0 {
+		errs = append(errs, fmt.Errorf("-job-ttl must not be negative"))
+	}
+	if cfg.DedupWindow < 0 {
+		errs = append(errs, fmt.Errorf("-dedup-window must not be negative"))
+	}
+	if cfg.TubeIdleTTL < 0 {
+		errs = append(errs, fmt.Errorf("-tube-idle-ttl must not be negative"))
+	}
+	if cfg.DrainTimeout < 0 {
+		errs = append(errs, fmt.Errorf("-restart-timeout must not be negative"))
+	}
+	if cfg.AuthFile != "" {
+		if _, err := authLoadFile(cfg.AuthFile); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// configMinLineSize is the shortest MaxLineSize allowed, which leaves room
+// for a put with every field at its longest.
+const configMinLineSize = 96
+
+// configApply makes cfg, which has been checked, the server's settings.
+func configApply(cfg *Config) {
+	maxJobSize = cfg.MaxJobSize
+	lineBufSize = cfg.MaxLineSize
+	lenientEOL = cfg.LenientEOL
+	minTTR = cfg.MinTTR
+	if cfg.MemoryLimit > 0 {
+		debug.SetMemoryLimit(cfg.MemoryLimit)
+	}
+	storageKind, storagePath = cfg.Storage, cfg.StoragePath
+	binlogSyncRate, binlogNoSync = cfg.FsyncInterval, cfg.NoFsync
+	binlogMaxSize = cfg.BinlogMaxSize
+	binlogKeySpec = cfg.BinlogKey
+	maxConns, rateCmds, rateBytes = cfg.MaxConns, cfg.RateCommands, cfg.RateBytes
+	connLimit.Store(int64(maxConns))
+	connRateCmds.Store(int64(rateCmds))
+	connRateBytes.Store(int64(rateBytes))
+	f, _ := ipFilterParse(cfg.Allow, cfg.Deny)
+	ipFilterActive.Store(f)
+	tubeMaxJobs, tubeMaxBytes = cfg.TubeMaxJobs, cfg.TubeMaxBytes
+	jobTTL, dedupWindow, tubeIdleTTL = cfg.JobTTL, cfg.DedupWindow, cfg.TubeIdleTTL
+	restartTimeout = cfg.DrainTimeout
+	authFile = cfg.AuthFile
+	clock = realClock{}
+	if cfg.Clock != nil {
+		clock = cfg.Clock
+	}
+}
+
+var (
+	ErrServerOpen   = errors.New("dispatch: a server is already open")
+	ErrServerClosed = errors.New("dispatch: server closed")
+)
+
+var (
+	// serverOpen is set while a Server is open.
+	serverOpen atomic.Bool
+
+	// serverSweeps starts the goroutines that expire jobs, delete idle
+	// tubes and fire schedules, which run until the program exits.
+	serverSweeps sync.Once
+)
+
+// NewServer opens a server, and its storage if cfg names one.
+func NewServer(cfg Config) (*Server, error) {
+	if errs := cfg.check(); len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	if !serverOpen.CompareAndSwap(false, true) {
+		return nil, ErrServerOpen
+	}
+	serverReset()
+	configApply(&cfg)
+	authTokens = nil
+	if authFile != "" {
+		tokens, err := authLoadFile(authFile)
+		if err != nil {
+			serverOpen.Store(false)
+			return nil, err
+		}
+		authTokens = tokens
+	}
+	if storagePath != "" {
+		s, err := openStorage(storageKind, storagePath)
+		if err != nil {
+			serverOpen.Store(false)
+			return nil, err
+		}
+		jobsMu.Lock()
+		jobStore = s
+		depsRecover()
+		jobsMu.Unlock()
+	}
+	serverSweeps.Do(func() {
+		go expireRun()
+		go tubeGCRun()
+		go scheduleRun()
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Server{ctx: ctx, cancel: cancel, ls: map[net.Listener]struct{}{}}, nil
+}
+
+// serverReset empties the job and tube tables.
+func serverReset() {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	nextJobID = 1
+	allJobs = map[uint64]*job{}
+	tubes = map[string]*tube{}
+	readyCount, delayedCount, heldCount = 0, 0, 0
+	globalStat.reservedCount = 0
+	depWaiters = map[uint64][]*job{}
+	schedules = map[string]*schedule{}
+	jobStore, wal = nil, nil
+}
+
+// Serve accepts clients on l until the server is shut down, when it closes
+// l and returns ErrServerClosed. It may be called for several listeners.
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		l.Close()
+		return ErrServerClosed
+	}
+	s.ls[l] = struct{}{}
+	s.wg.Add(1)
+	s.mu.Unlock()
+	defer s.wg.Done()
+
+	serving.Store(true)
+	serve(s.ctx, l, listenerOrigin(l))
+	return ErrServerClosed
+}
+
+// Shutdown stops accepting clients, lets those connected finish the
+// command they are on until ctx is done, and closes the storage. It
+// returns ctx's error if clients were still connected.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrServerClosed
+	}
+	s.closed = true
+	for l := range s.ls {
+		l.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	serving.Store(false)
+	s.cancel()
+
+	timeout := restartTimeout
+	if d, ok := ctx.Deadline(); ok {
+		timeout = time.Until(d)
+	}
+	connsDrain(timeout)
+	var err error
+	if curConnCount.Load() > 0 {
+		err = ctx.Err()
+		if err == nil {
+			err = context.DeadlineExceeded
+		}
+	}
+
+	jobsMu.Lock()
+	if jobStore != nil {
+		if cerr := jobStore.close(); err == nil {
+			err = cerr
+		}
+		jobStore, wal = nil, nil
+	}
+	jobsMu.Unlock()
+	serverOpen.Store(false)
+	return err
+}
@@ -0,0 +1,144 @@
+package dispatch
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// shutdown stops the server from the protocol, for orchestration that
+// cannot send it a signal:
+//
+//	shutdown [graceful|now]\r\n
+//
+// is answered SHUTTING_DOWN, after which the server stops accepting
+// clients and exits. Graceful, the default, lets every connection finish
+// the commands it has sent, waiting up to -restart-timeout, as a restart
+// does; now exits without waiting for them. Either way storage is closed
+// cleanly, so no acknowledged job is lost. The connection must have
+// authenticated, with auth or a TLS client certificate, and with -authz be
+// allowed the shutdown op, which the admin role includes; otherwise it is
+// answered FORBIDDEN.
+//
+// POST /api/shutdown, with ?mode=now to not wait, does the same on the
+// admin listener. It is held to the same rule: the request must carry
+//
+//	Authorization: Bearer <token>
+//
+// with a token from -auth-file, or come with a TLS client certificate, and
+// with -authz be allowed the shutdown op. It is answered 401 otherwise, or
+// 403 if the identity may not shut the server down.
+
+const (
+	cmdShutdown     = "shutdown"
+	msgShuttingDown = "SHUTTING_DOWN\r\n"
+)
+
+var errShutdownUnavailable = errors.New("shutdown is not available")
+
+var (
+	shutdownMu sync.Mutex
+	// shutdownStop closes the listeners, after which Main drains the
+	// connections and returns. It is set only while Main serves, so a
+	// Server in another program cannot be made to stop this way.
+	shutdownStop func()
+	// shutdownNow is set if the shutdown asked not to wait for clients.
+	shutdownNow bool
+
+	// shuttingDown is set once a shutdown has been asked for.
+	shuttingDown atomic.Bool
+)
+
+// shutdownRequest starts a shutdown. Once one is under way, asking again
+// changes nothing.
+func shutdownRequest(now bool, identity, remote string) error {
+	shutdownMu.Lock()
+	defer shutdownMu.Unlock()
+	if shuttingDown.Load() {
+		return nil
+	}
+	if shutdownStop == nil {
+		return errShutdownUnavailable
+	}
+	mode := "graceful"
+	if now {
+		mode = "now"
+	}
+	slog.Info("shutting down", "mode", mode, "identity", identity, "remote", remote)
+	audit("shutdown", identity, remote, "mode", mode)
+	shuttingDown.Store(true)
+	shutdownNow = now
+	go shutdownStop()
+	return nil
+}
+
+// shutdownDrainTimeout is how long Main waits for clients once its
+// listeners are closed.
+func shutdownDrainTimeout() time.Duration {
+	shutdownMu.Lock()
+	defer shutdownMu.Unlock()
+	if shutdownNow {
+		return 0
+	}
+	return restartTimeout
+}
+
+func doShutdown(c *conn, now bool) {
+	if err := shutdownRequest(now, c.identity, c.conn.RemoteAddr().String()); err != nil {
+		slog.Warn("shutdown refused", "err", err)
+		replyMsg(c, msgInternalError)
+		return
+	}
+	replyMsg(c, msgShuttingDown)
+}
+
+// apiShutdown is the admin API's shutdown.
+func apiShutdown(w http.ResponseWriter, r *http.Request) {
+	var now bool
+	switch r.URL.Query().Get("mode") {
+	case "", "graceful":
+	case "now":
+		now = true
+	default:
+		apiError(w, http.StatusBadRequest, errors.New("mode must be graceful or now"))
+		return
+	}
+	identity := apiIdentity(r)
+	if identity == "" {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		apiError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+		return
+	}
+	if !authorizeReq(&authzRequest{ctx: r.Context(), identity: identity, remote: r.RemoteAddr, op: cmdShutdown}) {
+		apiError(w, http.StatusForbidden, errors.New("forbidden"))
+		return
+	}
+	if err := shutdownRequest(now, identity, r.RemoteAddr); err != nil {
+		apiError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	apiServerGet(w, r)
+}
+
+// apiIdentity returns the identity r authenticated as, from its client
+// certificate or a bearer token listed in -auth-file, or "" if it did not.
+func apiIdentity(r *http.Request) string {
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		return r.TLS.PeerCertificates[0].Subject.CommonName
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return ""
+	}
+	identity, ok := authCheck([]byte(token))
+	if !ok {
+		authFailCount.Add(1)
+		audit("auth-failure", "", r.RemoteAddr)
+		return ""
+	}
+	return identity
+}
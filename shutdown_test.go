@@ -0,0 +1,47 @@
+package dispatch
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAPIShutdownAuth(t *testing.T) {
+	savedTokens, savedAuthz := authTokens, authz
+	authTokens = []authToken{
+		{identity: "alice", token: []byte("a-token")},
+		{identity: "bob", token: []byte("b-token")},
+	}
+	authz = &staticAuthz{rules: []authzRule{{identity: "alice", ops: []string{"shutdown"}, tube: "*"}}}
+	t.Cleanup(func() { authTokens, authz = savedTokens, savedAuthz })
+
+	tests := []struct {
+		name   string
+		header string
+		want   int
+	}{
+		{"no credentials", "", http.StatusUnauthorized},
+		{"not bearer", "Basic YTpi", http.StatusUnauthorized},
+		{"unknown token", "Bearer nope", http.StatusUnauthorized},
+		{"not allowed", "Bearer b-token", http.StatusForbidden},
+		// Outside Main there is nothing to stop, so an allowed request
+		// gets as far as being told so.
+		{"allowed", "Bearer a-token", http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/api/shutdown", nil)
+			if tt.header != "" {
+				r.Header.Set("Authorization", tt.header)
+			}
+			w := httptest.NewRecorder()
+			apiShutdown(w, r)
+			if w.Code != tt.want {
+				t.Errorf("got %d, want %d", w.Code, tt.want)
+			}
+			if shuttingDown.Load() {
+				t.Fatal("shutdown started")
+			}
+		})
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package dispatch
+
+import "os"
+
+// Without SIGUSR1 and SIGUSR2 there is no signal to ask for a snapshot or
+// a restart: the snapshot command is the only way to take a snapshot, and
+// the server cannot restart without refusing connections.
+
+var snapshotSignal, restartSignal os.Signal
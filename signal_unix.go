@@ -0,0 +1,15 @@
+//go:build unix
+
+package dispatch
+
+import (
+	"os"
+	"syscall"
+)
+
+var (
+	// snapshotSignal has the server take a snapshot of the binlog.
+	snapshotSignal os.Signal = syscall.SIGUSR1
+	// restartSignal has the server hand its sockets to a new process.
+	restartSignal os.Signal = syscall.SIGUSR2
+)
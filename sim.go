@@ -0,0 +1,513 @@
+package dispatch
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dispatch sim runs the server in this process on a FakeClock and drives
+// it with a script of client events drawn from -seed: puts of every kind,
+// bodies cut off by a disconnect, reconnects, snapshots, time moving on
+// so that jobs expire, and crashes, which restart the server from its
+// binlog. One event happens at a time, each waiting for its reply, so a
+// seed always plays out the same way and a failure can be replayed
+// exactly. After every event the harness checks that
+//
+//   - verify finds nothing wrong with the job and tube tables
+//   - every job the server holds was acknowledged, with the tube and body
+//     it was put with, and was not gone before
+//   - every acknowledged job is still held, unless its ttl has passed or
+//     it was waiting on jobs of which none is left
+//   - ids are never handed out twice, across crashes too
+//
+// A crash here closes the binlog as a restart would, so what was written
+// but not synced survives, as it does when the process dies but not when
+// the machine does; dispatch soak -spawn kills a real process for that.
+// The text protocol has no reserve or delete yet; once it does, they
+// belong in the script along with a check that no job is reserved twice.
+
+type simConfig struct {
+	seed    int64
+	steps   int
+	clients int
+	tubes   int
+	ttl     time.Duration
+	crash   float64
+	verbose bool
+}
+
+// simJob is what the harness knows of a job it was told was put.
+type simJob struct {
+	tube    string
+	body    string
+	created time.Time
+	deps    []uint64
+}
+
+type simState struct {
+	cfg   simConfig
+	rng   *rand.Rand
+	clock *FakeClock
+	dir   string
+
+	srv   *Server
+	l     *simListener
+	conns []*simConn
+
+	// jobs are the acknowledged jobs, and gone those since seen to have
+	// gone. maxID is the highest id handed out.
+	jobs  map[uint64]*simJob
+	gone  map[uint64]bool
+	maxID uint64
+	// unique maps a tube and put-unique key to the ids it was given.
+	unique map[string][]uint64
+
+	step   int
+	events []string
+	counts map[string]int
+}
+
+type simConn struct {
+	c    net.Conn
+	r    *bufio.Reader
+	tube string
+}
+
+func simMain(args []string) int {
+	var cfg simConfig
+	fs := flag.NewFlagSet("sim", flag.ExitOnError)
+	fs.Int64Var(&cfg.seed, "seed", time.Now().UnixNano(), "random seed; a failing seed fails the same way again")
+	fs.IntVar(&cfg.steps, "steps", 10000, "number of events to play")
+	fs.IntVar(&cfg.clients, "clients", 4, "client connections")
+	fs.IntVar(&cfg.tubes, "tubes", 4, "number of tubes to spread jobs over")
+	fs.DurationVar(&cfg.ttl, "ttl", 10*time.Minute, "job ttl, in virtual time")
+	fs.Float64Var(&cfg.crash, "crash", 0.005, "probability that an event is a crash")
+	fs.BoolVar(&cfg.verbose, "v", false, "log the server's messages and each event")
+	fs.Parse(args)
+
+	fmt.Printf("sim: seed %d\n", cfg.seed)
+	if !cfg.verbose {
+		slog.SetLogLoggerLevel(slog.LevelError)
+	}
+
+	dir, err := os.MkdirTemp("", "dispatch-sim-")
+	if err != nil {
+		fmt.Printf("sim: %v\n", err)
+		return 1
+	}
+	defer os.RemoveAll(dir)
+
+	s := &simState{
+		cfg:    cfg,
+		rng:    rand.New(rand.NewSource(cfg.seed)),
+		clock:  NewFakeClock(time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)),
+		dir:    dir,
+		jobs:   map[uint64]*simJob{},
+		gone:   map[uint64]bool{},
+		unique: map[string][]uint64{},
+		counts: map[string]int{},
+	}
+	err = simRun(s)
+	if s.srv != nil {
+		simStop(s)
+	}
+	if err != nil {
+		fmt.Printf("sim: FAILED at step %d: %v\n", s.step, err)
+		fmt.Printf("sim: last events:\n")
+		for _, e := range s.events {
+			fmt.Printf("\t%s\n", e)
+		}
+		return 1
+	}
+	var kinds []string
+	for k, n := range s.counts {
+		kinds = append(kinds, k+" "+strconv.Itoa(n))
+	}
+	sort.Strings(kinds)
+	fmt.Printf("sim: ok, %d steps, %d jobs left: %s\n", cfg.steps, len(s.jobs)-len(s.gone), strings.Join(kinds, ", "))
+	return 0
+}
+
+func simRun(s *simState) error {
+	if err := simStart(s); err != nil {
+		return err
+	}
+	for s.step = 1; s.step <= s.cfg.steps; s.step++ {
+		kind := simPick(s)
+		s.counts[kind]++
+		if err := simEvent(s, kind); err != nil {
+			return fmt.Errorf("%s: %v", kind, err)
+		}
+		if err := simCheck(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// simLog notes an event, keeping the last few for a failure report.
+func simLog(s *simState, format string, args ...any) {
+	e := fmt.Sprintf("%d: ", s.step) + fmt.Sprintf(format, args...)
+	if s.cfg.verbose {
+		fmt.Println(e)
+	}
+	if s.events = append(s.events, e); len(s.events) > 20 {
+		s.events = s.events[1:]
+	}
+}
+
+func simPick(s *simState) string {
+	if s.rng.Float64() < s.cfg.crash {
+		return "crash"
+	}
+	switch n := s.rng.Intn(100); {
+	case n < 40:
+		return "put"
+	case n < 50:
+		return "put-unique"
+	case n < 58:
+		return "put-after"
+	case n < 66:
+		return "mput"
+	case n < 72:
+		return "cut"
+	case n < 77:
+		return "reconnect"
+	case n < 79:
+		return "snapshot"
+	default:
+		return "advance"
+	}
+}
+
+func simEvent(s *simState, kind string) error {
+	switch kind {
+	case "crash":
+		simLog(s, "crash")
+		simStop(s)
+		return simStart(s)
+	case "advance":
+		d := time.Duration(s.rng.Int63n(int64(s.cfg.ttl / 4)))
+		simLog(s, "advance %v", d)
+		s.clock.Advance(d)
+		// The sweeps tick on the clock as well, but run them here so
+		// that the check after this event sees them done.
+		now := s.clock.Now()
+		jobsMu.Lock()
+		expireSweep(now)
+		tubeGCSweep(now)
+		jobsMu.Unlock()
+		return nil
+	case "reconnect":
+		i := s.rng.Intn(len(s.conns))
+		simLog(s, "reconnect client %d", i)
+		return simReconnect(s, i)
+	case "snapshot":
+		c := s.conns[s.rng.Intn(len(s.conns))]
+		simLog(s, "snapshot")
+		reply, err := simCmd(c, "snapshot", nil)
+		if err != nil {
+			return err
+		}
+		if !strings.HasPrefix(reply, "SNAPSHOT ") {
+			return fmt.Errorf("got %q", reply)
+		}
+		return nil
+	}
+
+	i := s.rng.Intn(len(s.conns))
+	c := s.conns[i]
+	tube := "t" + strconv.Itoa(s.rng.Intn(s.cfg.tubes))
+	if c.tube != tube {
+		reply, err := simCmd(c, "use "+tube, nil)
+		if err != nil {
+			return err
+		}
+		if reply != "USING "+tube {
+			return fmt.Errorf("use %s: got %q", tube, reply)
+		}
+		c.tube = tube
+	}
+	body := simBody(s)
+	var delay int
+	if s.rng.Intn(4) == 0 {
+		delay = s.rng.Intn(600)
+	}
+	args := fmt.Sprintf("0 %d 60 %d", delay, len(body))
+
+	switch kind {
+	case "put":
+		simLog(s, "client %d: put %q into %s", i, body, tube)
+		return simPut(s, c, "put "+args, body, nil, "")
+	case "put-unique":
+		key := "k" + strconv.Itoa(s.rng.Intn(8))
+		simLog(s, "client %d: put-unique %s %q into %s", i, key, body, tube)
+		return simPut(s, c, "put-unique "+key+" "+args, body, nil, tube+" "+key)
+	case "put-after":
+		var deps []uint64
+		var ids []string
+		for n := 1 + s.rng.Intn(3); n > 0 && s.maxID > 0; n-- {
+			id := 1 + uint64(s.rng.Int63n(int64(s.maxID)))
+			deps = append(deps, id)
+			ids = append(ids, strconv.FormatUint(id, 10))
+		}
+		if deps == nil {
+			return nil
+		}
+		line := "put-after " + strings.Join(ids, ",") + " " + args
+		simLog(s, "client %d: %s %q into %s", i, line, body, tube)
+		return simPut(s, c, line, body, deps, "")
+	case "mput":
+		n := 1 + s.rng.Intn(5)
+		var req strings.Builder
+		bodies := make([]string, n)
+		fmt.Fprintf(&req, "mput %d\r\n", n)
+		for k := range bodies {
+			bodies[k] = simBody(s)
+			fmt.Fprintf(&req, "0 0 60 %d\r\n%s\r\n", len(bodies[k]), bodies[k])
+		}
+		simLog(s, "client %d: mput %q into %s", i, bodies, tube)
+		if _, err := c.c.Write([]byte(req.String())); err != nil {
+			return err
+		}
+		reply, err := simReply(c)
+		if err != nil {
+			return err
+		}
+		f := strings.Fields(reply)
+		if len(f) != n+1 || f[0] != "INSERTED_BATCH" {
+			return fmt.Errorf("got %q", reply)
+		}
+		for k, a := range f[1:] {
+			id, err := strconv.ParseUint(a, 10, 64)
+			if err != nil {
+				return fmt.Errorf("got %q", reply)
+			}
+			if err := simAck(s, id, tube, bodies[k], nil, ""); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "cut":
+		// The body is cut short by the client going away, so the job
+		// must not be put.
+		line := "put " + args + "\r\n"
+		sent := line + body[:s.rng.Intn(len(body)+1)]
+		simLog(s, "client %d: put cut after %d bytes", i, len(sent))
+		if _, err := c.c.Write([]byte(sent)); err != nil {
+			return err
+		}
+		return simReconnect(s, i)
+	}
+	return fmt.Errorf("unknown event")
+}
+
+func simBody(s *simState) string {
+	b := make([]byte, 1+s.rng.Intn(32))
+	for i := range b {
+		b[i] = byte('a' + s.rng.Intn(26))
+	}
+	return string(b)
+}
+
+// simPut sends a put and records the job it is told was put.
+func simPut(s *simState, c *simConn, line, body string, deps []uint64, unique string) error {
+	reply, err := simCmd(c, line, []byte(body))
+	if err != nil {
+		return err
+	}
+	id, ok := strings.CutPrefix(reply, "INSERTED ")
+	if !ok {
+		return fmt.Errorf("got %q", reply)
+	}
+	n, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return fmt.Errorf("got %q", reply)
+	}
+	return simAck(s, n, c.tube, body, deps, unique)
+}
+
+// simAck records that id was put. A put-unique may be given the id of the
+// job first put with its key, and nothing else may be given an id twice.
+func simAck(s *simState, id uint64, tube, body string, deps []uint64, unique string) error {
+	if unique != "" {
+		for _, u := range s.unique[unique] {
+			if u == id {
+				return nil
+			}
+		}
+	}
+	if id <= s.maxID {
+		return fmt.Errorf("id %d handed out again, the highest so far is %d", id, s.maxID)
+	}
+	s.maxID = id
+	s.jobs[id] = &simJob{tube: tube, body: body, created: s.clock.Now(), deps: deps}
+	if unique != "" {
+		s.unique[unique] = append(s.unique[unique], id)
+	}
+	return nil
+}
+
+// simCheck checks the server's tables against each other and against the
+// jobs acknowledged.
+func simCheck(s *simState) error {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+
+	if r := verifyState(wal, false); len(r.problems) > 0 {
+		return fmt.Errorf("verify: %s", strings.Join(r.problems, "; "))
+	}
+	for id, j := range allJobs {
+		sj := s.jobs[id]
+		switch {
+		case sj == nil:
+			return fmt.Errorf("job %d is held but was never acknowledged", id)
+		case s.gone[id]:
+			return fmt.Errorf("job %d came back after it was gone", id)
+		case j.tube.name != sj.tube:
+			return fmt.Errorf("job %d is in tube %q, was put into %q", id, j.tube.name, sj.tube)
+		case string(jobBody(j)) != sj.body+"\r\n":
+			return fmt.Errorf("job %d has body %q, was put with %q", id, jobBody(j), sj.body)
+		}
+	}
+	now := s.clock.Now()
+	for id, sj := range s.jobs {
+		if s.gone[id] || allJobs[id] != nil {
+			continue
+		}
+		if now.Sub(sj.created) < s.cfg.ttl {
+			return fmt.Errorf("job %d is lost: it was put %v ago, within the ttl", id, now.Sub(sj.created))
+		}
+		for _, d := range sj.deps {
+			if allJobs[d] != nil {
+				return fmt.Errorf("job %d is lost: it was still waiting for job %d", id, d)
+			}
+		}
+		s.gone[id] = true
+	}
+	return nil
+}
+
+func simStart(s *simState) error {
+	cfg := DefaultConfig()
+	cfg.Storage, cfg.StoragePath = storageBinlog, s.dir
+	cfg.JobTTL = s.cfg.ttl
+	cfg.TubeIdleTTL = s.cfg.ttl
+	cfg.Clock = s.clock
+	srv, err := NewServer(cfg)
+	if err != nil {
+		return err
+	}
+	s.srv = srv
+	s.l = newSimListener()
+	go srv.Serve(s.l)
+	s.conns = make([]*simConn, s.cfg.clients)
+	for i := range s.conns {
+		if err := simReconnect(s, i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func simStop(s *simState) {
+	for _, c := range s.conns {
+		if c != nil {
+			c.c.Close()
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := s.srv.Shutdown(ctx); err != nil {
+		slog.Error("sim: shutdown", "err", err)
+	}
+	s.srv = nil
+}
+
+func simReconnect(s *simState, i int) error {
+	if c := s.conns[i]; c != nil {
+		c.c.Close()
+	}
+	c, err := s.l.dial()
+	if err != nil {
+		return err
+	}
+	s.conns[i] = &simConn{c: c, r: bufio.NewReader(c), tube: defaultTubeName}
+	return nil
+}
+
+// simCmd sends a command, and a body if there is one, and returns the
+// reply line without its CRLF.
+func simCmd(c *simConn, line string, body []byte) (string, error) {
+	b := []byte(line + "\r\n")
+	if body != nil {
+		b = append(append(b, body...), "\r\n"...)
+	}
+	if _, err := c.c.Write(b); err != nil {
+		return "", err
+	}
+	return simReply(c)
+}
+
+func simReply(c *simConn) (string, error) {
+	c.c.SetReadDeadline(time.Now().Add(10 * time.Second))
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(line, "\r\n"), nil
+}
+
+// simListener hands the server the far ends of in-memory pipes.
+type simListener struct {
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+type simAddr struct{}
+
+func (simAddr) Network() string { return "sim" }
+func (simAddr) String() string  { return "sim" }
+
+func newSimListener() *simListener {
+	return &simListener{conns: make(chan net.Conn), done: make(chan struct{})}
+}
+
+func (l *simListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *simListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *simListener) Addr() net.Addr { return simAddr{} }
+
+func (l *simListener) dial() (net.Conn, error) {
+	c, srv := net.Pipe()
+	select {
+	case l.conns <- srv:
+		return c, nil
+	case <-l.done:
+		return nil, errors.New("server closed")
+	}
+}
@@ -0,0 +1,212 @@
+package dispatch
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strconv"
+)
+
+// A snapshot writes every tube and live job into a single new segment and
+// then removes all segments before it, so that replay reads one compact file
+// instead of the whole history.
+//
+// It works in three steps. First, with the tables locked, it reserves the
+// next segment number N for the snapshot, moves writing on to N+1, and
+// copies the jobs. Then, without locks, it writes binlog.N.tmp, syncs it, and
+// renames it into place. Finally, with the tables locked again, it homes the
+// copied jobs in N and removes the older segments. Changes made while the
+// snapshot is written go to N+1, which replay applies after N. A crash before
+// the rename leaves only the ignored .tmp file behind.
+
+var errSnapshotRunning = errors.New("snapshot already in progress")
+
+func walSnapshot(w *binlog) (seq int, jobs int, err error) {
+	jobsMu.Lock()
+	w.mu.Lock()
+	if w.snapshotting {
+		w.mu.Unlock()
+		jobsMu.Unlock()
+		return 0, 0, errSnapshotRunning
+	}
+	seq = w.cur.seq + 1
+	if err := walRotateTo(w, seq+1); err != nil {
+		w.mu.Unlock()
+		jobsMu.Unlock()
+		return 0, 0, err
+	}
+	w.snapshotting = true
+	// The copied jobs share their bodies with the live ones.
+	bodyHold.Add(1)
+	defer bodyHold.Add(-1)
+
+	// Only tube names are written, so that is all that is copied.
+	ts := make([]tube, 0, len(tubes))
+	for _, t := range tubes {
+		ts = append(ts, tube{name: t.name})
+	}
+	js := make([]job, 0, len(allJobs))
+	for _, j := range allJobs {
+		js = append(js, *j)
+	}
+	w.mu.Unlock()
+	jobsMu.Unlock()
+
+	defer func() {
+		w.mu.Lock()
+		w.snapshotting = false
+		w.mu.Unlock()
+	}()
+
+	sizes, size, err := walWriteSnapshot(w.dir, w.aead, seq, ts, js)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	snap := &walSegment{seq: seq, size: size, sealed: w.aead != nil, jobs: map[uint64]*job{}}
+	for id, n := range sizes {
+		j, ok := allJobs[id]
+		if !ok || j.walSeg == nil || j.walSeg.seq > seq {
+			// Deleted, or moved on to a later segment, in the meantime.
+			continue
+		}
+		walUnhome(j)
+		j.walSeg = snap
+		j.walSize = n
+		snap.jobs[id] = j
+		snap.live += n
+	}
+
+	segs := []*walSegment{snap}
+	for _, old := range w.segs {
+		if old.seq < seq {
+			if err := os.Remove(walSegmentPath(w.dir, old.seq)); err != nil && !os.IsNotExist(err) {
+				return 0, 0, err
+			}
+			continue
+		}
+		segs = append(segs, old)
+	}
+	w.segs = segs
+	return seq, len(snap.jobs), nil
+}
+
+// walWriteSnapshot writes the given tubes and jobs as binlog.seq, sealed
+// with aead if it is not nil, returning the size of each job's record and
+// of the whole file.
+func walWriteSnapshot(dir string, aead cipher.AEAD, seq int, ts []tube, js []job) (map[uint64]int64, int64, error) {
+	path := walSegmentPath(dir, seq)
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer os.Remove(tmp)
+	defer f.Close()
+
+	var buf []byte
+	buf = binary.LittleEndian.AppendUint32(buf, walVersion(aead))
+	size := int64(len(buf))
+
+	flush := func() error {
+		if _, err := f.Write(buf); err != nil {
+			return err
+		}
+		size += int64(len(buf))
+		buf = buf[:0]
+		return nil
+	}
+	frame := func(start int) int64 {
+		if aead != nil {
+			sealed := walSeal(aead, nil, buf[start+recHeaderSize:])
+			buf = append(buf[:start+recHeaderSize], sealed...)
+		}
+		rec := buf[start:]
+		binary.LittleEndian.PutUint32(rec[0:4], uint32(len(rec)-recHeaderSize))
+		binary.LittleEndian.PutUint32(rec[4:8], crc32.ChecksumIEEE(rec[recHeaderSize:]))
+		return int64(len(rec))
+	}
+
+	for i := range ts {
+		start := len(buf)
+		buf = walEncodeTube(buf, &ts[i])
+		frame(start)
+	}
+
+	sizes := make(map[uint64]int64, len(js))
+	for i := range js {
+		start := len(buf)
+		buf = walEncodePut(buf, &js[i])
+		sizes[js[i].id] = frame(start)
+		if len(buf) > 1<<20 {
+			if err := flush(); err != nil {
+				return nil, 0, err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return nil, 0, err
+	}
+
+	if err := f.Sync(); err != nil {
+		return nil, 0, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return nil, 0, err
+	}
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return sizes, size, nil
+}
+
+// snapshotOnSignal takes a snapshot whenever the process gets SIGUSR1,
+// where there is one.
+func snapshotOnSignal(w *binlog) {
+	if snapshotSignal == nil {
+		return
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, snapshotSignal)
+	go func() {
+		for range ch {
+			seq, n, err := walSnapshot(w)
+			if err != nil {
+				slog.Error("snapshot failed", "err", err)
+				continue
+			}
+			slog.Info("snapshot written", "jobs", n, "file", walSegmentPath(w.dir, seq))
+		}
+	}()
+}
+
+func doSnapshot(c *conn) {
+	if wal == nil {
+		replyMsg(c, msgNoBinlog)
+		return
+	}
+	seq, n, err := walSnapshot(wal)
+	if err != nil {
+		slog.Error("snapshot failed", "err", err)
+		replyMsg(c, msgInternalError)
+		return
+	}
+	audit("snapshot", c.identity, c.conn.RemoteAddr().String(), "seq", seq, "jobs", n)
+	b := newReply(c)
+	*b = append(*b, "SNAPSHOT "...)
+	*b = strconv.AppendInt(*b, int64(seq), 10)
+	*b = append(*b, ' ')
+	*b = strconv.AppendInt(*b, int64(n), 10)
+	*b = append(*b, "\r\n"...)
+	replyBytes(c, b, connStateSendWord)
+}
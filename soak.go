@@ -0,0 +1,442 @@
+package dispatch
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// The soak harness drives a server with a mixed workload for a long time and
+// periodically stops the workload to check invariants against stats:
+//
+//   - every INSERTED id is unique and ids only grow on a connection
+//   - every acknowledged job is still present (ready + delayed)
+//   - current-connections matches the connections the harness holds
+//
+// With -spawn the harness runs the server itself with a binlog and kills it
+// with SIGKILL every -crash-every, so the checks also cover recovery.
+//
+// The text protocol has no reserve or delete yet; once it does, consumers
+// should be added here along with the no-double-completion check.
+
+type soakConfig struct {
+	addr       string
+	duration   time.Duration
+	clients    int
+	tubes      int
+	maxBody    int
+	maxDelay   int
+	churn      float64
+	checkEvery time.Duration
+	crashEvery time.Duration
+	spawn      bool
+	seed       int64
+}
+
+type soakState struct {
+	cfg soakConfig
+
+	// pause is held for reading by every operation and for writing by the
+	// checker, so that checks see a quiescent server.
+	pause sync.RWMutex
+
+	mu    sync.Mutex
+	ids   map[uint64]bool
+	acked uint64
+	maxID uint64
+	open  int
+
+	ops      atomic.Uint64
+	failures atomic.Uint64
+
+	server *exec.Cmd
+	binlog string
+}
+
+func soakMain(args []string) int {
+	var cfg soakConfig
+	fs := flag.NewFlagSet("soak", flag.ExitOnError)
+	fs.StringVar(&cfg.addr, "addr", "127.0.0.1:3333", "server address")
+	fs.DurationVar(&cfg.duration, "duration", time.Hour, "how long to run")
+	fs.IntVar(&cfg.clients, "clients", 16, "concurrent client connections")
+	fs.IntVar(&cfg.tubes, "tubes", 8, "number of tubes to spread jobs over")
+	fs.IntVar(&cfg.maxBody, "max-body", 1024, "maximum job body size")
+	fs.IntVar(&cfg.maxDelay, "max-delay", 3600, "maximum job delay in seconds")
+	fs.Float64Var(&cfg.churn, "churn", 0.01, "probability that a client reconnects after an operation")
+	fs.DurationVar(&cfg.checkEvery, "check-every", 10*time.Second, "interval between invariant checks")
+	fs.DurationVar(&cfg.crashEvery, "crash-every", time.Minute, "with -spawn, interval between server kills")
+	fs.BoolVar(&cfg.spawn, "spawn", false, "run and periodically kill the server under test")
+	fs.Int64Var(&cfg.seed, "seed", time.Now().UnixNano(), "random seed")
+	fs.Parse(args)
+
+	fmt.Printf("soak: seed %d\n", cfg.seed)
+
+	s := &soakState{cfg: cfg, ids: map[uint64]bool{}}
+	if cfg.spawn {
+		dir, err := os.MkdirTemp("", "dispatch-soak-")
+		if err != nil {
+			fmt.Printf("soak: %v\n", err)
+			return 1
+		}
+		defer os.RemoveAll(dir)
+		s.binlog = dir
+
+		if err := soakStartServer(s); err != nil {
+			fmt.Printf("soak: %v\n", err)
+			return 1
+		}
+		defer soakStopServer(s)
+	}
+
+	if err := soakRun(s); err != nil {
+		fmt.Printf("soak: FAILED: %v\n", err)
+		return 1
+	}
+	fmt.Printf("soak: ok, %d ops, %d jobs\n", s.ops.Load(), s.acked)
+	return 0
+}
+
+func soakRun(s *soakState) error {
+	stop := make(chan struct{})
+	errc := make(chan error, s.cfg.clients+1)
+
+	var wg sync.WaitGroup
+	for i := 0; i < s.cfg.clients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(s.cfg.seed + int64(i)))
+			if err := soakClient(s, rng, stop); err != nil {
+				errc <- err
+			}
+		}(i)
+	}
+
+	deadline := time.After(s.cfg.duration)
+	check := time.NewTicker(s.cfg.checkEvery)
+	defer check.Stop()
+
+	var crash <-chan time.Time
+	if s.cfg.spawn {
+		t := time.NewTicker(s.cfg.crashEvery)
+		defer t.Stop()
+		crash = t.C
+	}
+
+	var err error
+loop:
+	for {
+		select {
+		case <-deadline:
+			break loop
+		case err = <-errc:
+			break loop
+		case <-check.C:
+			if err = soakCheck(s, true); err != nil {
+				break loop
+			}
+		case <-crash:
+			if err = soakCrash(s); err != nil {
+				break loop
+			}
+		}
+	}
+
+	close(stop)
+	wg.Wait()
+	if err != nil {
+		return err
+	}
+	return soakCheck(s, true)
+}
+
+type soakConn struct {
+	c net.Conn
+	r *bufio.Reader
+}
+
+func soakDial(s *soakState) (*soakConn, error) {
+	c, err := net.DialTimeout("tcp", s.cfg.addr, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	return &soakConn{c: c, r: bufio.NewReader(c)}, nil
+}
+
+func soakRoundTrip(sc *soakConn, req []byte) (string, error) {
+	sc.c.SetDeadline(time.Now().Add(30 * time.Second))
+	if _, err := sc.c.Write(req); err != nil {
+		return "", err
+	}
+	line, err := sc.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(line, "\r\n"), nil
+}
+
+// soakStatsBody reads the body of a stats reply, framed as OK <bytes>.
+func soakStatsBody(sc *soakConn, reply string) ([]byte, error) {
+	n, err := strconv.Atoi(strings.TrimPrefix(reply, "OK "))
+	if !strings.HasPrefix(reply, "OK ") || err != nil {
+		return nil, fmt.Errorf("%w: stats: unexpected reply %q", errSoakInvariant, reply)
+	}
+	body := make([]byte, n+2)
+	if _, err := io.ReadFull(sc.r, body); err != nil {
+		return nil, err
+	}
+	if string(body[n:]) != "\r\n" {
+		return nil, fmt.Errorf("%w: stats: body not followed by CRLF", errSoakInvariant)
+	}
+	return body[:n], nil
+}
+
+// soakClient runs one connection's worth of workload until stop is closed.
+// Connection errors are expected while a spawned server is being restarted
+// and only lead to a reconnect; wrong replies are fatal.
+func soakClient(s *soakState, rng *rand.Rand, stop <-chan struct{}) error {
+	var sc *soakConn
+	var lastID uint64
+
+	disconnect := func() {
+		if sc == nil {
+			return
+		}
+		sc.c.Close()
+		sc = nil
+		s.mu.Lock()
+		s.open--
+		s.mu.Unlock()
+	}
+	defer disconnect()
+
+	for {
+		select {
+		case <-stop:
+			return nil
+		default:
+		}
+
+		s.pause.RLock()
+		err := func() error {
+			if sc == nil {
+				c, err := soakDial(s)
+				if err != nil {
+					return nil
+				}
+				sc = c
+				lastID = 0
+				s.mu.Lock()
+				s.open++
+				s.mu.Unlock()
+			}
+
+			err := soakOp(s, sc, rng, &lastID)
+			if errors.Is(err, errSoakInvariant) {
+				return err
+			}
+			if err != nil || rng.Float64() < s.cfg.churn {
+				if err != nil {
+					s.failures.Add(1)
+				} else {
+					soakRoundTrip(sc, []byte("quit\r\n"))
+				}
+				disconnect()
+			}
+			return nil
+		}()
+		s.pause.RUnlock()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+var errSoakInvariant = errors.New("invariant violated")
+
+func soakOp(s *soakState, sc *soakConn, rng *rand.Rand, lastID *uint64) error {
+	s.ops.Add(1)
+
+	switch n := rng.Intn(100); {
+	case n < 10:
+		tube := "soak-" + strconv.Itoa(rng.Intn(s.cfg.tubes))
+		reply, err := soakRoundTrip(sc, []byte("use "+tube+"\r\n"))
+		if err != nil {
+			return err
+		}
+		if !strings.HasPrefix(reply, "USING ") {
+			return fmt.Errorf("%w: use: unexpected reply %q", errSoakInvariant, reply)
+		}
+	case n < 15:
+		reply, err := soakRoundTrip(sc, []byte("stats\r\n"))
+		if err != nil {
+			return err
+		}
+		if _, err := soakStatsBody(sc, reply); err != nil {
+			return err
+		}
+	default:
+		size := rng.Intn(s.cfg.maxBody + 1)
+		body := make([]byte, size)
+		for i := range body {
+			body[i] = byte('a' + rng.Intn(26))
+		}
+		delay := 0
+		if rng.Intn(4) == 0 {
+			delay = rng.Intn(s.cfg.maxDelay + 1)
+		}
+		req := fmt.Sprintf("put %d %d %d %d\r\n%s\r\n", rng.Intn(2048), delay, 1+rng.Intn(120), size, body)
+		reply, err := soakRoundTrip(sc, []byte(req))
+		if err != nil {
+			return err
+		}
+		if reply == strings.TrimSuffix(msgInternalError, "\r\n") {
+			return nil
+		}
+		if !strings.HasPrefix(reply, msgInserted) {
+			return fmt.Errorf("%w: put: unexpected reply %q", errSoakInvariant, reply)
+		}
+		id, err := strconv.ParseUint(reply[len(msgInserted):], 10, 64)
+		if err != nil {
+			return fmt.Errorf("%w: put: bad id in %q", errSoakInvariant, reply)
+		}
+		if id <= *lastID {
+			return fmt.Errorf("%w: put: id %d after %d on the same connection", errSoakInvariant, id, *lastID)
+		}
+		*lastID = id
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.ids[id] {
+			return fmt.Errorf("%w: put: id %d handed out twice", errSoakInvariant, id)
+		}
+		s.ids[id] = true
+		s.acked++
+		if id > s.maxID {
+			s.maxID = id
+		}
+	}
+	return nil
+}
+
+// soakCheck stops the workload and compares the server's stats with what the
+// harness has been told. Connections are not compared right after a
+// restart, while clients still hold connections to the old process.
+func soakCheck(s *soakState, conns bool) error {
+	s.pause.Lock()
+	defer s.pause.Unlock()
+
+	st, err := soakStats(s)
+	if err != nil {
+		if s.cfg.spawn {
+			// The server may be in the middle of a restart.
+			return nil
+		}
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	jobs := st["current-jobs-ready"] + st["current-jobs-delayed"] + st["current-jobs-reserved"] + st["current-jobs-buried"]
+	if jobs != s.acked {
+		return fmt.Errorf("%w: server holds %d jobs, %d were acknowledged", errSoakInvariant, jobs, s.acked)
+	}
+	// One connection is the one used for this check.
+	if n := st["current-connections"]; conns && n != uint64(s.open+1) {
+		return fmt.Errorf("%w: server reports %d connections, harness holds %d", errSoakInvariant, n, s.open+1)
+	}
+
+	fmt.Printf("soak: %s ok: %d ops, %d jobs, %d conns, %d failed ops\n",
+		time.Now().Format(time.TimeOnly), s.ops.Load(), s.acked, s.open, s.failures.Load())
+	return nil
+}
+
+func soakStats(s *soakState) (map[string]uint64, error) {
+	sc, err := soakDial(s)
+	if err != nil {
+		return nil, err
+	}
+	defer sc.c.Close()
+
+	reply, err := soakRoundTrip(sc, []byte("stats\r\n"))
+	if err != nil {
+		return nil, err
+	}
+	body, err := soakStatsBody(sc, reply)
+	if err != nil {
+		return nil, err
+	}
+
+	st := map[string]uint64{}
+	for _, line := range strings.Split(string(body), "\n") {
+		k, v, ok := strings.Cut(line, ": ")
+		if !ok {
+			continue
+		}
+		if n, err := strconv.ParseUint(v, 10, 64); err == nil {
+			st[k] = n
+		}
+	}
+
+	soakRoundTrip(sc, []byte("quit\r\n"))
+	return st, nil
+}
+
+func soakStartServer(s *soakState) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(exe, "-b", s.binlog, "-f", "0")
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	s.server = cmd
+
+	for i := 0; i < 50; i++ {
+		if c, err := net.Dial("tcp", s.cfg.addr); err == nil {
+			c.Close()
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return fmt.Errorf("server did not start listening on %s", s.cfg.addr)
+}
+
+func soakStopServer(s *soakState) {
+	if s.server == nil {
+		return
+	}
+	s.server.Process.Signal(syscall.SIGKILL)
+	s.server.Wait()
+	s.server = nil
+}
+
+// soakCrash kills the spawned server mid-workload, restarts it on the same
+// binlog, and checks that every acknowledged job came back.
+func soakCrash(s *soakState) error {
+	s.pause.Lock()
+	soakStopServer(s)
+	err := soakStartServer(s)
+	s.pause.Unlock()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("soak: restarted server\n")
+	return soakCheck(s, false)
+}
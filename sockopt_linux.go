@@ -0,0 +1,6 @@
+//go:build linux && !(mips || mipsle || mips64 || mips64le || sparc64)
+
+package dispatch
+
+// The syscall package predates SO_REUSEPORT and does not define it.
+const soReusePort = 0xf
@@ -0,0 +1,220 @@
+package dispatch
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// The sqlite storage keeps jobs in an ordinary table so that operators can
+// inspect a stuck queue with the sqlite3 shell while the server is down:
+//
+//	SELECT id, tube, state, pri, length(body) FROM jobs WHERE state = 'buried';
+//
+// Bodies are stored without their trailing CRLF and times as nanoseconds
+// since the epoch (0 for none). The driver is only linked in with
+// -tags sqlite.
+
+const sqliteDriver = "sqlite"
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS tubes (
+	name TEXT PRIMARY KEY
+);
+CREATE TABLE IF NOT EXISTS jobs (
+	id       INTEGER PRIMARY KEY,
+	tube     TEXT NOT NULL,
+	state    TEXT NOT NULL,
+	pri      INTEGER NOT NULL,
+	delay    INTEGER NOT NULL,
+	ttr      INTEGER NOT NULL,
+	created  INTEGER NOT NULL,
+	deadline INTEGER NOT NULL,
+	body     BLOB NOT NULL
+);
+CREATE INDEX IF NOT EXISTS jobs_tube_state ON jobs (tube, state);
+`
+
+var jobStateNames = map[jobState]string{
+	jobStateReady:    "ready",
+	jobStateReserved: "reserved",
+	jobStateBuried:   "buried",
+	jobStateDelayed:  "delayed",
+	jobStateHeld:     "held",
+}
+
+type sqliteStorage struct {
+	db *sql.DB
+
+	stmtTube   *sql.Stmt
+	stmtPut    *sql.Stmt
+	stmtUpdate *sql.Stmt
+	stmtDelete *sql.Stmt
+}
+
+func sqliteOpen(path string) (storage, error) {
+	registered := false
+	for _, d := range sql.Drivers() {
+		registered = registered || d == sqliteDriver
+	}
+	if !registered {
+		return nil, fmt.Errorf("sqlite storage is not compiled in; build with -tags sqlite")
+	}
+
+	db, err := sql.Open(sqliteDriver, path)
+	if err != nil {
+		return nil, err
+	}
+	// One connection keeps writes in order and avoids SQLITE_BUSY.
+	db.SetMaxOpenConns(1)
+
+	sync := "FULL"
+	if binlogNoSync {
+		sync = "OFF"
+	}
+	s := &sqliteStorage{db: db}
+	err = sqliteExec(db,
+		"PRAGMA journal_mode = WAL",
+		"PRAGMA synchronous = "+sync,
+		sqliteSchema,
+	)
+	if err == nil {
+		err = sqlitePrepare(s)
+	}
+	if err == nil {
+		err = sqliteLoad(db)
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func sqliteExec(db *sql.DB, stmts ...string) error {
+	for _, q := range stmts {
+		if _, err := db.Exec(q); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sqlitePrepare(s *sqliteStorage) error {
+	var err error
+	prepare := func(q string) *sql.Stmt {
+		if err != nil {
+			return nil
+		}
+		var st *sql.Stmt
+		st, err = s.db.Prepare(q)
+		return st
+	}
+	s.stmtTube = prepare(`INSERT OR IGNORE INTO tubes (name) VALUES (?)`)
+	s.stmtPut = prepare(`INSERT OR REPLACE INTO jobs
+		(id, tube, state, pri, delay, ttr, created, deadline, body)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	s.stmtUpdate = prepare(`UPDATE jobs SET state = ?, pri = ?, delay = ?, deadline = ? WHERE id = ?`)
+	s.stmtDelete = prepare(`DELETE FROM jobs WHERE id = ?`)
+	return err
+}
+
+func sqliteLoad(db *sql.DB) error {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+
+	rows, err := db.Query(`SELECT name FROM tubes`)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		tubeFindOrMakeLocked(name)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	states := map[string]jobState{}
+	for st, name := range jobStateNames {
+		states[name] = st
+	}
+
+	rows, err = db.Query(`SELECT id, tube, state, pri, delay, ttr, created, deadline, body FROM jobs`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			j                 job
+			tube, state       string
+			created, deadline int64
+		)
+		err := rows.Scan(&j.id, &tube, &state, &j.pri, &j.delay, &j.ttr, &created, &deadline, &j.body)
+		if err != nil {
+			return err
+		}
+		st, ok := states[state]
+		if !ok {
+			return fmt.Errorf("sqlite: job %d has unknown state %q", j.id, state)
+		}
+		j.state = st
+		j.body = append(j.body, "\r\n"...)
+		j.bodySize = uint64(len(j.body))
+		j.created = walTimeDecode(uint64(created))
+		j.deadline = walTimeDecode(uint64(deadline))
+		j.tube = tubeFindOrMakeLocked(tube)
+
+		storeJob(&j)
+		if j.id >= nextJobID {
+			nextJobID = j.id + 1
+		}
+	}
+	return rows.Err()
+}
+
+func sqliteTime(t time.Time) int64 {
+	return int64(walTime(t))
+}
+
+// sqliteBody is j's body as it was put, without its CRLF.
+func sqliteBody(j *job) []byte {
+	b := jobBody(j)
+	if n := len(b); n >= 2 {
+		return b[:n-2]
+	}
+	return b
+}
+
+func (s *sqliteStorage) putJob(j *job) error {
+	if _, err := s.stmtTube.Exec(j.tube.name); err != nil {
+		return err
+	}
+	_, err := s.stmtPut.Exec(j.id, j.tube.name, jobStateNames[j.state], j.pri, j.delay, j.ttr,
+		sqliteTime(j.created), sqliteTime(j.deadline), sqliteBody(j))
+	return err
+}
+
+func (s *sqliteStorage) updateJob(j *job) error {
+	_, err := s.stmtUpdate.Exec(jobStateNames[j.state], j.pri, j.delay, sqliteTime(j.deadline), j.id)
+	return err
+}
+
+func (s *sqliteStorage) deleteJob(j *job) error {
+	_, err := s.stmtDelete.Exec(j.id)
+	return err
+}
+
+func (s *sqliteStorage) check() error {
+	return s.db.Ping()
+}
+
+func (s *sqliteStorage) close() error {
+	return s.db.Close()
+}
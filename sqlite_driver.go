@@ -0,0 +1,5 @@
+//go:build sqlite
+
+package dispatch
+
+import _ "modernc.org/sqlite"
@@ -0,0 +1,883 @@
+package dispatch
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jkasarherou/dispatch/protocol"
+)
+
+// The SQS facade serves the core of the Amazon SQS API on -sqs-addr, so
+// that programs written against an AWS SDK can put jobs into dispatch and
+// take them out, on premises or in development, by pointing the SDK's
+// endpoint at it. It
+// speaks the JSON protocol current SDKs use (X-Amz-Target: AmazonSQS.<Action>
+// with an application/x-amz-json-1.0 body), not the older query protocol.
+//
+// A queue is a tube, and its URL is http://<host>/<tube>. Of a queue URL
+// sent in a request only the last path segment is read, so the URLs of an
+// AWS account, .../123456789012/emails, work too. CreateQueue and
+// GetQueueUrl return the URL for any valid name, since tubes are made when
+// first used; the queue's attributes are ignored, as tubes are set up in
+// the config file. GetQueueAttributes reports ApproximateNumberOfMessages,
+// ...NotVisible and ...Delayed from the tube's ready, reserved, and delayed
+// and held jobs.
+//
+// SendMessage and SendMessageBatch put a job per message, with the message
+// body as its body, DelaySeconds as its delay, and these attributes:
+//
+//	priority  Number, the job's priority, or 1024
+//	ttr       Number, the job's TTR in seconds, or sqsVisibilityTimeout
+//
+// The job's TTR is the visibility timeout of its message: how long a
+// consumer may take before the job is handed out again. Other String or
+// Number attributes become the job's put-headers, and must follow their
+// rules; Binary attributes are refused. The message id is the job id.
+//
+// ReceiveMessage hands out up to MaxNumberOfMessages of a tube's jobs, in
+// the order the tube delivers them, reserving each for VisibilityTimeout
+// seconds or, if that is not given, its TTR. A delayed job whose delay has
+// ended, or a reserved one whose reservation has lapsed, is handed out as
+// a ready one is; a lapse counts as a timeout. With WaitTimeSeconds the
+// receive waits until a job turns up, the time is up or the server stops,
+// woken by the tube rather than looking again; see ready.go. A paused tube
+// hands out nothing. A message carries the job's headers as String
+// attributes and its priority and ttr as Number ones, those of them
+// MessageAttributeNames asks for; system attributes are not kept.
+//
+// A receipt handle names one reservation of a job: its id and how many
+// times it has been reserved. DeleteMessage and ChangeMessageVisibility
+// refuse a handle once the job has been handed out again or made ready, so
+// a consumer whose reservation lapsed can still delete the job only if no
+// other has received it since.
+//
+// ChangeMessageVisibility and ChangeMessageVisibilityBatch reserve a job
+// that is in flight for VisibilityTimeout more seconds, or with 0 make it
+// ready at once.
+//
+// Requests are not authenticated: SigV4 signatures are accepted without
+// being checked, so like -admin-addr the listener belongs on a private
+// address. Its clients are held to -allow and -deny as the text
+// protocol's are. With -authz each action is checked for the remote
+// address without an identity, as put, reserve, touch, release, delete,
+// stats-tube or use.
+
+const (
+	sqsTargetPrefix = "AmazonSQS."
+
+	// sqsVisibilityTimeout is SQS's default visibility timeout, in
+	// seconds, and the TTR of jobs whose message sets none.
+	sqsVisibilityTimeout = 30
+
+	// sqsMaxVisibility caps a visibility timeout, in seconds, and
+	// sqsMaxWait a receive's wait, as SQS does.
+	sqsMaxVisibility = 12 * 60 * 60
+	sqsMaxWait       = 20
+
+	// sqsBatchMax is the number of entries a batch holds at most, and of
+	// messages a receive hands out.
+	sqsBatchMax = 10
+
+	// sqsMaxRequest caps the size of a request body, which holds up to
+	// sqsBatchMax bodies escaped as JSON strings.
+	sqsMaxRequest = 32 << 20
+)
+
+var sqsAddr string
+
+// sqsError is an error reply, sent as {"__type": ..., "message": ...}.
+type sqsError struct {
+	status  int
+	code    string
+	message string
+}
+
+func (e *sqsError) Error() string { return e.code + ": " + e.message }
+
+func sqsInvalid(format string, args ...any) *sqsError {
+	return &sqsError{http.StatusBadRequest, "InvalidParameterValue", fmt.Sprintf(format, args...)}
+}
+
+func sqsMissing(name string) *sqsError {
+	return &sqsError{http.StatusBadRequest, "MissingParameter", "The request must contain the parameter " + name + "."}
+}
+
+var (
+	sqsErrNoQueue        = &sqsError{http.StatusBadRequest, "QueueDoesNotExist", "The specified queue does not exist."}
+	sqsErrForbidden      = &sqsError{http.StatusForbidden, "AccessDenied", "forbidden"}
+	sqsErrDraining       = &sqsError{http.StatusServiceUnavailable, "ServiceUnavailable", "draining"}
+	sqsErrRateLimited    = &sqsError{http.StatusBadRequest, "RequestThrottled", "rate limited"}
+	sqsErrTubeFull       = &sqsError{http.StatusBadRequest, "OverLimit", "tube full"}
+	sqsErrInternal       = &sqsError{http.StatusInternalServerError, "InternalError", "internal error"}
+	sqsErrBadHandle      = &sqsError{http.StatusBadRequest, "ReceiptHandleIsInvalid", "The receipt handle is not valid."}
+	sqsErrNotInflight    = &sqsError{http.StatusBadRequest, "MessageNotInflight", "The message is not in flight."}
+	sqsErrEmptyBatch     = &sqsError{http.StatusBadRequest, "EmptyBatchRequest", "The batch request does not contain any entries."}
+	sqsErrTooManyInBatch = &sqsError{http.StatusBadRequest, "TooManyEntriesInBatchRequest", "The batch request contains more than 10 entries."}
+)
+
+// sqsActions are the actions served, each given the request and its body.
+var sqsActions = map[string]func(*http.Request, []byte) (any, error){
+	"CreateQueue":                  sqsGetQueueURL,
+	"GetQueueUrl":                  sqsGetQueueURL,
+	"GetQueueAttributes":           sqsGetQueueAttributes,
+	"SendMessage":                  sqsSendMessage,
+	"SendMessageBatch":             sqsSendMessageBatch,
+	"DeleteMessage":                sqsDeleteMessage,
+	"ReceiveMessage":               sqsReceiveMessage,
+	"ChangeMessageVisibility":      sqsChangeMessageVisibility,
+	"ChangeMessageVisibilityBatch": sqsChangeMessageVisibilityBatch,
+}
+
+// sqsServe serves the facade on l until l is closed. Requests' contexts
+// are ctx's, so that receives waiting for jobs end once it is done.
+func sqsServe(ctx context.Context, l net.Listener) {
+	srv := &http.Server{
+		Handler:           http.HandlerFunc(sqsHandle),
+		ReadHeaderTimeout: 10 * time.Second,
+		BaseContext:       func(net.Listener) context.Context { return ctx },
+	}
+	slog.Info("SQS listening", "addr", l.Addr().String())
+	if err := srv.Serve(l); err != nil && err != http.ErrServerClosed && !errors.Is(err, net.ErrClosed) {
+		slog.Error("SQS server failed", "err", err)
+	}
+}
+
+func sqsHandle(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	action, ok := strings.CutPrefix(r.Header.Get("X-Amz-Target"), sqsTargetPrefix)
+	if !ok {
+		sqsReplyError(w, &sqsError{http.StatusBadRequest, "InvalidAction", "only the JSON protocol is served; X-Amz-Target is missing"})
+		return
+	}
+	h := sqsActions[action]
+	if h == nil {
+		sqsReplyError(w, &sqsError{http.StatusBadRequest, "InvalidAction", "dispatch does not serve " + action})
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, sqsMaxRequest))
+	if err != nil {
+		sqsReplyError(w, sqsInvalid("reading the request: %v", err))
+		return
+	}
+	res, err := h(r, body)
+	if err != nil {
+		var e *sqsError
+		if !errors.As(err, &e) {
+			e = sqsInvalid("%v", err)
+		}
+		sqsReplyError(w, e)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+	json.NewEncoder(w).Encode(res)
+}
+
+func sqsReplyError(w http.ResponseWriter, e *sqsError) {
+	w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+	w.WriteHeader(e.status)
+	json.NewEncoder(w).Encode(map[string]string{
+		"__type":  "com.amazonaws.sqs#" + e.code,
+		"message": e.message,
+	})
+}
+
+// sqsDecode reads body into req, answering a malformed body as SQS does.
+func sqsDecode(body []byte, req any) error {
+	if err := json.Unmarshal(body, req); err != nil {
+		return sqsInvalid("malformed request: %v", err)
+	}
+	return nil
+}
+
+// sqsAuthorize checks op on tube for the sender of r.
+func sqsAuthorize(r *http.Request, op, tube string) error {
+	if !authorizeReq(&authzRequest{ctx: r.Context(), remote: r.RemoteAddr, op: op, tube: tube}) {
+		return sqsErrForbidden
+	}
+	return nil
+}
+
+// sqsQueueURL is the URL of the queue for tube name, on the host r was sent
+// to.
+func sqsQueueURL(r *http.Request, name string) string {
+	return "http://" + r.Host + "/" + url.PathEscape(name)
+}
+
+// sqsQueueName reads the tube name from the last path segment of a queue
+// URL.
+func sqsQueueName(queueURL string) (string, error) {
+	if queueURL == "" {
+		return "", sqsMissing("QueueUrl")
+	}
+	u, err := url.Parse(queueURL)
+	if err != nil {
+		return "", sqsErrNoQueue
+	}
+	p := u.EscapedPath()
+	name, err := url.PathUnescape(p[strings.LastIndexByte(p, '/')+1:])
+	if err != nil || !protocol.ValidTubeName(name) {
+		return "", sqsErrNoQueue
+	}
+	return name, nil
+}
+
+// sqsQueueNameOf checks the name given to CreateQueue or GetQueueUrl.
+func sqsQueueNameOf(r *http.Request, name string) error {
+	if name == "" {
+		return sqsMissing("QueueName")
+	}
+	if !protocol.ValidTubeName(name) {
+		return sqsInvalid("bad queue name %q", name)
+	}
+	return sqsAuthorize(r, "use", name)
+}
+
+type sqsQueueRequest struct {
+	QueueName string
+}
+
+type sqsQueueURLResponse struct {
+	QueueUrl string
+}
+
+// sqsGetQueueURL serves CreateQueue as well as GetQueueUrl.
+func sqsGetQueueURL(r *http.Request, body []byte) (any, error) {
+	var req sqsQueueRequest
+	if err := sqsDecode(body, &req); err != nil {
+		return nil, err
+	}
+	if err := sqsQueueNameOf(r, req.QueueName); err != nil {
+		return nil, err
+	}
+	return &sqsQueueURLResponse{QueueUrl: sqsQueueURL(r, req.QueueName)}, nil
+}
+
+func sqsGetQueueAttributes(r *http.Request, body []byte) (any, error) {
+	var req struct {
+		QueueUrl       string
+		AttributeNames []string
+	}
+	if err := sqsDecode(body, &req); err != nil {
+		return nil, err
+	}
+	name, err := sqsQueueName(req.QueueUrl)
+	if err != nil {
+		return nil, err
+	}
+	if err := sqsAuthorize(r, "stats-tube", name); err != nil {
+		return nil, err
+	}
+	var s tubeStats
+	jobsMu.Lock()
+	if t := tubes[name]; t != nil {
+		s = t.stat
+	}
+	jobsMu.Unlock()
+
+	all := map[string]string{
+		"ApproximateNumberOfMessages":           strconv.Itoa(s.ready),
+		"ApproximateNumberOfMessagesNotVisible": strconv.Itoa(s.reserved),
+		"ApproximateNumberOfMessagesDelayed":    strconv.Itoa(s.delayed + s.held),
+		"VisibilityTimeout":                     strconv.Itoa(sqsVisibilityTimeout),
+	}
+	attrs := map[string]string{}
+	for _, a := range req.AttributeNames {
+		if a == "All" {
+			attrs = all
+			break
+		}
+		if v, ok := all[a]; ok {
+			attrs[a] = v
+		}
+	}
+	return map[string]any{"Attributes": attrs}, nil
+}
+
+// sqsAttribute is a message attribute.
+type sqsAttribute struct {
+	DataType    string
+	StringValue string
+	BinaryValue []byte `json:",omitempty"`
+}
+
+// sqsMessage is a message to send, alone or in a batch.
+type sqsMessage struct {
+	Id                string
+	MessageBody       string
+	DelaySeconds      *int64
+	MessageAttributes map[string]sqsAttribute
+}
+
+type sqsSendResult struct {
+	Id                     string `json:",omitempty"`
+	MessageId              string
+	MD5OfMessageBody       string
+	MD5OfMessageAttributes string `json:",omitempty"`
+}
+
+func sqsSendMessage(r *http.Request, body []byte) (any, error) {
+	var req struct {
+		QueueUrl string
+		sqsMessage
+	}
+	if err := sqsDecode(body, &req); err != nil {
+		return nil, err
+	}
+	name, err := sqsQueueName(req.QueueUrl)
+	if err != nil {
+		return nil, err
+	}
+	return sqsSend(r, name, &req.sqsMessage)
+}
+
+func sqsSendMessageBatch(r *http.Request, body []byte) (any, error) {
+	var req struct {
+		QueueUrl string
+		Entries  []sqsMessage
+	}
+	if err := sqsDecode(body, &req); err != nil {
+		return nil, err
+	}
+	name, err := sqsQueueName(req.QueueUrl)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case len(req.Entries) == 0:
+		return nil, sqsErrEmptyBatch
+	case len(req.Entries) > sqsBatchMax:
+		return nil, sqsErrTooManyInBatch
+	}
+
+	res := struct {
+		Successful []*sqsSendResult
+		Failed     []sqsBatchFailure
+	}{Successful: []*sqsSendResult{}, Failed: []sqsBatchFailure{}}
+	for i := range req.Entries {
+		m := &req.Entries[i]
+		sent, err := sqsSend(r, name, m)
+		if err != nil {
+			res.Failed = append(res.Failed, sqsBatchFailed(m.Id, err))
+			continue
+		}
+		sent.Id = m.Id
+		res.Successful = append(res.Successful, sent)
+	}
+	return &res, nil
+}
+
+// sqsBatchFailure is an entry of a batch that failed.
+type sqsBatchFailure struct {
+	Id          string
+	SenderFault bool
+	Code        string
+	Message     string
+}
+
+func sqsBatchFailed(id string, err error) sqsBatchFailure {
+	e := err.(*sqsError)
+	return sqsBatchFailure{id, e.status < 500, e.code, e.message}
+}
+
+// sqsSend puts m into the tube name.
+func sqsSend(r *http.Request, name string, m *sqsMessage) (*sqsSendResult, error) {
+	if m.MessageBody == "" {
+		return nil, sqsMissing("MessageBody")
+	}
+	if p := m.DelaySeconds; p != nil && (*p < 0 || *p > 1<<32-1) {
+		return nil, sqsInvalid("bad DelaySeconds %d", *p)
+	}
+	pri, ttr, given, headers, err := sqsAttributes(m.MessageAttributes)
+	if err != nil {
+		return nil, err
+	}
+	var delay uint64
+	if m.DelaySeconds != nil {
+		delay = uint64(*m.DelaySeconds)
+		given |= putDelay
+	}
+	id, err := sqsPut(r.Context(), r.RemoteAddr, name, pri, delay, ttr, given, headers, []byte(m.MessageBody))
+	if err != nil {
+		return nil, err
+	}
+	sum := md5.Sum([]byte(m.MessageBody))
+	res := &sqsSendResult{
+		MessageId:        strconv.FormatUint(id, 10),
+		MD5OfMessageBody: hex.EncodeToString(sum[:]),
+	}
+	if len(m.MessageAttributes) > 0 {
+		res.MD5OfMessageAttributes = sqsAttributesMD5(m.MessageAttributes)
+	}
+	return res, nil
+}
+
+// sqsAttributes reads a message's priority and TTR from its attributes,
+// and which of them it gives, and its other attributes as headers.
+func sqsAttributes(attrs map[string]sqsAttribute) (pri, ttr uint64, given putFields, headers []jobHeader, err error) {
+	pri, ttr = bridgePri, sqsVisibilityTimeout
+	names := make([]string, 0, len(attrs))
+	for name := range attrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		a := attrs[name]
+		typ, _, _ := strings.Cut(a.DataType, ".")
+		if typ != "String" && typ != "Number" {
+			return 0, 0, 0, nil, sqsInvalid("attribute %s is of type %q; only String and Number are kept", name, a.DataType)
+		}
+		switch name {
+		case "priority", "ttr":
+			n, ok := protocol.ParseUint([]byte(a.StringValue), 32)
+			if typ != "Number" || !ok {
+				return 0, 0, 0, nil, sqsInvalid("bad %s attribute %q", name, a.StringValue)
+			}
+			if name == "priority" {
+				pri = n
+				given |= putPri
+			} else {
+				ttr = n
+				given |= putTTR
+			}
+		default:
+			if !headerKeyOK(name) || !headerValueOK(a.StringValue) {
+				return 0, 0, 0, nil, sqsInvalid("attribute %s=%q cannot be a header", name, a.StringValue)
+			}
+			if len(headers) == headersMax {
+				return 0, 0, 0, nil, sqsInvalid("more than %d attributes besides priority and ttr", headersMax)
+			}
+			headers = append(headers, jobHeader{name, a.StringValue})
+		}
+	}
+	return pri, ttr, given, headers, nil
+}
+
+// sqsAttributesMD5 is the digest of attrs SDKs check a send's reply
+// against: each attribute, by name, as its name, data type, transport type
+// and value, with lengths as 4-byte big-endian prefixes.
+func sqsAttributesMD5(attrs map[string]sqsAttribute) string {
+	names := make([]string, 0, len(attrs))
+	for name := range attrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	h := md5.New()
+	put := func(b []byte) {
+		var n [4]byte
+		binary.BigEndian.PutUint32(n[:], uint32(len(b)))
+		h.Write(n[:])
+		h.Write(b)
+	}
+	for _, name := range names {
+		a := attrs[name]
+		put([]byte(name))
+		put([]byte(a.DataType))
+		if strings.HasPrefix(a.DataType, "Binary") {
+			h.Write([]byte{2})
+			put(a.BinaryValue)
+		} else {
+			h.Write([]byte{1})
+			put([]byte(a.StringValue))
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// sqsPut puts a job into the tube name for the client at remote and
+// returns its id. given says which of pri, delay and ttr the message gave.
+func sqsPut(ctx context.Context, remote, name string, pri, delay, ttr uint64, given putFields, headers []jobHeader, body []byte) (uint64, error) {
+	sp := spanStart("dispatch.put")
+	defer spanEnd(sp)
+	spanString(sp, "dispatch.tube", name)
+	spanInt(sp, "dispatch.body_size", int64(len(body)))
+
+	if !authorizeReq(&authzRequest{ctx: ctx, remote: remote, op: "put", tube: name}) {
+		return 0, sqsErrForbidden
+	}
+	if draining.Load() {
+		return 0, sqsErrDraining
+	}
+	t := tubeFindOrMake(name)
+	if uint64(len(body)) > t.maxJobSize.Load() {
+		return 0, sqsInvalid("message must be at most %d bytes", t.maxJobSize.Load())
+	}
+	pri, delay, ttr, err := t.limits.Load().limit(pri, delay, ttr, given)
+	if err != nil {
+		return 0, sqsInvalid("%v", err)
+	}
+	if !tubePutAdmit(ctx, t) {
+		return 0, sqsErrRateLimited
+	}
+	j := makeJob(pri, delay, ttr, uint64(len(body))+2)
+	copy(j.body, body)
+	copy(j.body[len(body):], "\r\n")
+	j.tube = t
+	j.origin = originSQS
+	j.headers = headers
+	if err := jobInsert(j, sp); err != nil {
+		bodyFree(j.body)
+		if err == errTubeFull {
+			return 0, sqsErrTubeFull
+		}
+		return 0, sqsErrInternal
+	}
+	return j.id, nil
+}
+
+func sqsDeleteMessage(r *http.Request, body []byte) (any, error) {
+	var req struct {
+		QueueUrl      string
+		ReceiptHandle string
+	}
+	if err := sqsDecode(body, &req); err != nil {
+		return nil, err
+	}
+	name, err := sqsQueueName(req.QueueUrl)
+	if err != nil {
+		return nil, err
+	}
+	if req.ReceiptHandle == "" {
+		return nil, sqsMissing("ReceiptHandle")
+	}
+	id, reserves, err := sqsParseReceipt(req.ReceiptHandle)
+	if err != nil {
+		return nil, err
+	}
+	if err := sqsAuthorize(r, "delete", name); err != nil {
+		return nil, err
+	}
+
+	jobsMu.Lock()
+	j, err := sqsReservation(name, id, reserves)
+	if err != nil {
+		jobsMu.Unlock()
+		return nil, err
+	}
+	err = jobDelete(j)
+	jobsMu.Unlock()
+	if err != nil {
+		return nil, sqsErrInternal
+	}
+	audit("delete", "", r.RemoteAddr, "job", id, "tube", name)
+	return struct{}{}, nil
+}
+
+// sqsReceived is a message handed out by ReceiveMessage.
+type sqsReceived struct {
+	MessageId              string
+	ReceiptHandle          string
+	MD5OfBody              string
+	Body                   string
+	MD5OfMessageAttributes string                  `json:",omitempty"`
+	MessageAttributes      map[string]sqsAttribute `json:",omitempty"`
+}
+
+func sqsReceiveMessage(r *http.Request, body []byte) (any, error) {
+	var req struct {
+		QueueUrl              string
+		MaxNumberOfMessages   *int64
+		VisibilityTimeout     *int64
+		WaitTimeSeconds       *int64
+		MessageAttributeNames []string
+	}
+	if err := sqsDecode(body, &req); err != nil {
+		return nil, err
+	}
+	name, err := sqsQueueName(req.QueueUrl)
+	if err != nil {
+		return nil, err
+	}
+	n, visibility, wait := int64(1), int64(-1), int64(0)
+	if p := req.MaxNumberOfMessages; p != nil {
+		if *p < 1 || *p > sqsBatchMax {
+			return nil, sqsInvalid("bad MaxNumberOfMessages %d", *p)
+		}
+		n = *p
+	}
+	if p := req.VisibilityTimeout; p != nil {
+		if *p < 0 || *p > sqsMaxVisibility {
+			return nil, sqsInvalid("bad VisibilityTimeout %d", *p)
+		}
+		visibility = *p
+	}
+	if p := req.WaitTimeSeconds; p != nil {
+		if *p < 0 || *p > sqsMaxWait {
+			return nil, sqsInvalid("bad WaitTimeSeconds %d", *p)
+		}
+		wait = *p
+	}
+	if err := sqsAuthorize(r, "reserve", name); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), time.Duration(wait)*time.Second)
+	defer cancel()
+	var res struct {
+		Messages []*sqsReceived `json:",omitempty"`
+	}
+	err = tubeAwait(ctx, []string{name}, func(now time.Time) (bool, error) {
+		var err error
+		res.Messages, err = sqsReserveLocked(tubes[name], now, int(n), visibility, req.MessageAttributeNames)
+		return len(res.Messages) > 0, err
+	})
+	// Those reserved before any failure are handed out.
+	if err != nil && len(res.Messages) == 0 {
+		return nil, sqsErrInternal
+	}
+	return &res, nil
+}
+
+// sqsReserveLocked reserves up to n of the jobs the tube t, nil if there
+// is none, is to hand out at now, for visibility seconds or, if that is
+// negative, each job's TTR, and returns their messages with the attributes
+// names asks for. The caller must hold jobsMu.
+func sqsReserveLocked(t *tube, now time.Time, n int, visibility int64, names []string) ([]*sqsReceived, error) {
+	if t == nil || now.Before(t.pauseDeadline) {
+		return nil, nil
+	}
+	// A job reserved for no time is due again at once, but not to this
+	// receive.
+	tubeDue(t, now)
+	var msgs []*sqsReceived
+	for len(msgs) < n {
+		j := tubeNext(t)
+		if j == nil {
+			break
+		}
+		secs := visibility
+		if secs < 0 {
+			secs = int64(j.ttr)
+		}
+		lapsed := j.state == jobStateReserved
+		if err := jobMove(j, jobStateReserved, now.Add(time.Duration(secs)*time.Second)); err != nil {
+			return msgs, err
+		}
+		if lapsed {
+			t.stat.timeouts++
+			globalStat.timeoutCount++
+		}
+		j.reserves++
+		eventEmit(eventReserved, j)
+		msgs = append(msgs, sqsReceivedOf(j, names))
+	}
+	return msgs, nil
+}
+
+// sqsReceipt is the receipt handle of j's latest reservation: its id and
+// the number of times it has been reserved.
+func sqsReceipt(j *job) string {
+	return strconv.FormatUint(j.id, 10) + "-" + strconv.FormatUint(j.reserves, 10)
+}
+
+// sqsParseReceipt returns the job id and reservation that handle, made by
+// sqsReceipt, names.
+func sqsParseReceipt(handle string) (id, reserves uint64, err error) {
+	idStr, resStr, ok := strings.Cut(handle, "-")
+	if !ok {
+		return 0, 0, sqsErrBadHandle
+	}
+	id, err = strconv.ParseUint(idStr, 10, 64)
+	if err != nil {
+		return 0, 0, sqsErrBadHandle
+	}
+	reserves, err = strconv.ParseUint(resStr, 10, 64)
+	if err != nil {
+		return 0, 0, sqsErrBadHandle
+	}
+	return id, reserves, nil
+}
+
+// sqsReservation returns the job id of the tube name if its latest
+// reservation is the one reserves counts, and it has not been ended since.
+// The caller must hold jobsMu.
+func sqsReservation(name string, id, reserves uint64) (*job, error) {
+	j := allJobs[id]
+	if j == nil || j.tube.name != name || j.reserves != reserves {
+		return nil, sqsErrBadHandle
+	}
+	if j.state != jobStateReserved {
+		return nil, sqsErrNotInflight
+	}
+	return j, nil
+}
+
+// sqsReceivedOf is the message for j, with the attributes names asks for.
+// It shares no memory with j, so it can be sent once jobsMu, which the
+// caller must hold, is let go.
+func sqsReceivedOf(j *job, names []string) *sqsReceived {
+	b := jobBody(j)
+	body := sqsBodyString(b[:len(b)-2])
+	sum := md5.Sum([]byte(body))
+	m := &sqsReceived{
+		MessageId:     strconv.FormatUint(j.id, 10),
+		ReceiptHandle: sqsReceipt(j),
+		MD5OfBody:     hex.EncodeToString(sum[:]),
+		Body:          body,
+	}
+	attrs := map[string]sqsAttribute{}
+	add := func(name, typ, value string) {
+		if sqsWantAttribute(names, name) {
+			attrs[name] = sqsAttribute{DataType: typ, StringValue: value}
+		}
+	}
+	for _, h := range j.headers {
+		add(h.key, "String", h.value)
+	}
+	add("priority", "Number", strconv.FormatUint(j.pri, 10))
+	add("ttr", "Number", strconv.FormatUint(j.ttr, 10))
+	if len(attrs) > 0 {
+		m.MessageAttributes = attrs
+		m.MD5OfMessageAttributes = sqsAttributesMD5(attrs)
+	}
+	return m
+}
+
+// sqsBodyString is b as JSON carries it, with each byte that is not part of
+// UTF-8 replaced by U+FFFD, so that MD5OfBody is that of what the client
+// reads.
+func sqsBodyString(b []byte) string {
+	if utf8.Valid(b) {
+		return string(b)
+	}
+	return string([]rune(string(b)))
+}
+
+// sqsWantAttribute reports whether MessageAttributeNames, names, asks for
+// the attribute name: by its name, with All or .*, or with a prefix of it
+// up to a dot followed by *.
+func sqsWantAttribute(names []string, name string) bool {
+	for _, n := range names {
+		if n == "All" || n == ".*" || n == name {
+			return true
+		}
+		if p, ok := strings.CutSuffix(n, "*"); ok && strings.HasSuffix(p, ".") && strings.HasPrefix(name, p) {
+			return true
+		}
+	}
+	return false
+}
+
+func sqsChangeMessageVisibility(r *http.Request, body []byte) (any, error) {
+	var req struct {
+		QueueUrl          string
+		ReceiptHandle     string
+		VisibilityTimeout *int64
+	}
+	if err := sqsDecode(body, &req); err != nil {
+		return nil, err
+	}
+	name, err := sqsQueueName(req.QueueUrl)
+	if err != nil {
+		return nil, err
+	}
+	if err := sqsChangeVisibility(r, name, req.ReceiptHandle, req.VisibilityTimeout); err != nil {
+		return nil, err
+	}
+	return struct{}{}, nil
+}
+
+func sqsChangeMessageVisibilityBatch(r *http.Request, body []byte) (any, error) {
+	var req struct {
+		QueueUrl string
+		Entries  []struct {
+			Id                string
+			ReceiptHandle     string
+			VisibilityTimeout *int64
+		}
+	}
+	if err := sqsDecode(body, &req); err != nil {
+		return nil, err
+	}
+	name, err := sqsQueueName(req.QueueUrl)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case len(req.Entries) == 0:
+		return nil, sqsErrEmptyBatch
+	case len(req.Entries) > sqsBatchMax:
+		return nil, sqsErrTooManyInBatch
+	}
+
+	type success struct {
+		Id string
+	}
+	res := struct {
+		Successful []success
+		Failed     []sqsBatchFailure
+	}{Successful: []success{}, Failed: []sqsBatchFailure{}}
+	for _, e := range req.Entries {
+		if err := sqsChangeVisibility(r, name, e.ReceiptHandle, e.VisibilityTimeout); err != nil {
+			res.Failed = append(res.Failed, sqsBatchFailed(e.Id, err))
+			continue
+		}
+		res.Successful = append(res.Successful, success{e.Id})
+	}
+	return &res, nil
+}
+
+// sqsChangeVisibility reserves the job of the tube name that handle names,
+// which must be in flight, for timeout more seconds, or with 0 makes it
+// ready.
+func sqsChangeVisibility(r *http.Request, name, handle string, timeout *int64) error {
+	if handle == "" {
+		return sqsMissing("ReceiptHandle")
+	}
+	if timeout == nil {
+		return sqsMissing("VisibilityTimeout")
+	}
+	if *timeout < 0 || *timeout > sqsMaxVisibility {
+		return sqsInvalid("bad VisibilityTimeout %d", *timeout)
+	}
+	id, reserves, err := sqsParseReceipt(handle)
+	if err != nil {
+		return err
+	}
+	op := "touch"
+	if *timeout == 0 {
+		op = "release"
+	}
+	if err := sqsAuthorize(r, op, name); err != nil {
+		return err
+	}
+
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	j, err := sqsReservation(name, id, reserves)
+	if err != nil {
+		return err
+	}
+	now := clock.Now()
+	if !now.Before(j.deadline) {
+		return sqsErrNotInflight
+	}
+	if *timeout == 0 {
+		if err := jobMove(j, jobStateReady, time.Time{}); err != nil {
+			return sqsErrInternal
+		}
+		eventEmit(eventReleased, j)
+		return nil
+	}
+	if err := jobMove(j, jobStateReserved, now.Add(time.Duration(*timeout)*time.Second)); err != nil {
+		return sqsErrInternal
+	}
+	return nil
+}
@@ -0,0 +1,244 @@
+package dispatch
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// sqsTestPut puts a job with body and priority pri into the tube name.
+func sqsTestPut(t *testing.T, name, body string, pri uint64) {
+	t.Helper()
+	j := makeJob(pri, 0, 30, uint64(len(body))+2)
+	copy(j.body, body+"\r\n")
+	j.tube = tubeFindOrMake(name)
+	j.origin = originSQS
+	if err := jobInsert(j, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// sqsTestReceive receives up to n messages from the tube name, reserved
+// for visibility seconds, and returns their bodies.
+func sqsTestReceive(t *testing.T, name string, n int, visibility int64) []string {
+	t.Helper()
+	jobsMu.Lock()
+	msgs, err := sqsReserveLocked(tubes[name], clock.Now(), n, visibility, nil)
+	jobsMu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var bodies []string
+	for _, m := range msgs {
+		bodies = append(bodies, m.Body)
+	}
+	return bodies
+}
+
+func TestSQSReserve(t *testing.T) {
+	fc := NewFakeClock(time.Unix(1e9, 0))
+	saved := clock
+	clock = fc
+	serverReset()
+	t.Cleanup(func() {
+		clock = saved
+		serverReset()
+	})
+
+	sqsTestPut(t, "q", "low", 2000)
+	sqsTestPut(t, "q", "high", 10)
+	sqsTestPut(t, "q", "mid", 500)
+	sqsTestPut(t, "other", "elsewhere", 0)
+
+	if got := sqsTestReceive(t, "q", 2, 10); len(got) != 2 || got[0] != "high" || got[1] != "mid" {
+		t.Fatalf("first receive: got %q, want [high mid]", got)
+	}
+	if got := sqsTestReceive(t, "q", 10, 10); len(got) != 1 || got[0] != "low" {
+		t.Fatalf("second receive: got %q, want [low]", got)
+	}
+	if got := sqsTestReceive(t, "q", 10, 10); len(got) != 0 {
+		t.Fatalf("all in flight: got %q", got)
+	}
+
+	// The reservations lapse and the jobs are handed out again, in order.
+	fc.Advance(10 * time.Second)
+	if got := sqsTestReceive(t, "q", 1, 10); len(got) != 1 || got[0] != "high" {
+		t.Fatalf("after lapse: got %q, want [high]", got)
+	}
+	jobsMu.Lock()
+	timeouts, reserved := tubes["q"].stat.timeouts, tubes["q"].stat.reserved
+	jobsMu.Unlock()
+	if timeouts != 1 || reserved != 3 {
+		t.Errorf("timeouts %d, reserved %d, want 1, 3", timeouts, reserved)
+	}
+}
+
+func TestSQSReceipt(t *testing.T) {
+	fc := NewFakeClock(time.Unix(1e9, 0))
+	saved := clock
+	clock = fc
+	serverReset()
+	t.Cleanup(func() {
+		clock = saved
+		serverReset()
+	})
+
+	sqsTestPut(t, "q", "job", 0)
+	receive := func() string {
+		t.Helper()
+		jobsMu.Lock()
+		defer jobsMu.Unlock()
+		msgs, err := sqsReserveLocked(tubes["q"], clock.Now(), 1, 10, nil)
+		if err != nil || len(msgs) != 1 {
+			t.Fatalf("got %d messages, %v; want 1", len(msgs), err)
+		}
+		return msgs[0].ReceiptHandle
+	}
+	reservation := func(name, handle string) error {
+		t.Helper()
+		id, reserves, err := sqsParseReceipt(handle)
+		if err != nil {
+			return err
+		}
+		jobsMu.Lock()
+		defer jobsMu.Unlock()
+		_, err = sqsReservation(name, id, reserves)
+		return err
+	}
+
+	first := receive()
+	if err := reservation("q", first); err != nil {
+		t.Errorf("first handle: %v", err)
+	}
+	// The reservation lapses but the job is not handed out again, so the
+	// first handle still holds.
+	fc.Advance(10 * time.Second)
+	if err := reservation("q", first); err != nil {
+		t.Errorf("lapsed handle: %v", err)
+	}
+	second := receive()
+	if second == first {
+		t.Fatalf("both receives got handle %q", first)
+	}
+	if err := reservation("q", first); err != sqsErrBadHandle {
+		t.Errorf("first handle after another receive: got %v, want %v", err, sqsErrBadHandle)
+	}
+	if err := reservation("q", second); err != nil {
+		t.Errorf("second handle: %v", err)
+	}
+	if err := reservation("other", second); err != sqsErrBadHandle {
+		t.Errorf("handle of another queue: got %v, want %v", err, sqsErrBadHandle)
+	}
+	for _, handle := range []string{"1", "x-1", "1-x", ""} {
+		if err := reservation("q", handle); err != sqsErrBadHandle {
+			t.Errorf("handle %q: got %v, want %v", handle, err, sqsErrBadHandle)
+		}
+	}
+
+	// Once made ready the job is no longer in flight.
+	jobsMu.Lock()
+	id, _, _ := sqsParseReceipt(second)
+	err := jobMove(allJobs[id], jobStateReady, time.Time{})
+	jobsMu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := reservation("q", second); err != sqsErrNotInflight {
+		t.Errorf("handle of a ready job: got %v, want %v", err, sqsErrNotInflight)
+	}
+}
+
+func TestSQSWantAttribute(t *testing.T) {
+	tests := []struct {
+		names []string
+		name  string
+		want  bool
+	}{
+		{nil, "color", false},
+		{[]string{"All"}, "color", true},
+		{[]string{".*"}, "color", true},
+		{[]string{"color"}, "color", true},
+		{[]string{"colour"}, "color", false},
+		{[]string{"app.*"}, "app.color", true},
+		{[]string{"app.*"}, "application", false},
+		{[]string{"app*"}, "application", false},
+	}
+	for _, tt := range tests {
+		if got := sqsWantAttribute(tt.names, tt.name); got != tt.want {
+			t.Errorf("sqsWantAttribute(%q, %q) = %v, want %v", tt.names, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSQSBodyString(t *testing.T) {
+	if got := sqsBodyString([]byte("héllo")); got != "héllo" {
+		t.Errorf("got %q", got)
+	}
+	if got := sqsBodyString([]byte{'a', 0xff, 0xfe, 'b'}); got != "a��b" {
+		t.Errorf("got %q, want each bad byte replaced", got)
+	}
+}
+
+func TestSQSReceiveWokenByPut(t *testing.T) {
+	serverReset()
+	t.Cleanup(serverReset)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	got := make(chan []*sqsReceived, 1)
+	go func() {
+		var msgs []*sqsReceived
+		tubeAwait(ctx, []string{"q"}, func(now time.Time) (bool, error) {
+			var err error
+			msgs, err = sqsReserveLocked(tubes["q"], now, 1, 10, nil)
+			return len(msgs) > 0, err
+		})
+		got <- msgs
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	// fmtStats runs alongside the put, as a stats command would.
+	for _, f := range fmtStats() {
+		if f.key == "current-waiting" && f.value != int64(1) {
+			t.Errorf("current-waiting %v, want 1", f.value)
+		}
+	}
+	start := time.Now()
+	sqsTestPut(t, "q", "hello", 0)
+	msgs := <-got
+	if len(msgs) != 1 || msgs[0].Body != "hello" {
+		t.Fatalf("got %v, want the job put", msgs)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("woken %v after the put", d)
+	}
+}
+
+func TestSQSReserveDelayed(t *testing.T) {
+	fc := NewFakeClock(time.Unix(1e9, 0))
+	saved := clock
+	clock = fc
+	serverReset()
+	t.Cleanup(func() {
+		clock = saved
+		serverReset()
+	})
+
+	j := makeJob(0, 5, 30, 7)
+	copy(j.body, "later\r\n")
+	j.tube = tubeFindOrMake("q")
+	if err := jobInsert(j, nil); err != nil {
+		t.Fatal(err)
+	}
+	sqsTestPut(t, "q", "now", 100)
+	if got := sqsTestReceive(t, "q", 10, 0); len(got) != 1 || got[0] != "now" {
+		t.Fatalf("before the delay: got %q, want [now]", got)
+	}
+	// The job reserved for no time was not handed out twice above, and is
+	// handed out again now, after the delayed job, which goes first by
+	// priority once its delay is over.
+	fc.Advance(5 * time.Second)
+	if got := sqsTestReceive(t, "q", 10, 10); len(got) != 2 || got[0] != "later" || got[1] != "now" {
+		t.Fatalf("after the delay: got %q, want [later now]", got)
+	}
+}
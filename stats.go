@@ -0,0 +1,143 @@
+package dispatch
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Stats replies are dictionaries, built as a statsDict, which keeps its
+// keys in the order they are added, and encoded as a YAML document the way
+// beanstalkd sends them, or as a JSON object for a connection that asked
+// for one with format. Values are integers, booleans, strings, durations,
+// which are given in seconds, or lists of strings.
+
+type statsField struct {
+	key   string
+	value interface{}
+}
+
+type statsDict []statsField
+
+type statsFunc func() statsDict
+
+func (d *statsDict) add(key string, value interface{}) {
+	*d = append(*d, statsField{key, value})
+}
+
+// statsScalar formats v, a value that is not a list, and reports whether
+// it is a string.
+func statsScalar(v interface{}) (string, bool) {
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case bool:
+		return strconv.FormatBool(v), false
+	case time.Duration:
+		return fmt.Sprintf("%d.%06d", v/time.Second, v%time.Second/time.Microsecond), false
+	default:
+		return fmt.Sprint(v), false
+	}
+}
+
+// statsString is v as a grpc stats value, without YAML quoting.
+func statsString(v interface{}) string {
+	if l, ok := v.([]string); ok {
+		return strings.Join(l, "\n")
+	}
+	s, _ := statsScalar(v)
+	return s
+}
+
+func (d statsDict) yaml() []byte {
+	b := []byte("---\n")
+	for _, f := range d {
+		b = append(b, f.key...)
+		b = append(b, ':')
+		if l, ok := f.value.([]string); ok {
+			if len(l) == 0 {
+				b = append(b, " []"...)
+			}
+			b = append(b, '\n')
+			for _, s := range l {
+				b = append(b, "- "...)
+				b = yamlString(b, s)
+				b = append(b, '\n')
+			}
+			continue
+		}
+		b = append(b, ' ')
+		s, str := statsScalar(f.value)
+		if str {
+			b = yamlString(b, s)
+		} else {
+			b = append(b, s...)
+		}
+		b = append(b, '\n')
+	}
+	return b
+}
+
+// yamlString appends s as a YAML scalar, in double quotes if it would
+// otherwise read as something else.
+func yamlString(b []byte, s string) []byte {
+	if yamlNeedsQuote(s) {
+		return strconv.AppendQuote(b, s)
+	}
+	return append(b, s...)
+}
+
+func yamlNeedsQuote(s string) bool {
+	if s == "" || s != strings.TrimSpace(s) {
+		return true
+	}
+	switch strings.ToLower(s) {
+	case "true", "false", "yes", "no", "on", "off", "y", "n", "null", "~":
+		return true
+	}
+	if _, err := strconv.ParseFloat(s, 64); err == nil {
+		return true
+	}
+	if strings.ContainsAny(s[:1], "-?:,[]{}#&*!|>'\"%@`.") {
+		return true
+	}
+	if strings.Contains(s, ": ") || strings.Contains(s, " #") || strings.HasSuffix(s, ":") {
+		return true
+	}
+	for _, r := range s {
+		if r < ' ' || r == 0x7f || r == '\\' {
+			return true
+		}
+	}
+	return false
+}
+
+func (d statsDict) json() []byte {
+	b := []byte{'{'}
+	for i, f := range d {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		k, _ := json.Marshal(f.key)
+		b = append(b, k...)
+		b = append(b, ':')
+		if l, ok := f.value.([]string); ok {
+			if l == nil {
+				l = []string{}
+			}
+			v, _ := json.Marshal(l)
+			b = append(b, v...)
+			continue
+		}
+		s, str := statsScalar(f.value)
+		if str {
+			v, _ := json.Marshal(s)
+			b = append(b, v...)
+		} else {
+			b = append(b, s...)
+		}
+	}
+	return append(b, "}\n"...)
+}
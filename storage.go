@@ -0,0 +1,100 @@
+package dispatch
+
+import (
+	"fmt"
+)
+
+// storage persists changes to the job table so that it can be rebuilt when
+// the server restarts. Opening a storage loads what it holds into the job
+// and tube tables. All methods are called with jobsMu held, in the order the
+// changes are made.
+//
+// Writes take no context. A change is made to the job table before it is
+// written, under jobsMu, so a write given up on because its client went
+// away or the server began to stop would leave storage behind memory and
+// every later write out of order with it. A client's context bounds what
+// it waits for before its change, such as a tube's put rate, and a
+// storage bounds its own writes: the redis storage with a deadline on each
+// round trip, the others by being local files.
+type storage interface {
+	putJob(j *job) error
+	updateJob(j *job) error
+	deleteJob(j *job) error
+	// check reports whether the storage can still take writes.
+	check() error
+	close() error
+}
+
+// jobStore is nil when jobs are kept in memory only.
+var jobStore storage
+
+const (
+	storageBinlog = "binlog"
+	storageBolt   = "bolt"
+	storageSQLite = "sqlite"
+	storageRedis  = "redis"
+)
+
+var (
+	storageKind string
+	storagePath string
+)
+
+func openStorage(kind, path string) (storage, error) {
+	switch kind {
+	case storageBinlog:
+		w, err := walInit(path)
+		if err != nil {
+			return nil, err
+		}
+		wal = w
+		return binlogStorage{w}, nil
+	case storageBolt:
+		return boltOpen(path)
+	case storageSQLite:
+		return sqliteOpen(path)
+	case storageRedis:
+		return redisOpen(path)
+	}
+	return nil, fmt.Errorf("unknown storage %q", kind)
+}
+
+func storePutJob(j *job) error {
+	if jobStore == nil {
+		return nil
+	}
+	return jobStore.putJob(j)
+}
+
+func storeUpdateJob(j *job) error {
+	if jobStore == nil {
+		return nil
+	}
+	return jobStore.updateJob(j)
+}
+
+// storeCheck reports whether storage can take writes. The caller must hold
+// jobsMu.
+func storeCheck() error {
+	if jobStore == nil {
+		return nil
+	}
+	return jobStore.check()
+}
+
+func storeDeleteJob(j *job) error {
+	if jobStore == nil {
+		return nil
+	}
+	return jobStore.deleteJob(j)
+}
+
+type binlogStorage struct {
+	w *binlog
+}
+
+func (s binlogStorage) putJob(j *job) error    { return walWritePut(s.w, j) }
+func (s binlogStorage) updateJob(j *job) error { return walWriteState(s.w, j) }
+func (s binlogStorage) deleteJob(j *job) error { return walWriteDelete(s.w, j) }
+func (s binlogStorage) check() error           { return walCheck(s.w) }
+func (s binlogStorage) close() error           { return walClose(s.w) }
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package dispatch
+
+import "errors"
+
+// suSwitch fails: -u needs Unix user and group ids.
+func suSwitch(uid, gid int) error {
+	return errors.New("-u is only supported on Unix")
+}
@@ -0,0 +1,16 @@
+//go:build unix
+
+package dispatch
+
+import "syscall"
+
+// suSwitch sets the process's groups, group and user.
+func suSwitch(uid, gid int) error {
+	if err := syscall.Setgroups([]int{gid}); err != nil {
+		return err
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return err
+	}
+	return syscall.Setuid(uid)
+}
@@ -0,0 +1,267 @@
+package dispatch
+
+import (
+	"bufio"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The op trace, enabled with -trace-ops, records every change to the job and
+// tube tables with a sequence number and timestamp, so that a problem seen
+// in production can be replayed offline one step at a time with
+// dispatch replay. Unlike the binlog it is never compacted: it is a history,
+// not a means of recovery.
+//
+// The file starts with the same version header as a binlog segment. Each
+// record is framed like a binlog record, and its payload is
+//
+//	u64 sequence number
+//	u64 time, ns since the epoch
+//	binlog record payload
+//
+// Tracing begins after binlog recovery with one record per recovered tube
+// and job, so the trace alone is enough to rebuild the server's state.
+
+const traceHeaderSize = 16
+
+type traceLog struct {
+	mu  sync.Mutex
+	f   *os.File
+	seq uint64
+	buf []byte
+}
+
+var opTrace *traceLog
+
+// traceOpen creates the trace file and writes the current state to it. The
+// caller must hold jobsMu.
+func traceOpen(path string) (*traceLog, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return nil, err
+	}
+
+	var hdr [4]byte
+	binary.LittleEndian.PutUint32(hdr[:], binlogVersion)
+	if _, err := f.Write(hdr[:]); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	t := &traceLog{f: f}
+	for _, tb := range tubes {
+		if err := traceTube(t, tb); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	for _, j := range allJobs {
+		if err := tracePut(t, j); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+func traceClose(t *traceLog) error {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.f.Close()
+}
+
+func tracePut(t *traceLog, j *job) error {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.buf = walEncodePut(traceRecord(t), j)
+	return traceAppend(t)
+}
+
+func traceTube(t *traceLog, tb *tube) error {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.buf = walEncodeTube(traceRecord(t), tb)
+	return traceAppend(t)
+}
+
+func traceState(t *traceLog, j *job) error {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.buf = walEncodeState(traceRecord(t), j)
+	return traceAppend(t)
+}
+
+func traceDelete(t *traceLog, j *job) error {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.buf = walEncodeRecord(traceRecord(t), recDelete, j.id)
+	return traceAppend(t)
+}
+
+// traceRecord starts a record in t.buf with the next sequence number and
+// the current time. The binlog payload is appended after it; the header the
+// binlog encoder adds for itself is dropped by traceAppend.
+func traceRecord(t *traceLog) []byte {
+	t.seq++
+	b := append(t.buf[:0], make([]byte, recHeaderSize)...)
+	b = binary.LittleEndian.AppendUint64(b, t.seq)
+	return binary.LittleEndian.AppendUint64(b, uint64(time.Now().UnixNano()))
+}
+
+func traceAppend(t *traceLog) error {
+	// Remove the binlog record header that sits after the trace header.
+	start := recHeaderSize + traceHeaderSize
+	t.buf = append(t.buf[:start], t.buf[start+recHeaderSize:]...)
+
+	binary.LittleEndian.PutUint32(t.buf[0:4], uint32(len(t.buf)-recHeaderSize))
+	binary.LittleEndian.PutUint32(t.buf[4:8], crc32.ChecksumIEEE(t.buf[recHeaderSize:]))
+	_, err := t.f.Write(t.buf)
+	return err
+}
+
+var recKindNames = map[recKind]string{
+	recPut:    "put",
+	recState:  "state",
+	recDelete: "delete",
+	recTube:   "tube",
+}
+
+// replayMain rebuilds server state from an op trace, optionally stopping at
+// a sequence number, printing every step, or checking invariants after each
+// step to find the first operation that breaks them.
+func replayMain(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	until := fs.Uint64("until", 0, "stop after the operation with this sequence number")
+	step := fs.Bool("step", false, "print the state after every operation")
+	verify := fs.Bool("verify", false, "check invariants after every operation and stop at the first failure")
+	listJobs := fs.Bool("jobs", false, "list the jobs in the final state")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: dispatch replay [flags] <trace file>\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		fmt.Printf("replay: %v\n", err)
+		return 1
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		fmt.Printf("replay: %v\n", err)
+		return 1
+	}
+	if v := binary.LittleEndian.Uint32(hdr[:]); v != binlogVersion {
+		fmt.Printf("replay: unsupported version %d\n", v)
+		return 1
+	}
+
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+
+	// Jobs have to be homed somewhere for walApply; nothing reads it.
+	seg := &walSegment{jobs: map[uint64]*job{}}
+	var maxID, last uint64
+	var buf []byte
+	for {
+		var rh [recHeaderSize]byte
+		if _, err := io.ReadFull(r, rh[:]); err != nil {
+			if err != io.EOF {
+				fmt.Printf("replay: truncated after operation %d\n", last)
+			}
+			break
+		}
+		size := binary.LittleEndian.Uint32(rh[0:4])
+		if cap(buf) < int(size) {
+			buf = make([]byte, size)
+		}
+		buf = buf[:size]
+		if _, err := io.ReadFull(r, buf); err != nil || size < traceHeaderSize+9 {
+			fmt.Printf("replay: truncated after operation %d\n", last)
+			break
+		}
+		if crc32.ChecksumIEEE(buf) != binary.LittleEndian.Uint32(rh[4:8]) {
+			fmt.Printf("replay: corrupt record after operation %d\n", last)
+			return 1
+		}
+
+		seq := binary.LittleEndian.Uint64(buf[0:8])
+		if *until > 0 && seq > *until {
+			break
+		}
+		at := time.Unix(0, int64(binary.LittleEndian.Uint64(buf[8:16])))
+		p := buf[traceHeaderSize:]
+		if err := walApply(seg, p, &maxID); err != nil {
+			fmt.Printf("replay: operation %d: %v\n", seq, err)
+			return 1
+		}
+		last = seq
+
+		if *step {
+			kind := recKind(p[0])
+			id := binary.LittleEndian.Uint64(p[1:9])
+			fmt.Printf("%d %s %-6s job %-6d jobs=%d ready=%d delayed=%d tubes=%d\n",
+				seq, at.Format(time.RFC3339Nano), recKindNames[kind], id,
+				len(allJobs), readyCount, delayedCount, len(tubes))
+		}
+		if *verify {
+			if maxID >= nextJobID {
+				nextJobID = maxID + 1
+			}
+			if vr := verifyState(nil, false); len(vr.problems) > 0 {
+				fmt.Printf("invariants broken by operation %d at %s\n", seq, at.Format(time.RFC3339Nano))
+				fmt.Print(fmtVerifyReport(vr))
+				return 1
+			}
+		}
+	}
+
+	fmt.Printf("replayed %d operations: %d jobs (%d ready, %d delayed) in %d tubes\n",
+		last, len(allJobs), readyCount, delayedCount, len(tubes))
+	if *listJobs {
+		ids := make([]uint64, 0, len(allJobs))
+		for id := range allJobs {
+			ids = append(ids, id)
+		}
+		sort.Slice(ids, func(i, k int) bool { return ids[i] < ids[k] })
+		for _, id := range ids {
+			j := allJobs[id]
+			fmt.Printf("job %d tube %q state %d pri %d delay %d ttr %d size %d\n",
+				j.id, j.tube.name, j.state, j.pri, j.delay, j.ttr, len(j.body))
+		}
+	}
+	return 0
+}
@@ -0,0 +1,67 @@
+package dispatch
+
+// Command handling can be traced with OpenTelemetry. Every command gets a
+// span named after it, with the tube, job id and body size as attributes
+// where they apply, and storage writes get child spans. The exporter is
+// only linked in with -tags otel.
+
+// tracer starts spans. It is nil when tracing is off, which the helpers
+// below check so that call sites need not.
+type tracer interface {
+	start(name string) span
+}
+
+type span interface {
+	child(name string) span
+	setString(key, val string)
+	setInt(key string, val int64)
+	fail(err error)
+	end()
+}
+
+var cmdTracer tracer
+
+// Tracing settings, set from flags in main.
+var (
+	otelEnabled  bool
+	otelEndpoint string
+	otelService  = "dispatch"
+)
+
+func spanStart(name string) span {
+	if cmdTracer == nil {
+		return nil
+	}
+	return cmdTracer.start(name)
+}
+
+func spanChild(s span, name string) span {
+	if s == nil {
+		return nil
+	}
+	return s.child(name)
+}
+
+func spanString(s span, key, val string) {
+	if s != nil {
+		s.setString(key, val)
+	}
+}
+
+func spanInt(s span, key string, val int64) {
+	if s != nil {
+		s.setInt(key, val)
+	}
+}
+
+func spanFail(s span, err error) {
+	if s != nil {
+		s.fail(err)
+	}
+}
+
+func spanEnd(s span) {
+	if s != nil {
+		s.end()
+	}
+}
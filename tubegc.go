@@ -0,0 +1,75 @@
+package dispatch
+
+import (
+	"log/slog"
+	"time"
+)
+
+// A tube other than default that has held no jobs and been used by no
+// connection for -tube-idle-ttl is deleted, so that a server whose clients
+// make up tube names does not keep every tube it has seen. Paused tubes
+// and tubes with put-unique keys still in their window are kept. A later
+// use or put makes the tube afresh, with its settings from the config
+// file. The admin API shows each tube's users and how long it has been
+// idle, and stats count deleted tubes as tubes-deleted.
+
+// tubeGCInterval is how often idle tubes are looked for, and so how much
+// longer than -tube-idle-ttl a tube may be kept.
+const tubeGCInterval = time.Second
+
+// tubeUse moves a connection using old, or nil for a new connection, to
+// the tube called name.
+func tubeUse(old *tube, name string) *tube {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	if old != nil {
+		old.users--
+	}
+	t := tubeFindOrMakeLocked(name)
+	t.users++
+	return t
+}
+
+func tubeGCRun() {
+	for now := range clock.Tick(tubeGCInterval) {
+		jobsMu.Lock()
+		tubeGCSweep(now)
+		jobsMu.Unlock()
+	}
+}
+
+// tubeGCSweep notes which tubes are idle at now and deletes those that
+// have been for tubeIdleTTL. The caller must hold jobsMu.
+func tubeGCSweep(now time.Time) {
+	for name, t := range tubes {
+		if !tubeIdle(t, now) {
+			t.idleSince = time.Time{}
+			continue
+		}
+		if t.idleSince.IsZero() {
+			t.idleSince = now
+		}
+		if tubeIdleTTL == 0 || now.Sub(t.idleSince) < tubeIdleTTL {
+			continue
+		}
+		delete(tubes, name)
+		t.gone = true
+		tubeWake(t)
+		tubeDeletedCount.Add(1)
+		slog.Debug("idle tube deleted", "tube", name)
+	}
+}
+
+// tubeIdle reports whether t could be deleted at now. The caller must hold
+// jobsMu.
+func tubeIdle(t *tube, now time.Time) bool {
+	if t.name == defaultTubeName || t.users > 0 || now.Before(t.pauseDeadline) {
+		return false
+	}
+	s := &t.stat
+	if s.ready+s.delayed+s.reserved+s.buried+s.held > 0 {
+		return false
+	}
+	dedupPrune(t, now)
+	return len(t.dedup) == 0
+}
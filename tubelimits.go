@@ -0,0 +1,119 @@
+package dispatch
+
+import (
+	"errors"
+	"fmt"
+)
+
+// A tube's section of the config file can bound the fields of the jobs put
+// into it:
+//
+//	[tube."emails"]
+//	default-ttr = 60
+//	min-ttr = 10
+//	max-ttr = 3600
+//	default-delay = 30
+//	max-delay = 86400
+//	default-pri = 1024
+//	min-pri = 100
+//	max-pri = 2048
+//
+// default-ttr, default-delay and default-pri are the TTR, delay and
+// priority of jobs whose producer leaves them out: gRPC puts that send 0,
+// as proto3 does for a field not set, SQS messages without the attribute or
+// DelaySeconds, bridged messages without the header, and schedules that do
+// not set them. A put in the text protocol always gives all three, so 0 is
+// kept as it is. TTRs are then raised to min-ttr, which stands in for
+// -min-ttr in the tube, and lowered to max-ttr, which wins over -min-ttr.
+// Priorities more urgent than min-pri are lowered to it, so that one tube's
+// producers cannot jump ahead of the rest, and those less urgent than
+// max-pri are raised to it. A put with a delay longer than max-delay
+// seconds is refused with DELAY_TOO_LONG. 0 leaves any of them unset or
+// unbounded. A config file whose bounds disagree, such as a default-delay
+// above max-delay or a min-pri above max-pri, is refused.
+
+// tubeLimits are the bounds of a tube's jobs. They are not changed once
+// made, so that puts can read them without jobsMu.
+type tubeLimits struct {
+	defaultTTR   uint64
+	minTTR       uint64
+	maxTTR       uint64
+	defaultDelay uint64
+	maxDelay     uint64
+	defaultPri   uint64
+	minPri       uint64
+	maxPri       uint64
+}
+
+// putFields says which of a job's priority, delay and TTR its producer
+// gave; tube defaults stand in for the others.
+type putFields uint8
+
+const (
+	putPri putFields = 1 << iota
+	putDelay
+	putTTR
+
+	putAll = putPri | putDelay | putTTR
+)
+
+var errDelayTooLong = errors.New("delay too long")
+
+// limit returns the priority, delay and TTR of a job put with pri, delay
+// and ttr, of which given were given by its producer, or errDelayTooLong.
+// Those not given are the tube's defaults if it has them.
+func (l *tubeLimits) limit(pri, delay, ttr uint64, given putFields) (uint64, uint64, uint64, error) {
+	if given&putDelay == 0 && l.defaultDelay > 0 {
+		delay = l.defaultDelay
+	}
+	if l.maxDelay > 0 && delay > l.maxDelay {
+		return 0, 0, 0, errDelayTooLong
+	}
+	if given&putTTR == 0 && l.defaultTTR > 0 {
+		ttr = l.defaultTTR
+	}
+	ttr = max(ttr, l.minTTR)
+	if l.maxTTR > 0 {
+		ttr = min(ttr, l.maxTTR)
+	}
+	if given&putPri == 0 && l.defaultPri > 0 {
+		pri = l.defaultPri
+	}
+	pri = max(pri, l.minPri)
+	if l.maxPri > 0 {
+		pri = min(pri, l.maxPri)
+	}
+	return pri, delay, ttr, nil
+}
+
+// check reports bounds of l that disagree, so that no job could meet them
+// all.
+func (l *tubeLimits) check() error {
+	switch {
+	case l.maxTTR > 0 && l.minTTR > l.maxTTR:
+		return fmt.Errorf("min-ttr %d is above max-ttr %d", l.minTTR, l.maxTTR)
+	case l.defaultTTR > 0 && l.defaultTTR < l.minTTR:
+		return fmt.Errorf("default-ttr %d is below min-ttr %d", l.defaultTTR, l.minTTR)
+	case l.maxTTR > 0 && l.defaultTTR > l.maxTTR:
+		return fmt.Errorf("default-ttr %d is above max-ttr %d", l.defaultTTR, l.maxTTR)
+	case l.maxDelay > 0 && l.defaultDelay > l.maxDelay:
+		return fmt.Errorf("default-delay %d is above max-delay %d", l.defaultDelay, l.maxDelay)
+	case l.maxPri > 0 && l.minPri > l.maxPri:
+		return fmt.Errorf("min-pri %d is above max-pri %d", l.minPri, l.maxPri)
+	case l.defaultPri > 0 && l.defaultPri < l.minPri:
+		return fmt.Errorf("default-pri %d is below min-pri %d", l.defaultPri, l.minPri)
+	case l.maxPri > 0 && l.defaultPri > l.maxPri:
+		return fmt.Errorf("default-pri %d is above max-pri %d", l.defaultPri, l.maxPri)
+	}
+	return nil
+}
+
+// tubeLimitsCheck reports a tube in tcs whose bounds disagree.
+func tubeLimitsCheck(tcs map[string]*tubeConfig) error {
+	for name, tc := range tcs {
+		if err := tc.limits.check(); err != nil {
+			return fmt.Errorf("tube %q: %v", name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+package dispatch
+
+import "testing"
+
+// tubeLimitsFor configures a tube whose config file section sets limits
+// and returns the limits it ends up with.
+func tubeLimitsFor(t *testing.T, limits tubeLimits) *tubeLimits {
+	t.Helper()
+	saved := tubeConfigs
+	t.Cleanup(func() { tubeConfigs = saved })
+	tubeConfigs = map[string]*tubeConfig{"t": {limits: limits}}
+	tb := &tube{name: "t"}
+	tubeConfigure(tb)
+	return tb.limits.Load()
+}
+
+func TestTubeLimitsTTR(t *testing.T) {
+	tests := []struct {
+		name     string
+		limits   tubeLimits
+		ttr      uint64
+		given    putFields
+		wantTTR  uint64
+		wantNote string
+	}{
+		{"no limits", tubeLimits{}, 60, putAll, 60, "kept"},
+		{"no limits zero", tubeLimits{}, 0, putAll, 1, "raised to -min-ttr"},
+		{"max-ttr alone below", tubeLimits{maxTTR: 120}, 60, putAll, 60, "kept"},
+		{"max-ttr alone above", tubeLimits{maxTTR: 120}, 600, putAll, 120, "lowered to max-ttr"},
+		{"max-ttr alone zero", tubeLimits{maxTTR: 120}, 0, putAll, 1, "raised to -min-ttr"},
+		{"default-ttr left out", tubeLimits{defaultTTR: 60}, 0, 0, 60, "defaulted"},
+		{"default-ttr given zero", tubeLimits{defaultTTR: 60}, 0, putAll, 1, "raised to -min-ttr"},
+		{"default-ttr given", tubeLimits{defaultTTR: 60}, 5, putAll, 5, "kept"},
+		{"no default-ttr left out", tubeLimits{}, 30, 0, 30, "kept"},
+		{"min-ttr", tubeLimits{minTTR: 10}, 5, putAll, 10, "raised to min-ttr"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := tubeLimitsFor(t, tt.limits)
+			_, _, ttr, err := l.limit(1024, 0, tt.ttr, tt.given)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ttr != tt.wantTTR {
+				t.Errorf("ttr %d: got %d, want %d (%s)", tt.ttr, ttr, tt.wantTTR, tt.wantNote)
+			}
+		})
+	}
+}
+
+func TestTubeLimitsDelay(t *testing.T) {
+	tests := []struct {
+		name      string
+		limits    tubeLimits
+		delay     uint64
+		given     putFields
+		wantDelay uint64
+		wantErr   error
+	}{
+		{"no limits", tubeLimits{}, 30, putAll, 30, nil},
+		{"no limits zero", tubeLimits{}, 0, putAll, 0, nil},
+		{"max-delay below", tubeLimits{maxDelay: 60}, 60, putAll, 60, nil},
+		{"max-delay above", tubeLimits{maxDelay: 60}, 61, putAll, 0, errDelayTooLong},
+		{"default-delay left out", tubeLimits{defaultDelay: 30}, 0, 0, 30, nil},
+		{"default-delay given zero", tubeLimits{defaultDelay: 30}, 0, putAll, 0, nil},
+		{"default-delay given", tubeLimits{defaultDelay: 30}, 5, putAll, 5, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := tubeLimitsFor(t, tt.limits)
+			_, delay, _, err := l.limit(1024, tt.delay, 60, tt.given)
+			if err != tt.wantErr {
+				t.Fatalf("delay %d: got error %v, want %v", tt.delay, err, tt.wantErr)
+			}
+			if delay != tt.wantDelay {
+				t.Errorf("delay %d: got %d, want %d", tt.delay, delay, tt.wantDelay)
+			}
+		})
+	}
+}
+
+func TestTubeLimitsPri(t *testing.T) {
+	tests := []struct {
+		name     string
+		limits   tubeLimits
+		pri      uint64
+		given    putFields
+		wantPri  uint64
+		wantNote string
+	}{
+		{"no limits", tubeLimits{}, 5, putAll, 5, "kept"},
+		{"no limits zero", tubeLimits{}, 0, putAll, 0, "kept"},
+		{"min-pri", tubeLimits{minPri: 100}, 5, putAll, 100, "lowered to min-pri"},
+		{"max-pri below", tubeLimits{maxPri: 2048}, 1024, putAll, 1024, "kept"},
+		{"max-pri above", tubeLimits{maxPri: 2048}, 4096, putAll, 2048, "raised to max-pri"},
+		{"default-pri left out", tubeLimits{defaultPri: 2000}, 1024, 0, 2000, "defaulted"},
+		{"default-pri given zero", tubeLimits{defaultPri: 1024}, 0, putAll, 0, "kept"},
+		{"default-pri given", tubeLimits{defaultPri: 1024}, 5, putAll, 5, "kept"},
+		{"min-pri left out", tubeLimits{minPri: 100}, 0, 0, 100, "lowered to min-pri"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := tubeLimitsFor(t, tt.limits)
+			pri, _, _, err := l.limit(tt.pri, 0, 60, tt.given)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if pri != tt.wantPri {
+				t.Errorf("pri %d: got %d, want %d (%s)", tt.pri, pri, tt.wantPri, tt.wantNote)
+			}
+		})
+	}
+}
+
+func TestTubeLimitsConfig(t *testing.T) {
+	tcs := map[string]*tubeConfig{}
+	for _, kv := range [][2]string{
+		{"default-ttr", "60"}, {"min-ttr", "10"}, {"max-ttr", "3600"},
+		{"default-delay", "30"}, {"max-delay", "86400"},
+		{"default-pri", "1024"}, {"min-pri", "100"}, {"max-pri", "2048"},
+	} {
+		if err := configTube(tcs, "t", configEntry{key: kv[0], value: kv[1]}); err != nil {
+			t.Fatalf("%s: %v", kv[0], err)
+		}
+	}
+	want := tubeLimits{
+		defaultTTR: 60, minTTR: 10, maxTTR: 3600,
+		defaultDelay: 30, maxDelay: 86400,
+		defaultPri: 1024, minPri: 100, maxPri: 2048,
+	}
+	if got := tcs["t"].limits; got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if err := configTube(tcs, "t", configEntry{key: "max-pri", value: "-1"}); err == nil {
+		t.Error("max-pri -1 accepted")
+	}
+}
+
+func TestTubeLimitsCheck(t *testing.T) {
+	tests := []struct {
+		name   string
+		limits tubeLimits
+		ok     bool
+	}{
+		{"none", tubeLimits{}, true},
+		{"all agree", tubeLimits{
+			defaultTTR: 60, minTTR: 10, maxTTR: 3600,
+			defaultDelay: 30, maxDelay: 86400,
+			defaultPri: 1024, minPri: 100, maxPri: 2048,
+		}, true},
+		{"max-ttr alone", tubeLimits{maxTTR: 5}, true},
+		{"min-ttr above max-ttr", tubeLimits{minTTR: 100, maxTTR: 50}, false},
+		{"default-ttr below min-ttr", tubeLimits{defaultTTR: 5, minTTR: 10}, false},
+		{"default-ttr above max-ttr", tubeLimits{defaultTTR: 60, maxTTR: 30}, false},
+		{"default-delay at max-delay", tubeLimits{defaultDelay: 60, maxDelay: 60}, true},
+		{"default-delay above max-delay", tubeLimits{defaultDelay: 90, maxDelay: 60}, false},
+		{"min-pri above max-pri", tubeLimits{minPri: 100, maxPri: 50}, false},
+		{"default-pri below min-pri", tubeLimits{defaultPri: 10, minPri: 100}, false},
+		{"default-pri above max-pri", tubeLimits{defaultPri: 4096, maxPri: 2048}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tubeLimitsCheck(map[string]*tubeConfig{"t": {limits: tt.limits}})
+			if (err == nil) != tt.ok {
+				t.Errorf("got %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestDefaultMinTTR(t *testing.T) {
+	if got := DefaultConfig().MinTTR; got != 1 {
+		t.Errorf("DefaultConfig().MinTTR = %d, want 1", got)
+	}
+	if minTTR != 1 {
+		t.Errorf("minTTR = %d, want 1", minTTR)
+	}
+}
@@ -0,0 +1,293 @@
+package dispatch
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+// verifyReport collects the inconsistencies found by verifyState.
+type verifyReport struct {
+	problems []string
+	repaired int
+}
+
+func verifyProblem(r *verifyReport, fixed bool, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if fixed {
+		msg += " (repaired)"
+		r.repaired++
+	}
+	r.problems = append(r.problems, msg)
+}
+
+func verifyStats(r *verifyReport) statsDict {
+	var d statsDict
+	d.add("problems", len(r.problems))
+	d.add("repaired", r.repaired)
+	if len(r.problems) > 0 {
+		d.add("details", r.problems)
+	}
+	return d
+}
+
+func fmtVerifyReport(r *verifyReport) string {
+	return string(verifyStats(r).yaml())
+}
+
+// verifyState cross-checks the job table against the tube table, the state
+// counters, and the binlog's record of where each job lives. With repair
+// set, discrepancies are fixed where the right answer is unambiguous. The
+// caller must hold jobsMu.
+func verifyState(w *binlog, repair bool) *verifyReport {
+	r := &verifyReport{}
+
+	var ready, delayed, held int
+	perTube := map[*tube]*tubeStats{}
+	for id, j := range allJobs {
+		if j.id != id {
+			verifyProblem(r, false, "job %d is indexed as %d", j.id, id)
+		}
+		if j.id >= nextJobID {
+			verifyProblem(r, repair, "job %d is not below the next job id %d", j.id, nextJobID)
+			if repair {
+				nextJobID = j.id + 1
+			}
+		}
+
+		if j.tube == nil {
+			verifyProblem(r, repair, "job %d has no tube", j.id)
+			if repair {
+				j.tube = tubeFindOrMakeLocked(defaultTubeName)
+			}
+		} else if t := tubes[j.tube.name]; t != j.tube {
+			verifyProblem(r, repair, "job %d is in unregistered tube %q", j.id, j.tube.name)
+			if repair {
+				if t == nil {
+					tubes[j.tube.name] = j.tube
+				} else {
+					j.tube = t
+				}
+			}
+		}
+
+		switch j.state {
+		case jobStateReady:
+			ready++
+		case jobStateDelayed:
+			if j.deadline.IsZero() {
+				verifyProblem(r, repair, "delayed job %d has no deadline", j.id)
+				if repair {
+					j.state = jobStateReady
+					ready++
+					break
+				}
+			}
+			delayed++
+		case jobStateHeld:
+			held++
+		case jobStateReserved, jobStateBuried:
+		default:
+			verifyProblem(r, false, "job %d has invalid state %d", j.id, j.state)
+		}
+
+		if j.tube != nil {
+			if perTube[j.tube] == nil {
+				perTube[j.tube] = &tubeStats{}
+			}
+			tubeStatsAdd(perTube[j.tube], j.state, 1)
+			perTube[j.tube].bytes += uint64(len(j.body))
+		}
+	}
+
+	for _, t := range tubes {
+		want := tubeStats{}
+		if ts := perTube[t]; ts != nil {
+			want = *ts
+		}
+		got := t.stat
+		if got.ready != want.ready || got.delayed != want.delayed ||
+			got.reserved != want.reserved || got.buried != want.buried {
+			verifyProblem(r, repair, "tube %q counts %d/%d/%d/%d ready/delayed/reserved/buried jobs, holds %d/%d/%d/%d",
+				t.name, got.ready, got.delayed, got.reserved, got.buried,
+				want.ready, want.delayed, want.reserved, want.buried)
+			if repair {
+				t.stat.ready, t.stat.delayed = want.ready, want.delayed
+				t.stat.reserved, t.stat.buried = want.reserved, want.buried
+			}
+		}
+		if got.bytes != want.bytes {
+			verifyProblem(r, repair, "tube %q counts %d body bytes, holds %d", t.name, got.bytes, want.bytes)
+			if repair {
+				t.stat.bytes = want.bytes
+			}
+		}
+	}
+
+	if readyCount != ready {
+		verifyProblem(r, repair, "ready count is %d, %d jobs are ready", readyCount, ready)
+		if repair {
+			readyCount = ready
+		}
+	}
+	if delayedCount != uint(delayed) {
+		verifyProblem(r, repair, "delayed count is %d, %d jobs are delayed", delayedCount, delayed)
+		if repair {
+			delayedCount = uint(delayed)
+		}
+	}
+	if heldCount != held {
+		verifyProblem(r, repair, "held count is %d, %d jobs are held", heldCount, held)
+		if repair {
+			heldCount = held
+		}
+	}
+
+	// Jobs repaired in place may be indexed under the wrong tube or state.
+	if r.repaired > 0 {
+		tubeReindex()
+	}
+
+	if w != nil {
+		verifyBinlog(w, r, repair)
+	}
+	return r
+}
+
+// verifyBinlog checks that every job is homed in exactly one segment still
+// on disk and that the per-segment accounting agrees. The caller must hold
+// jobsMu.
+func verifyBinlog(w *binlog, r *verifyReport, repair bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	segs := map[*walSegment]bool{}
+	for _, seg := range w.segs {
+		segs[seg] = true
+	}
+
+	for _, j := range allJobs {
+		switch {
+		case j.walSeg == nil || !segs[j.walSeg]:
+			// Writing the job out again is only possible in a running
+			// server; fsck has no segment open for writing.
+			fixed := repair && w.cur != nil
+			verifyProblem(r, fixed, "job %d is not in the binlog", j.id)
+			if fixed {
+				if err := walWritePutLocked(w, j); err != nil {
+					verifyProblem(r, false, "job %d could not be written: %v", j.id, err)
+				}
+			}
+		case j.walSeg.jobs[j.id] != j:
+			verifyProblem(r, repair, "job %d is missing from binlog.%d", j.id, j.walSeg.seq)
+			if repair {
+				j.walSeg.jobs[j.id] = j
+			}
+		}
+	}
+
+	for _, seg := range w.segs {
+		var live int64
+		for id, j := range seg.jobs {
+			if allJobs[id] != j || j.walSeg != seg {
+				verifyProblem(r, repair, "binlog.%d holds stale job %d", seg.seq, id)
+				if repair {
+					delete(seg.jobs, id)
+				}
+				continue
+			}
+			live += j.walSize
+		}
+		if seg.live != live {
+			verifyProblem(r, repair, "binlog.%d has %d live bytes, counted %d", seg.seq, seg.live, live)
+			if repair {
+				seg.live = live
+			}
+		}
+	}
+}
+
+func doVerify(c *conn, repair bool) {
+	jobsMu.Lock()
+	r := verifyState(wal, repair)
+	jobsMu.Unlock()
+	if repair {
+		audit("verify-repair", c.identity, c.conn.RemoteAddr().String())
+	}
+
+	doStats(c, func() statsDict {
+		return verifyStats(r)
+	})
+}
+
+// fsckMain checks a binlog directory offline: every segment must decode to
+// the end and the state it replays to must pass verifyState. With -repair,
+// segments with a torn or corrupt tail are truncated after their last good
+// record.
+func fsckMain(args []string) int {
+	fs := flag.NewFlagSet("fsck", flag.ExitOnError)
+	repair := fs.Bool("repair", false, "truncate damaged segments and fix what can be fixed")
+	keySpec := fs.String("binlog-key", "", "read a binlog encrypted with the key in this `file`, or printed by exec:<command>")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: dispatch fsck [-repair] <binlog dir>\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	dir := fs.Arg(0)
+
+	lock, err := walLockDir(dir)
+	if err != nil {
+		fmt.Printf("fsck: %v\n", err)
+		return 1
+	}
+	defer lock.Close()
+
+	seqs, err := walSegments(dir)
+	if err != nil {
+		fmt.Printf("fsck: %v\n", err)
+		return 1
+	}
+
+	aead, err := walKeyLoad(*keySpec)
+	if err != nil {
+		fmt.Printf("fsck: %v\n", err)
+		return 1
+	}
+	w := &binlog{dir: dir, aead: aead}
+	damage, err := walReplay(w, seqs)
+	if err != nil {
+		fmt.Printf("fsck: %v\n", err)
+		return 1
+	}
+
+	r := &verifyReport{}
+	for _, d := range damage {
+		path := walSegmentPath(dir, d.seq)
+		fixed := false
+		if *repair {
+			if err := os.Truncate(path, d.good); err != nil {
+				fmt.Printf("fsck: %v\n", err)
+			} else {
+				fixed = true
+			}
+		}
+		verifyProblem(r, fixed, "%s: unreadable after %d records at offset %d: %v", path, d.records, d.good, d.err)
+	}
+
+	jobsMu.Lock()
+	vr := verifyState(w, *repair)
+	jobsMu.Unlock()
+	r.problems = append(r.problems, vr.problems...)
+	r.repaired += vr.repaired
+
+	fmt.Printf("%d segments, %d jobs, %d tubes\n", len(seqs), len(allJobs), len(tubes))
+	fmt.Print(fmtVerifyReport(r))
+	if len(r.problems) > r.repaired {
+		return 1
+	}
+	return 0
+}